@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+const (
+	accessLogPlain = "plain"
+	accessLogJSON  = "json"
+)
+
+// accessRecord is one access log entry: a client connection and the upstream
+// it was given.
+type accessRecord struct {
+	At       time.Time `json:"at"`
+	Conn     string    `json:"conn"`
+	Listener string    `json:"listener"`
+	Client   string    `json:"client"`
+	Proxy    string    `json:"proxy"`
+	Target   string    `json:"target"`
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// accessLog writes accessRecords to a file or stdout. A nil *accessLog
+// writes nothing.
+type accessLog struct {
+	format string
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// openAccessLog opens path ("stdout" or "-" for standard output) for
+// appending in the given format.
+func openAccessLog(path, format string) (*accessLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if format == "" {
+		format = accessLogPlain
+	}
+	if path == "stdout" || path == "-" {
+		return &accessLog{format: format, w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLog{format: format, w: f, closer: f}, nil
+}
+
+// Log records a dial by listener for the connection in ctx. A zero proxy
+// means the target was dialed directly or rejected before an upstream was chosen.
+func (l *accessLog) Log(ctx context.Context, listener string, proxy logic.ProxyNode, target string, err error) {
+	if l == nil {
+		return
+	}
+	r := accessRecord{
+		At:       time.Now(),
+		Conn:     logic.RequestIDFrom(ctx),
+		Listener: listener,
+		Client:   logic.ClientAddrFrom(ctx),
+		Proxy:    proxy.Addr(),
+		Target:   target,
+		OK:       err == nil,
+	}
+	if r.Proxy == "" {
+		r.Proxy = "direct"
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	var line []byte
+	if l.format == accessLogJSON {
+		line, _ = json.Marshal(r)
+	} else {
+		status := "ok"
+		if !r.OK {
+			status = "fail error=" + strconv.Quote(r.Error)
+		}
+		line = fmt.Appendf(nil, "%s conn=%s listener=%s client=%s proxy=%s target=%s %s",
+			r.At.Format("2006/01/02 15:04:05"), r.Conn, r.Listener, r.Client, r.Proxy, r.Target, status)
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+func (l *accessLog) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+const (
+	// auditActorSystem is the actor of entries not caused by an API call.
+	auditActorSystem = "system"
+	// maxAuditEntries bounds the in-memory ring served by /api/audit.
+	maxAuditEntries = 1000
+	// maxAuditBody is the largest request body recorded with an entry.
+	maxAuditBody = 1024
+	// auditQueueSize is how many entries may wait for the file writer
+	// before new ones are dropped from the file (never from the ring).
+	auditQueueSize = 1024
+)
+
+// AuditEntry is one mutating action: an API call or a scheduled job.
+type AuditEntry struct {
+	At time.Time `json:"at"`
+	// Actor is the client IP, or auditActorSystem.
+	Actor string `json:"actor"`
+	// Identity is the web client certificate's common name under mutual TLS.
+	Identity  string            `json:"identity,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Endpoint  string            `json:"endpoint"`
+	Params    map[string]string `json:"params,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	Outcome   string            `json:"outcome"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// AuditLog keeps the latest entries in memory and appends every entry as a
+// JSON line to an optional file. File writes happen on their own goroutine,
+// so a slow disk never stalls the caller.
+type AuditLog struct {
+	logger *log.Logger
+
+	mu      sync.RWMutex
+	entries []AuditEntry
+
+	queue   chan []byte
+	dropped atomic.Int64
+}
+
+// NewAuditLog starts the file writer when path is set. The file is opened
+// for appending up front so a bad path fails startup.
+func NewAuditLog(path string, logger *log.Logger) (*AuditLog, error) {
+	a := &AuditLog{logger: logger}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a.queue = make(chan []byte, auditQueueSize)
+	go a.write(f)
+	return a, nil
+}
+
+func (a *AuditLog) write(w io.WriteCloser) {
+	defer w.Close()
+	for line := range a.queue {
+		if _, err := w.Write(line); err != nil {
+			a.logger.Printf("audit log: %v", err)
+		}
+	}
+}
+
+// Record stores e, stamping its time when unset.
+func (a *AuditLog) Record(e AuditEntry) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	a.mu.Lock()
+	a.entries = append(a.entries, e)
+	if len(a.entries) > maxAuditEntries {
+		a.entries = append([]AuditEntry(nil), a.entries[len(a.entries)-maxAuditEntries:]...)
+	}
+	a.mu.Unlock()
+
+	if a.queue == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	select {
+	case a.queue <- append(b, '\n'):
+	default:
+		if a.dropped.Add(1) == 1 {
+			a.logger.Printf("audit log: writer is behind, dropping file entries")
+		}
+	}
+}
+
+// RecordSystem records a scheduled action; err is its outcome.
+func (a *AuditLog) RecordSystem(endpoint string, params map[string]string, err error) {
+	e := AuditEntry{Actor: auditActorSystem, Endpoint: endpoint, Params: params, Outcome: "ok"}
+	if err != nil {
+		e.Outcome, e.Error = "error", err.Error()
+	}
+	a.Record(e)
+}
+
+// Entries returns up to limit of the newest entries, oldest first.
+func (a *AuditLog) Entries(limit int) []AuditEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	out := a.entries
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return append([]AuditEntry(nil), out...)
+}
+
+// Dropped returns how many entries did not make it to the file.
+func (a *AuditLog) Dropped() int64 { return a.dropped.Load() }
+
+// Audited marks a route as auditable: the call is recorded after its
+// handler runs, with path and query parameters and, when withBody is set,
+// a request body of up to maxAuditBody bytes.
+func (a *AuditLog) Audited(withBody bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body []byte
+		if withBody && c.Request.Body != nil && c.Request.ContentLength >= 0 && c.Request.ContentLength <= maxAuditBody {
+			b, err := io.ReadAll(io.LimitReader(c.Request.Body, maxAuditBody+1))
+			if err == nil && len(b) <= maxAuditBody {
+				body = b
+			}
+			c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), c.Request.Body))
+		}
+
+		c.Next()
+
+		params := make(map[string]string)
+		for _, p := range c.Params {
+			params[p.Key] = p.Value
+		}
+		for k, v := range c.Request.URL.Query() {
+			if len(v) > 0 {
+				params[k] = v[0]
+			}
+		}
+		if len(params) == 0 {
+			params = nil
+		}
+		e := AuditEntry{
+			Actor:     c.ClientIP(),
+			RequestID: logic.RequestIDFrom(c.Request.Context()),
+			Endpoint:  c.Request.Method + " " + c.FullPath(),
+			Params:    params,
+			Body:      string(bytes.TrimSpace(body)),
+			Status:    c.Writer.Status(),
+			Outcome:   "ok",
+		}
+		if tls := c.Request.TLS; tls != nil && len(tls.PeerCertificates) > 0 {
+			e.Identity = tls.PeerCertificates[0].Subject.CommonName
+		}
+		if e.Status >= 400 {
+			e.Outcome = "error"
+		}
+		if len(c.Errors) > 0 {
+			e.Error = c.Errors.Last().Error()
+		}
+		a.Record(e)
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+// defaultCheckTarget is what POST /api/check probes without ?target.
+const defaultCheckTarget = "example.com:443"
+
+func (s *Server) check(c *gin.Context) {
+	rctx, cancel := context.WithTimeout(c.Request.Context(), 20*time.Second)
+	defer cancel()
+
+	mode := c.Query("mode")
+	if mode == "" {
+		mode = "fixed"
+	}
+	m, ok := s.manager(mode)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"valid": false, "error": "invalid mode"})
+		return
+	}
+	current, ok := m.Current()
+	if !ok && mode == "auto" && m.PoolSize() > 0 {
+		current, ok = m.Next()
+	}
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"valid": false, "error": "empty_pool"})
+		return
+	}
+	target := c.Query("target")
+	if target == "" {
+		target = defaultCheckTarget
+	}
+	// Ranges and lists probe one of their targets.
+	targets, terr := logic.ExpandTarget(target)
+	if terr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": terr.Error()})
+		return
+	}
+	target = targets[rand.Intn(len(targets))]
+
+	tlsVerify := false
+	switch c.Query("tls") {
+	case "1", "true", "yes", "on":
+		tlsVerify = true
+	case "0", "false", "no", "off":
+		tlsVerify = false
+	default:
+		_, _, port, err := logic.ParseTargetAddr(target)
+		if err == nil && port == "443" {
+			tlsVerify = true
+		}
+	}
+
+	start := time.Now()
+	valid, timing, err := s.Probe(rctx, current, target, tlsVerify)
+	latency := time.Since(start).Milliseconds()
+	resp := gin.H{"valid": false, "latency": latency, "handshake_ms": timing.HandshakeMS, "connect_ms": timing.ConnectMS, "type": current.Type, "proxy": current.String(), "target": target, "tls_verify": tlsVerify, "auth_failed": false}
+	if err != nil {
+		authFailed := logic.IsAuthFailure(err)
+		if authFailed {
+			m.ReportAuthFailure(current)
+		} else {
+			m.ReportFailure(current, 1)
+		}
+		resp["error"], resp["category"], resp["auth_failed"] = err.Error(), logic.DialErrorCategory(err), authFailed
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	if !valid {
+		resp["error"] = "check failed"
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	m.ReportSuccess(current)
+	resp["valid"] = true
+	c.JSON(http.StatusOK, resp)
+}
+
+// checkSpec probes a proxy that is not (and never becomes) part of a pool.
+func (s *Server) checkSpec(c *gin.Context) {
+	var req struct {
+		Spec   string `json:"spec"`
+		Target string `json:"target"`
+		TLS    *bool  `json:"tls"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		return
+	}
+	node, ok := logic.ParseProxySpec(strings.TrimSpace(req.Spec), "auto")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid spec"})
+		return
+	}
+	if !s.cfg.AllowPrivateProxies && !logic.IsPublicIP(net.ParseIP(node.IP)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "private proxy addresses are not allowed"})
+		return
+	}
+	test := s.cfg.Validation.TestFor(node.Type)
+	targets := test.TestTargets()
+	if req.Target != "" {
+		var err error
+		if targets, err = logic.ExpandTarget(req.Target); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	target := targets[rand.Intn(len(targets))]
+	if req.TLS != nil {
+		test.TLS = req.TLS
+	}
+	tlsVerify := test.TLSFor(target)
+
+	rctx, cancel := context.WithTimeout(c.Request.Context(), 20*time.Second)
+	defer cancel()
+	valid, timing, err := s.Probe(rctx, node, target, tlsVerify)
+	resp := gin.H{"valid": valid && err == nil, "latency": timing.TotalMS, "handshake_ms": timing.HandshakeMS, "connect_ms": timing.ConnectMS, "proxy": node.String(), "target": target, "tls_verify": tlsVerify}
+	if err != nil {
+		resp["error"] = err.Error()
+		resp["category"] = logic.DialErrorCategory(err)
+		resp["auth_failed"] = logic.IsAuthFailure(err)
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"lite-proxy/logic"
+)
+
+func TestCheckAuthFailed(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantAuth     bool
+		wantCategory string
+	}{
+		{"credentials rejected", &logic.DialError{Category: logic.DialErrAuth, Err: logic.ErrSOCKS5AuthFailed}, true, logic.DialErrAuth},
+		{"wrapped auth failure", fmt.Errorf("probe: %w", logic.ErrSOCKS5AuthFailed), true, logic.DialErrAuth},
+		{"dead proxy", &logic.DialError{Category: logic.DialErrRefused, Err: fmt.Errorf("connection refused")}, false, logic.DialErrRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixed := newFakeManager(node("192.0.2.1", "1080"))
+			fixed.cur = 0
+			s, h := testServer(t, fixed, newFakeManager(), &fakeRefresher{})
+			s.Probe = func(context.Context, logic.ProxyNode, string, bool) (bool, logic.ProbeTiming, error) {
+				return false, logic.ProbeTiming{}, tt.err
+			}
+
+			code, body := do(t, h, http.MethodPost, "/api/check?target=example.com:80")
+			if code != http.StatusOK || body["valid"] != false {
+				t.Fatalf("check = %d %v", code, body)
+			}
+			if body["auth_failed"] != tt.wantAuth || body["category"] != tt.wantCategory {
+				t.Errorf("auth_failed, category = %v, %v; want %v, %s", body["auth_failed"], body["category"], tt.wantAuth, tt.wantCategory)
+			}
+			if gotAuth := len(fixed.authFailures) == 1; gotAuth != tt.wantAuth || len(fixed.failures)+len(fixed.authFailures) != 1 {
+				t.Errorf("reported failures %v, auth failures %v", fixed.failures, fixed.authFailures)
+			}
+		})
+	}
+}
+
+func TestPoolRemoved(t *testing.T) {
+	s, h := testServer(t, newFakeManager(), newFakeManager(), &fakeRefresher{})
+	s.RemovedLog = logic.NewRemovedLog(10)
+	s.RemovedLog.Record("192.0.2.1:1080", logic.RemovedReasonFailed)
+	s.RemovedLog.Record("192.0.2.2:1080", logic.RemovedReasonAuthFailed)
+
+	_, body := do(t, h, http.MethodGet, "/api/pool/removed?reason=auth_failed")
+	items, _ := body["items"].([]any)
+	if len(items) != 1 || items[0].(map[string]any)["proxy"] != "192.0.2.2:1080" {
+		t.Fatalf("items = %v, want only the auth failure", body["items"])
+	}
+	_, body = do(t, h, http.MethodGet, "/api/pool/removed")
+	if items, _ := body["items"].([]any); len(items) != 2 {
+		t.Errorf("items = %v, want both removals", body["items"])
+	}
+}
+
+func TestCheckTargetRange(t *testing.T) {
+	fixed := newFakeManager(node("192.0.2.1", "1080"))
+	fixed.cur = 0
+	s, h := testServer(t, fixed, newFakeManager(), &fakeRefresher{})
+	var probed []string
+	s.Probe = func(_ context.Context, _ logic.ProxyNode, target string, _ bool) (bool, logic.ProbeTiming, error) {
+		probed = append(probed, target)
+		return true, logic.ProbeTiming{}, nil
+	}
+
+	for i := 0; i < 20; i++ {
+		if code, body := do(t, h, http.MethodPost, "/api/check?target=svc.internal:8440-8442"); code != http.StatusOK {
+			t.Fatalf("check with a range = %d %v", code, body)
+		}
+	}
+	for _, p := range probed {
+		switch p {
+		case "svc.internal:8440", "svc.internal:8441", "svc.internal:8442":
+		default:
+			t.Fatalf("probed %q, want a port from the range", p)
+		}
+	}
+
+	if code, body := do(t, h, http.MethodPost, "/api/check?target=svc.internal:8449-8440"); code != http.StatusBadRequest {
+		t.Errorf("check with a reversed range = %d %v, want 400", code, body)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+func (s *Server) history(c *gin.Context) {
+	limit := 0
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	var items any
+	if s.History != nil {
+		items = s.History(limit)
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items, "every": s.cfg.HistoryEvery.String()})
+}
+
+func (s *Server) poolHistory(c *gin.Context) {
+	if s.PoolHistory == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "history_path is not configured"})
+		return
+	}
+	since := 24 * time.Hour
+	if raw := c.Query("since"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+			return
+		}
+		since = d
+	}
+	items, err := s.PoolHistory(time.Now().Add(-since))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+func (s *Server) rotateHistory(c *gin.Context) {
+	var items []logic.RotationEvent
+	if s.RotationHistory != nil {
+		items = s.RotationHistory.Events()
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+func (s *Server) rotateInterval(c *gin.Context) {
+	if s.Rotation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rotation is not available"})
+		return
+	}
+	raw := c.Query("interval")
+	if raw == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval is required"})
+		return
+	}
+	var d logic.Duration
+	if err := d.UnmarshalJSON([]byte(strconv.Quote(raw))); err != nil {
+		secs, perr := strconv.ParseFloat(raw, 64)
+		if perr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid interval"})
+			return
+		}
+		d = logic.DurationValue(time.Duration(secs * float64(time.Second)))
+	}
+	if d.Duration() < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be >= 0"})
+		return
+	}
+	s.Rotation.SetInterval(d.Duration())
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "interval": s.Rotation.Interval().String()})
+}
+
+func (s *Server) audit(c *gin.Context) {
+	limit := 200
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = n
+	}
+	c.JSON(http.StatusOK, gin.H{"items": s.Audit.Entries(limit), "file_dropped": s.Audit.Dropped()})
+}
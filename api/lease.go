@@ -0,0 +1,216 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+// maxLeaseDuration bounds how long one lease may hold the fixed upstream.
+const maxLeaseDuration = 24 * time.Hour
+
+var (
+	errLeaseHeld    = errors.New("a lease is already active")
+	errLeaseNone    = errors.New("no active lease")
+	errLeaseToken   = errors.New("lease token does not match")
+	errLeaseNoProxy = errors.New("no current proxy to lease")
+)
+
+// Lease is an exclusive hold on the fixed manager's current node. Node is
+// kept redacted; the manager holds the pinned node itself.
+type Lease struct {
+	token    string
+	Note     string          `json:"note,omitempty"`
+	Acquired time.Time       `json:"acquired_at"`
+	Expires  time.Time       `json:"expires_at"`
+	Node     logic.ProxyNode `json:"node"`
+}
+
+// LeaseStore holds at most one lease. While it does, the manager is pinned
+// to the leased node, so failures and refreshes cannot move it either;
+// callers gate explicit moves with Allows.
+type LeaseStore struct {
+	manager Manager
+	logger  *log.Logger
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cur   *Lease
+	timer *time.Timer
+}
+
+func NewLeaseStore(manager Manager, logger *log.Logger) *LeaseStore {
+	return &LeaseStore{manager: manager, logger: logger, now: time.Now}
+}
+
+// Acquire pins the current node for d and returns the new lease, whose
+// token is needed to release it or move the node early.
+func (s *LeaseStore) Acquire(d time.Duration, note string) (Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	if s.cur != nil {
+		return *s.cur, errLeaseHeld
+	}
+	node, ok := s.manager.Current()
+	if !ok {
+		return Lease{}, errLeaseNoProxy
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return Lease{}, err
+	}
+	now := s.now()
+	l := &Lease{token: hex.EncodeToString(b[:]), Note: note, Acquired: now, Expires: now.Add(d), Node: node.Redacted()}
+	s.cur = l
+	s.manager.Pin(node)
+	token := l.token
+	s.timer = time.AfterFunc(d, func() { s.expire(token) })
+	return *l, nil
+}
+
+// Release ends the active lease early; token must match unless force.
+func (s *LeaseStore) Release(token string, force bool) (Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	if s.cur == nil {
+		return Lease{}, errLeaseNone
+	}
+	if !force && token != s.cur.token {
+		return *s.cur, errLeaseToken
+	}
+	l := *s.cur
+	s.endLocked()
+	return l, nil
+}
+
+// Active returns the active lease, if any.
+func (s *LeaseStore) Active() (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	if s.cur == nil {
+		return Lease{}, false
+	}
+	return *s.cur, true
+}
+
+// Allows reports whether a caller presenting token may move the fixed
+// node: when no lease is active, the token is the lease's, or force is set.
+// Otherwise it returns the blocking lease.
+func (s *LeaseStore) Allows(token string, force bool) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+	if s.cur == nil || force || token == s.cur.token {
+		return Lease{}, true
+	}
+	return *s.cur, false
+}
+
+// Follow re-pins an active lease to the manager's current node after an
+// allowed move, so the lease keeps the node the holder moved to.
+func (s *LeaseStore) Follow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur == nil {
+		return
+	}
+	s.manager.Unpin()
+	if node, ok := s.manager.Current(); ok {
+		s.cur.Node = node.Redacted()
+		s.manager.Pin(node)
+	}
+}
+
+// expire ends the lease with token if it is still the active one; a timer
+// firing after its lease was released or replaced does nothing.
+func (s *LeaseStore) expire(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur != nil && s.cur.token == token {
+		s.logger.Printf("lease expired: note=%q node=%s", s.cur.Note, s.cur.Node.Addr())
+		s.endLocked()
+	}
+}
+
+// expireLocked ends the lease once past its expiry, so callers never see
+// a stale lease while the timer is still pending.
+func (s *LeaseStore) expireLocked() {
+	if s.cur != nil && !s.now().Before(s.cur.Expires) {
+		s.logger.Printf("lease expired: note=%q node=%s", s.cur.Note, s.cur.Node.Addr())
+		s.endLocked()
+	}
+}
+
+func (s *LeaseStore) endLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.cur = nil
+	s.manager.Unpin()
+}
+
+func (s *Server) lease(c *gin.Context) {
+	l, ok := s.Leases.Active()
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"active": true, "lease": l})
+}
+
+func (s *Server) acquireLease(c *gin.Context) {
+	var req struct {
+		Duration logic.Duration `json:"duration"`
+		Note     string         `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		return
+	}
+	d := req.Duration.Duration()
+	if d <= 0 || d > maxLeaseDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duration must be > 0 and <= " + maxLeaseDuration.String()})
+		return
+	}
+	l, err := s.Leases.Acquire(d, req.Note)
+	switch {
+	case errors.Is(err, errLeaseHeld):
+		c.JSON(http.StatusConflict, gin.H{"status": "leased", "lease": l})
+		return
+	case errors.Is(err, errLeaseNoProxy):
+		c.JSON(http.StatusConflict, gin.H{"status": "empty_pool"})
+		return
+	case err != nil:
+		_ = c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.Logger.Printf("lease acquired: note=%q node=%s until %s", l.Note, l.Node.Addr(), l.Expires.Format(time.RFC3339))
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "token": l.token, "lease": l})
+}
+
+func (s *Server) releaseLease(c *gin.Context) {
+	l, err := s.Leases.Release(c.GetHeader("X-Lease-Token"), c.Query("force") == "1")
+	switch {
+	case errors.Is(err, errLeaseNone):
+		c.JSON(http.StatusNotFound, gin.H{"status": "no_lease"})
+		return
+	case errors.Is(err, errLeaseToken):
+		c.JSON(http.StatusForbidden, gin.H{"status": "leased", "error": err.Error(), "lease": l})
+		return
+	}
+	s.Logger.Printf("lease released: note=%q node=%s", l.Note, l.Node.Addr())
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "released": l})
+}
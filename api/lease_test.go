@@ -0,0 +1,260 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+func pinnedManager(t *testing.T) *logic.ProxyManager {
+	t.Helper()
+	m := logic.NewProxyManager()
+	m.SetPool([]logic.ProxyNode{node("192.0.2.1", "1080"), node("192.0.2.2", "1080")})
+	if cur, ok := m.Current(); !ok || cur.Addr() != "192.0.2.1:1080" {
+		t.Fatalf("Current() = %v, %v on a fresh pool", cur.Addr(), ok)
+	}
+	return m
+}
+
+func TestLeaseStore(t *testing.T) {
+	m := pinnedManager(t)
+	now := time.Unix(1000, 0)
+	s := NewLeaseStore(m, log.New(io.Discard, "", 0))
+	s.now = func() time.Time { return now }
+
+	l, err := s.Acquire(time.Hour, "scrape")
+	if err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+	if l.token == "" || l.Node.Addr() != "192.0.2.1:1080" || !l.Expires.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Acquire() = %+v", l)
+	}
+	if p, ok := m.Pinned(); !ok || p.Addr() != "192.0.2.1:1080" {
+		t.Fatalf("Pinned() = %v, %v; want the leased node", p.Addr(), ok)
+	}
+	if _, err := s.Acquire(time.Hour, "other"); !errors.Is(err, errLeaseHeld) {
+		t.Errorf("second Acquire() = %v, want errLeaseHeld", err)
+	}
+
+	for _, tt := range []struct {
+		token string
+		force bool
+		want  bool
+	}{
+		{"", false, false},
+		{"wrong", false, false},
+		{l.token, false, true},
+		{"", true, true},
+	} {
+		if _, ok := s.Allows(tt.token, tt.force); ok != tt.want {
+			t.Errorf("Allows(%q, %v) = %v, want %v", tt.token, tt.force, ok, tt.want)
+		}
+	}
+
+	if _, err := s.Release("wrong", false); !errors.Is(err, errLeaseToken) {
+		t.Errorf("Release(wrong) = %v, want errLeaseToken", err)
+	}
+	if _, err := s.Release(l.token, false); err != nil {
+		t.Fatalf("Release(token) = %v", err)
+	}
+	if _, ok := m.Pinned(); ok {
+		t.Error("manager still pinned after Release")
+	}
+	if _, err := s.Release("", true); !errors.Is(err, errLeaseNone) {
+		t.Errorf("Release() without a lease = %v, want errLeaseNone", err)
+	}
+
+	// A lease past its expiry ends on the next look, before its timer fires.
+	if _, err := s.Acquire(time.Minute, ""); err != nil {
+		t.Fatalf("Acquire() after Release = %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, ok := s.Active(); ok {
+		t.Error("Active() past the expiry = true")
+	}
+	if _, ok := m.Pinned(); ok {
+		t.Error("manager still pinned after expiry")
+	}
+}
+
+func TestLeaseStoreEmptyPool(t *testing.T) {
+	s := NewLeaseStore(logic.NewProxyManager(), log.New(io.Discard, "", 0))
+	if _, err := s.Acquire(time.Hour, ""); !errors.Is(err, errLeaseNoProxy) {
+		t.Fatalf("Acquire() on an empty pool = %v, want errLeaseNoProxy", err)
+	}
+}
+
+// TestLeaseStaleTimer checks that a timer outliving its lease leaves the
+// next lease alone.
+func TestLeaseStaleTimer(t *testing.T) {
+	s := NewLeaseStore(pinnedManager(t), log.New(io.Discard, "", 0))
+	old, err := s.Acquire(time.Hour, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Release(old.token, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Acquire(time.Hour, "new"); err != nil {
+		t.Fatal(err)
+	}
+	s.expire(old.token)
+	if l, ok := s.Active(); !ok || l.Note != "new" {
+		t.Fatalf("Active() = %+v, %v after a stale expire; want the new lease", l, ok)
+	}
+}
+
+// TestLeaseExpiryRacesRotation runs rotation ticks and move checks while the
+// lease timer fires: a tick must never see the lease gone with the node still
+// pinned, and the lease must end exactly once.
+func TestLeaseExpiryRacesRotation(t *testing.T) {
+	var logs bytes.Buffer
+	m := pinnedManager(t)
+	s := NewLeaseStore(m, log.New(&logs, "", 0))
+	if _, err := s.Acquire(30*time.Millisecond, "race"); err != nil {
+		t.Fatal(err)
+	}
+
+	var freed, broken atomic.Bool
+	gate := func() {
+		_, held := s.Active()
+		if !held {
+			freed.Store(true)
+			if _, pinned := m.Pinned(); pinned {
+				broken.Store(true)
+			}
+		}
+	}
+	rotation := logic.NewRotationController(m, logic.RotationConfig{Interval: time.Millisecond})
+	// Hold reports what main's hook would decide but never lets the tick
+	// through, so nothing here depends on a live upstream.
+	rotation.Hold = func(string) bool {
+		gate()
+		return true
+	}
+	rotation.Start(context.Background())
+	defer rotation.Stop()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, ok := s.Allows("", false); ok {
+					if _, pinned := m.Pinned(); pinned {
+						broken.Store(true)
+					}
+				}
+				gate()
+			}
+		}()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !freed.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if !freed.Load() {
+		t.Fatal("the lease never expired")
+	}
+	if broken.Load() {
+		t.Error("a check saw the lease gone with the node still pinned")
+	}
+	if n := strings.Count(logs.String(), "lease expired"); n != 1 {
+		t.Errorf("lease expired %d times, want once:\n%s", n, logs.String())
+	}
+}
+
+// leaseDo serves method path with an optional X-Lease-Token header and
+// returns the status code.
+func leaseDo(t *testing.T, h http.Handler, method, path, token string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("X-Lease-Token", token)
+	}
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestLeaseHandlers(t *testing.T) {
+	fixed := pinnedManager(t)
+	s, h := testServer(t, newFakeManager(), newFakeManager(), &fakeRefresher{})
+	s.fixed = fixed
+	s.Leases = NewLeaseStore(fixed, s.Logger)
+
+	for _, body := range []string{`{"duration": "0s"}`, `{"duration": "25h"}`, `{`} {
+		if code, _ := doBody(t, h, http.MethodPost, "/api/lease", body); code != http.StatusBadRequest {
+			t.Errorf("POST /api/lease %s = %d, want 400", body, code)
+		}
+	}
+
+	code, body := doBody(t, h, http.MethodPost, "/api/lease", `{"duration": "1h", "note": "scrape"}`)
+	token, _ := body["token"].(string)
+	if code != http.StatusOK || token == "" {
+		t.Fatalf("POST /api/lease = %d %v, want 200 with a token", code, body)
+	}
+	if code, body := doBody(t, h, http.MethodPost, "/api/lease", `{"duration": "1h"}`); code != http.StatusConflict || body["status"] != "leased" {
+		t.Errorf("second POST /api/lease = %d %v, want 409 leased", code, body)
+	}
+	code, body = do(t, h, http.MethodGet, "/api/lease")
+	if code != http.StatusOK || body["active"] != true {
+		t.Fatalf("GET /api/lease = %d %v, want an active lease", code, body)
+	}
+	if strings.Contains(fmt.Sprint(body), token) {
+		t.Errorf("GET /api/lease = %v exposes the token", body)
+	}
+
+	if code := leaseDo(t, h, http.MethodPost, "/api/next", ""); code != http.StatusLocked {
+		t.Errorf("POST /api/next without the token = %d, want 423", code)
+	}
+	if cur, _ := fixed.Current(); cur.Addr() != "192.0.2.1:1080" {
+		t.Fatalf("a refused /next moved the node to %s", cur.Addr())
+	}
+	if code := leaseDo(t, h, http.MethodPost, "/api/next", token); code != http.StatusOK {
+		t.Errorf("POST /api/next with the token = %d, want 200", code)
+	}
+	// The lease follows the holder's move.
+	if p, ok := fixed.Pinned(); !ok || p.Addr() != "192.0.2.2:1080" {
+		t.Errorf("Pinned() = %v, %v after the holder's /next; want 192.0.2.2:1080", p.Addr(), ok)
+	}
+	if code := leaseDo(t, h, http.MethodPost, "/api/next?force=1", ""); code != http.StatusOK {
+		t.Errorf("POST /api/next?force=1 = %d, want 200", code)
+	}
+
+	if code := leaseDo(t, h, http.MethodDelete, "/api/lease", "wrong"); code != http.StatusForbidden {
+		t.Errorf("DELETE /api/lease with a wrong token = %d, want 403", code)
+	}
+	if code := leaseDo(t, h, http.MethodDelete, "/api/lease", token); code != http.StatusOK {
+		t.Errorf("DELETE /api/lease with the token = %d, want 200", code)
+	}
+	if code := leaseDo(t, h, http.MethodDelete, "/api/lease", token); code != http.StatusNotFound {
+		t.Errorf("DELETE /api/lease twice = %d, want 404", code)
+	}
+	if code := leaseDo(t, h, http.MethodPost, "/api/next", ""); code != http.StatusOK {
+		t.Errorf("POST /api/next after release = %d, want 200", code)
+	}
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+// leaseAllows answers 423 Locked and returns false when a lease holds the
+// fixed upstream and the caller has neither its X-Lease-Token nor
+// ?force=1.
+func (s *Server) leaseAllows(c *gin.Context) bool {
+	l, ok := s.Leases.Allows(c.GetHeader("X-Lease-Token"), c.Query("force") == "1")
+	if !ok {
+		c.JSON(http.StatusLocked, gin.H{"status": "leased", "lease": l})
+	}
+	return ok
+}
+
+func (s *Server) next(c *gin.Context) {
+	mode := c.DefaultQuery("mode", "fixed")
+	m, ok := s.manager(mode)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode"})
+		return
+	}
+	if mode == "fixed" && !s.leaseAllows(c) {
+		return
+	}
+	if m.PoolSize() == 0 {
+		c.JSON(http.StatusConflict, gin.H{"status": "empty_pool"})
+		return
+	}
+	prev, hadPrev := m.Current()
+	var next logic.ProxyNode
+	tag := c.Query("tag")
+	skipUnhealthy := false
+	switch c.Query("skip_unhealthy") {
+	case "1", "true", "yes", "on":
+		skipUnhealthy = true
+	}
+	switch {
+	case tag != "":
+		next, ok = m.NextWithTag(tag)
+		if !ok {
+			c.JSON(http.StatusConflict, gin.H{"status": "no_tagged_proxy", "tag": tag})
+			return
+		}
+	case skipUnhealthy:
+		next, ok = m.NextHealthy()
+		if !ok {
+			c.JSON(http.StatusConflict, gin.H{"status": "no_healthy_proxy"})
+			return
+		}
+	default:
+		next, ok = m.Next()
+		if !ok {
+			// The pool is not empty, so every node in it is disabled.
+			c.JSON(http.StatusConflict, gin.H{"status": "all_disabled"})
+			return
+		}
+	}
+	if mode == "fixed" {
+		s.Leases.Follow()
+	}
+	s.rotated(mode, logic.RotationReasonManualNext, prev, next)
+	brief := func(n logic.ProxyNode) gin.H {
+		return gin.H{"addr": n.Addr(), "country": n.Country, "latency": n.LatencyMS}
+	}
+	resp := gin.H{"status": "ok", "mode": mode, "type": next.Type, "new_proxy": next.String(), "new": brief(next)}
+	if hadPrev {
+		resp["previous"] = brief(prev)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) selectNode(c *gin.Context) {
+	if !s.leaseAllows(c) {
+		return
+	}
+	addr := c.Query("addr")
+	if addr != "" {
+		if n, ok := logic.ParseProxySpec(addr, "auto"); ok {
+			addr = n.Addr()
+		}
+		prev, _ := s.fixed.Current()
+		current, ok := s.fixed.SetCurrentByAddr(addr)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"status": "not_found", "addr": addr})
+			return
+		}
+		s.Leases.Follow()
+		s.rotated("fixed", logic.RotationReasonManualPromote, prev, current)
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "type": current.Type, "new_proxy": current.String()})
+		return
+	}
+	idxParam := c.Query("index")
+	if idxParam == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "addr or index is required"})
+		return
+	}
+	idx, err := strconv.Atoi(idxParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid index"})
+		return
+	}
+	prev, _ := s.fixed.Current()
+	current, ok := s.fixed.SetCurrentIndex(idx)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"status": "not_found", "index": idx})
+		return
+	}
+	s.Leases.Follow()
+	s.rotated("fixed", logic.RotationReasonManualPromote, prev, current)
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "type": current.Type, "new_proxy": current.String()})
+}
+
+func (s *Server) setCurrent(c *gin.Context) {
+	var req struct {
+		Addr string `json:"addr"`
+		Mode string `json:"mode"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "fixed"
+	}
+	m, ok := s.manager(req.Mode)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode"})
+		return
+	}
+	if req.Mode == "fixed" && !s.leaseAllows(c) {
+		return
+	}
+	addr := req.Addr
+	if n, ok := logic.ParseProxySpec(addr, "auto"); ok {
+		addr = n.Addr()
+	}
+	node, ok := m.Lookup(addr)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"status": "not_found", "addr": addr})
+		return
+	}
+	switch c.Query("check") {
+	case "1", "true", "yes", "on":
+		rctx, cancel := context.WithTimeout(c.Request.Context(), 20*time.Second)
+		valid, _, err := s.Probe(rctx, node, s.cfg.Validation.TestFor(node.Type).Target, false)
+		cancel()
+		if err != nil || !valid {
+			msg := "check failed"
+			if err != nil {
+				msg = err.Error()
+			}
+			c.JSON(http.StatusConflict, gin.H{"status": "check_failed", "proxy": node.String(), "error": msg})
+			return
+		}
+	}
+	prev, _ := m.Current()
+	current, ok := m.SetCurrentByAddr(addr)
+	if !ok {
+		// Removed by a concurrent refresh or failure report.
+		c.JSON(http.StatusNotFound, gin.H{"status": "not_found", "addr": addr})
+		return
+	}
+	if req.Mode == "fixed" {
+		s.Leases.Follow()
+	}
+	s.rotated(req.Mode, logic.RotationReasonManualPromote, prev, current)
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "mode": req.Mode, "type": current.Type, "new_proxy": current.String()})
+}
+
+func (s *Server) poolRemoved(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"items": s.RemovedLog.Items(c.Query("reason"))})
+}
+
+// poolItem is a pool node with its sighting record, when there is one.
+type poolItem struct {
+	logic.ProxyNode
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Survival  int        `json:"refresh_survival"`
+	// EffectiveTimeoutMS is the dial timeout the node gets now.
+	EffectiveTimeoutMS int64 `json:"effective_dial_timeout_ms"`
+}
+
+// maxPoolItems bounds the nodes GET /api/pool lists.
+const maxPoolItems = 200
+
+func (s *Server) pool(c *gin.Context) {
+	mode := c.Query("mode")
+	if mode == "" {
+		mode = "fixed"
+	}
+	minSurvival := 0
+	if raw := c.Query("min_survival"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid min_survival"})
+			return
+		}
+		minSurvival = n
+	}
+	m, ok := s.manager(mode)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode"})
+		return
+	}
+	nodes := logic.FilterByTag(m.PoolSnapshot(0), c.Query("tag"))
+	if !s.cfg.ExposeCredentials {
+		nodes = logic.RedactNodes(nodes)
+	}
+	// The pool mixes proxy types; count each across the whole pool.
+	types := make(map[string]int)
+	for _, n := range nodes {
+		types[n.Type]++
+	}
+	items := make([]poolItem, 0, min(len(nodes), maxPoolItems))
+	for _, n := range nodes {
+		if len(items) == maxPoolItems {
+			break
+		}
+		item := poolItem{ProxyNode: n, EffectiveTimeoutMS: m.DialTimeout(n, s.cfg.DialTimeout).Milliseconds()}
+		if seen, ok := s.Seen.Get(n.Addr()); ok {
+			item.FirstSeen, item.LastSeen, item.Survival = &seen.FirstSeen, &seen.LastSeen, seen.Survival
+		}
+		if item.Survival < minSurvival {
+			continue
+		}
+		items = append(items, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"types": types, "items": items, "pool_size": len(nodes)})
+}
+
+func (s *Server) poolAdd(c *gin.Context) {
+	var req struct {
+		Proxies  []string `json:"proxies"`
+		Tags     []string `json:"tags"`
+		Validate bool     `json:"validate"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Proxies) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "proxies is required"})
+		return
+	}
+	var nodes []logic.ProxyNode
+	for _, spec := range req.Proxies {
+		expanded, err := logic.ExpandProxySpecLimit(spec, "auto", s.cfg.MaxProxyRange)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		nodes = append(nodes, expanded...)
+	}
+	rctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Minute)
+	defer cancel()
+	added, err := s.refresh.Add(rctx, nodes, req.Tags, req.Validate)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	addrs := make([]string, len(added))
+	for i, n := range added {
+		addrs[i] = n.Addr()
+	}
+	c.JSON(http.StatusOK, gin.H{"added": addrs, "pool_size": s.fixed.PoolSize()})
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+func (s *Server) runRefresh(c *gin.Context) {
+	mode := c.DefaultQuery("mode", s.cfg.RefreshMode)
+	if mode != logic.RefreshModeReplace && mode != logic.RefreshModeTopUp {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be replace or topup"})
+		return
+	}
+	rctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	count, diff, err := s.refresh.Run(rctx, mode)
+	resp := gin.H{"count": count, "mode": mode}
+	if !diff.At.IsZero() {
+		sum := diff.Summary()
+		resp["added"], resp["removed"], resp["retained"] = sum.Added, sum.Removed, sum.Retained
+	}
+	if err != nil && count > 0 {
+		resp["warning"] = err.Error()
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	if err != nil {
+		_ = c.Error(err)
+		resp["error"] = err.Error()
+		c.JSON(errorStatus(err), resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) dryRun(c *gin.Context) {
+	var override logic.RefreshOverride
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&override); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+			return
+		}
+	}
+	if override.Sources != nil {
+		for i, src := range *override.Sources {
+			if err := src.Validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("sources[%d]: %v", i, err)})
+				return
+			}
+		}
+	}
+	if override.Validation != nil {
+		// DryRun applies the defaults too; check what it will run.
+		v := *override.Validation
+		v.ApplyDefaults()
+		if err := v.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "validation: " + err.Error()})
+			return
+		}
+	}
+	rctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	report, err := s.refresh.DryRun(rctx, override)
+	if err != nil && report.PoolSize == 0 {
+		c.JSON(errorStatus(err), report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (s *Server) reload(c *gin.Context) {
+	if s.Reload == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "not started with -config"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "1" || c.Query("dry_run") == "true"
+	rctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	rep, rejected := s.Reload(rctx, dryRun)
+	if rejected {
+		c.JSON(http.StatusUnprocessableEntity, rep)
+		return
+	}
+	c.JSON(http.StatusOK, rep)
+}
+
+func (s *Server) sources(c *gin.Context) {
+	// Provider secrets live in env vars, so the configured sources are safe to echo.
+	c.JSON(http.StatusOK, gin.H{"items": s.refresh.Sources()})
+}
+
+func (s *Server) refreshDiff(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"items": s.refresh.Diffs()})
+}
+
+func (s *Server) blocklist(c *gin.Context) {
+	entries := s.Blocklist.Entries(time.Now())
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":  s.Blocklist != nil,
+		"after":    s.cfg.BlocklistAfter,
+		"duration": s.cfg.BlocklistDuration,
+		"size":     len(entries),
+		"entries":  entries,
+	})
+}
+
+func (s *Server) unblock(c *gin.Context) {
+	addr := strings.TrimSpace(c.Query("addr"))
+	if addr == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "addr is required"})
+		return
+	}
+	if !s.Blocklist.Remove(addr) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not blocklisted", "addr": addr})
+		return
+	}
+	if s.BlocklistChanged != nil {
+		s.BlocklistChanged()
+	}
+	s.Logger.Printf("blocklist: %s unblocked", addr)
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "addr": addr})
+}
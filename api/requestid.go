@@ -0,0 +1,37 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+// maxRequestIDLen bounds the X-Request-ID a client may supply; longer ones
+// are replaced rather than copied into every log line.
+const maxRequestIDLen = 128
+
+// RequestLog tags each request with an ID, taken from X-Request-ID or
+// generated, stores it in the request context (logic.RequestIDFrom), echoes
+// it in the response header and logs the request with it. Status and health
+// probes are not logged.
+func RequestLog(logger *log.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > maxRequestIDLen {
+			id = logic.NewRequestID()
+		}
+		c.Request = c.Request.WithContext(logic.WithRequestID(c.Request.Context(), id))
+		c.Header("X-Request-ID", id)
+
+		start := time.Now()
+		c.Next()
+		path := c.Request.URL.Path
+		if path == "/api/status" || path == "/healthz" || path == "/readyz" {
+			return
+		}
+		logger.Printf("%s %s %s %d %s id=%s", c.ClientIP(), c.Request.Method, path, c.Writer.Status(), time.Since(start).Truncate(time.Millisecond), id)
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+func TestRequestLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var buf bytes.Buffer
+	r := gin.New()
+	r.Use(RequestLog(log.New(&buf, "", 0)))
+	// The handler logs the ID it sees, as the proxy and API handlers do.
+	var seen string
+	handler := func(c *gin.Context) {
+		seen = logic.RequestIDFrom(c.Request.Context())
+		c.Status(http.StatusNoContent)
+	}
+	r.GET("/api/pool", handler)
+	r.GET("/healthz", handler)
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		logged bool
+	}{
+		{"client ID", "/api/pool", "client-42", true},
+		{"generated", "/api/pool", "", true},
+		{"overlong", "/api/pool", strings.Repeat("x", maxRequestIDLen+1), true},
+		{"health probe", "/healthz", "probe-1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Request-ID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			id := w.Header().Get("X-Request-ID")
+			if id == "" {
+				t.Fatal("no X-Request-ID response header")
+			}
+			if len(tt.header) <= maxRequestIDLen && tt.header != "" && id != tt.header {
+				t.Errorf("X-Request-ID = %q, want the client's %q", id, tt.header)
+			}
+			if len(id) > maxRequestIDLen {
+				t.Errorf("X-Request-ID is %d bytes, want at most %d", len(id), maxRequestIDLen)
+			}
+			if seen != id {
+				t.Errorf("handler saw ID %q, response header has %q", seen, id)
+			}
+			line := buf.String()
+			if !tt.logged {
+				if line != "" {
+					t.Errorf("logged %q, want health probes left out", line)
+				}
+				return
+			}
+			if !strings.Contains(line, "GET "+tt.path+" 204 ") || !strings.HasSuffix(line, " id="+id+"\n") {
+				t.Errorf("log line %q, want the request with id=%s", line, id)
+			}
+		})
+	}
+}
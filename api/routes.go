@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeInfo describes one web endpoint for GET /api/routes.
+type routeInfo struct {
+	Method      string `json:"method"`
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+// routeTable registers handlers on a gin group together with a one-line
+// description, so the API can list itself. Every endpoint should be
+// registered through it.
+type routeTable struct {
+	group  *gin.RouterGroup
+	routes *[]routeInfo
+}
+
+func (t routeTable) Group(path string) routeTable {
+	return routeTable{group: t.group.Group(path), routes: t.routes}
+}
+
+func (t routeTable) handle(method, path, desc string, handlers ...gin.HandlerFunc) {
+	t.group.Handle(method, path, handlers...)
+	full := strings.TrimSuffix(t.group.BasePath(), "/") + path
+	*t.routes = append(*t.routes, routeInfo{Method: method, Path: full, Description: desc})
+}
+
+func (t routeTable) GET(path, desc string, handlers ...gin.HandlerFunc) {
+	t.handle(http.MethodGet, path, desc, handlers...)
+}
+
+func (t routeTable) POST(path, desc string, handlers ...gin.HandlerFunc) {
+	t.handle(http.MethodPost, path, desc, handlers...)
+}
+
+func (t routeTable) PUT(path, desc string, handlers ...gin.HandlerFunc) {
+	t.handle(http.MethodPut, path, desc, handlers...)
+}
+
+func (t routeTable) DELETE(path, desc string, handlers ...gin.HandlerFunc) {
+	t.handle(http.MethodDelete, path, desc, handlers...)
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"os"
+	"runtime"
+	"time"
+)
+
+// runtimeStats is what GET /api/runtime reports.
+type runtimeStats struct {
+	GoVersion  string `json:"go_version"`
+	Goroutines int    `json:"goroutines"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	// OpenFDs is -1 where the count is not available (no /proc).
+	OpenFDs int           `json:"open_fds"`
+	Uptime  string        `json:"uptime"`
+	Memory  runtimeMemory `json:"memory"`
+}
+
+type runtimeMemory struct {
+	Alloc        uint64  `json:"alloc"`
+	TotalAlloc   uint64  `json:"total_alloc"`
+	Sys          uint64  `json:"sys"`
+	HeapAlloc    uint64  `json:"heap_alloc"`
+	HeapInuse    uint64  `json:"heap_inuse"`
+	HeapIdle     uint64  `json:"heap_idle"`
+	HeapReleased uint64  `json:"heap_released"`
+	HeapObjects  uint64  `json:"heap_objects"`
+	StackInuse   uint64  `json:"stack_inuse"`
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotalMS float64 `json:"gc_pause_total_ms"`
+	LastGC       string  `json:"last_gc,omitempty"`
+}
+
+func readRuntimeStats(started time.Time) runtimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	st := runtimeStats{
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		OpenFDs:    openFDs(),
+		Uptime:     time.Since(started).Truncate(time.Second).String(),
+		Memory: runtimeMemory{
+			Alloc:        ms.Alloc,
+			TotalAlloc:   ms.TotalAlloc,
+			Sys:          ms.Sys,
+			HeapAlloc:    ms.HeapAlloc,
+			HeapInuse:    ms.HeapInuse,
+			HeapIdle:     ms.HeapIdle,
+			HeapReleased: ms.HeapReleased,
+			HeapObjects:  ms.HeapObjects,
+			StackInuse:   ms.StackInuse,
+			NumGC:        ms.NumGC,
+			PauseTotalMS: float64(ms.PauseTotalNs) / 1e6,
+		},
+	}
+	if ms.LastGC > 0 {
+		st.Memory.LastGC = time.Unix(0, int64(ms.LastGC)).UTC().Format(time.RFC3339)
+	}
+	return st
+}
+
+// openFDs counts this process's open file descriptors, or returns -1.
+func openFDs() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			// The read itself holds one descriptor open.
+			return len(entries) - 1
+		}
+	}
+	return -1
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+// Self-test stages, reported where a test stopped.
+const (
+	selfTestStageListener = "listener"
+	selfTestStageUpstream = "upstream"
+	selfTestStageTarget   = "target"
+)
+
+// selfTestResult is the outcome of fetching a URL through one of our own
+// SOCKS listeners, like a client would.
+type selfTestResult struct {
+	Mode      string `json:"mode"`
+	Listener  string `json:"listener"`
+	OK        bool   `json:"ok"`
+	Stage     string `json:"stage,omitempty"`
+	Upstream  string `json:"upstream,omitempty"`
+	Target    string `json:"target"`
+	Status    int    `json:"status,omitempty"`
+	ExitIP    string `json:"exit_ip,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// DialWatch tells a self test which upstream the listener dialed for it.
+// The listeners Note every dial while a test runs, keyed by the client
+// address, and the test takes the entry of its own connection.
+type DialWatch struct {
+	running atomic.Bool
+
+	mu     sync.Mutex
+	active int
+	seen   map[string]string
+}
+
+func NewDialWatch() *DialWatch {
+	return &DialWatch{seen: make(map[string]string)}
+}
+
+// Note records via as the upstream dialed for the client in ctx.
+func (w *DialWatch) Note(ctx context.Context, via logic.ProxyNode) {
+	if !w.running.Load() || via.Addr() == "" {
+		return
+	}
+	client := logic.ClientAddrFrom(ctx)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.active > 0 && client != "" {
+		w.seen[client] = via.Addr()
+	}
+}
+
+func (w *DialWatch) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.active++
+	w.running.Store(true)
+}
+
+// stop ends a test; the last one drops the dials of other clients.
+func (w *DialWatch) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.active--; w.active == 0 {
+		w.running.Store(false)
+		clear(w.seen)
+	}
+}
+
+func (w *DialWatch) take(client string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	via := w.seen[client]
+	delete(w.seen, client)
+	return via
+}
+
+// selfTest GETs target through the SOCKS5 listener at ln. The stage of a
+// failure tells a listener that cannot be reached from an upstream that
+// refused the tunnel and from a target that failed behind a working tunnel.
+// The upstream reported is the one the listener dialed, as told by watch.
+func selfTest(ctx context.Context, ln net.Addr, target string, timeout time.Duration, watch *DialWatch) (res selfTestResult) {
+	res = selfTestResult{Target: target}
+	if ln == nil {
+		res.Stage, res.Error = selfTestStageListener, "listener is disabled"
+		return res
+	}
+	res.Listener = ln.String()
+	tcp, ok := ln.(*net.TCPAddr)
+	if !ok {
+		res.Stage, res.Error = selfTestStageListener, "self test needs a tcp listener"
+		return res
+	}
+	ip := tcp.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	local := logic.ProxyNode{Type: logic.ProxyTypeSOCKS5, IP: ip.String(), Port: fmt.Sprint(tcp.Port)}
+
+	watch.start()
+	defer watch.stop()
+	// The transport may still be dialing when a timed out request returns.
+	var (
+		dialMu     sync.Mutex
+		dialErr    error
+		clientAddr string
+	)
+	dialed := func(addr string, err error) {
+		dialMu.Lock()
+		defer dialMu.Unlock()
+		if addr != "" {
+			clientAddr = addr
+		}
+		dialErr = err
+	}
+	defer func() {
+		dialMu.Lock()
+		defer dialMu.Unlock()
+		if clientAddr != "" {
+			res.Upstream = watch.take(clientAddr)
+		}
+	}()
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				d := net.Dialer{Timeout: timeout}
+				conn, err := d.DialContext(ctx, "tcp", local.Addr())
+				if err != nil {
+					dialed("", err)
+					return nil, err
+				}
+				c, err := logic.SOCKS5ConnectOver(ctx, conn, local, addr, timeout)
+				dialed(conn.LocalAddr().String(), err)
+				return c, err
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	start := time.Now()
+	defer func() { res.LatencyMS = time.Since(start).Milliseconds() }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		res.Stage, res.Error = selfTestStageTarget, err.Error()
+		return res
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		dialMu.Lock()
+		dialErr := dialErr
+		dialMu.Unlock()
+		var replyErr *logic.SOCKS5ReplyError
+		switch {
+		case dialErr == nil:
+			res.Stage = selfTestStageTarget
+		case errors.As(dialErr, &replyErr):
+			// Our listener answered but could not get through an upstream.
+			res.Stage = selfTestStageUpstream
+		default:
+			res.Stage = selfTestStageListener
+		}
+		return res
+	}
+	defer resp.Body.Close()
+	res.Status = resp.StatusCode
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if resp.StatusCode != http.StatusOK {
+		res.Stage, res.Error = selfTestStageTarget, "unexpected status "+resp.Status
+		return res
+	}
+	if s := strings.TrimSpace(string(body)); net.ParseIP(s) != nil {
+		res.ExitIP = s
+	}
+	res.OK = true
+	return res
+}
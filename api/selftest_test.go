@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+// testListener serves SOCKS5 on loopback, noting via for every dial and
+// failing them with dialErr when set.
+func testListener(t *testing.T, watch *DialWatch, via logic.ProxyNode, dialErr error) net.Addr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &logic.SOCKS5Server{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Another client's dial during the test must not be reported.
+		watch.Note(logic.WithClientAddr(ctx, "127.0.0.1:1"), logic.ProxyNode{Type: logic.ProxyTypeSOCKS5, IP: "192.0.2.99", Port: "1080"})
+		watch.Note(ctx, via)
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}}
+	go srv.Serve(ln)
+	return ln.Addr()
+}
+
+func TestSelfTest(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("203.0.113.9\n"))
+	}))
+	defer target.Close()
+	via := logic.ProxyNode{Type: logic.ProxyTypeSOCKS5, IP: "192.0.2.1", Port: "1080"}
+
+	t.Run("ok", func(t *testing.T) {
+		watch := NewDialWatch()
+		res := selfTest(context.Background(), testListener(t, watch, via, nil), target.URL, 5*time.Second, watch)
+		if !res.OK || res.Upstream != via.Addr() || res.ExitIP != "203.0.113.9" || res.Status != http.StatusOK {
+			t.Errorf("selfTest() = %+v, want ok via %s with exit 203.0.113.9", res, via.Addr())
+		}
+		if len(watch.seen) != 0 || watch.running.Load() {
+			t.Errorf("the watch kept %v after the test", watch.seen)
+		}
+	})
+
+	t.Run("upstream refused", func(t *testing.T) {
+		watch := NewDialWatch()
+		refused := &logic.UpstreamError{Proxy: via.Addr(), Err: syscall.ECONNREFUSED}
+		res := selfTest(context.Background(), testListener(t, watch, via, refused), target.URL, 5*time.Second, watch)
+		if res.OK || res.Stage != selfTestStageUpstream || res.Upstream != via.Addr() {
+			t.Errorf("selfTest() = %+v, want an upstream failure via %s", res, via.Addr())
+		}
+	})
+
+	t.Run("listener unreachable", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr()
+		ln.Close()
+		res := selfTest(context.Background(), addr, target.URL, 5*time.Second, NewDialWatch())
+		if res.OK || res.Stage != selfTestStageListener || res.Upstream != "" {
+			t.Errorf("selfTest() = %+v, want a listener failure and no upstream", res)
+		}
+	})
+
+	t.Run("listener disabled", func(t *testing.T) {
+		res := selfTest(context.Background(), nil, target.URL, time.Second, NewDialWatch())
+		if res.Stage != selfTestStageListener {
+			t.Errorf("selfTest() = %+v, want a listener failure", res)
+		}
+	})
+}
+
+func TestDialWatchIdle(t *testing.T) {
+	w := NewDialWatch()
+	w.Note(logic.WithClientAddr(context.Background(), "127.0.0.1:5"), logic.ProxyNode{Type: logic.ProxyTypeSOCKS5, IP: "192.0.2.1", Port: "1080"})
+	if len(w.seen) != 0 {
+		t.Error("Note recorded a dial with no test running")
+	}
+}
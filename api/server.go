@@ -0,0 +1,302 @@
+// Package api serves the web API. Its handlers read and steer the pools
+// through the managers, refresher and hooks a Server is given, so they can
+// be tested against fakes.
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+// Config is the part of the configuration the API reads.
+type Config struct {
+	WebListen        string
+	WebListenNetwork string
+	HTTPProxyListen  string
+	WebTLS           bool
+	WebMTLS          bool
+
+	DialTimeout  time.Duration
+	Validation   logic.ValidationConfig
+	RefreshMode  string
+	SelfTestURL  string
+	MaxClients   int
+	ReadyMinPool int
+	// MaxProxyRange caps the ranges POST /api/pool/add expands.
+	MaxProxyRange       int
+	AllowPrivateProxies bool
+	// ExposeCredentials keeps proxy passwords in /api/pool and state
+	// exports.
+	ExposeCredentials bool
+	BlocklistAfter    int
+	BlocklistDuration logic.Duration
+	HistoryEvery      time.Duration
+}
+
+// Manager is the pool of one mode ("fixed" or "auto");
+// *logic.ProxyManager implements it.
+type Manager interface {
+	Status() logic.Status
+	Metrics() logic.PoolMetrics
+	Memory() logic.ManagerMemory
+	PoolSize() int
+	PoolSizeByType() map[string]int
+	CountByCountry() map[string]int
+	PoolSnapshot(limit int) []logic.ProxyNode
+	Lookup(addr string) (logic.ProxyNode, bool)
+	DialTimeout(n logic.ProxyNode, fallback time.Duration) time.Duration
+
+	Current() (logic.ProxyNode, bool)
+	Next() (logic.ProxyNode, bool)
+	NextWithTag(tag string) (logic.ProxyNode, bool)
+	NextHealthy() (logic.ProxyNode, bool)
+	SetCurrentByAddr(addr string) (logic.ProxyNode, bool)
+	SetCurrentIndex(i int) (logic.ProxyNode, bool)
+	Pin(node logic.ProxyNode)
+	Unpin()
+
+	ReportSuccess(node logic.ProxyNode)
+	ReportFailure(node logic.ProxyNode, removeAfter int) bool
+	ReportAuthFailure(node logic.ProxyNode) bool
+
+	Export() logic.ManagerState
+	Import(st logic.ManagerState)
+}
+
+// Refresher refreshes both pools. *logic.Refresher implements all but Run,
+// which lets the caller add its bookkeeping to API-triggered refreshes.
+type Refresher interface {
+	// Run refreshes in mode, logic.RefreshModeReplace or RefreshModeTopUp.
+	Run(ctx context.Context, mode string) (int, logic.PoolDiff, error)
+	DryRun(ctx context.Context, override logic.RefreshOverride) (logic.RefreshReport, error)
+	Add(ctx context.Context, nodes []logic.ProxyNode, tags []string, validate bool) ([]logic.ProxyNode, error)
+	LastDiff() (logic.PoolDiff, bool)
+	Diffs() []logic.PoolDiff
+	Sources() logic.Sources
+	SourceStats() []logic.SourceStats
+	SetSourceStats(stats []logic.SourceStats)
+	IfIdle(fn func()) bool
+}
+
+// Listener is a SOCKS listener that can be switched at runtime.
+type Listener interface {
+	// Addr is the bound address, nil while disabled.
+	Addr() net.Addr
+	ListenAddr() string
+	Network() string
+	Enabled() bool
+	// Off reports a listener turned off in the config, which Enable
+	// refuses.
+	Off() bool
+	Enable() error
+	Disable()
+}
+
+// Health reports whether the instance is degraded: its pool is empty or
+// its refreshes fail.
+type Health interface {
+	Degraded() (bool, string, time.Time)
+}
+
+// Rotation is the scheduled rotation of the fixed upstream.
+type Rotation interface {
+	Interval() time.Duration
+	SetInterval(d time.Duration)
+}
+
+// ConnStats is the connection usage of a listener; Max 0 means unlimited.
+// Queued counts connections that waited for a slot.
+type ConnStats struct {
+	Active   int64 `json:"active"`
+	Max      int   `json:"max"`
+	Queued   int64 `json:"queued"`
+	Rejected int64 `json:"rejected"`
+}
+
+// Server holds the API's dependencies; its handlers are methods on it.
+// Fields left nil serve empty results, so tests set only what they use.
+type Server struct {
+	Logger *log.Logger
+	// Leases gate moves of the fixed upstream; Audit records mutating
+	// calls. New sets in-memory ones.
+	Leases *LeaseStore
+	Audit  *AuditLog
+	// Listeners are the "fixed" and "auto" SOCKS listeners;
+	// SelfTestDials is what they note their dials to.
+	Listeners     map[string]Listener
+	SelfTestDials *DialWatch
+	Health        Health
+	Rotation      Rotation
+
+	RotationHistory *logic.RotationHistory
+	RemovedLog      *logic.RemovedLog
+	Blocklist       *logic.Blocklist
+	Seen            *logic.SeenTracker
+	TypeCache       *logic.TypeCache
+	Targets         *logic.TargetPolicy
+	Upstreams       *logic.UpstreamPool
+	Shapers         map[string]*logic.Shaper
+
+	// Counters of the listeners, zero unless shared with them.
+	DialErrors     *logic.DialErrorStats
+	SOCKSReplies   *logic.ReplyStats
+	DialsAbandoned *atomic.Int64
+	StaleChecks    *atomic.Int64
+	StaleRotations *atomic.Int64
+	Started        time.Time
+
+	// Probe checks node by connecting through it to target, over TLS when
+	// tls is set (default: logic.CheckSOCKS5TLSWith or CheckSOCKS5TCP).
+	Probe func(ctx context.Context, node logic.ProxyNode, target string, tls bool) (bool, logic.ProbeTiming, error)
+
+	// Bound and Advertised are the listen addresses per listener, as
+	// bound and as clients should use them; Connections is the usage per
+	// listener and "global".
+	Bound       func() map[string]string
+	Advertised  func() map[string]string
+	Connections func() map[string]ConnStats
+	// ListenersChanged is called after a listener was enabled, since it
+	// may be bound elsewhere now.
+	ListenersChanged func()
+	// OnRotate is called for every manual move of an upstream.
+	OnRotate func(logic.RotationEvent)
+	// BlocklistChanged is called after an address was unblocked.
+	BlocklistChanged func()
+	// History serves /api/history; PoolHistory serves /api/history/pool
+	// and is nil without history_path.
+	History     func(limit int) any
+	PoolHistory func(since time.Time) (any, error)
+	// Reload re-reads the config file, applying it unless dryRun or it
+	// was rejected; nil when there is no config file.
+	Reload func(ctx context.Context, dryRun bool) (report any, rejected bool)
+
+	cfg     Config
+	fixed   Manager
+	auto    Manager
+	refresh Refresher
+	routes  []routeInfo
+}
+
+// New returns a Server for the fixed and auto pools.
+func New(cfg Config, fixed, auto Manager, refresh Refresher) *Server {
+	logger := log.New(io.Discard, "", 0)
+	audit, _ := NewAuditLog("", logger)
+	s := &Server{
+		Logger:         logger,
+		Leases:         NewLeaseStore(fixed, logger),
+		Audit:          audit,
+		SelfTestDials:  NewDialWatch(),
+		DialErrors:     &logic.DialErrorStats{},
+		SOCKSReplies:   &logic.ReplyStats{},
+		DialsAbandoned: &atomic.Int64{},
+		StaleChecks:    &atomic.Int64{},
+		StaleRotations: &atomic.Int64{},
+		Started:        time.Now(),
+		cfg:            cfg,
+		fixed:          fixed,
+		auto:           auto,
+		refresh:        refresh,
+	}
+	s.Probe = s.probe
+	return s
+}
+
+func (s *Server) probe(ctx context.Context, node logic.ProxyNode, target string, tls bool) (bool, logic.ProbeTiming, error) {
+	if tls {
+		return logic.CheckSOCKS5TLSWith(ctx, node, target, s.cfg.DialTimeout, s.cfg.Validation.TLSProbe())
+	}
+	return logic.CheckSOCKS5TCP(ctx, node, target, s.cfg.DialTimeout)
+}
+
+// manager returns the pool of mode, "fixed" or "auto".
+func (s *Server) manager(mode string) (Manager, bool) {
+	switch mode {
+	case "fixed":
+		return s.fixed, true
+	case "auto":
+		return s.auto, true
+	}
+	return nil, false
+}
+
+// rotated records a manual move of mode's upstream.
+func (s *Server) rotated(mode, reason string, from, to logic.ProxyNode) {
+	if s.OnRotate != nil {
+		s.OnRotate(logic.RotationEvent{Mode: mode, From: from.Addr(), To: to.Addr(), Reason: reason})
+	}
+}
+
+// Register adds /healthz, /readyz and the /api endpoints to r.
+func (s *Server) Register(r *gin.RouterGroup) {
+	root := routeTable{group: r, routes: &s.routes}
+	root.GET("/healthz", "Liveness probe", s.healthz)
+	root.GET("/readyz", "Readiness: enough pooled nodes (ready_min_pool)", s.readyz)
+
+	audited := s.Audit.Audited
+	api := root.Group("/api")
+	api.GET("/routes", "This list of endpoints", s.listRoutes)
+	api.GET("/status", "Pool, rotation, listener and refresh status", s.status)
+	api.POST("/listener/:name/:action", "Enable or disable the fixed or auto listener", audited(false), s.switchListener)
+	api.GET("/selftest", "Fetch a test URL through a local listener (?mode, ?target)", s.runSelfTest)
+	api.GET("/lease", "The active lease on the fixed upstream", s.lease)
+	api.POST("/lease", "Lease the fixed upstream so nothing moves it", audited(true), s.acquireLease)
+	api.DELETE("/lease", "Release the active lease", audited(false), s.releaseLease)
+	api.GET("/blocklist", "Repeat offenders skipped by refreshes, with expiry", s.blocklist)
+	api.DELETE("/blocklist", "Unblock an address (?addr)", audited(false), s.unblock)
+	api.POST("/next", "Advance to the next upstream (?mode, ?tag, ?skip_unhealthy)", audited(false), s.next)
+	api.POST("/select", "Make the pool node at ?addr current", audited(false), s.selectNode)
+	api.POST("/current", "Set the current upstream from a JSON {addr, mode}", audited(true), s.setCurrent)
+	api.GET("/pool/removed", "Nodes recently removed from the pool and why", s.poolRemoved)
+	api.GET("/history", "In-memory trend of pool metrics (?limit)", s.history)
+	api.GET("/history/pool", "Persisted pool samples (?since)", s.poolHistory)
+	api.GET("/rotate/history", "Recent upstream rotations", s.rotateHistory)
+	api.POST("/refresh", "Fetch and validate the sources now", audited(false), s.runRefresh)
+	api.POST("/refresh/dryrun", "Run a refresh without applying it", s.dryRun)
+	api.POST("/reload", "Re-read -config and apply it after a shadow check (?dry_run=1 only checks)", audited(false), s.reload)
+	api.GET("/stats", "Dial error, upstream pool and bandwidth stats", s.stats)
+	api.GET("/debug/memory", "Sizes of internal tables and runtime memory stats", s.debugMemory)
+	api.GET("/runtime", "Goroutines, open files, memory and connections per listener", s.runtimeInfo)
+	api.GET("/sources", "The configured sources", s.sources)
+	api.GET("/refresh/diff", "What the last refresh added and removed", s.refreshDiff)
+	api.POST("/check", "Probe the current upstream (?mode, ?target)", s.check)
+	api.POST("/check/spec", "Probe a proxy spec without adding it", s.checkSpec)
+	api.PUT("/rotate/interval", "Change the scheduled rotation interval", audited(false), s.rotateInterval)
+	api.GET("/audit", "Recent mutating API calls", s.audit)
+	api.GET("/state/export", "Export pools and rotation state", s.exportState)
+	api.POST("/state/import", "Import state from /api/state/export", audited(false), s.importState)
+	api.POST("/pool/add", "Add proxy specs from a JSON {proxies, tags, validate} until the next refresh", audited(false), s.poolAdd)
+	api.GET("/pool", "Pool nodes with sighting records (?mode, ?tag, ?min_survival)", s.pool)
+}
+
+func (s *Server) listRoutes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"routes": s.routes})
+}
+
+// errorStatus maps pipeline errors to API status codes.
+func errorStatus(err error) int {
+	var (
+		fetchErr *logic.FetchError
+		dialErr  *logic.DialError
+	)
+	switch {
+	case errors.Is(err, logic.ErrEmptyPool), errors.Is(err, logic.ErrNoValidProxies),
+		errors.Is(err, logic.ErrNoSources), errors.Is(err, logic.ErrValidationDisabled):
+		return http.StatusConflict
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &fetchErr), errors.Is(err, logic.ErrFetchFailed), errors.As(err, &dialErr):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,736 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+// fakeManager is a round-robin pool over nodes that records the reports it
+// gets.
+type fakeManager struct {
+	nodes []logic.ProxyNode
+	cur   int // -1 before the first Next
+
+	successes, failures, authFailures []string
+}
+
+func newFakeManager(nodes ...logic.ProxyNode) *fakeManager {
+	return &fakeManager{nodes: nodes, cur: -1}
+}
+
+func (m *fakeManager) Status() logic.Status {
+	st := logic.Status{PoolSize: len(m.nodes), SOCKS5PoolSize: len(m.nodes), CurrentSOCKS5Index: m.cur}
+	if n, ok := m.Current(); ok {
+		st.CurrentSOCKS5 = n.String()
+	}
+	return st
+}
+func (m *fakeManager) Metrics() logic.PoolMetrics     { return logic.PoolMetrics{} }
+func (m *fakeManager) Memory() logic.ManagerMemory    { return logic.ManagerMemory{} }
+func (m *fakeManager) PoolSize() int                  { return len(m.nodes) }
+func (m *fakeManager) PoolSizeByType() map[string]int { return map[string]int{} }
+func (m *fakeManager) CountByCountry() map[string]int { return map[string]int{} }
+func (m *fakeManager) PoolSnapshot(int) []logic.ProxyNode {
+	return append([]logic.ProxyNode(nil), m.nodes...)
+}
+func (m *fakeManager) DialTimeout(_ logic.ProxyNode, fallback time.Duration) time.Duration {
+	return fallback
+}
+
+func (m *fakeManager) Lookup(addr string) (logic.ProxyNode, bool) {
+	for _, n := range m.nodes {
+		if n.Addr() == addr {
+			return n, true
+		}
+	}
+	return logic.ProxyNode{}, false
+}
+
+func (m *fakeManager) Current() (logic.ProxyNode, bool) {
+	if m.cur < 0 || m.cur >= len(m.nodes) {
+		return logic.ProxyNode{}, false
+	}
+	return m.nodes[m.cur], true
+}
+
+func (m *fakeManager) Next() (logic.ProxyNode, bool) {
+	if len(m.nodes) == 0 {
+		return logic.ProxyNode{}, false
+	}
+	m.cur = (m.cur + 1) % len(m.nodes)
+	return m.nodes[m.cur], true
+}
+
+func (m *fakeManager) NextWithTag(string) (logic.ProxyNode, bool) { return m.Next() }
+
+// NextHealthy skips the nodes with a reported failure.
+func (m *fakeManager) NextHealthy() (logic.ProxyNode, bool) {
+	for i := 1; i <= len(m.nodes); i++ {
+		idx := (m.cur + i) % len(m.nodes)
+		if idx < 0 {
+			idx += len(m.nodes)
+		}
+		if !slices.Contains(m.failures, m.nodes[idx].Addr()) {
+			m.cur = idx
+			return m.nodes[idx], true
+		}
+	}
+	return logic.ProxyNode{}, false
+}
+
+func (m *fakeManager) SetCurrentByAddr(addr string) (logic.ProxyNode, bool) {
+	for i, n := range m.nodes {
+		if n.Addr() == addr {
+			m.cur = i
+			return n, true
+		}
+	}
+	return logic.ProxyNode{}, false
+}
+
+func (m *fakeManager) SetCurrentIndex(i int) (logic.ProxyNode, bool) {
+	if i < 0 || i >= len(m.nodes) {
+		return logic.ProxyNode{}, false
+	}
+	m.cur = i
+	return m.nodes[i], true
+}
+
+func (m *fakeManager) Pin(logic.ProxyNode) {}
+func (m *fakeManager) Unpin()              {}
+
+func (m *fakeManager) ReportSuccess(n logic.ProxyNode) { m.successes = append(m.successes, n.Addr()) }
+func (m *fakeManager) ReportFailure(n logic.ProxyNode, _ int) bool {
+	m.failures = append(m.failures, n.Addr())
+	return false
+}
+func (m *fakeManager) ReportAuthFailure(n logic.ProxyNode) bool {
+	m.authFailures = append(m.authFailures, n.Addr())
+	return false
+}
+
+func (m *fakeManager) Export() logic.ManagerState {
+	return logic.ManagerState{Pool: m.nodes, CurrentIndex: m.cur}
+}
+func (m *fakeManager) Import(st logic.ManagerState) { m.nodes, m.cur = st.Pool, st.CurrentIndex }
+
+// fakeRefresher answers Run with count and err, noting the modes asked for.
+// A busy fakeRefresher refuses IfIdle, as during a refresh.
+type fakeRefresher struct {
+	count int
+	diff  logic.PoolDiff
+	err   error
+	modes []string
+	busy  bool
+	// dryRuns counts DryRun calls.
+	dryRuns int
+}
+
+func (r *fakeRefresher) Run(_ context.Context, mode string) (int, logic.PoolDiff, error) {
+	r.modes = append(r.modes, mode)
+	return r.count, r.diff, r.err
+}
+func (r *fakeRefresher) DryRun(context.Context, logic.RefreshOverride) (logic.RefreshReport, error) {
+	r.dryRuns++
+	return logic.RefreshReport{DryRun: true}, nil
+}
+func (r *fakeRefresher) Add(_ context.Context, nodes []logic.ProxyNode, _ []string, _ bool) ([]logic.ProxyNode, error) {
+	return nodes, nil
+}
+func (r *fakeRefresher) LastDiff() (logic.PoolDiff, bool)   { return r.diff, !r.diff.At.IsZero() }
+func (r *fakeRefresher) Diffs() []logic.PoolDiff            { return nil }
+func (r *fakeRefresher) Sources() logic.Sources             { return logic.Sources{} }
+func (r *fakeRefresher) SourceStats() []logic.SourceStats   { return nil }
+func (r *fakeRefresher) SetSourceStats([]logic.SourceStats) {}
+func (r *fakeRefresher) IfIdle(fn func()) bool {
+	if r.busy {
+		return false
+	}
+	fn()
+	return true
+}
+
+func node(ip, port string) logic.ProxyNode {
+	return logic.ProxyNode{Type: logic.ProxyTypeSOCKS5, IP: ip, Port: port}
+}
+
+// testServer returns the API over fixed and auto, with its router.
+func testServer(t *testing.T, fixed, auto *fakeManager, refresh *fakeRefresher) (*Server, http.Handler) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s := New(Config{RefreshMode: logic.RefreshModeReplace, DialTimeout: time.Second}, fixed, auto, refresh)
+	s.Probe = func(context.Context, logic.ProxyNode, string, bool) (bool, logic.ProbeTiming, error) {
+		t.Fatal("unexpected probe")
+		return false, logic.ProbeTiming{}, nil
+	}
+	r := gin.New()
+	s.Register(&r.RouterGroup)
+	return s, r
+}
+
+// do serves method path and decodes the JSON response into a map.
+func do(t *testing.T, h http.Handler, method, path string) (int, map[string]any) {
+	t.Helper()
+	return doBody(t, h, method, path, "")
+}
+
+// doBody is do with a JSON request body.
+func doBody(t *testing.T, h http.Handler, method, path, reqBody string) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(rec, req)
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: decode %q: %v", method, path, rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestStatus(t *testing.T) {
+	fixed := newFakeManager(node("192.0.2.1", "1080"), node("192.0.2.2", "1080"))
+	fixed.cur = 1
+	s, h := testServer(t, fixed, newFakeManager(), &fakeRefresher{})
+	s.Connections = func() map[string]ConnStats {
+		return map[string]ConnStats{"global": {Active: 3}, "fixed": {Active: 2, Max: 10}}
+	}
+
+	code, body := do(t, h, http.MethodGet, "/api/status")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if body["pool_size"] != 2.0 || body["current_socks5"] != "socks5://192.0.2.2:1080" {
+		t.Fatalf("pool_size, current_socks5 = %v, %v", body["pool_size"], body["current_socks5"])
+	}
+	if body["clients_fixed"] != 2.0 {
+		t.Fatalf("clients_fixed = %v, want 2", body["clients_fixed"])
+	}
+	if conns := body["connections"].(map[string]any); conns["active"] != 3.0 {
+		t.Fatalf("connections = %v, want 3 active", conns)
+	}
+	if body["degraded"] != false {
+		t.Fatalf("degraded = %v without a health check", body["degraded"])
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		fixed      []logic.ProxyNode
+		wantCode   int
+		wantStatus string
+	}{
+		{name: "invalid mode", path: "/api/next?mode=bogus", wantCode: http.StatusBadRequest},
+		{name: "empty pool", path: "/api/next", wantCode: http.StatusConflict, wantStatus: "empty_pool"},
+		{name: "ok", path: "/api/next", fixed: []logic.ProxyNode{node("192.0.2.1", "1080")}, wantCode: http.StatusOK, wantStatus: "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, h := testServer(t, newFakeManager(tt.fixed...), newFakeManager(), &fakeRefresher{})
+			var rotations []logic.RotationEvent
+			s.OnRotate = func(ev logic.RotationEvent) { rotations = append(rotations, ev) }
+
+			code, body := do(t, h, http.MethodPost, tt.path)
+			if code != tt.wantCode {
+				t.Fatalf("code = %d, want %d (%v)", code, tt.wantCode, body)
+			}
+			if tt.wantStatus != "" && body["status"] != tt.wantStatus {
+				t.Fatalf("status = %v, want %q", body["status"], tt.wantStatus)
+			}
+			if code != http.StatusOK {
+				if len(rotations) != 0 {
+					t.Fatalf("rotations = %v, want none", rotations)
+				}
+				return
+			}
+			if body["new_proxy"] != "socks5://192.0.2.1:1080" {
+				t.Fatalf("new_proxy = %v", body["new_proxy"])
+			}
+			if len(rotations) != 1 || rotations[0].Reason != logic.RotationReasonManualNext {
+				t.Fatalf("rotations = %v, want one manual next", rotations)
+			}
+		})
+	}
+}
+
+func TestNextPrevious(t *testing.T) {
+	a, b, c := node("192.0.2.1", "1080"), node("192.0.2.2", "1080"), node("192.0.2.3", "1080")
+	a.Country, b.Country = "DE", "FR"
+	tests := []struct {
+		name       string
+		path       string
+		failures   []string
+		wantCode   int
+		wantStatus string
+		wantNew    string
+	}{
+		{"auto", "/api/next?mode=auto", nil, http.StatusOK, "ok", b.Addr()},
+		{"skip unhealthy", "/api/next?mode=auto&skip_unhealthy=1", []string{b.Addr()}, http.StatusOK, "ok", c.Addr()},
+		{"failures ignored by default", "/api/next?mode=auto", []string{b.Addr()}, http.StatusOK, "ok", b.Addr()},
+		{"all unhealthy", "/api/next?mode=auto&skip_unhealthy=1", []string{a.Addr(), b.Addr(), c.Addr()}, http.StatusConflict, "no_healthy_proxy", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixed, auto := newFakeManager(c), newFakeManager(a, b, c)
+			auto.cur, auto.failures = 0, tt.failures
+			_, h := testServer(t, fixed, auto, &fakeRefresher{})
+
+			code, body := do(t, h, http.MethodPost, tt.path)
+			if code != tt.wantCode || body["status"] != tt.wantStatus {
+				t.Fatalf("next = %d %v, want %d %s", code, body, tt.wantCode, tt.wantStatus)
+			}
+			if fixed.cur != -1 {
+				t.Errorf("fixed pool rotated for mode=auto")
+			}
+			if code != http.StatusOK {
+				if auto.cur != 0 {
+					t.Errorf("current moved to %d without a healthy node", auto.cur)
+				}
+				return
+			}
+			prev, _ := body["previous"].(map[string]any)
+			next, _ := body["new"].(map[string]any)
+			if prev["addr"] != a.Addr() || prev["country"] != "DE" || body["mode"] != "auto" {
+				t.Errorf("previous = %v, mode %v; want %s in DE", prev, body["mode"], a.Addr())
+			}
+			if next["addr"] != tt.wantNew {
+				t.Errorf("new = %v, want %s", next, tt.wantNew)
+			}
+		})
+	}
+}
+
+func TestSetCurrent(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		probeErr error
+		wantCode int
+		wantCur  string
+	}{
+		{name: "invalid body", path: "/api/current", body: "{", wantCode: http.StatusBadRequest, wantCur: "192.0.2.1:1080"},
+		{name: "invalid mode", path: "/api/current", body: `{"addr":"192.0.2.2:1080","mode":"bogus"}`, wantCode: http.StatusBadRequest, wantCur: "192.0.2.1:1080"},
+		{name: "not in pool", path: "/api/current", body: `{"addr":"192.0.2.9:1080"}`, wantCode: http.StatusNotFound, wantCur: "192.0.2.1:1080"},
+		{name: "promote", path: "/api/current", body: `{"addr":"192.0.2.2:1080"}`, wantCode: http.StatusOK, wantCur: "192.0.2.2:1080"},
+		{name: "promote a spec", path: "/api/current", body: `{"addr":"socks5://192.0.2.2:1080"}`, wantCode: http.StatusOK, wantCur: "192.0.2.2:1080"},
+		{name: "check passes", path: "/api/current?check=1", body: `{"addr":"192.0.2.2:1080"}`, wantCode: http.StatusOK, wantCur: "192.0.2.2:1080"},
+		{name: "check fails", path: "/api/current?check=1", body: `{"addr":"192.0.2.2:1080"}`, probeErr: errors.New("refused"), wantCode: http.StatusConflict, wantCur: "192.0.2.1:1080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixed := newFakeManager(node("192.0.2.1", "1080"), node("192.0.2.2", "1080"))
+			fixed.cur = 0
+			s, h := testServer(t, fixed, newFakeManager(), &fakeRefresher{})
+			probes := 0
+			s.Probe = func(context.Context, logic.ProxyNode, string, bool) (bool, logic.ProbeTiming, error) {
+				probes++
+				return tt.probeErr == nil, logic.ProbeTiming{}, tt.probeErr
+			}
+			var rotations []logic.RotationEvent
+			s.OnRotate = func(ev logic.RotationEvent) { rotations = append(rotations, ev) }
+
+			code, body := doBody(t, h, http.MethodPost, tt.path, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("code = %d, want %d (%v)", code, tt.wantCode, body)
+			}
+			if cur, _ := fixed.Current(); cur.Addr() != tt.wantCur {
+				t.Fatalf("current = %s, want %s", cur.Addr(), tt.wantCur)
+			}
+			if wantProbes := strings.Count(tt.path, "check=1"); code != http.StatusBadRequest && probes != wantProbes {
+				t.Fatalf("probed %d times, want %d", probes, wantProbes)
+			}
+			if code != http.StatusOK {
+				if len(rotations) != 0 {
+					t.Fatalf("rotations = %v, want none", rotations)
+				}
+				return
+			}
+			want := logic.RotationEvent{Mode: "fixed", From: "192.0.2.1:1080", To: "192.0.2.2:1080", Reason: logic.RotationReasonManualPromote}
+			if len(rotations) != 1 || rotations[0] != want {
+				t.Fatalf("rotations = %+v, want [%+v]", rotations, want)
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		count    int
+		err      error
+		wantCode int
+		wantMode string
+	}{
+		{name: "invalid mode", path: "/api/refresh?mode=bogus", wantCode: http.StatusBadRequest},
+		{name: "default mode", path: "/api/refresh", count: 5, wantCode: http.StatusOK, wantMode: logic.RefreshModeReplace},
+		{name: "topup", path: "/api/refresh?mode=topup", count: 5, wantCode: http.StatusOK, wantMode: logic.RefreshModeTopUp},
+		{name: "partial failure", path: "/api/refresh", count: 2, err: logic.ErrFetchFailed, wantCode: http.StatusOK, wantMode: logic.RefreshModeReplace},
+		{name: "empty pool", path: "/api/refresh", err: logic.ErrEmptyPool, wantCode: http.StatusConflict, wantMode: logic.RefreshModeReplace},
+		{name: "fetch failed", path: "/api/refresh", err: fmt.Errorf("source a: %w", logic.ErrFetchFailed), wantCode: http.StatusBadGateway, wantMode: logic.RefreshModeReplace},
+		{name: "timeout", path: "/api/refresh", err: context.DeadlineExceeded, wantCode: http.StatusGatewayTimeout, wantMode: logic.RefreshModeReplace},
+		{name: "other error", path: "/api/refresh", err: errors.New("boom"), wantCode: http.StatusInternalServerError, wantMode: logic.RefreshModeReplace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refresh := &fakeRefresher{count: tt.count, err: tt.err}
+			_, h := testServer(t, newFakeManager(), newFakeManager(), refresh)
+
+			code, body := do(t, h, http.MethodPost, tt.path)
+			if code != tt.wantCode {
+				t.Fatalf("code = %d, want %d (%v)", code, tt.wantCode, body)
+			}
+			if tt.wantMode == "" {
+				if len(refresh.modes) != 0 {
+					t.Fatalf("refreshed %v, want no refresh", refresh.modes)
+				}
+				return
+			}
+			if len(refresh.modes) != 1 || refresh.modes[0] != tt.wantMode {
+				t.Fatalf("refreshed %v, want [%s]", refresh.modes, tt.wantMode)
+			}
+			if body["count"] != float64(tt.count) {
+				t.Fatalf("count = %v, want %d", body["count"], tt.count)
+			}
+			if tt.err != nil && tt.count > 0 && body["warning"] != tt.err.Error() {
+				t.Fatalf("warning = %v, want %q", body["warning"], tt.err)
+			}
+		})
+	}
+}
+
+// TestDryRunValidation checks that a validation override is held to the
+// same rules as the config file before anything runs.
+func TestDryRunValidation(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantErr  string
+	}{
+		{"no override", "", http.StatusOK, ""},
+		{"content check", `{"validation": {"enabled": true, "expect_url": "http://example.com/", "expect_sha256": "` + digest + `"}}`, http.StatusOK, ""},
+		{"digest without url", `{"validation": {"enabled": true, "expect_sha256": "` + digest + `"}}`, http.StatusBadRequest, "validation: expect_url is required"},
+		{"bad digest", `{"validation": {"enabled": true, "expect_url": "http://example.com/", "expect_sha256": "abcd"}}`, http.StatusBadRequest, "validation: expect_sha256"},
+		{"dedupe without lookup", `{"validation": {"enabled": true, "dedupe_exit_ip": true}}`, http.StatusBadRequest, "validation: exit_ip_url is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refresh := &fakeRefresher{}
+			_, h := testServer(t, newFakeManager(), newFakeManager(), refresh)
+			code, body := doBody(t, h, http.MethodPost, "/api/refresh/dryrun", tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("code = %d, want %d (%v)", code, tt.wantCode, body)
+			}
+			if tt.wantErr == "" {
+				if refresh.dryRuns != 1 {
+					t.Errorf("ran %d dry runs, want 1", refresh.dryRuns)
+				}
+				return
+			}
+			if msg, _ := body["error"].(string); !strings.Contains(msg, tt.wantErr) {
+				t.Errorf("error = %q, want %q", msg, tt.wantErr)
+			}
+			if refresh.dryRuns != 0 {
+				t.Errorf("ran a dry run with an invalid override")
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		fixed    []logic.ProxyNode
+		auto     []logic.ProxyNode
+		probeErr error
+		wantCode int
+		wantTLS  bool
+		// wantValid is checked for probed requests only.
+		wantValid bool
+	}{
+		{name: "invalid mode", path: "/api/check?mode=bogus", wantCode: http.StatusBadRequest},
+		{name: "empty pool", path: "/api/check", wantCode: http.StatusConflict},
+		{name: "auto empty pool", path: "/api/check?mode=auto", wantCode: http.StatusConflict},
+		{name: "tls auto-detected on 443", path: "/api/check", fixed: []logic.ProxyNode{node("192.0.2.1", "1080")}, wantCode: http.StatusOK, wantTLS: true, wantValid: true},
+		{name: "plain tcp off 443", path: "/api/check?target=example.com:80", fixed: []logic.ProxyNode{node("192.0.2.1", "1080")}, wantCode: http.StatusOK, wantValid: true},
+		{name: "tls=0 overrides 443", path: "/api/check?target=example.com:443&tls=0", fixed: []logic.ProxyNode{node("192.0.2.1", "1080")}, wantCode: http.StatusOK, wantValid: true},
+		{name: "tls=1 off 443", path: "/api/check?target=example.com:80&tls=1", fixed: []logic.ProxyNode{node("192.0.2.1", "1080")}, wantCode: http.StatusOK, wantTLS: true, wantValid: true},
+		{name: "auto picks a node", path: "/api/check?mode=auto", auto: []logic.ProxyNode{node("192.0.2.2", "1080")}, wantCode: http.StatusOK, wantTLS: true, wantValid: true},
+		{name: "failure", path: "/api/check", fixed: []logic.ProxyNode{node("192.0.2.1", "1080")}, probeErr: errors.New("connection refused"), wantCode: http.StatusOK, wantTLS: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixed, auto := newFakeManager(tt.fixed...), newFakeManager(tt.auto...)
+			if len(tt.fixed) > 0 {
+				fixed.cur = 0
+			}
+			s, h := testServer(t, fixed, auto, &fakeRefresher{})
+			probes := 0
+			var gotTLS bool
+			s.Probe = func(_ context.Context, _ logic.ProxyNode, _ string, tls bool) (bool, logic.ProbeTiming, error) {
+				probes++
+				gotTLS = tls
+				return tt.probeErr == nil, logic.ProbeTiming{}, tt.probeErr
+			}
+
+			code, body := do(t, h, http.MethodPost, tt.path)
+			if code != tt.wantCode {
+				t.Fatalf("code = %d, want %d (%v)", code, tt.wantCode, body)
+			}
+			if code != http.StatusOK {
+				if probes != 0 {
+					t.Fatalf("probed %d times, want none", probes)
+				}
+				if code == http.StatusConflict && body["error"] != "empty_pool" {
+					t.Fatalf("error = %v, want empty_pool", body["error"])
+				}
+				return
+			}
+			if probes != 1 || gotTLS != tt.wantTLS {
+				t.Fatalf("probes, tls = %d, %v; want 1, %v", probes, gotTLS, tt.wantTLS)
+			}
+			if body["valid"] != tt.wantValid || body["tls_verify"] != tt.wantTLS {
+				t.Fatalf("valid, tls_verify = %v, %v; want %v, %v", body["valid"], body["tls_verify"], tt.wantValid, tt.wantTLS)
+			}
+			m := fixed
+			if len(tt.auto) > 0 {
+				m = auto
+			}
+			if tt.probeErr != nil {
+				if len(m.failures) != 1 || len(m.successes) != 0 {
+					t.Fatalf("failures, successes = %v, %v; want one failure", m.failures, m.successes)
+				}
+				if body["error"] != tt.probeErr.Error() {
+					t.Fatalf("error = %v, want %q", body["error"], tt.probeErr)
+				}
+			} else if len(m.successes) != 1 || len(m.failures) != 0 {
+				t.Fatalf("failures, successes = %v, %v; want one success", m.failures, m.successes)
+			}
+		})
+	}
+}
+
+func TestPool(t *testing.T) {
+	secret := node("192.0.2.1", "1080")
+	secret.User, secret.Pass = "u", "hunter2"
+	web := node("192.0.2.3", "3128")
+	web.Type = logic.ProxyTypeHTTP
+	fixed := newFakeManager(secret, node("192.0.2.2", "1080"), web)
+	_, h := testServer(t, fixed, newFakeManager(), &fakeRefresher{})
+
+	if code, _ := do(t, h, http.MethodGet, "/api/pool?mode=bogus"); code != http.StatusBadRequest {
+		t.Fatalf("invalid mode: code = %d, want 400", code)
+	}
+	if code, _ := do(t, h, http.MethodGet, "/api/pool?min_survival=-1"); code != http.StatusBadRequest {
+		t.Fatalf("invalid min_survival: code = %d, want 400", code)
+	}
+
+	code, body := do(t, h, http.MethodGet, "/api/pool")
+	if code != http.StatusOK {
+		t.Fatalf("code = %d, want 200", code)
+	}
+	items := body["items"].([]any)
+	if len(items) != 3 || body["pool_size"] != 3.0 {
+		t.Fatalf("items, pool_size = %d, %v; want 3, 3", len(items), body["pool_size"])
+	}
+	if got := fmt.Sprint(body["types"]); got != "map[http:1 socks5:2]" {
+		t.Fatalf("types = %s, want 2 socks5 and 1 http", got)
+	}
+	first := items[0].(map[string]any)
+	if first["ip"] != "192.0.2.1" || first["pass"] == "hunter2" {
+		t.Fatalf("first item = %v, want 192.0.2.1 without its password", first)
+	}
+	if first["effective_dial_timeout_ms"] != 1000.0 {
+		t.Fatalf("effective_dial_timeout_ms = %v, want 1000", first["effective_dial_timeout_ms"])
+	}
+
+	code, body = do(t, h, http.MethodGet, "/api/pool?mode=auto")
+	if code != http.StatusOK || len(body["items"].([]any)) != 0 {
+		t.Fatalf("auto: code, items = %d, %v; want 200 and none", code, body["items"])
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	_, h := testServer(t, newFakeManager(), newFakeManager(), &fakeRefresher{})
+
+	code, body := do(t, h, http.MethodGet, "/api/routes")
+	if code != http.StatusOK {
+		t.Fatalf("code = %d, want 200", code)
+	}
+	want := map[string]bool{"GET /healthz": false, "GET /api/status": false, "POST /api/check": false, "GET /api/routes": false}
+	for _, r := range body["routes"].([]any) {
+		r := r.(map[string]any)
+		key := fmt.Sprint(r["method"], " ", r["path"])
+		if _, ok := want[key]; ok {
+			want[key] = true
+		}
+		if r["description"] == "" {
+			t.Errorf("%s has no description", key)
+		}
+	}
+	for key, found := range want {
+		if !found {
+			t.Errorf("%s is not listed", key)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("refresh: %w", logic.ErrEmptyPool), http.StatusConflict},
+		{fmt.Errorf("refresh: %w", fmt.Errorf("validate: %w", logic.ErrNoValidProxies)), http.StatusConflict},
+		{logic.ErrValidationDisabled, http.StatusConflict},
+		{errors.Join(&logic.FetchError{URL: "https://lists.example", StatusCode: 503}), http.StatusBadGateway},
+		{fmt.Errorf("probe: %w", &logic.DialError{Category: logic.DialErrRefused, Err: errors.New("refused")}), http.StatusBadGateway},
+		{fmt.Errorf("probe: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := errorStatus(tt.err); got != tt.want {
+			t.Errorf("errorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStatsBandwidth(t *testing.T) {
+	s, h := testServer(t, newFakeManager(), newFakeManager(), &fakeRefresher{})
+	s.Shapers = map[string]*logic.Shaper{"fixed": nil, "auto": logic.NewShaper(1<<20, 64<<10)}
+	code, body := do(t, h, http.MethodGet, "/api/stats")
+	if code != http.StatusOK {
+		t.Fatalf("GET /api/stats = %d %v", code, body)
+	}
+	bw, _ := body["bandwidth"].(map[string]any)
+	if _, ok := bw["fixed"]; ok {
+		t.Errorf("bandwidth = %v, want the unshaped fixed listener left out", bw)
+	}
+	auto, _ := bw["auto"].(map[string]any)
+	if auto["limit"] != float64(1<<20) || auto["per_conn_limit"] != float64(64<<10) {
+		t.Errorf("bandwidth.auto = %v", auto)
+	}
+}
+
+func TestPoolMinSurvival(t *testing.T) {
+	a, b := node("192.0.2.1", "1080"), node("192.0.2.2", "1080")
+	s, h := testServer(t, newFakeManager(a, b), newFakeManager(), &fakeRefresher{})
+	s.Seen = logic.NewSeenTracker(0)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Seen.Observe([]logic.ProxyNode{a, b}, start)
+	s.Seen.Observe([]logic.ProxyNode{a}, start.Add(time.Hour))
+
+	tests := []struct {
+		query string
+		code  int
+		want  []string
+	}{
+		{"", http.StatusOK, []string{"192.0.2.1:1080", "192.0.2.2:1080"}},
+		{"?min_survival=1", http.StatusOK, []string{"192.0.2.1:1080"}},
+		{"?min_survival=2", http.StatusOK, nil},
+		{"?min_survival=-1", http.StatusBadRequest, nil},
+		{"?min_survival=x", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			code, body := do(t, h, http.MethodGet, "/api/pool"+tt.query)
+			if code != tt.code {
+				t.Fatalf("GET /api/pool%s = %d %v, want %d", tt.query, code, body, tt.code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			items, _ := body["items"].([]any)
+			var got []string
+			for _, it := range items {
+				item := it.(map[string]any)
+				got = append(got, fmt.Sprintf("%v:%v", item["ip"], item["port"]))
+				if item["first_seen"] == nil || item["refresh_survival"] == nil {
+					t.Errorf("item %v has no sighting record", item)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("items = %v, want %v", got, tt.want)
+			}
+			if body["pool_size"] != float64(2) {
+				t.Errorf("pool_size = %v, want 2", body["pool_size"])
+			}
+		})
+	}
+}
+
+func TestDebugMemory(t *testing.T) {
+	s, h := testServer(t, newFakeManager(), newFakeManager(), &fakeRefresher{})
+	s.Seen = logic.NewSeenTracker(0)
+	s.Seen.Observe([]logic.ProxyNode{node("192.0.2.1", "1080"), node("192.0.2.2", "1080")}, time.Now())
+	code, body := do(t, h, http.MethodGet, "/api/debug/memory")
+	if code != http.StatusOK {
+		t.Fatalf("GET /api/debug/memory = %d %v", code, body)
+	}
+	tables, _ := body["tables"].(map[string]any)
+	if tables["seen"] != float64(2) || tables["type_cache"] != float64(0) {
+		t.Errorf("tables = %v, want 2 sightings and no type cache", tables)
+	}
+	for _, key := range []string{"fixed", "auto", "upstream_pool"} {
+		if _, ok := tables[key].(map[string]any); !ok {
+			t.Errorf("tables.%s = %v, want an object", key, tables[key])
+		}
+	}
+	rt, _ := body["runtime"].(map[string]any)
+	if heap, _ := rt["heap_alloc"].(float64); heap <= 0 {
+		t.Errorf("runtime = %v, want a heap size", rt)
+	}
+}
+
+func TestReload(t *testing.T) {
+	s, h := testServer(t, newFakeManager(), newFakeManager(), &fakeRefresher{})
+	if code, _ := do(t, h, http.MethodPost, "/api/reload"); code != http.StatusConflict {
+		t.Errorf("reload without -config = %d, want 409", code)
+	}
+
+	var dryRuns []bool
+	rejected := false
+	s.Reload = func(_ context.Context, dryRun bool) (any, bool) {
+		dryRuns = append(dryRuns, dryRun)
+		return gin.H{"dry_run": dryRun, "applied": !dryRun && !rejected}, rejected
+	}
+	tests := []struct {
+		path     string
+		rejected bool
+		code     int
+		dryRun   bool
+	}{
+		{"/api/reload", false, http.StatusOK, false},
+		{"/api/reload?dry_run=1", false, http.StatusOK, true},
+		{"/api/reload?dry_run=true", true, http.StatusUnprocessableEntity, true},
+		{"/api/reload", true, http.StatusUnprocessableEntity, false},
+	}
+	for _, tt := range tests {
+		rejected = tt.rejected
+		code, body := do(t, h, http.MethodPost, tt.path)
+		if code != tt.code || body["dry_run"] != tt.dryRun {
+			t.Errorf("POST %s (rejected %v) = %d %v, want %d", tt.path, tt.rejected, code, body, tt.code)
+		}
+	}
+	if fmt.Sprint(dryRuns) != "[false true true false]" {
+		t.Errorf("Reload dry runs = %v", dryRuns)
+	}
+}
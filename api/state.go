@@ -0,0 +1,84 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+// stateVersion is the current export format. Imports accept any version up
+// to this one; fields added later are optional and unknown fields are ignored.
+const stateVersion = 1
+
+// stateExport is the /api/state/export document.
+type stateExport struct {
+	Version    int                 `json:"version"`
+	ExportedAt time.Time           `json:"exported_at"`
+	Fixed      logic.ManagerState  `json:"fixed"`
+	Auto       logic.ManagerState  `json:"auto"`
+	Sources    []logic.SourceStats `json:"sources,omitempty"`
+}
+
+// redacted masks proxy passwords. Importing it back keeps the passwords of
+// nodes that are still in the pool.
+func (s stateExport) redacted() stateExport {
+	s.Fixed = s.Fixed.Redacted()
+	s.Auto = s.Auto.Redacted()
+	return s
+}
+
+func (s stateExport) check() error {
+	if s.Version <= 0 {
+		return fmt.Errorf("missing state version")
+	}
+	if s.Version > stateVersion {
+		return fmt.Errorf("state version %d is newer than supported version %d", s.Version, stateVersion)
+	}
+	return nil
+}
+
+func (s *Server) exportState(c *gin.Context) {
+	st := stateExport{
+		Version:    stateVersion,
+		ExportedAt: time.Now().UTC(),
+		Fixed:      s.fixed.Export(),
+		Auto:       s.auto.Export(),
+		Sources:    s.refresh.SourceStats(),
+	}
+	if !s.cfg.ExposeCredentials {
+		st = st.redacted()
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+// importState applies the posted state to both managers while no refresh
+// is running.
+func (s *Server) importState(c *gin.Context) {
+	var st stateExport
+	if err := c.ShouldBindJSON(&st); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := st.check(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applied := s.refresh.IfIdle(func() {
+		s.fixed.Import(st.Fixed)
+		s.auto.Import(st.Auto)
+		s.refresh.SetSourceStats(st.Sources)
+	})
+	if !applied {
+		c.JSON(http.StatusConflict, gin.H{"error": "refresh in progress"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":          "ok",
+		"fixed_pool_size": s.fixed.PoolSize(),
+		"auto_pool_size":  s.auto.PoolSize(),
+	})
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"lite-proxy/logic"
+)
+
+func TestStateExportImport(t *testing.T) {
+	a := node("192.0.2.1", "1080")
+	a.User, a.Pass = "alice", "s3cret"
+	fixed := newFakeManager(a, node("192.0.2.2", "1080"))
+	fixed.cur = 1
+	_, h := testServer(t, fixed, newFakeManager(node("192.0.2.3", "1080")), &fakeRefresher{})
+
+	code, body := do(t, h, http.MethodGet, "/api/state/export")
+	if code != http.StatusOK || body["version"] != float64(stateVersion) {
+		t.Fatalf("export = %d, version %v; want 200, %d", code, body["version"], stateVersion)
+	}
+	blob, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(blob), "s3cret") {
+		t.Fatalf("export %s leaks a password", blob)
+	}
+
+	// Import into a fresh instance.
+	fixed2, auto2 := newFakeManager(), newFakeManager()
+	_, h2 := testServer(t, fixed2, auto2, &fakeRefresher{})
+	code, body = doBody(t, h2, http.MethodPost, "/api/state/import", string(blob))
+	if code != http.StatusOK || body["fixed_pool_size"] != 2.0 || body["auto_pool_size"] != 1.0 {
+		t.Fatalf("import = %d %v, want both pools applied", code, body)
+	}
+	if fixed2.cur != 1 || fixed2.nodes[0].User != "alice" || fixed2.nodes[0].Pass != logic.RedactedPassword {
+		t.Errorf("imported fixed = %+v at %d", fixed2.nodes, fixed2.cur)
+	}
+}
+
+func TestStateImportRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		busy     bool
+		wantCode int
+	}{
+		{"not JSON", `{`, false, http.StatusBadRequest},
+		{"no version", `{"fixed": {"pool": []}}`, false, http.StatusBadRequest},
+		{"newer version", `{"version": 99, "fixed": {"pool": []}}`, false, http.StatusBadRequest},
+		{"refresh running", `{"version": 1, "fixed": {"pool": []}}`, true, http.StatusConflict},
+		{"unknown fields", `{"version": 1, "fixed": {"pool": [], "scores": {}}, "future": true}`, false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixed := newFakeManager(node("192.0.2.1", "1080"))
+			_, h := testServer(t, fixed, newFakeManager(), &fakeRefresher{busy: tt.busy})
+			code, body := doBody(t, h, http.MethodPost, "/api/state/import", tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("import = %d %v, want %d", code, body, tt.wantCode)
+			}
+			if wantKept := tt.wantCode != http.StatusOK; wantKept != (len(fixed.nodes) == 1) {
+				t.Errorf("fixed pool = %v after a %d", fixed.nodes, code)
+			}
+		})
+	}
+}
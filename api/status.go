@@ -0,0 +1,271 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"lite-proxy/logic"
+)
+
+func (s *Server) healthz(c *gin.Context) {
+	c.String(http.StatusOK, "ok\n")
+}
+
+func (s *Server) readyz(c *gin.Context) {
+	size := max(s.fixed.PoolSize(), s.auto.PoolSize())
+	if size < s.cfg.ReadyMinPool {
+		c.String(http.StatusServiceUnavailable, "not ready: pool %d < %d\n", size, s.cfg.ReadyMinPool)
+		return
+	}
+	// A degraded instance still serves from its pool.
+	if degraded, reason, _ := s.degraded(); degraded {
+		c.String(http.StatusOK, "ok, degraded: %s\n", reason)
+		return
+	}
+	c.String(http.StatusOK, "ok\n")
+}
+
+func (s *Server) degraded() (bool, string, time.Time) {
+	if s.Health == nil {
+		return false, "", time.Time{}
+	}
+	return s.Health.Degraded()
+}
+
+// apiStatus is the GET /api/status document.
+type apiStatus struct {
+	WebListen        string       `json:"web_listen"`
+	SOCKSFixedListen string       `json:"socks_fixed_listen"`
+	SOCKSAutoListen  string       `json:"socks_auto_listen"`
+	HTTPProxyListen  string       `json:"http_proxy_listen"`
+	Fixed            logic.Status `json:"fixed"`
+	Auto             logic.Status `json:"auto"`
+
+	WebListenNetwork string `json:"web_listen_network"`
+	// Bound holds the actual listen addresses, e.g. for ":0" ports;
+	// Advertised the addresses clients should use.
+	Bound                   map[string]string `json:"bound"`
+	Advertised              map[string]string `json:"advertised"`
+	WebTLS                  bool              `json:"web_tls"`
+	WebMTLS                 bool              `json:"web_mtls"`
+	SOCKSFixedListenNetwork string            `json:"socks_fixed_listen_network"`
+	SOCKSAutoListenNetwork  string            `json:"socks_auto_listen_network"`
+
+	// Backward-compatible fields (fixed).
+	CurrentSOCKS5      string    `json:"current_socks5,omitempty"`
+	CurrentSOCKS5Index int       `json:"current_socks5_index"`
+	SOCKS5PoolSize     int       `json:"socks5_pool_size"`
+	PoolSize           int       `json:"pool_size"`
+	LastRefreshAt      time.Time `json:"last_refresh_at,omitempty"`
+	LastRefreshErr     string    `json:"last_refresh_err,omitempty"`
+
+	// Degraded is set while the pool is empty or refreshes fail.
+	Degraded       bool      `json:"degraded"`
+	DegradedReason string    `json:"degraded_reason,omitempty"`
+	DegradedSince  time.Time `json:"degraded_since,omitempty"`
+
+	// Lease is the active lease of the fixed upstream, if any.
+	Lease *Lease `json:"lease,omitempty"`
+
+	RefreshDiff    *logic.PoolDiffSummary `json:"refresh_diff,omitempty"`
+	FixedMetrics   logic.PoolMetrics      `json:"fixed_metrics"`
+	FixedByType    map[string]int         `json:"fixed_by_type"`
+	FixedByCountry map[string]int         `json:"fixed_by_country"`
+
+	DialsAbandoned int64            `json:"dials_abandoned"`
+	SOCKSReplies   map[string]int64 `json:"socks_replies"`
+	StaleChecks    int64            `json:"stale_checks"`
+	StaleRotations int64            `json:"stale_rotations"`
+	ClientsFixed   int64            `json:"clients_fixed"`
+	ClientsAuto    int64            `json:"clients_auto"`
+	MaxClients     int              `json:"max_clients"`
+	// Connections is the global connection usage; ConnectionsBy breaks
+	// it down per listener.
+	Connections   ConnStats            `json:"connections"`
+	ConnectionsBy map[string]ConnStats `json:"connections_by_listener"`
+	Listeners     map[string]bool      `json:"listeners"`
+}
+
+func (s *Server) status(c *gin.Context) {
+	fixed := s.fixed.Status()
+	degraded, degradedReason, degradedSince := s.degraded()
+	var activeLease *Lease
+	if l, ok := s.Leases.Active(); ok {
+		activeLease = &l
+	}
+	var diffSummary *logic.PoolDiffSummary
+	if d, ok := s.refresh.LastDiff(); ok {
+		sum := d.Summary()
+		diffSummary = &sum
+	}
+	conns := s.connections()
+	st := apiStatus{
+		WebListen:       s.cfg.WebListen,
+		HTTPProxyListen: s.cfg.HTTPProxyListen,
+		Fixed:           fixed,
+		Auto:            s.auto.Status(),
+
+		WebListenNetwork: s.cfg.WebListenNetwork,
+		Bound:            addrs(s.Bound),
+		Advertised:       addrs(s.Advertised),
+		WebTLS:           s.cfg.WebTLS,
+		WebMTLS:          s.cfg.WebMTLS,
+
+		CurrentSOCKS5:      fixed.CurrentSOCKS5,
+		CurrentSOCKS5Index: fixed.CurrentSOCKS5Index,
+		SOCKS5PoolSize:     fixed.SOCKS5PoolSize,
+		PoolSize:           fixed.PoolSize,
+		LastRefreshAt:      fixed.LastRefreshAt,
+		LastRefreshErr:     fixed.LastRefreshErr,
+
+		Degraded:       degraded,
+		DegradedReason: degradedReason,
+		DegradedSince:  degradedSince,
+
+		Lease: activeLease,
+
+		RefreshDiff:    diffSummary,
+		FixedMetrics:   s.fixed.Metrics(),
+		FixedByType:    s.fixed.PoolSizeByType(),
+		FixedByCountry: s.fixed.CountByCountry(),
+
+		DialsAbandoned: s.DialsAbandoned.Load(),
+		SOCKSReplies:   s.SOCKSReplies.Snapshot(),
+		StaleChecks:    s.StaleChecks.Load(),
+		StaleRotations: s.StaleRotations.Load(),
+		ClientsFixed:   conns["fixed"].Active,
+		ClientsAuto:    conns["auto"].Active,
+		MaxClients:     s.cfg.MaxClients,
+		Connections:    conns["global"],
+		ConnectionsBy: map[string]ConnStats{
+			"fixed": conns["fixed"],
+			"auto":  conns["auto"],
+			"web":   conns["web"],
+			"http":  conns["http"],
+		},
+		Listeners: map[string]bool{},
+	}
+	if l, ok := s.Listeners["fixed"]; ok {
+		st.SOCKSFixedListen, st.SOCKSFixedListenNetwork = l.ListenAddr(), l.Network()
+		st.Listeners["fixed"] = l.Enabled()
+	}
+	if l, ok := s.Listeners["auto"]; ok {
+		st.SOCKSAutoListen, st.SOCKSAutoListenNetwork = l.ListenAddr(), l.Network()
+		st.Listeners["auto"] = l.Enabled()
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+// addrs returns f(), or nil for a nil f.
+func addrs(f func() map[string]string) map[string]string {
+	if f == nil {
+		return nil
+	}
+	return f()
+}
+
+func (s *Server) connections() map[string]ConnStats {
+	if s.Connections == nil {
+		return map[string]ConnStats{}
+	}
+	return s.Connections()
+}
+
+func (s *Server) switchListener(c *gin.Context) {
+	l, ok := s.Listeners[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown listener"})
+		return
+	}
+	switch c.Param("action") {
+	case "enable":
+		if err := l.Enable(); err != nil && l.Off() {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// A ":0" listener may come back on another port.
+		if s.ListenersChanged != nil {
+			s.ListenersChanged()
+		}
+	case "disable":
+		l.Disable()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "action must be enable or disable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"listener": c.Param("name"), "enabled": l.Enabled()})
+}
+
+func (s *Server) runSelfTest(c *gin.Context) {
+	mode := c.DefaultQuery("mode", "fixed")
+	l, ok := s.Listeners[mode]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode"})
+		return
+	}
+	target := c.DefaultQuery("target", s.cfg.SelfTestURL)
+	rctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	res := selfTest(rctx, l.Addr(), target, s.cfg.DialTimeout, s.SelfTestDials)
+	res.Mode = mode
+	c.JSON(http.StatusOK, res)
+}
+
+func (s *Server) stats(c *gin.Context) {
+	bandwidth := make(map[string]logic.ShaperStats)
+	for name, sh := range s.Shapers {
+		if sh != nil {
+			bandwidth[name] = sh.Stats()
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"target_policy": s.Targets.Stats(),
+		"upstream_pool": s.Upstreams.Stats(),
+		"dial_errors":   s.DialErrors.Snapshot(),
+		"bandwidth":     bandwidth,
+	})
+}
+
+func (s *Server) debugMemory(c *gin.Context) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	up := s.Upstreams.Stats()
+	c.JSON(http.StatusOK, gin.H{
+		"tables": gin.H{
+			"fixed":         s.fixed.Memory(),
+			"auto":          s.auto.Memory(),
+			"seen":          s.Seen.Len(),
+			"type_cache":    s.TypeCache.Len(),
+			"upstream_pool": gin.H{"upstreams": up.Upstreams, "idle": up.Idle},
+		},
+		"runtime": gin.H{
+			"heap_alloc":   ms.HeapAlloc,
+			"heap_inuse":   ms.HeapInuse,
+			"heap_objects": ms.HeapObjects,
+			"sys":          ms.Sys,
+			"num_gc":       ms.NumGC,
+			"goroutines":   runtime.NumGoroutine(),
+		},
+	})
+}
+
+func (s *Server) runtimeInfo(c *gin.Context) {
+	conns := s.connections()
+	c.JSON(http.StatusOK, gin.H{
+		"runtime": readRuntimeStats(s.Started),
+		"connections": gin.H{
+			"fixed":  conns["fixed"],
+			"auto":   conns["auto"],
+			"web":    conns["web"],
+			"http":   conns["http"],
+			"global": conns["global"],
+		},
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// assetServer serves the web UI files. Files in dir, when set, take
+// precedence over the embedded copies, so the UI can be edited without
+// rebuilding; missing ones fall back to the embedded files.
+type assetServer struct {
+	embedded fs.FS
+	dir      fs.FS
+	// started is the Last-Modified of embedded files, which carry no
+	// modification time.
+	started time.Time
+}
+
+func newAssetServer(embedded fs.FS, dir string) *assetServer {
+	s := &assetServer{embedded: embedded, started: time.Now()}
+	if dir != "" {
+		s.dir = os.DirFS(dir)
+	}
+	return s
+}
+
+// ServeHTTP serves the asset named by the URL path relative to the asset
+// root; "/" serves index.html. Paths that are not clean relative names,
+// such as ones with ".." elements, are not found.
+func (s *assetServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		http.NotFound(w, r)
+		return
+	}
+	data, modTime, err := s.open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	// Revalidate every load; an unchanged file costs a 304.
+	w.Header().Set("Cache-Control", "no-cache")
+	// ServeContent answers If-None-Match and If-Modified-Since with 304.
+	http.ServeContent(w, r, path.Base(name), modTime, bytes.NewReader(data))
+}
+
+func (s *assetServer) open(name string) ([]byte, time.Time, error) {
+	if s.dir != nil {
+		data, err := fs.ReadFile(s.dir, name)
+		if err == nil {
+			var modTime time.Time
+			if fi, err := fs.Stat(s.dir, name); err == nil {
+				modTime = fi.ModTime()
+			}
+			return data, modTime, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, time.Time{}, err
+		}
+	}
+	data, err := fs.ReadFile(s.embedded, name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return data, s.started, nil
+}
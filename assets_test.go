@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func testAssets(t *testing.T) (*assetServer, string) {
+	t.Helper()
+	embedded := fstest.MapFS{
+		"index.html":    {Data: []byte("<html>embedded</html>")},
+		"static/app.js": {Data: []byte("// embedded js")},
+		"static/ui.css": {Data: []byte("/* embedded css */")},
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "static"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "static", "app.js"), []byte("// live js"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Outside the asset root.
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return newAssetServer(embedded, dir), dir
+}
+
+func serveAsset(s http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.URL.Path = path
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAssetServer(t *testing.T) {
+	s, _ := testAssets(t)
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"index", "/", http.StatusOK, "<html>embedded</html>"},
+		{"override", "/static/app.js", http.StatusOK, "// live js"},
+		{"fallback", "/static/ui.css", http.StatusOK, "/* embedded css */"},
+		{"missing", "/static/nope.js", http.StatusNotFound, ""},
+		{"dot dot", "/../secret.txt", http.StatusNotFound, ""},
+		{"nested dot dot", "/static/../../secret.txt", http.StatusNotFound, ""},
+		{"absolute", "//etc/passwd", http.StatusNotFound, ""},
+		{"backslash", `/..\secret.txt`, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveAsset(s, tt.path, nil)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("GET %s = %d, want %d", tt.path, rec.Code, tt.wantCode)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("GET %s = %q, want %q", tt.path, rec.Body.String(), tt.wantBody)
+			}
+			if rec.Code == http.StatusOK && rec.Header().Get("ETag") == "" {
+				t.Errorf("GET %s has no ETag", tt.path)
+			}
+		})
+	}
+}
+
+func TestAssetServerConditional(t *testing.T) {
+	s, dir := testAssets(t)
+	for _, path := range []string{"/", "/static/app.js"} {
+		first := serveAsset(s, path, nil)
+		etag, lastMod := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+		if lastMod == "" {
+			t.Errorf("GET %s has no Last-Modified", path)
+		}
+		if rec := serveAsset(s, path, http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusNotModified {
+			t.Errorf("GET %s with its ETag = %d, want 304", path, rec.Code)
+		}
+		if rec := serveAsset(s, path, http.Header{"If-None-Match": {`"stale"`}}); rec.Code != http.StatusOK {
+			t.Errorf("GET %s with another ETag = %d, want 200", path, rec.Code)
+		}
+	}
+
+	// Editing an on-disk asset changes its ETag.
+	before := serveAsset(s, "/static/app.js", nil).Header().Get("ETag")
+	if err := os.WriteFile(filepath.Join(dir, "static", "app.js"), []byte("// edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec := serveAsset(s, "/static/app.js", http.Header{"If-None-Match": {before}})
+	if rec.Code != http.StatusOK || rec.Body.String() != "// edited" {
+		t.Errorf("GET after an edit = %d %q, want the new file", rec.Code, rec.Body.String())
+	}
+}
+
+// TestEmbeddedAssets checks the files index.html links to are embedded.
+func TestEmbeddedAssets(t *testing.T) {
+	embedded, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newAssetServer(embedded, "")
+	index := serveAsset(s, "/", nil)
+	if index.Code != http.StatusOK {
+		t.Fatalf("GET / = %d", index.Code)
+	}
+	for _, name := range []string{"app.css", "app.js"} {
+		if !strings.Contains(index.Body.String(), "/static/"+name) {
+			t.Errorf("index.html does not link /static/%s", name)
+		}
+		if rec := serveAsset(s, "/"+name, nil); rec.Code != http.StatusOK {
+			t.Errorf("GET /static/%s = %d", name, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+// runValidate implements "lite-proxy validate": fetch and validate the pool
+// once, write the valid proxies and exit without starting any listener.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to JSON config (sources, proxies, validation)")
+	output := fs.String("output", "-", `file to write valid proxies to ("-" for stdout)`)
+	format := fs.String("format", "plain", `output format: "plain" (one proxy URL per line) or "json"`)
+	timeout := fs.Duration("timeout", 10*time.Minute, "give up after this long")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "plain" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "validate: unknown format %q\n", *format)
+		return 2
+	}
+
+	var cfg Config
+	if *configPath != "" {
+		loaded, err := LoadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "validate: load config: %v\n", err)
+			return 1
+		}
+		cfg = loaded
+	}
+	cfg.ApplyDefaults()
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "validate: invalid config: %v\n", err)
+		return 1
+	}
+	// The point of the command is a validated list, whatever the server uses.
+	cfg.Validation.Enabled = true
+	logic.SetDialOptions(logic.DialOptions{
+		KeepAlive:   cfg.UpstreamKeepAlive.Duration(),
+		IdleTimeout: cfg.IdleConnTimeout.Duration(),
+	})
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ctx, cancelTimeout := context.WithTimeout(ctx, *timeout)
+	defer cancelTimeout()
+
+	manager := logic.NewProxyManager()
+	refresh := logic.NewRefresher([]*logic.ProxyManager{manager}, *cfg.Sources, cfg.Proxies, cfg.Validation, cfg.DialTimeout.Duration())
+	refresh.AllowPrivate = cfg.AllowPrivateProxies
+	refresh.TrustStatic = cfg.TrustStatic
+	refresh.MaxProxyRange = cfg.MaxProxyRange
+	count, _, err := refresh.Refresh(ctx)
+	if v := refresh.LastValidation(); v != nil {
+		fmt.Fprintf(os.Stderr, "validate: %d tested, %d valid\n", v.Tested, v.Valid)
+	}
+	if count == 0 {
+		fmt.Fprintf(os.Stderr, "validate: %v\n", err)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "validate: warning: %v\n", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if *output != "-" {
+		f, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "validate: %v\n", err)
+			return 1
+		}
+		w = f
+	}
+	if err := writeProxies(w, manager.PoolSnapshot(0), *format); err != nil {
+		fmt.Fprintf(os.Stderr, "validate: write: %v\n", err)
+		return 1
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "validate: write: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// runCheckConfig implements -check-config: load, default and validate the
+// config at path, print the resolved config with secrets redacted and
+// report whether it is valid, without starting anything.
+func runCheckConfig(path string) int {
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "check-config: -config is required")
+		return 2
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check-config: load config: %v\n", err)
+		return 1
+	}
+	cfg.ApplyDefaults()
+	verr := cfg.Validate()
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(redactConfig(cfg)); err != nil {
+		fmt.Fprintf(os.Stderr, "check-config: %v\n", err)
+		return 1
+	}
+	if verr != nil {
+		fmt.Fprintf(os.Stderr, "check-config: invalid config: %v\n", verr)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "check-config: ok")
+	return 0
+}
+
+// redactedSecret replaces passwords, tokens and keys in printed config.
+const redactedSecret = "***"
+
+// redactSpecPassword masks the password of a spec that ParseProxySpec
+// cannot round-trip, such as a range.
+func redactSpecPassword(spec string) string {
+	start := 0
+	if i := strings.Index(spec, "://"); i >= 0 {
+		start = i + 3
+	}
+	at := strings.LastIndex(spec, "@")
+	if at < start {
+		return spec
+	}
+	user, _, ok := strings.Cut(spec[start:at], ":")
+	if !ok {
+		return spec
+	}
+	return spec[:start] + user + ":" + redactedSecret + spec[at:]
+}
+
+// redactConfig returns a copy of cfg safe to print: proxy and URL passwords,
+// secret-looking query parameters and literal auth header values are masked.
+func redactConfig(cfg Config) Config {
+	if len(cfg.Proxies) > 0 {
+		proxies := make([]string, len(cfg.Proxies))
+		for i, spec := range cfg.Proxies {
+			proxies[i] = spec
+			if n, ok := logic.ParseProxySpec(spec, logic.ProxyTypeSOCKS5); ok && n.Pass != "" {
+				n.Pass = redactedSecret
+				proxies[i] = unescapeRedacted(logic.FormatProxySpec(n))
+			} else if !ok {
+				proxies[i] = redactSpecPassword(spec)
+			}
+		}
+		cfg.Proxies = proxies
+	}
+	if cfg.Sources != nil {
+		sources := append(logic.Sources(nil), *cfg.Sources...)
+		for i := range sources {
+			sources[i].URL = redactURL(sources[i].URL)
+			// "$KEY" templates are not secret; the key lives in api_key_env.
+			if name, value, ok := strings.Cut(sources[i].AuthHeader, ":"); ok && !strings.Contains(value, "$KEY") {
+				sources[i].AuthHeader = name + ": " + redactedSecret
+			}
+		}
+		cfg.Sources = &sources
+	}
+	cfg.WebhookURL = redactURL(cfg.WebhookURL)
+	return cfg
+}
+
+// redactURL masks the password and secret-looking query values of raw.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedSecret)
+	}
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			if secretParam(k) {
+				q[k] = []string{redactedSecret}
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return unescapeRedacted(u.String())
+}
+
+// unescapeRedacted undoes URL escaping of redactedSecret for readability.
+func unescapeRedacted(s string) string {
+	return strings.ReplaceAll(s, url.QueryEscape(redactedSecret), redactedSecret)
+}
+
+func secretParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"key", "token", "secret", "pass", "auth", "sig"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeProxies(w io.Writer, nodes []logic.ProxyNode, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(nodes)
+	}
+	bw := bufio.NewWriter(w)
+	for _, n := range nodes {
+		if _, err := fmt.Fprintln(bw, logic.FormatProxySpec(n)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -4,69 +4,332 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
+
+	"lite-proxy/api"
+	"lite-proxy/httpproxy"
 	"lite-proxy/logic"
 )
 
-type Duration struct {
-	d   time.Duration
-	set bool
-}
-
-func DurationValue(d time.Duration) Duration {
-	return Duration{d: d, set: true}
-}
-
-func (d Duration) Duration() time.Duration { return d.d }
+// Duration is the config's duration setting (see logic.Duration).
+type Duration = logic.Duration
 
-func (d Duration) IsSet() bool { return d.set }
+func DurationValue(d time.Duration) Duration { return logic.DurationValue(d) }
 
-func (d *Duration) UnmarshalJSON(b []byte) error {
-	d.set = true
-	d.d = 0
+// ProxyList is the proxies setting. Entries are specs, or objects such as
+// {"proxy": "socks5://1.2.3.4:1080", "dial_timeout": "2s", "tags": ["eu"]}
+// whose settings are folded into the spec's "#" fragment. A range of
+// proxies sharing credentials takes {"cidr": "203.0.113.0/24", "port":
+// 1080, "type": "socks5", "user": "u", "pass": "p", "sample": 64} instead
+// of "proxy", for a range spec (see logic.ExpandProxySpecLimit).
+type ProxyList []string
 
-	if len(b) == 0 || string(b) == "null" {
+func (l *ProxyList) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*l = nil
 		return nil
 	}
-	if b[0] == '"' {
-		var s string
-		if err := json.Unmarshal(b, &s); err != nil {
-			return err
+	out := make(ProxyList, 0, len(raw))
+	for i, r := range raw {
+		var spec string
+		if err := json.Unmarshal(r, &spec); err == nil {
+			out = append(out, spec)
+			continue
 		}
-		if s == "" {
-			d.d = 0
-			return nil
+		var entry struct {
+			Proxy       string   `json:"proxy"`
+			DialTimeout Duration `json:"dial_timeout"`
+			Tags        []string `json:"tags"`
+
+			CIDR   string `json:"cidr"`
+			Port   int    `json:"port"`
+			Type   string `json:"type"`
+			User   string `json:"user"`
+			Pass   string `json:"pass"`
+			Sample int    `json:"sample"`
 		}
-		dd, err := time.ParseDuration(s)
-		if err != nil {
-			return err
+		if err := json.Unmarshal(r, &entry); err != nil {
+			return fmt.Errorf("proxies[%d]: %w", i, err)
 		}
-		d.d = dd
-		return nil
-	}
-
-	var seconds float64
-	if err := json.Unmarshal(b, &seconds); err != nil {
-		return err
+		if entry.CIDR != "" {
+			if entry.Proxy != "" {
+				return fmt.Errorf("proxies[%d]: proxy and cidr are exclusive", i)
+			}
+			spec, err := rangeSpec(entry.CIDR, entry.Port, entry.Type, entry.User, entry.Pass, entry.Sample)
+			if err != nil {
+				return fmt.Errorf("proxies[%d]: %w", i, err)
+			}
+			entry.Proxy = spec
+		}
+		if entry.Proxy == "" {
+			return fmt.Errorf("proxies[%d]: missing proxy", i)
+		}
+		if entry.DialTimeout.Duration() < 0 {
+			return fmt.Errorf("proxies[%d]: dial_timeout must be >= 0", i)
+		}
+		out = append(out, logic.WithSpecOptions(entry.Proxy, entry.Tags, entry.DialTimeout.Duration()))
 	}
-	d.d = time.Duration(seconds * float64(time.Second))
+	*l = out
 	return nil
 }
 
 type Config struct {
+	// The listen addresses take "off" or "none" to not start that
+	// listener; at least one must stay on. Empty means the default, which
+	// for HTTPProxyListen is off.
 	SOCKSListen  string        `json:"socks_listen"`
 	SOCKSAutoListen string     `json:"socks_auto_listen"`
 	WebListen    string        `json:"web_listen"`
+	// HTTPProxyListen serves an HTTP proxy (CONNECT and plain-HTTP
+	// forwarding) through the auto listener's pool, e.g. "127.0.0.1:18080".
+	HTTPProxyListen string     `json:"http_proxy_listen,omitempty"`
+	// HTTPProxyStripHeaders removes these headers from the plain-HTTP
+	// requests the HTTP proxy forwards; "identity" stands for
+	// httpproxy.IdentityHeaders. HTTPProxySetHeaders then sets headers,
+	// or removes those given an empty value, e.g. {"User-Agent": ""}.
+	// Both are off by default.
+	HTTPProxyStripHeaders []string        `json:"http_proxy_strip_headers,omitempty"`
+	HTTPProxySetHeaders   map[string]string `json:"http_proxy_set_headers,omitempty"`
+	// HTTPProxyMaxResponseBytes cuts forwarded response bodies off at this
+	// size, refusing larger declared ones with 502; HTTPProxyMaxRequestBytes
+	// refuses larger client request bodies with 413 (0 = unlimited).
+	HTTPProxyMaxResponseBytes int64 `json:"http_proxy_max_response_bytes,omitempty"`
+	HTTPProxyMaxRequestBytes  int64 `json:"http_proxy_max_request_bytes,omitempty"`
+	// The advertise addresses are reported by /api/status in place of the
+	// listen addresses, e.g. a container's published host:port. Unset, a
+	// wildcard listen host is replaced by the primary interface address.
+	SOCKSAdvertise string      `json:"socks_advertise,omitempty"`
+	SOCKSAutoAdvertise string  `json:"socks_auto_advertise,omitempty"`
+	WebAdvertise string        `json:"web_advertise,omitempty"`
+	WebTLSCert   string        `json:"web_tls_cert,omitempty"`
+	WebTLSKey    string        `json:"web_tls_key,omitempty"`
+	// WebTLSClientCA requires web clients to present a certificate signed by
+	// one of these CAs (PEM bundle); it needs web_tls_cert.
+	WebTLSClientCA string      `json:"web_tls_client_ca,omitempty"`
+	// WebAssetsDir overrides the embedded web UI files with those in this
+	// directory; files it lacks are still served from the binary.
+	WebAssetsDir string        `json:"web_assets_dir,omitempty"`
+	// UnixSocketMode is the octal file mode for unix:// listeners, e.g. "0660".
+	UnixSocketMode string      `json:"unix_socket_mode,omitempty"`
+	// MaxClients caps concurrent client connections per SOCKS listener (0 = unlimited).
+	MaxClients   int           `json:"max_clients,omitempty"`
+	// MaxConnections caps open connections across all listeners, the web
+	// server and HTTP proxy included (0 = unlimited).
+	MaxConnections int         `json:"max_connections,omitempty"`
+	// ListenerMaxConnections caps single listeners by name: "fixed", "auto"
+	// (both default to max_clients), "web" and "http".
+	ListenerMaxConnections map[string]int `json:"listener_max_connections,omitempty"`
+	// ConnectionLimitMode is what happens to a client over a cap: "queue"
+	// (default) lets it wait a few seconds for a slot before it is closed,
+	// "reject" closes it at once. Both count the event.
+	ConnectionLimitMode string `json:"connection_limit_mode,omitempty"`
+	// BandwidthLimit caps a SOCKS listener's tunnels, by listener name
+	// ("fixed", "auto"), to bytes per second shared by all of them;
+	// PerConnBandwidthLimit caps each tunnel. Both directions count
+	// together (0 = unlimited).
+	BandwidthLimit        map[string]int64 `json:"bandwidth_limit,omitempty"`
+	PerConnBandwidthLimit map[string]int64 `json:"per_conn_bandwidth_limit,omitempty"`
 	RefreshEvery Duration      `json:"refresh_every"`
+	// RefreshJitter randomizes each refresh interval within ±RefreshJitter
+	// so many instances don't hit the sources at once (0 disables).
+	RefreshJitter Duration     `json:"refresh_jitter"`
+	// RefreshMode is "replace" (default) or "topup", which merges validated
+	// nodes into the pool instead of swapping it; MaxPoolSize caps a top-up
+	// by evicting the worst old nodes (0 = unlimited).
+	RefreshMode  string        `json:"refresh_mode,omitempty"`
+	MaxPoolSize  int           `json:"max_pool_size,omitempty"`
+	// RefreshProgressive merges nodes into the pool in batches while
+	// validation is still running; the refresh result then reconciles it.
+	RefreshProgressive bool    `json:"refresh_progressive,omitempty"`
+	// AutoStrategy is how the auto listener picks an upstream per
+	// connection: "round_robin" (default), "random" or "weighted" (by live
+	// latency and success rate). AutoAvoidRepeat never picks the upstream
+	// of the previous connection twice in a row.
+	AutoStrategy string        `json:"auto_strategy,omitempty"`
+	AutoAvoidRepeat bool       `json:"auto_avoid_repeat,omitempty"`
+	// AutoLatencyExponent (default 1) sharpens "weighted" toward fast
+	// nodes; AutoExplore (default 0.1) is the share of connections spread
+	// evenly so slow nodes keep fresh stats.
+	AutoLatencyExponent float64 `json:"auto_latency_exponent,omitempty"`
+	AutoExplore  float64       `json:"auto_explore,omitempty"`
+	// AutoGeoAffinity makes the auto listener prefer upstreams from the
+	// target's region: by TLD for host names (never resolved), by
+	// AutoGeoTable CIDRs for IP literals. AutoGeoTable adds or overrides
+	// entries, e.g. {"co.jp": ["JP"], "203.0.113.0/24": ["DE"]}.
+	AutoGeoAffinity bool       `json:"auto_geo_affinity,omitempty"`
+	AutoGeoTable map[string][]string `json:"auto_geo_table,omitempty"`
 	RotateEvery  Duration      `json:"rotate_every"`
+	RotateJitter float64       `json:"rotate_jitter"`
 	DialTimeout  Duration      `json:"dial_timeout"`
+	// DialTimeoutMultiplier enables adaptive dial timeouts: a node with live
+	// latency gets that many times its average dial time, clamped to
+	// [dial_timeout_min, dial_timeout_max] (defaults 1s and dial_timeout).
+	// Nodes without history use dial_timeout; 0 disables it.
+	DialTimeoutMultiplier float64 `json:"dial_timeout_multiplier,omitempty"`
+	DialTimeoutMin Duration    `json:"dial_timeout_min"`
+	DialTimeoutMax Duration    `json:"dial_timeout_max"`
+	// RetryAttempts is how many upstreams an auto listener dial tries
+	// (default 3), each within RetryAttemptTimeout when set, waiting
+	// RetryBackoff before the second and doubling up to RetryMaxBackoff.
+	// RetryOn limits retries to those failure categories (e.g. "timeout",
+	// "connection_refused", or an upstream reply such as
+	// "socks5_host_unreachable" or "http_502"); empty retries every failure.
+	RetryAttempts int          `json:"retry_attempts,omitempty"`
+	RetryAttemptTimeout Duration `json:"retry_attempt_timeout"`
+	RetryBackoff Duration      `json:"retry_backoff"`
+	RetryMaxBackoff Duration   `json:"retry_max_backoff"`
+	RetryOn      []string      `json:"retry_on,omitempty"`
+	UpstreamKeepAlive Duration `json:"upstream_keepalive"`
+	// PipeBufferSize is the per-direction copy buffer of a tunnel in bytes
+	// (default 32 KiB); buffers are pooled across connections.
+	PipeBufferSize int         `json:"pipe_buffer_size,omitempty"`
+	IdleConnTimeout   Duration `json:"idle_conn_timeout"`
+	// OutboundFwmark sets SO_MARK on upstream sockets so fwmark rules can
+	// route them (Linux only, needs CAP_NET_ADMIN); 0 disables it.
+	OutboundFwmark uint32      `json:"outbound_fwmark,omitempty"`
+	// StaleCurrentAfter health-checks the fixed upstream before a client dial
+	// when no dial has succeeded for this long (0 disables).
+	StaleCurrentAfter Duration `json:"stale_current_after"`
+	// UpstreamConnPoolSize keeps this many pre-connected idle TCP connections
+	// per upstream in use, each for at most UpstreamConnPoolTTL (0 disables).
+	UpstreamConnPoolSize int   `json:"upstream_conn_pool_size,omitempty"`
+	UpstreamConnPoolTTL Duration `json:"upstream_conn_pool_ttl"`
+	// WarmFixedCurrent keeps idle connections to the fixed listener's current
+	// upstream open ahead of use; it implies a pool size of 2 when unset.
+	WarmFixedCurrent bool      `json:"warm_fixed_current,omitempty"`
+	// BreakerThreshold consecutive failures open a proxy's circuit for
+	// BreakerCooldown (default 1m) instead of removing it (0 disables).
+	BreakerThreshold int      `json:"breaker_threshold,omitempty"`
+	BreakerCooldown   Duration `json:"breaker_cooldown"`
+	// RemovalPolicy is what happens to a node that keeps failing client
+	// dials: "remove" (default) drops it until the next refresh, "disable"
+	// keeps it in the pool out of rotation until the latency sweep or a
+	// refresh finds it working again.
+	RemovalPolicy string       `json:"removal_policy,omitempty"`
+	// LatencySweepEvery re-measures LatencySweepConcurrency (default 4) pool
+	// nodes per tick against the validation test address (0 disables).
+	LatencySweepEvery Duration `json:"latency_sweep_every"`
+	LatencySweepConcurrency int `json:"latency_sweep_concurrency,omitempty"`
 	Sources      *logic.Sources `json:"sources"`
-	Proxies      []string      `json:"proxies"`
+	// TypeCacheTTL is how long the detected protocol of a node from a
+	// type "infer" source is reused (default 6h, 0 re-probes every refresh).
+	TypeCacheTTL Duration      `json:"type_cache_ttl"`
+	// SeenRetention is how long a node no refresh lists keeps its first/last
+	// seen record (default 168h). SeenPath, when set, persists the records
+	// across restarts.
+	SeenRetention Duration     `json:"seen_retention"`
+	SeenPath     string        `json:"seen_path,omitempty"`
+	// BlocklistAfter quarantines addresses that failed validation in that
+	// many consecutive refreshes (0 = off) for BlocklistDuration (default
+	// 24h). BlocklistPath, when set, persists the list, e.g. next to
+	// snapshot_path.
+	BlocklistAfter int         `json:"blocklist_after,omitempty"`
+	BlocklistDuration Duration `json:"blocklist_duration"`
+	BlocklistPath string       `json:"blocklist_path,omitempty"`
+	Proxies      ProxyList     `json:"proxies"`
+	// MaxProxyRange caps how many addresses a proxies range may cover,
+	// sampled IPv6 ranges aside (default 4096, a /20).
+	MaxProxyRange int          `json:"max_proxy_range,omitempty"`
+	AllowPrivateProxies bool   `json:"allow_private_proxies"`
+	// RemoteDNS sends target host names to every upstream unresolved, as if
+	// all proxies were socks5h://.
+	RemoteDNS    bool          `json:"remote_dns,omitempty"`
+	// TargetBlocklist and TargetAllowlist restrict client destinations:
+	// host names, "*.domain" / ".domain" wildcards, IPs and CIDRs.
+	TargetBlocklist []string   `json:"target_blocklist,omitempty"`
+	TargetAllowlist []string   `json:"target_allowlist,omitempty"`
+	// SelfAddrs are further addresses ("ip" or "ip:port") that reach this
+	// process, e.g. a NAT's public side. Client targets and pool candidates
+	// matching them or a listener are refused.
+	SelfAddrs    []string      `json:"self_addrs,omitempty"`
+	// ExposeCredentials includes proxy passwords in /api/pool and
+	// /api/state/export, which redact them by default.
+	ExposeCredentials bool     `json:"expose_credentials,omitempty"`
+	// LogTargets allows destination host names in logs and stats.
+	LogTargets   bool          `json:"log_targets,omitempty"`
+	// AccessLog writes a line per client dial (client, upstream, target,
+	// outcome) to this file, or to standard output for "stdout".
+	// AccessLogFormat is "plain" (default) or "json".
+	AccessLog       string     `json:"access_log,omitempty"`
+	AccessLogFormat string     `json:"access_log_format,omitempty"`
+	// AuditLogPath appends every mutating API call and scheduled refresh
+	// or rotation to this file as JSON lines; /api/audit serves the latest
+	// ones either way.
+	AuditLogPath string        `json:"audit_log_path,omitempty"`
+	TrustStatic  bool          `json:"trust_static"`
+	// SelfTestURL is fetched through our own listeners by /api/selftest;
+	// a plain-text exit IP echo service works best.
+	SelfTestURL  string        `json:"selftest_url,omitempty"`
+	// ReadyMinPool is the pool size at which /readyz starts returning 200.
+	ReadyMinPool int           `json:"ready_min_pool,omitempty"`
+	// UnhealthyExitAfter exits the process (status 1) once the pool has
+	// been empty or every refresh has failed for this long, so a supervisor
+	// can restart it (0 disables; it is still reported as degraded).
+	UnhealthyExitAfter Duration `json:"unhealthy_exit_after"`
+
+	SnapshotPath     string `json:"snapshot_path,omitempty"`
+	SnapshotMinNodes int    `json:"snapshot_min_nodes,omitempty"`
+	SnapshotKeep     int    `json:"snapshot_keep,omitempty"`
+
+	// HistoryPath enables pool quality samples every HistoryEvery (default
+	// 5m), kept for HistoryRetention (default 168h) in daily JSON-lines files.
+	// HistoryEvery also paces the in-memory trend of /api/history.
+	HistoryPath      string   `json:"history_path,omitempty"`
+	HistoryEvery     Duration `json:"history_every"`
+	HistoryRetention Duration `json:"history_retention"`
+
+	WebhookURL       string   `json:"webhook_url,omitempty"`
+	WebhookTimeout   Duration `json:"webhook_timeout"`
+	WebhookPoolFloor int      `json:"webhook_pool_floor,omitempty"`
 	Validation   logic.ValidationConfig `json:"validation"`
 }
 
+// rangeSpec renders the object form of a proxy range as a range spec.
+func rangeSpec(cidr string, port int, typ, user, pass string, sample int) (string, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return "", fmt.Errorf("invalid cidr: %w", err)
+	}
+	if port < 1 || port > 65535 {
+		return "", fmt.Errorf("port must be 1-65535")
+	}
+	if sample < 0 {
+		return "", fmt.Errorf("sample must be >= 0")
+	}
+	switch typ = strings.ToLower(strings.TrimSpace(typ)); typ {
+	case "":
+		typ = logic.ProxyTypeSOCKS5
+	case logic.ProxyTypeSOCKS5, "socks5h", logic.ProxyTypeHTTP, logic.ProxyTypeHTTPS:
+	default:
+		return "", fmt.Errorf("type must be socks5, socks5h, http or https")
+	}
+	host := p.String()
+	if p.Addr().Is6() {
+		host = "[" + host + "]"
+	}
+	var userinfo string
+	if user != "" || pass != "" {
+		userinfo = url.UserPassword(user, pass).String() + "@"
+	}
+	spec := typ + "://" + userinfo + host + ":" + strconv.Itoa(port)
+	if sample > 0 {
+		spec += "#sample=" + strconv.Itoa(sample)
+	}
+	return spec, nil
+}
+
 func LoadConfig(path string) (Config, error) {
 	if path == "" {
 		return Config{}, errors.New("empty config path")
@@ -92,9 +355,24 @@ func (c *Config) ApplyDefaults() {
 	if c.WebListen == "" {
 		c.WebListen = "127.0.0.1:8088"
 	}
+	if c.HTTPProxyListen == "" {
+		c.HTTPProxyListen = "off"
+	}
 	if !c.RefreshEvery.IsSet() {
 		c.RefreshEvery = DurationValue(30 * time.Minute)
 	}
+	if c.RefreshMode == "" {
+		c.RefreshMode = logic.RefreshModeReplace
+	}
+	if c.AutoStrategy == "" {
+		c.AutoStrategy = logic.StrategyRoundRobin
+	}
+	if c.AutoLatencyExponent == 0 {
+		c.AutoLatencyExponent = logic.DefaultLatencyExponent
+	}
+	if c.AutoExplore == 0 {
+		c.AutoExplore = logic.DefaultExplore
+	}
 	if !c.RotateEvery.IsSet() {
 		// Default to disabled: fixed SOCKS should stay stable unless switched via UI.
 		c.RotateEvery = DurationValue(0)
@@ -102,14 +380,112 @@ func (c *Config) ApplyDefaults() {
 	if !c.DialTimeout.IsSet() {
 		c.DialTimeout = DurationValue(15 * time.Second)
 	}
+	if !c.DialTimeoutMin.IsSet() {
+		c.DialTimeoutMin = DurationValue(time.Second)
+	}
+	if !c.DialTimeoutMax.IsSet() {
+		c.DialTimeoutMax = c.DialTimeout
+	}
+	if !c.StaleCurrentAfter.IsSet() {
+		c.StaleCurrentAfter = DurationValue(10 * time.Minute)
+	}
+	if c.WarmFixedCurrent && c.UpstreamConnPoolSize == 0 {
+		c.UpstreamConnPoolSize = 2
+	}
+	if !c.UpstreamConnPoolTTL.IsSet() {
+		c.UpstreamConnPoolTTL = DurationValue(30 * time.Second)
+	}
+	if !c.BreakerCooldown.IsSet() {
+		c.BreakerCooldown = DurationValue(time.Minute)
+	}
+	if !c.SeenRetention.IsSet() || c.SeenRetention.Duration() <= 0 {
+		c.SeenRetention = DurationValue(logic.DefaultSeenRetention)
+	}
+	if c.RetryAttempts <= 0 {
+		c.RetryAttempts = logic.DefaultRetryAttempts
+	}
+	if !c.BlocklistDuration.IsSet() || c.BlocklistDuration.Duration() <= 0 {
+		c.BlocklistDuration = DurationValue(logic.DefaultBlocklistDuration)
+	}
+	if !c.TypeCacheTTL.IsSet() {
+		c.TypeCacheTTL = DurationValue(6 * time.Hour)
+	}
 	if c.Sources == nil {
 		ds := logic.DefaultSources()
 		c.Sources = &ds
 	}
+	if c.SelfTestURL == "" {
+		c.SelfTestURL = "https://api.ipify.org"
+	}
+	if c.ReadyMinPool <= 0 {
+		c.ReadyMinPool = 1
+	}
+	if !c.HistoryEvery.IsSet() || c.HistoryEvery.Duration() <= 0 {
+		c.HistoryEvery = DurationValue(5 * time.Minute)
+	}
+	if !c.HistoryRetention.IsSet() || c.HistoryRetention.Duration() <= 0 {
+		c.HistoryRetention = DurationValue(7 * 24 * time.Hour)
+	}
+	if !c.WebhookTimeout.IsSet() {
+		c.WebhookTimeout = DurationValue(5 * time.Second)
+	}
+	if c.SnapshotMinNodes <= 0 {
+		c.SnapshotMinNodes = 10
+	}
+	if c.SnapshotKeep <= 0 {
+		c.SnapshotKeep = 5
+	}
 	// Keep defaults in sync with logic.ValidationConfig.
 	c.Validation.ApplyDefaults()
 }
 
+// RetryPolicy is the retry policy of auto listener dials.
+func (c Config) RetryPolicy() logic.RetryPolicy {
+	return logic.RetryPolicy{
+		MaxAttempts:    c.RetryAttempts,
+		AttemptTimeout: c.RetryAttemptTimeout.Duration(),
+		Backoff:        c.RetryBackoff.Duration(),
+		MaxBackoff:     c.RetryMaxBackoff.Duration(),
+		RetryOn:        c.RetryOn,
+	}
+}
+
+// HTTPProxyHeaders is the header rewriting of the HTTP proxy.
+func (c Config) HTTPProxyHeaders() httpproxy.HeaderRules {
+	var strip []string
+	for _, h := range c.HTTPProxyStripHeaders {
+		if strings.EqualFold(h, "identity") {
+			strip = append(strip, httpproxy.IdentityHeaders...)
+			continue
+		}
+		strip = append(strip, h)
+	}
+	return httpproxy.HeaderRules{Strip: strip, Set: c.HTTPProxySetHeaders}
+}
+
+// API is the part of the config the web API reads.
+func (c Config) API() api.Config {
+	return api.Config{
+		WebListen:           c.WebListen,
+		WebListenNetwork:    listenNetwork(c.WebListen),
+		HTTPProxyListen:     c.HTTPProxyListen,
+		WebTLS:              c.WebTLSCert != "",
+		WebMTLS:             c.WebTLSClientCA != "",
+		DialTimeout:         c.DialTimeout.Duration(),
+		Validation:          c.Validation,
+		RefreshMode:         c.RefreshMode,
+		SelfTestURL:         c.SelfTestURL,
+		MaxClients:          c.MaxClients,
+		ReadyMinPool:        c.ReadyMinPool,
+		MaxProxyRange:       c.MaxProxyRange,
+		AllowPrivateProxies: c.AllowPrivateProxies,
+		ExposeCredentials:   c.ExposeCredentials,
+		BlocklistAfter:      c.BlocklistAfter,
+		BlocklistDuration:   c.BlocklistDuration,
+		HistoryEvery:        c.HistoryEvery.Duration(),
+	}
+}
+
 func (c *Config) Validate() error {
 	if c.SOCKSListen == "" {
 		return fmt.Errorf("socks_listen is empty")
@@ -120,6 +496,196 @@ func (c *Config) Validate() error {
 	if c.WebListen == "" {
 		return fmt.Errorf("web_listen is empty")
 	}
+	if c.HTTPProxyListen == "" {
+		return fmt.Errorf("http_proxy_listen is empty")
+	}
+	listens := []struct{ name, addr string }{
+		{"web_listen", c.WebListen},
+		{"socks_listen", c.SOCKSListen},
+		{"socks_auto_listen", c.SOCKSAutoListen},
+		{"http_proxy_listen", c.HTTPProxyListen},
+	}
+	if listenOff(c.WebListen) && listenOff(c.SOCKSListen) && listenOff(c.SOCKSAutoListen) && listenOff(c.HTTPProxyListen) {
+		return fmt.Errorf("web_listen, socks_listen, socks_auto_listen and http_proxy_listen are all off; at least one listener is required")
+	}
+	for i := range listens {
+		for _, other := range listens[i+1:] {
+			if listenConflict(listens[i].addr, other.addr) {
+				return fmt.Errorf("%s and %s both use %s", listens[i].name, other.name, other.addr)
+			}
+		}
+	}
+	for _, a := range []struct{ name, addr string }{
+		{"web_advertise", c.WebAdvertise},
+		{"socks_advertise", c.SOCKSAdvertise},
+		{"socks_auto_advertise", c.SOCKSAutoAdvertise},
+	} {
+		if a.addr == "" {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(a.addr); err != nil || host == "" {
+			return fmt.Errorf("%s must be host:port", a.name)
+		}
+	}
+	if (c.WebTLSCert == "") != (c.WebTLSKey == "") {
+		return fmt.Errorf("web_tls_cert and web_tls_key must be set together")
+	}
+	if c.WebTLSClientCA != "" && c.WebTLSCert == "" {
+		return fmt.Errorf("web_tls_client_ca requires web_tls_cert and web_tls_key")
+	}
+	if c.WebAssetsDir != "" {
+		if fi, err := os.Stat(c.WebAssetsDir); err != nil {
+			return fmt.Errorf("web_assets_dir: %w", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("web_assets_dir: %s is not a directory", c.WebAssetsDir)
+		}
+	}
+	if _, err := parseSocketMode(c.UnixSocketMode); err != nil {
+		return err
+	}
+	if c.UpstreamConnPoolSize < 0 {
+		return fmt.Errorf("upstream_conn_pool_size must be >= 0")
+	}
+	if c.MaxClients < 0 {
+		return fmt.Errorf("max_clients must be >= 0")
+	}
+	if c.PipeBufferSize < 0 || c.PipeBufferSize > 4<<20 {
+		return fmt.Errorf("pipe_buffer_size must be between 0 and 4 MiB")
+	}
+	if c.OutboundFwmark != 0 && !logic.FwmarkSupported {
+		return fmt.Errorf("outbound_fwmark is only supported on Linux")
+	}
+	for _, h := range c.HTTPProxyStripHeaders {
+		if !strings.EqualFold(h, "identity") && !httpguts.ValidHeaderFieldName(h) {
+			return fmt.Errorf("http_proxy_strip_headers: invalid header name %q", h)
+		}
+	}
+	for k, v := range c.HTTPProxySetHeaders {
+		if !httpguts.ValidHeaderFieldName(k) || !httpguts.ValidHeaderFieldValue(v) {
+			return fmt.Errorf("http_proxy_set_headers: invalid header %q", k)
+		}
+	}
+	if c.HTTPProxyMaxResponseBytes < 0 || c.HTTPProxyMaxRequestBytes < 0 {
+		return fmt.Errorf("http_proxy_max_response_bytes and http_proxy_max_request_bytes must be >= 0")
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must be >= 0")
+	}
+	for name, n := range c.ListenerMaxConnections {
+		switch name {
+		case "fixed", "auto", "web", "http":
+		default:
+			return fmt.Errorf("listener_max_connections: unknown listener %q", name)
+		}
+		if n < 0 {
+			return fmt.Errorf("listener_max_connections.%s must be >= 0", name)
+		}
+	}
+	for field, limits := range map[string]map[string]int64{
+		"bandwidth_limit":          c.BandwidthLimit,
+		"per_conn_bandwidth_limit": c.PerConnBandwidthLimit,
+	} {
+		for name, n := range limits {
+			switch name {
+			case "fixed", "auto":
+			default:
+				return fmt.Errorf("%s: unknown listener %q", field, name)
+			}
+			if n < 0 {
+				return fmt.Errorf("%s.%s must be >= 0", field, name)
+			}
+		}
+	}
+	switch c.ConnectionLimitMode {
+	case "", connLimitQueue, connLimitReject:
+	default:
+		return fmt.Errorf("connection_limit_mode must be %q or %q", connLimitQueue, connLimitReject)
+	}
+	if c.LatencySweepEvery.Duration() < 0 || c.LatencySweepConcurrency < 0 {
+		return fmt.Errorf("latency_sweep_every and latency_sweep_concurrency must be >= 0")
+	}
+	if j := c.RefreshJitter.Duration(); j < 0 || (c.RefreshEvery.Duration() > 0 && j >= c.RefreshEvery.Duration()) {
+		return fmt.Errorf("refresh_jitter must be >= 0 and less than refresh_every")
+	}
+	switch c.RefreshMode {
+	case "", logic.RefreshModeReplace, logic.RefreshModeTopUp:
+	default:
+		return fmt.Errorf("refresh_mode must be %q or %q", logic.RefreshModeReplace, logic.RefreshModeTopUp)
+	}
+	switch c.AutoStrategy {
+	case "", logic.StrategyRoundRobin, logic.StrategyRandom, logic.StrategyWeighted:
+	default:
+		return fmt.Errorf("auto_strategy must be %q, %q or %q", logic.StrategyRoundRobin, logic.StrategyRandom, logic.StrategyWeighted)
+	}
+	if c.AutoLatencyExponent < 0 || c.AutoLatencyExponent > 4 {
+		return fmt.Errorf("auto_latency_exponent must be between 0 and 4")
+	}
+	if c.AutoExplore < 0 || c.AutoExplore > 1 {
+		return fmt.Errorf("auto_explore must be between 0 and 1")
+	}
+	if c.MaxPoolSize < 0 {
+		return fmt.Errorf("max_pool_size must be >= 0")
+	}
+	if c.MaxProxyRange < 0 {
+		return fmt.Errorf("max_proxy_range must be >= 0")
+	}
+	if c.UnhealthyExitAfter.Duration() < 0 {
+		return fmt.Errorf("unhealthy_exit_after must be >= 0")
+	}
+	switch c.RemovalPolicy {
+	case "", logic.RemovalPolicyRemove, logic.RemovalPolicyDisable:
+	default:
+		return fmt.Errorf("removal_policy must be %q or %q", logic.RemovalPolicyRemove, logic.RemovalPolicyDisable)
+	}
+	if c.BreakerThreshold < 0 {
+		return fmt.Errorf("breaker_threshold must be >= 0")
+	}
+	switch c.AccessLogFormat {
+	case "", accessLogPlain, accessLogJSON:
+	default:
+		return fmt.Errorf("access_log_format must be %q or %q", accessLogPlain, accessLogJSON)
+	}
+	if c.DialTimeoutMultiplier < 0 {
+		return fmt.Errorf("dial_timeout_multiplier must be >= 0")
+	}
+	if c.DialTimeoutMultiplier > 0 && c.DialTimeoutMin.Duration() > c.DialTimeoutMax.Duration() {
+		return fmt.Errorf("dial_timeout_min must not exceed dial_timeout_max")
+	}
+	if c.RotateJitter < 0 || c.RotateJitter >= 1 {
+		return fmt.Errorf("rotate_jitter must be in [0, 1)")
+	}
+	if c.RetryAttemptTimeout.Duration() < 0 || c.RetryBackoff.Duration() < 0 || c.RetryMaxBackoff.Duration() < 0 {
+		return fmt.Errorf("retry_attempt_timeout, retry_backoff and retry_max_backoff must be >= 0")
+	}
+	for _, cat := range c.RetryOn {
+		if !logic.KnownFailureCategory(cat) {
+			return fmt.Errorf("retry_on: unknown failure category %q", cat)
+		}
+	}
+	if _, err := logic.NewGeoAffinity(c.AutoGeoTable); err != nil {
+		return err
+	}
+	if c.BlocklistAfter < 0 {
+		return fmt.Errorf("blocklist_after must be >= 0")
+	}
+	if _, err := logic.NewTargetPolicy(c.TargetAllowlist, c.TargetBlocklist); err != nil {
+		return err
+	}
+	if _, err := logic.NewSelfGuard(c.SelfAddrs); err != nil {
+		return err
+	}
+	for i, spec := range c.Proxies {
+		// Catch oversized and malformed ranges; plain specs are skipped
+		// when invalid, as before.
+		if strings.Contains(spec, "/") && !strings.HasPrefix(strings.TrimSpace(spec), "#") {
+			if _, err := logic.ExpandProxySpecLimit(spec, "auto", c.MaxProxyRange); err != nil {
+				return fmt.Errorf("proxies[%d]: %w", i, err)
+			}
+		}
+	}
+	if err := c.Validation.Validate(); err != nil {
+		return fmt.Errorf("validation: %w", err)
+	}
 	if c.Sources == nil {
 		return fmt.Errorf("sources is nil")
 	}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"lite-proxy/httpproxy"
+	"lite-proxy/logic"
+)
+
+// testConfig is a config that validates, with the given changes applied.
+func testConfig(t *testing.T, change func(*Config)) Config {
+	t.Helper()
+	var c Config
+	c.ApplyDefaults()
+	if change != nil {
+		change(&c)
+	}
+	return c
+}
+
+func TestValidateListenersOff(t *testing.T) {
+	allOff := func(c *Config) {
+		c.SOCKSListen, c.SOCKSAutoListen, c.WebListen = "off", "none", "OFF"
+	}
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{"defaults", nil, ""},
+		{"all off", allOff, "at least one listener"},
+		{"only the http proxy", func(c *Config) { allOff(c); c.HTTPProxyListen = "127.0.0.1:18080" }, ""},
+		{"only the web UI", func(c *Config) { allOff(c); c.WebListen = "127.0.0.1:8088" }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, tt.change)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyListenDefaultsOff(t *testing.T) {
+	c := testConfig(t, nil)
+	if !listenOff(c.HTTPProxyListen) {
+		t.Errorf("HTTPProxyListen = %q, want off by default", c.HTTPProxyListen)
+	}
+}
+
+func TestValidateDistinctListenAddrs(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{"socks twice", func(c *Config) { c.SOCKSAutoListen = c.SOCKSListen }, "socks_listen and socks_auto_listen"},
+		{"http proxy on the web port", func(c *Config) { c.HTTPProxyListen = "0.0.0.0:8088" }, "web_listen and http_proxy_listen"},
+		{"http proxy on the auto port", func(c *Config) { c.HTTPProxyListen = "localhost:1081" }, "socks_auto_listen and http_proxy_listen"},
+		{"http proxy on its own port", func(c *Config) { c.HTTPProxyListen = "127.0.0.1:18080" }, ""},
+		{"two listeners off", func(c *Config) { c.SOCKSListen, c.HTTPProxyListen = "off", "off" }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, tt.change)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListenConflict(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"127.0.0.1:1080", "127.0.0.1:1080", true},
+		{"127.0.0.1:1080", "localhost:1080", true},
+		{"0.0.0.0:1080", "127.0.0.1:1080", true},
+		{":1080", "[::1]:1080", true},
+		{"[::ffff:127.0.0.1]:1080", "127.0.0.1:1080", true},
+		{"127.0.0.1:1080", "127.0.0.1:1081", false},
+		{"127.0.0.1:1080", "127.0.0.2:1080", false},
+		{"127.0.0.1:0", "127.0.0.1:0", false},
+		{"unix:///run/lp.sock", "unix:///run/../run/lp.sock", true},
+		{"unix:///run/lp.sock", "127.0.0.1:1080", false},
+		{"off", "off", false},
+	}
+	for _, tt := range tests {
+		if got := listenConflict(tt.a, tt.b); got != tt.want {
+			t.Errorf("listenConflict(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPProxyHeaders(t *testing.T) {
+	c := testConfig(t, func(c *Config) {
+		c.HTTPProxyStripHeaders = []string{"Identity", "Cookie"}
+		c.HTTPProxySetHeaders = map[string]string{"User-Agent": "curl/8"}
+	})
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	rules := c.HTTPProxyHeaders()
+	if got, want := len(rules.Strip), len(httpproxy.IdentityHeaders)+1; got != want {
+		t.Errorf("Strip has %d headers, want %d", got, want)
+	}
+	if rules.Strip[len(rules.Strip)-1] != "Cookie" || rules.Set["User-Agent"] != "curl/8" {
+		t.Errorf("HTTPProxyHeaders() = %+v", rules)
+	}
+
+	for _, change := range []func(*Config){
+		func(c *Config) { c.HTTPProxyStripHeaders = []string{"Bad Header"} },
+		func(c *Config) { c.HTTPProxySetHeaders = map[string]string{"X-A": "line\nbreak"} },
+	} {
+		c := testConfig(t, change)
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() accepted %v %v", c.HTTPProxyStripHeaders, c.HTTPProxySetHeaders)
+		}
+	}
+}
+
+func TestValidateBandwidthLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{"both listeners", func(c *Config) {
+			c.BandwidthLimit = map[string]int64{"auto": 1 << 20, "fixed": 0}
+			c.PerConnBandwidthLimit = map[string]int64{"auto": 64 << 10}
+		}, ""},
+		{"unknown listener", func(c *Config) { c.BandwidthLimit = map[string]int64{"web": 1} }, `bandwidth_limit: unknown listener "web"`},
+		{"negative", func(c *Config) { c.PerConnBandwidthLimit = map[string]int64{"auto": -1} }, "per_conn_bandwidth_limit.auto must be >= 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, tt.change)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateOutboundFwmark(t *testing.T) {
+	c := testConfig(t, func(c *Config) { c.OutboundFwmark = 0x2a })
+	err := c.Validate()
+	if logic.FwmarkSupported {
+		if err != nil {
+			t.Fatalf("Validate() = %v", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), "only supported on Linux") {
+		t.Fatalf("Validate() = %v, want outbound_fwmark rejected off Linux", err)
+	}
+}
+
+func TestValidateSelfAddrs(t *testing.T) {
+	ok := testConfig(t, func(c *Config) { c.SelfAddrs = []string{"203.0.113.5", "203.0.113.5:1080", "[2001:db8::1]:1080"} })
+	if err := ok.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	bad := testConfig(t, func(c *Config) { c.SelfAddrs = []string{"nat.example:1080"} })
+	if err := bad.Validate(); err == nil || !strings.Contains(err.Error(), "nat.example:1080") {
+		t.Fatalf("Validate() = %v, want the bad self address named", err)
+	}
+}
+
+func TestValidateRetryOn(t *testing.T) {
+	ok := testConfig(t, func(c *Config) {
+		c.RetryOn = []string{"timeout", "no_response", "socks5_host_unreachable", "http_502"}
+	})
+	if err := ok.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	bad := testConfig(t, func(c *Config) { c.RetryOn = []string{"socks5_bogus"} })
+	if err := bad.Validate(); err == nil || !strings.Contains(err.Error(), `unknown failure category "socks5_bogus"`) {
+		t.Fatalf("Validate() = %v, want socks5_bogus rejected", err)
+	}
+}
+
+func TestValidateContentCheck(t *testing.T) {
+	c := testConfig(t, func(c *Config) { c.Validation.ExpectSHA256 = strings.Repeat("ab", 32) })
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "validation: expect_url is required") {
+		t.Fatalf("Validate() = %v, want expect_url required", err)
+	}
+}
+
+func TestValidateDedupeExitIP(t *testing.T) {
+	c := testConfig(t, func(c *Config) { c.Validation.DedupeExitIP = true })
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "validation: exit_ip_url is required") {
+		t.Fatalf("Validate() = %v, want exit_ip_url required", err)
+	}
+}
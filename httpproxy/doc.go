@@ -1,5 +1,3 @@
+// Package httpproxy serves an HTTP proxy (CONNECT and plain-HTTP forwarding)
+// on top of a logic.ProxyManager pool.
 package httpproxy
-
-// HTTP proxy module is removed/disabled by default.
-// The legacy implementation is kept behind the `httpproxy` build tag.
-
@@ -0,0 +1,42 @@
+package httpproxy
+
+import "net/http"
+
+// IdentityHeaders are request headers that commonly reveal the client or
+// the page it came from, for use in HeaderRules.Strip.
+var IdentityHeaders = []string{
+	"Referer",
+	"From",
+	"Forwarded",
+	"Via",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-IP",
+	"X-Client-IP",
+	"Client-IP",
+	"True-Client-IP",
+}
+
+// HeaderRules rewrite the headers of forwarded plain-HTTP requests before
+// they go upstream. The zero value forwards headers as-is.
+type HeaderRules struct {
+	// Strip lists headers to remove.
+	Strip []string
+	// Set replaces or adds headers, after Strip; an empty value removes
+	// the header instead, e.g. {"User-Agent": "Mozilla/5.0 ..."}.
+	Set map[string]string
+}
+
+func (r HeaderRules) apply(h http.Header) {
+	for _, k := range r.Strip {
+		h.Del(k)
+	}
+	for k, v := range r.Set {
+		if v == "" {
+			h.Del(k)
+			continue
+		}
+		h.Set(k, v)
+	}
+}
@@ -0,0 +1,42 @@
+package httpproxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	in := http.Header{
+		"User-Agent": {"app/1"},
+		"Referer":    {"http://a.example/"},
+		"Accept":     {"*/*"},
+		"X-Trace":    {"1"},
+	}
+	tests := []struct {
+		name  string
+		rules HeaderRules
+		want  http.Header
+	}{
+		{"zero value", HeaderRules{}, in},
+		{
+			name:  "strip then set",
+			rules: HeaderRules{Strip: []string{"referer", "X-Trace"}, Set: map[string]string{"User-Agent": "Mozilla/5.0", "X-New": "v"}},
+			want:  http.Header{"User-Agent": {"Mozilla/5.0"}, "Accept": {"*/*"}, "X-New": {"v"}},
+		},
+		{
+			name:  "empty value removes",
+			rules: HeaderRules{Set: map[string]string{"User-Agent": ""}},
+			want:  http.Header{"Referer": {"http://a.example/"}, "Accept": {"*/*"}, "X-Trace": {"1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := in.Clone()
+			tt.rules.apply(h)
+			if !reflect.DeepEqual(h, tt.want) {
+				t.Errorf("apply() = %v, want %v", h, tt.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,3 @@
-//go:build httpproxy
-
 package httpproxy
 
 import (
@@ -23,8 +21,28 @@ type Server struct {
 	Addr       string
 	Logger     *log.Logger
 	DialTimeout time.Duration
+	// KeepAlive and IdleConnTimeout tune the upstream transports; zero keeps
+	// the defaults (30s and 90s).
+	KeepAlive       time.Duration
+	IdleConnTimeout time.Duration
 
 	Manager *logic.ProxyManager
+	// Targets, when set, rejects blocked destinations with 403 before an
+	// upstream is selected; so does Self for destinations that loop back
+	// to this process.
+	Targets *logic.TargetPolicy
+	Self    *logic.SelfGuard
+	// Headers rewrites forwarded plain-HTTP requests; off unless set.
+	Headers HeaderRules
+	// Retry is how CONNECT dials and idempotent forwards fail over to the
+	// next http node; a zero MaxAttempts means logic.DefaultRetryAttempts.
+	Retry logic.RetryPolicy
+	// MaxResponseBytes caps a forwarded response body: a larger declared
+	// length is refused with 502, a longer stream is cut off at the cap.
+	// MaxRequestBytes refuses larger client request bodies with 413. Both
+	// are logged; 0 means unlimited.
+	MaxResponseBytes int64
+	MaxRequestBytes  int64
 
 	lnMu sync.Mutex
 	ln   net.Listener
@@ -33,24 +51,28 @@ type Server struct {
 	transports  map[string]*http.Transport
 }
 
+// ListenAndServe listens on Addr (default 127.0.0.1:18080) and serves until
+// ctx is done.
 func (s *Server) ListenAndServe(ctx context.Context) error {
 	if s.Addr == "" {
 		s.Addr = "127.0.0.1:18080"
 	}
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve serves proxy clients on ln until ctx is done, then closes ln.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
 	if s.Logger == nil {
 		s.Logger = log.New(io.Discard, "", 0)
 	}
 	if s.Manager == nil {
+		_ = ln.Close()
 		return errors.New("httpproxy: Manager is nil")
 	}
-	if s.transports == nil {
-		s.transports = make(map[string]*http.Transport, 16)
-	}
-
-	ln, err := net.Listen("tcp", s.Addr)
-	if err != nil {
-		return err
-	}
 	s.lnMu.Lock()
 	s.ln = ln
 	s.lnMu.Unlock()
@@ -66,7 +88,7 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 0,
 	}
-	err = srv.Serve(ln)
+	err := srv.Serve(ln)
 	if errors.Is(err, net.ErrClosed) || errors.Is(err, http.ErrServerClosed) {
 		return nil
 	}
@@ -108,6 +130,42 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	s.handleForwardHTTP(w, r)
 }
 
+const (
+	// HeaderNode pins a request to the pool node with this ip:port.
+	HeaderNode = "X-LiteProxy-Node"
+	// HeaderCountry routes a request through a pool node in this country.
+	HeaderCountry = "X-LiteProxy-Country"
+)
+
+// selectNode picks the upstream for r. Selection headers are consumed and
+// removed so they never reach the target; pinned reports whether one applied.
+func (s *Server) selectNode(r *http.Request) (node logic.ProxyNode, pinned bool, ok bool, errMsg string) {
+	addr := strings.TrimSpace(r.Header.Get(HeaderNode))
+	country := strings.TrimSpace(r.Header.Get(HeaderCountry))
+	r.Header.Del(HeaderNode)
+	r.Header.Del(HeaderCountry)
+
+	switch {
+	case addr != "":
+		node, ok = s.Manager.Lookup(addr)
+		if !ok {
+			return logic.ProxyNode{}, true, false, "requested node not in pool"
+		}
+		return node, true, true, ""
+	case country != "":
+		node, ok = s.Manager.FindByCountry(country)
+		if !ok {
+			return logic.ProxyNode{}, true, false, "no proxy available for country " + country
+		}
+		return node, true, true, ""
+	}
+	node, ok = s.Manager.CurrentByType(logic.ProxyTypeHTTP)
+	if !ok {
+		return logic.ProxyNode{}, false, false, "no http proxy available"
+	}
+	return node, false, true, ""
+}
+
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	target := strings.TrimSpace(r.Host)
 	if target == "" {
@@ -118,6 +176,10 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "CONNECT target must be host:port", http.StatusBadRequest)
 		return
 	}
+	if err := s.checkTarget(target); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), s.effectiveDialTimeout())
 	defer cancel()
@@ -125,17 +187,19 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	var (
 		upConn logic.Conn
 		err    error
-		node   logic.ProxyNode
-		ok     bool
 	)
-	for attempt := 0; attempt < 3; attempt++ {
-		node, ok = s.Manager.CurrentByType(logic.ProxyTypeHTTP)
+	retry := s.retryPolicy()
+	for attempt := 0; attempt < retry.Attempts(); attempt++ {
+		if werr := retry.Wait(ctx, attempt); werr != nil {
+			break
+		}
+		node, pinned, ok, msg := s.selectNode(r)
 		if !ok {
-			http.Error(w, "no http proxy available", http.StatusServiceUnavailable)
+			http.Error(w, msg, http.StatusServiceUnavailable)
 			return
 		}
-		upConn, err = logic.DialViaProxy(ctx, node, "tcp", target, s.effectiveDialTimeout())
-		if err == nil {
+		upConn, err = logic.DialViaProxy(ctx, node, "tcp", target, retry.Timeout(s.effectiveDialTimeout()))
+		if err == nil || pinned || !retry.Retryable(err) {
 			break
 		}
 		_, _ = s.Manager.NextByType(logic.ProxyTypeHTTP)
@@ -180,46 +244,121 @@ func (s *Server) handleForwardHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "only http scheme supported (https requires CONNECT)", http.StatusBadRequest)
 		return
 	}
+	if err := s.checkTarget(hostPort(targetURL)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if s.MaxRequestBytes > 0 && r.ContentLength > s.MaxRequestBytes {
+		s.Logger.Printf("httpproxy: request body of %d bytes to %s exceeds %d", r.ContentLength, targetURL.Host, s.MaxRequestBytes)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Read the selection headers before they are stripped from the clone.
+	node, pinned, ok, msg := s.selectNode(r)
+	if !ok {
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
 
 	outReq := r.Clone(r.Context())
 	outReq.RequestURI = ""
 	outReq.URL = targetURL
 	outReq.Host = targetURL.Host
 	removeHopByHopHeaders(outReq.Header)
+	s.Headers.apply(outReq.Header)
+	if s.MaxRequestBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+		// Catches chunked bodies that declared no length.
+		outReq.Body = http.MaxBytesReader(w, r.Body, s.MaxRequestBytes)
+	}
 
 	canRetry := r.Method == http.MethodGet || r.Method == http.MethodHead
 	var (
 		resp *http.Response
 		roundTripErr  error
-		node logic.ProxyNode
-		ok   bool
 	)
-	for attempt := 0; attempt < 3; attempt++ {
-		node, ok = s.Manager.CurrentByType(logic.ProxyTypeHTTP)
-		if !ok {
-			http.Error(w, "no http proxy available", http.StatusServiceUnavailable)
-			return
+	retry := s.retryPolicy()
+	for attempt := 0; attempt < retry.Attempts(); attempt++ {
+		if attempt > 0 {
+			if werr := retry.Wait(r.Context(), attempt); werr != nil {
+				break
+			}
+			node, ok = s.Manager.CurrentByType(logic.ProxyTypeHTTP)
+			if !ok {
+				http.Error(w, "no http proxy available", http.StatusServiceUnavailable)
+				return
+			}
 		}
 		tr := s.transportFor(node)
 		resp, roundTripErr = tr.RoundTrip(outReq)
 		if roundTripErr == nil {
 			break
 		}
-		if !canRetry {
+		if !canRetry || pinned || !retry.Retryable(roundTripErr) {
 			break
 		}
 		_, _ = s.Manager.NextByType(logic.ProxyTypeHTTP)
 	}
 	if roundTripErr != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(roundTripErr, &tooLarge) {
+			s.Logger.Printf("httpproxy: request body to %s exceeds %d bytes", targetURL.Host, tooLarge.Limit)
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, roundTripErr.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	limit := s.MaxResponseBytes
+	if limit > 0 && resp.ContentLength > limit {
+		s.Logger.Printf("httpproxy: response of %d bytes from %s exceeds %d", resp.ContentLength, targetURL.Host, limit)
+		http.Error(w, "upstream response too large", http.StatusBadGateway)
+		return
+	}
+
 	removeHopByHopHeaders(resp.Header)
 	copyHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	if limit <= 0 {
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+	n, _ := io.Copy(w, io.LimitReader(resp.Body, limit))
+	if n == limit {
+		if m, _ := resp.Body.Read(make([]byte, 1)); m > 0 {
+			s.Logger.Printf("httpproxy: response from %s truncated at %d bytes", targetURL.Host, limit)
+		}
+	}
+}
+
+func (s *Server) checkTarget(addr string) error {
+	if err := s.Targets.Check(addr); err != nil {
+		return err
+	}
+	return s.Self.Check(addr)
+}
+
+// hostPort is u's host with the scheme's default port when it names none.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (s *Server) retryPolicy() logic.RetryPolicy {
+	p := s.Retry
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = logic.DefaultRetryAttempts
+	}
+	return p
 }
 
 func (s *Server) effectiveDialTimeout() time.Duration {
@@ -237,28 +376,47 @@ func (s *Server) transportFor(node logic.ProxyNode) *http.Transport {
 	if tr, ok := s.transports[key]; ok {
 		return tr
 	}
-
-	proxyURL := &url.URL{
-		Scheme: "http",
-		Host:   node.Addr(),
-	}
-	if node.User != "" || node.Pass != "" {
-		proxyURL.User = url.UserPassword(node.User, node.Pass)
+	if s.transports == nil {
+		s.transports = make(map[string]*http.Transport, 16)
 	}
 
 	timeout := s.effectiveDialTimeout()
+	keepAlive := s.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = 30 * time.Second
+	}
+	idleTimeout := s.IdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 90 * time.Second
+	}
 	tr := &http.Transport{
-		Proxy: http.ProxyURL(proxyURL),
 		DialContext: (&net.Dialer{
 			Timeout:   timeout,
-			KeepAlive: 30 * time.Second,
+			KeepAlive: keepAlive,
+			Control:   logic.DialControl(),
 		}).DialContext,
 		ForceAttemptHTTP2:     false,
 		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
+		IdleConnTimeout:       idleTimeout,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
+	if node.Type == logic.ProxyTypeHTTP {
+		proxyURL := &url.URL{
+			Scheme: "http",
+			Host:   node.Addr(),
+		}
+		if node.User != "" || node.Pass != "" {
+			proxyURL.User = url.UserPassword(node.User, node.Pass)
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	} else {
+		// Nodes picked with HeaderNode may speak another protocol: tunnel
+		// to the target through them instead.
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return logic.DialViaProxy(ctx, node, network, addr, timeout)
+		}
+	}
 
 	s.transports[key] = tr
 	return tr
@@ -321,12 +479,12 @@ func pipe(a, b net.Conn) {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(b, a)
+		_, _ = logic.CopyBuffered(b, a)
 		_ = b.SetDeadline(time.Now())
 	}()
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(a, b)
+		_, _ = logic.CopyBuffered(a, b)
 		_ = a.SetDeadline(time.Now())
 	}()
 	wg.Wait()
@@ -0,0 +1,193 @@
+package httpproxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lite-proxy/logic"
+)
+
+// upstream is a plain-HTTP proxy that answers every request itself,
+// recording the last one.
+func upstream(t *testing.T) (logic.ProxyNode, *http.Request) {
+	t.Helper()
+	got := new(http.Request)
+	node := upstreamFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		*got = *r.Clone(r.Context())
+		w.Header().Set("X-Upstream", "yes")
+		_, _ = w.Write([]byte("ok"))
+	})
+	return node, got
+}
+
+// upstreamFunc is a plain-HTTP proxy answering every request with h.
+func upstreamFunc(t *testing.T, h http.HandlerFunc) logic.ProxyNode {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	return logic.ProxyNode{Type: logic.ProxyTypeHTTP, IP: host, Port: port, Country: "DE"}
+}
+
+func TestForwardHTTP(t *testing.T) {
+	up, got := upstream(t)
+	m := logic.NewProxyManager()
+	m.SetPool([]logic.ProxyNode{up})
+	targets, err := logic.NewTargetPolicy(nil, []string{"blocked.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Manager: m, Targets: targets, Headers: HeaderRules{Strip: []string{"Referer"}}}
+
+	tests := []struct {
+		name   string
+		url    string
+		header map[string]string
+		want   int
+	}{
+		{"default selection", "http://example.com/a?b=1", nil, http.StatusOK},
+		{"pinned node", "http://example.com/", map[string]string{HeaderNode: up.Addr()}, http.StatusOK},
+		{"pinned by country", "http://example.com/", map[string]string{HeaderCountry: "de"}, http.StatusOK},
+		{"unknown node", "http://example.com/", map[string]string{HeaderNode: "192.0.2.1:1"}, http.StatusServiceUnavailable},
+		{"unknown country", "http://example.com/", map[string]string{HeaderCountry: "FR"}, http.StatusServiceUnavailable},
+		{"blocked target", "http://blocked.example/", nil, http.StatusForbidden},
+		{"https without CONNECT", "https://example.com/", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*got = http.Request{}
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			req.Header.Set("Referer", "http://secret.example/")
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			s.serveHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Body, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				if got.URL != nil {
+					t.Error("the request reached the upstream")
+				}
+				return
+			}
+			if rec.Header().Get("X-Upstream") != "yes" || rec.Body.String() != "ok" {
+				t.Errorf("response not relayed: %v %q", rec.Header(), rec.Body)
+			}
+			if got.URL.String() != tt.url {
+				t.Errorf("upstream saw %s, want %s", got.URL, tt.url)
+			}
+			for _, h := range []string{HeaderNode, HeaderCountry, "Referer"} {
+				if v := got.Header.Get(h); v != "" {
+					t.Errorf("upstream saw %s: %s", h, v)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardHTTPNeedsAnHTTPNode(t *testing.T) {
+	m := logic.NewProxyManager()
+	m.SetPool([]logic.ProxyNode{{Type: logic.ProxyTypeSOCKS5, IP: "192.0.2.1", Port: "1080"}})
+	s := &Server{Manager: m}
+	rec := httptest.NewRecorder()
+	s.serveHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	for in, want := range map[string]string{
+		"http://example.com/":      "example.com:80",
+		"https://example.com/":     "example.com:443",
+		"http://example.com:8080/": "example.com:8080",
+		"http://[2001:db8::1]/":    "[2001:db8::1]:80",
+	} {
+		req := httptest.NewRequest(http.MethodGet, in, nil)
+		if got := hostPort(req.URL); got != want {
+			t.Errorf("hostPort(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestForwardHTTPSizeCaps(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	up := upstreamFunc(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/chunked" {
+			w.(http.Flusher).Flush() // no Content-Length
+		}
+		_, _ = io.WriteString(w, body)
+	})
+	m := logic.NewProxyManager()
+	m.SetPool([]logic.ProxyNode{up})
+	s := &Server{Manager: m, Logger: log.New(io.Discard, "", 0), MaxResponseBytes: 10, MaxRequestBytes: 10}
+
+	tests := []struct {
+		name     string
+		path     string
+		reqBody  string
+		wantCode int
+		wantBody string
+	}{
+		{"declared response too large", "/", "", http.StatusBadGateway, ""},
+		{"streamed response cut off", "/chunked", "", http.StatusOK, body[:10]},
+		{"request body too large", "/", strings.Repeat("y", 11), http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rb io.Reader
+			if tt.reqBody != "" {
+				rb = strings.NewReader(tt.reqBody)
+			}
+			rec := httptest.NewRecorder()
+			s.serveHTTP(rec, httptest.NewRequest(http.MethodPost, "http://example.com"+tt.path, rb))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Body, tt.wantCode)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRefuseSelfTargets(t *testing.T) {
+	up, got := upstream(t)
+	m := logic.NewProxyManager()
+	m.SetPool([]logic.ProxyNode{up})
+	self, err := logic.NewSelfGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self.SetListeners([]string{"0.0.0.0:18080", "[::1]:1080"})
+	s := &Server{Manager: m, Self: self}
+
+	for _, tt := range []struct {
+		method, target string
+	}{
+		{http.MethodGet, "http://127.0.0.1:18080/"},
+		{http.MethodGet, "http://localhost:18080/"},
+		{http.MethodGet, "http://[::1]:1080/"},
+		{http.MethodConnect, "127.0.0.1:18080"},
+		{http.MethodConnect, "[::1]:1080"},
+	} {
+		*got = http.Request{}
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		rec := httptest.NewRecorder()
+		s.serveHTTP(rec, req)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "own listeners") {
+			t.Errorf("%s %s = %d %q, want 403 naming the loop", tt.method, tt.target, rec.Code, rec.Body)
+		}
+		if got.URL != nil {
+			t.Errorf("%s %s reached the upstream", tt.method, tt.target)
+		}
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const unixScheme = "unix://"
+
+// splitListenAddr maps a listen address to a net.Listen network and address.
+// "unix:///path/to.sock" selects a Unix domain socket; anything else is TCP.
+func splitListenAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return "unix", strings.TrimPrefix(addr, unixScheme)
+	}
+	return "tcp", addr
+}
+
+// listenOff reports whether addr turns its listener off: "off" or "none".
+func listenOff(addr string) bool {
+	return strings.EqualFold(addr, "off") || strings.EqualFold(addr, "none")
+}
+
+// errListenerOff is returned when enabling a listener turned off in the config.
+var errListenerOff = errors.New("listener is turned off in the config")
+
+func listenNetwork(addr string) string {
+	network, _ := splitListenAddr(addr)
+	return network
+}
+
+// listenConflict reports whether two listen addresses would collide: the same
+// unix socket path, or the same TCP port on the same or a wildcard host.
+// Port 0 never conflicts since the kernel picks a free port.
+func listenConflict(a, b string) bool {
+	if listenOff(a) || listenOff(b) {
+		return false
+	}
+	netA, addrA := splitListenAddr(a)
+	netB, addrB := splitListenAddr(b)
+	if netA != netB {
+		return false
+	}
+	if netA == "unix" {
+		return filepath.Clean(addrA) == filepath.Clean(addrB)
+	}
+	hostA, portA, errA := net.SplitHostPort(addrA)
+	hostB, portB, errB := net.SplitHostPort(addrB)
+	if errA != nil || errB != nil {
+		return addrA == addrB
+	}
+	if portA != portB || portA == "0" {
+		return false
+	}
+	wildcard := func(h string) bool { return h == "" || h == "0.0.0.0" || h == "::" }
+	hostA, hostB = canonicalListenHost(hostA), canonicalListenHost(hostB)
+	return hostA == hostB || wildcard(hostA) || wildcard(hostB)
+}
+
+// canonicalListenHost spells equal hosts alike: "localhost" as 127.0.0.1,
+// IPv4-mapped IPv6 as IPv4 and other IPs in their shortest form. Other names
+// are compared case-insensitively.
+func canonicalListenHost(h string) string {
+	if strings.EqualFold(h, "localhost") {
+		return "127.0.0.1"
+	}
+	if ip, err := netip.ParseAddr(h); err == nil {
+		return ip.Unmap().String()
+	}
+	return strings.ToLower(h)
+}
+
+// advertiseAddr returns the address to tell clients for a listener on
+// listen, bound at bound (nil when not bound): advertise when set, else the
+// bound address, with a wildcard host ("", 0.0.0.0, ::) replaced by
+// primary's pick for that family. An unset primary keeps the wildcard. It
+// returns "" for a listener that is off.
+func advertiseAddr(listen, advertise string, bound net.Addr, primary func(v6 bool) netip.Addr) string {
+	if advertise != "" {
+		return advertise
+	}
+	if listenOff(listen) {
+		return ""
+	}
+	addr := listen
+	if bound != nil {
+		addr = bound.String()
+	}
+	if network, _ := splitListenAddr(listen); network == "unix" {
+		return listen
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || primary == nil {
+		return addr
+	}
+	wild, err := netip.ParseAddr(host)
+	if host != "" && (err != nil || !wild.IsUnspecified()) {
+		return addr
+	}
+	// A listener on "::" takes IPv4 too, which is what most clients use.
+	ip := primary(false)
+	if !ip.IsValid() && (host == "" || wild.Is6()) {
+		ip = primary(true)
+	}
+	if !ip.IsValid() {
+		return addr
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// primaryIP returns the address of the interface holding the default route
+// for the family, or else the first global unicast interface address. No
+// packet is sent: a UDP "dial" only picks the source address.
+func primaryIP(v6 bool) netip.Addr {
+	network, probe := "udp4", "192.0.2.1:9"
+	if v6 {
+		network, probe = "udp6", "[2001:db8::1]:9"
+	}
+	if c, err := net.Dial(network, probe); err == nil {
+		ap, perr := netip.ParseAddrPort(c.LocalAddr().String())
+		_ = c.Close()
+		if ip := ap.Addr().Unmap(); perr == nil && ip.IsGlobalUnicast() {
+			return ip
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return netip.Addr{}
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(n.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		if ip.Is6() == v6 && ip.IsGlobalUnicast() && !ip.IsLoopback() {
+			return ip
+		}
+	}
+	return netip.Addr{}
+}
+
+// parseSocketMode parses an octal permission string such as "0660".
+func parseSocketMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0o777 {
+		return 0, fmt.Errorf("invalid unix_socket_mode %q", s)
+	}
+	return os.FileMode(v), nil
+}
+
+// listen opens addr. For Unix sockets a stale socket file is removed first,
+// mode (when non-zero) is applied, and the returned cleanup removes the file.
+func listen(addr string, mode os.FileMode) (net.Listener, func(), error) {
+	network, address := splitListenAddr(addr)
+	if network != "unix" {
+		ln, err := net.Listen(network, address)
+		return ln, func() {}, err
+	}
+	if address == "" {
+		return nil, nil, fmt.Errorf("empty unix socket path in %q", addr)
+	}
+	if fi, err := os.Lstat(address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, nil, fmt.Errorf("%s exists and is not a socket", address)
+		}
+		if err := os.Remove(address); err != nil {
+			return nil, nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	ln, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The listener removes the file on Close; this is a fallback.
+	cleanup := func() { _ = os.Remove(address) }
+	if mode != 0 {
+		if err := os.Chmod(address, mode); err != nil {
+			_ = ln.Close()
+			cleanup()
+			return nil, nil, fmt.Errorf("chmod %s: %w", address, err)
+		}
+	}
+	return ln, cleanup, nil
+}
+
+// Connection limit modes, see limitListener.
+const (
+	connLimitQueue  = "queue"
+	connLimitReject = "reject"
+)
+
+// connQueueWait is how long a connection over the cap waits for a slot in
+// queue mode before it is rejected.
+const connQueueWait = 3 * time.Second
+
+// connLimit counts open connections against an optional cap and logs a
+// warning when usage crosses 80% of it. A nil *connLimit neither counts nor
+// limits.
+type connLimit struct {
+	name   string
+	max    int
+	sem    chan struct{}
+	logger *log.Logger
+
+	active   atomic.Int64
+	queued   atomic.Int64
+	rejected atomic.Int64
+	warned   atomic.Bool
+}
+
+// connLimitStats is the usage of a connLimit; Max 0 means unlimited.
+// Queued counts connections that had to wait for a slot, whether they got
+// one or were rejected after all.
+type connLimitStats struct {
+	Active   int64 `json:"active"`
+	Max      int   `json:"max"`
+	Queued   int64 `json:"queued"`
+	Rejected int64 `json:"rejected"`
+}
+
+func newConnLimit(name string, max int, logger *log.Logger) *connLimit {
+	l := &connLimit{name: name, max: max, logger: logger}
+	if max > 0 {
+		l.sem = make(chan struct{}, max)
+	}
+	return l
+}
+
+// tryAcquire takes a slot if one is free and counts a rejection otherwise.
+func (l *connLimit) tryAcquire() bool {
+	return l.acquire(0, nil)
+}
+
+// acquire takes a slot, waiting up to wait for one when none is free: such
+// a connection is counted as queued, and as rejected if the wait runs out.
+// A closed done gives up without counting a rejection.
+func (l *connLimit) acquire(wait time.Duration, done <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			if wait <= 0 {
+				l.rejected.Add(1)
+				return false
+			}
+			l.queued.Add(1)
+			t := time.NewTimer(wait)
+			defer t.Stop()
+			select {
+			case l.sem <- struct{}{}:
+			case <-t.C:
+				l.rejected.Add(1)
+				return false
+			case <-done:
+				return false
+			}
+		}
+	}
+	l.opened()
+	return true
+}
+
+func (l *connLimit) opened() {
+	if l == nil {
+		return
+	}
+	n := l.active.Add(1)
+	if l.max > 0 && n*5 >= int64(l.max)*4 && l.warned.CompareAndSwap(false, true) {
+		l.logger.Printf("warning: %s connections at %d of %d", l.name, n, l.max)
+	}
+}
+
+func (l *connLimit) release() {
+	if l == nil {
+		return
+	}
+	n := l.active.Add(-1)
+	if l.sem != nil {
+		<-l.sem
+	}
+	// Re-arm the warning once usage has clearly dropped.
+	if n*10 < int64(l.max)*7 {
+		l.warned.Store(false)
+	}
+}
+
+func (l *connLimit) Stats() connLimitStats {
+	if l == nil {
+		return connLimitStats{}
+	}
+	return connLimitStats{Active: l.active.Load(), Max: l.max, Queued: l.queued.Load(), Rejected: l.rejected.Load()}
+}
+
+// limitListener applies connection limits (typically the listener's own and
+// the global one) to accepted connections. A connection over a limit waits
+// up to wait for a slot, holding up Accept so later clients stay in the
+// kernel backlog, and is closed and counted as rejected if none frees up;
+// with a zero wait it is rejected at once.
+type limitListener struct {
+	net.Listener
+	limits []*connLimit
+	wait   time.Duration
+	done   chan struct{}
+	once   sync.Once
+}
+
+func limitConnections(ln net.Listener, wait time.Duration, limits ...*connLimit) net.Listener {
+	return &limitListener{Listener: ln, limits: limits, wait: wait, done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		i := 0
+		for i < len(l.limits) {
+			if !l.limits[i].acquire(l.wait, l.done) {
+				break
+			}
+			i++
+		}
+		if i < len(l.limits) {
+			l.release(l.limits[:i])
+			_ = c.Close()
+			select {
+			case <-l.done:
+				return nil, net.ErrClosed
+			default:
+			}
+			continue
+		}
+		return &limitConn{Conn: c, release: func() { l.release(l.limits) }}, nil
+	}
+}
+
+func (l *limitListener) release(limits []*connLimit) {
+	for _, lim := range limits {
+		lim.release()
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func (c *limitConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// bindTarget is one listener startup binds before serving any of them.
+type bindTarget struct {
+	bind   func() error
+	unbind func()
+}
+
+// bindAll binds every target, collecting all errors rather than stopping at
+// the first. When any fails, the targets that did bind are unbound again, so
+// startup holds either every address or none of them.
+func bindAll(targets []bindTarget) error {
+	var errs []error
+	var bound []bindTarget
+	for _, t := range targets {
+		if err := t.bind(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		bound = append(bound, t)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, t := range bound {
+		t.unbind()
+	}
+	return errors.Join(errs...)
+}
+
+// switchListener is a listener that can be closed and reopened at runtime.
+// Disable stops accepting new connections; open ones are left to finish.
+type switchListener struct {
+	name   string
+	addr   string
+	mode   os.FileMode
+	wrap   func(net.Listener) net.Listener
+	serve  func(net.Listener) error
+	logger *log.Logger
+	// fail is called when serve stops for a reason other than Disable.
+	fail func()
+
+	mu      sync.Mutex
+	ln      net.Listener
+	cleanup func()
+	serving bool
+}
+
+// Bind opens the listener without serving it yet, so startup can bind every
+// listener before serving any. It is a no-op when already bound.
+func (l *switchListener) Bind() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bindLocked()
+}
+
+func (l *switchListener) bindLocked() error {
+	if listenOff(l.addr) {
+		return errListenerOff
+	}
+	if l.ln != nil {
+		return nil
+	}
+	ln, cleanup, err := listen(l.addr, l.mode)
+	if err != nil {
+		return fmt.Errorf("listen %s %s: %w", l.name, l.addr, err)
+	}
+	if l.wrap != nil {
+		ln = l.wrap(ln)
+	}
+	l.ln, l.cleanup = ln, cleanup
+	return nil
+}
+
+// Enable binds the listener if needed and starts serving; it is a no-op when
+// enabled.
+func (l *switchListener) Enable() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.bindLocked(); err != nil {
+		return err
+	}
+	if l.serving {
+		return nil
+	}
+	l.serveLocked()
+	return nil
+}
+
+func (l *switchListener) serveLocked() {
+	l.serving = true
+	ln := l.ln
+	go func() {
+		l.logger.Printf("%s listening on %s", l.name, ln.Addr())
+		if err := l.serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+			l.logger.Printf("%s server error: %v", l.name, err)
+			if l.fail != nil {
+				l.fail()
+			}
+		}
+	}()
+}
+
+// Disable closes the listener; it is a no-op when disabled.
+func (l *switchListener) Disable() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.disableLocked()
+}
+
+func (l *switchListener) disableLocked() {
+	if l.ln == nil {
+		return
+	}
+	addr := l.ln.Addr()
+	_ = l.ln.Close()
+	l.cleanup()
+	l.ln, l.cleanup, l.serving = nil, nil, false
+	l.logger.Printf("%s stopped accepting on %s", l.name, addr)
+}
+
+// Move switches the listener to addr. A bound listener binds addr before
+// closing the old address, so a failed bind leaves it as it was, and keeps
+// serving if it was; a listener that was off comes up serving. "off" closes
+// it for good.
+func (l *switchListener) Move(addr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if addr == l.addr {
+		return nil
+	}
+	if listenOff(addr) {
+		l.disableLocked()
+		l.addr = addr
+		return nil
+	}
+	serve := l.serving || listenOff(l.addr)
+	if l.ln == nil && !serve {
+		// Disabled at runtime: it binds addr once enabled.
+		l.addr = addr
+		return nil
+	}
+	ln, cleanup, err := listen(addr, l.mode)
+	if err != nil {
+		return fmt.Errorf("listen %s %s: %w", l.name, addr, err)
+	}
+	if l.wrap != nil {
+		ln = l.wrap(ln)
+	}
+	l.disableLocked()
+	l.addr = addr
+	l.ln, l.cleanup = ln, cleanup
+	if serve {
+		l.serveLocked()
+	}
+	return nil
+}
+
+// ListenAddr returns the configured listen address.
+func (l *switchListener) ListenAddr() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.addr
+}
+
+// Network returns the network of the configured listen address.
+func (l *switchListener) Network() string {
+	return listenNetwork(l.ListenAddr())
+}
+
+// Addr returns the bound address, or nil when disabled.
+func (l *switchListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ln == nil {
+		return nil
+	}
+	return l.ln.Addr()
+}
+
+// Off reports whether the config turned the listener off (see listenOff).
+func (l *switchListener) Off() bool { return listenOff(l.ListenAddr()) }
+
+func (l *switchListener) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.serving
+}
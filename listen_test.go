@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"lite-proxy/logic"
+)
+
+// acceptAll accepts from ln until it is closed, sending each connection on.
+func acceptAll(ln net.Listener) <-chan net.Conn {
+	out := make(chan net.Conn, 16)
+	go func() {
+		defer close(out)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			out <- c
+		}
+	}()
+	return out
+}
+
+func dialN(t *testing.T, addr string, n int) []net.Conn {
+	t.Helper()
+	conns := make([]net.Conn, n)
+	for i := range conns {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		conns[i] = c
+	}
+	return conns
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLimitConnectionsReject(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	own := newConnLimit("http proxy", 2, logger)
+	global := newConnLimit("global", 3, logger)
+	other := newConnLimit("web", 0, logger)
+	// The global slot held by another listener counts against this one.
+	if !global.tryAcquire() || !other.tryAcquire() {
+		t.Fatal("tryAcquire failed below the cap")
+	}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := limitConnections(raw, 0, own, global)
+	defer ln.Close()
+	accepted := acceptAll(ln)
+
+	dialN(t, raw.Addr().String(), 4)
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		open = append(open, <-accepted)
+	}
+	waitFor(t, "the rejections", func() bool { return own.Stats().Rejected+global.Stats().Rejected == 2 })
+	if st := own.Stats(); st.Active != 2 {
+		t.Errorf("own Active = %d, want 2", st.Active)
+	}
+	if st := global.Stats(); st.Active != 3 || st.Max != 3 {
+		t.Errorf("global = %+v, want 3 active of 3", st)
+	}
+
+	open[0].Close()
+	open[0].Close() // a second close releases nothing
+	if st := own.Stats(); st.Active != 1 {
+		t.Errorf("own Active after close = %d, want 1", st.Active)
+	}
+	if st := global.Stats(); st.Active != 2 {
+		t.Errorf("global Active after close = %d, want 2", st.Active)
+	}
+	dialN(t, raw.Addr().String(), 1)
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("a connection under the cap was not accepted")
+	}
+}
+
+func TestLimitConnectionsQueue(t *testing.T) {
+	lim := newConnLimit("socks5 (auto)", 1, log.New(io.Discard, "", 0))
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := limitConnections(raw, 5*time.Second, lim)
+	accepted := acceptAll(ln)
+
+	dialN(t, raw.Addr().String(), 2)
+	first := <-accepted
+	waitFor(t, "the second connection to queue", func() bool { return lim.Stats().Queued == 1 })
+	if len(accepted) != 0 {
+		t.Fatal("accepted a second connection over the cap")
+	}
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued connection was not accepted after a close")
+	}
+	if st := lim.Stats(); st.Active != 0 || st.Queued != 1 || st.Rejected != 0 {
+		t.Errorf("Stats() = %+v, want one queued, nothing active or rejected", st)
+	}
+
+	// Close unblocks an Accept waiting for a slot.
+	held := lim.tryAcquire()
+	dialN(t, raw.Addr().String(), 1)
+	waitFor(t, "the third connection to queue", func() bool { return lim.Stats().Queued == 2 })
+	ln.Close()
+	select {
+	case _, ok := <-accepted:
+		if ok {
+			t.Fatal("accepted a connection after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not unblock Accept")
+	}
+	if st := lim.Stats(); st.Rejected != 0 {
+		t.Errorf("Rejected = %d after Close, want 0", st.Rejected)
+	}
+	if held {
+		lim.release()
+	}
+}
+
+// TestLimitConnectionsQueueTimeout checks that a queued connection is
+// rejected once no slot frees up within the wait.
+func TestLimitConnectionsQueueTimeout(t *testing.T) {
+	lim := newConnLimit("web", 1, log.New(io.Discard, "", 0))
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := limitConnections(raw, 50*time.Millisecond, lim)
+	defer ln.Close()
+	accepted := acceptAll(ln)
+	if !lim.tryAcquire() {
+		t.Fatal("tryAcquire failed below the cap")
+	}
+
+	c := dialN(t, raw.Addr().String(), 1)[0]
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read from a queued connection = %v, want EOF once it is rejected", err)
+	}
+	if st := lim.Stats(); st.Queued != 1 || st.Rejected != 1 || st.Active != 1 {
+		t.Errorf("Stats() = %+v, want one queued and rejected, the held slot active", st)
+	}
+	if len(accepted) != 0 {
+		t.Error("accepted the rejected connection")
+	}
+
+	lim.release()
+	dialN(t, raw.Addr().String(), 1)
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("a connection under the cap was not accepted")
+	}
+}
+
+func TestValidateListenerMaxConnections(t *testing.T) {
+	for name, ok := range map[string]bool{"fixed": true, "auto": true, "web": true, "http": true, "bogus": false} {
+		c := testConfig(t, func(c *Config) { c.ListenerMaxConnections = map[string]int{name: 10} })
+		if err := c.Validate(); (err == nil) != ok {
+			t.Errorf("listener_max_connections.%s: Validate() = %v", name, err)
+		}
+	}
+}
+
+func TestSplitListenAddr(t *testing.T) {
+	tests := []struct {
+		addr, network, address string
+	}{
+		{"127.0.0.1:1080", "tcp", "127.0.0.1:1080"},
+		{":0", "tcp", ":0"},
+		{"[::1]:1080", "tcp", "[::1]:1080"},
+		{"unix:///run/lite-proxy/socks.sock", "unix", "/run/lite-proxy/socks.sock"},
+		{"unix://relative.sock", "unix", "relative.sock"},
+	}
+	for _, tt := range tests {
+		network, address := splitListenAddr(tt.addr)
+		if network != tt.network || address != tt.address {
+			t.Errorf("splitListenAddr(%q) = %q, %q; want %q, %q", tt.addr, network, address, tt.network, tt.address)
+		}
+	}
+}
+
+// socksUpstream serves SOCKS5 on loopback TCP, dialing targets directly.
+func socksUpstream(t *testing.T) logic.ProxyNode {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &logic.SOCKS5Server{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}}
+	go srv.Serve(ln)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	return logic.ProxyNode{Type: logic.ProxyTypeSOCKS5, IP: host, Port: port}
+}
+
+// echoServer echoes one line per connection.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for c := range acceptAll(ln) {
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	// A stale socket left by a crashed run.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	up := socksUpstream(t)
+	srv := &logic.SOCKS5Server{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return logic.DialViaProxy(ctx, up, network, addr, 5*time.Second)
+	}}
+	l := &switchListener{name: "socks5 (fixed)", addr: unixScheme + path, mode: 0o600, serve: srv.Serve, logger: log.New(io.Discard, "", 0)}
+	if err := l.Enable(); err != nil {
+		t.Fatalf("Enable() over a stale socket: %v", err)
+	}
+	if got := l.Network(); got != "unix" {
+		t.Errorf("Network() = %q, want unix", got)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	dialer, err := proxy.SOCKS5("unix", path, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", echoServer(t))
+	if err != nil {
+		t.Fatalf("SOCKS5 over the unix socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping\n" {
+		t.Fatalf("echo = %q, %v; want ping", buf, err)
+	}
+
+	l.Disable()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after Disable: %v", err)
+	}
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := listen(unixScheme+path, 0); err == nil {
+		t.Fatal("listen over a regular file succeeded")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "keep me" {
+		t.Errorf("the regular file was touched: %q, %v", b, err)
+	}
+}
+
+func TestBindAllOrNothing(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	busy := taken.Addr().String()
+	quiet := log.New(io.Discard, "", 0)
+	newListener := func(name, addr string) *switchListener {
+		return &switchListener{name: name, addr: addr, serve: func(net.Listener) error { return nil }, logger: quiet}
+	}
+	target := func(l *switchListener) bindTarget { return bindTarget{bind: l.Bind, unbind: l.Disable} }
+
+	fixed, auto, web := newListener("socks5 (fixed)", "127.0.0.1:0"), newListener("socks5 (auto)", busy), newListener("web", busy)
+	err = bindAll([]bindTarget{target(fixed), target(auto), target(web)})
+	if err == nil {
+		t.Fatal("bindAll() over a busy port succeeded")
+	}
+	for _, want := range []string{"socks5 (auto) " + busy, "web " + busy} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not name %q", err, want)
+		}
+	}
+	if a := fixed.Addr(); a != nil {
+		t.Errorf("fixed is still bound on %s after a failed startup", a)
+	}
+
+	// An ephemeral port binds, and Addr reports the port it got.
+	fixed2, auto2 := newListener("socks5 (fixed)", "127.0.0.1:0"), newListener("socks5 (auto)", "127.0.0.1:0")
+	if err := bindAll([]bindTarget{target(fixed2), target(auto2)}); err != nil {
+		t.Fatalf("bindAll() = %v", err)
+	}
+	defer fixed2.Disable()
+	defer auto2.Disable()
+	for _, l := range []*switchListener{fixed2, auto2} {
+		if a, ok := l.Addr().(*net.TCPAddr); !ok || a.Port == 0 {
+			t.Errorf("%s bound to %v, want a real port", l.name, l.Addr())
+		}
+		if l.Enabled() {
+			t.Errorf("%s serving before startup enabled it", l.name)
+		}
+	}
+}
+
+func TestSwitchListenerMove(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	l := &switchListener{name: "socks5 (fixed)", addr: "127.0.0.1:0", serve: func(ln net.Listener) error {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return err
+			}
+			c.Close()
+		}
+	}, logger: log.New(io.Discard, "", 0)}
+	if err := l.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Disable()
+	old := l.Addr().String()
+
+	// A failed move leaves the listener serving where it was.
+	if err := l.Move(taken.Addr().String()); err == nil {
+		t.Fatal("Move() onto a busy port succeeded")
+	}
+	if got := l.Addr().String(); got != old || !l.Enabled() || l.ListenAddr() != "127.0.0.1:0" {
+		t.Fatalf("after a failed move: bound on %s, serving %v, addr %q; want %s unchanged", got, l.Enabled(), l.ListenAddr(), old)
+	}
+	dialN(t, old, 1)[0].Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := free.Addr().String()
+	free.Close()
+	if err := l.Move(moved); err != nil {
+		t.Fatalf("Move() = %v", err)
+	}
+	if got := l.Addr().String(); got != moved || !l.Enabled() {
+		t.Fatalf("after a move: bound on %s, serving %v; want %s, serving", got, l.Enabled(), moved)
+	}
+	dialN(t, moved, 1)[0].Close()
+	if c, err := net.DialTimeout("tcp", old, time.Second); err == nil {
+		c.Close()
+		t.Errorf("the old address %s still accepts", old)
+	}
+
+	if err := l.Move("off"); err != nil {
+		t.Fatalf("Move(off) = %v", err)
+	}
+	if l.Addr() != nil || !l.Off() {
+		t.Errorf("after Move(off): bound on %v, off %v", l.Addr(), l.Off())
+	}
+}
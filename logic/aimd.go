@@ -0,0 +1,100 @@
+package logic
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// A window of results with at least aimdDecreaseRate timeouts halves
+	// the limit; one with at most aimdIncreaseRate raises it.
+	aimdDecreaseRate = 0.5
+	aimdIncreaseRate = 0.2
+)
+
+// aimdGate bounds in-flight probes to a limit between min and max that
+// adapts to how many probes time out: each window of limit results raises
+// it additively when few timed out and halves it when most did, since
+// uniform timeouts mean the local network, not the proxies, is saturated.
+// A nil *aimdGate admits everything.
+type aimdGate struct {
+	min, max int
+	step     int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	inflight int
+	window   int
+	timeouts int
+}
+
+// newAIMDGate starts at a quarter of max, but not below min.
+func newAIMDGate(min, max int) *aimdGate {
+	if min <= 0 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	g := &aimdGate{min: min, max: max, step: maxInt(1, max/16)}
+	g.cond = sync.NewCond(&g.mu)
+	g.limit = maxInt(min, max/4)
+	return g
+}
+
+// acquire waits for a free slot. It returns ctx.Err() once ctx is done;
+// the caller must have arranged for wake() to be called then.
+func (g *aimdGate) acquire(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.inflight >= g.limit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		g.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	g.inflight++
+	return nil
+}
+
+// release frees a slot and feeds the probe's outcome into the limit.
+func (g *aimdGate) release(timedOut bool) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight--
+	g.window++
+	if timedOut {
+		g.timeouts++
+	}
+	if g.window >= g.limit {
+		rate := float64(g.timeouts) / float64(g.window)
+		switch {
+		case rate >= aimdDecreaseRate:
+			g.limit = maxInt(g.min, g.limit/2)
+		case rate <= aimdIncreaseRate:
+			g.limit = minInt(g.max, g.limit+g.step)
+		}
+		g.window, g.timeouts = 0, 0
+	}
+	g.cond.Broadcast()
+}
+
+// wake unblocks waiters so they can notice a cancelled context.
+func (g *aimdGate) wake() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cond.Broadcast()
+}
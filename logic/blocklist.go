@@ -0,0 +1,217 @@
+package logic
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBlocklistDuration is how long a repeat offender stays blocklisted.
+const DefaultBlocklistDuration = 24 * time.Hour
+
+const (
+	// maxBlocklistEntries caps the blocklist; a full list evicts the entry
+	// closest to expiry.
+	maxBlocklistEntries = 10_000
+	// maxBlocklistStrikes caps the addresses with failures on record; once
+	// full, new addresses are not counted until others pass or get blocked.
+	maxBlocklistStrikes = 100_000
+)
+
+// BlockEntry is a blocklisted address.
+type BlockEntry struct {
+	Addr    string    `json:"addr"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires_at"`
+}
+
+// BlocklistState is a Blocklist's persistent form.
+type BlocklistState struct {
+	Strikes map[string]int `json:"strikes,omitempty"`
+	Entries []BlockEntry   `json:"entries"`
+}
+
+// Blocklist quarantines repeat offenders: addresses that failed validation
+// in after consecutive refreshes are left out of the candidates for
+// duration. Exempt addresses (static and pinned proxies) are never counted.
+// A nil *Blocklist blocks nothing.
+type Blocklist struct {
+	after    int
+	duration time.Duration
+
+	mu      sync.Mutex
+	strikes map[string]int
+	entries map[string]BlockEntry
+}
+
+// NewBlocklist returns nil when after <= 0.
+func NewBlocklist(after int, duration time.Duration) *Blocklist {
+	if after <= 0 {
+		return nil
+	}
+	if duration <= 0 {
+		duration = DefaultBlocklistDuration
+	}
+	return &Blocklist{
+		after:    after,
+		duration: duration,
+		strikes:  make(map[string]int),
+		entries:  make(map[string]BlockEntry),
+	}
+}
+
+// Filter returns nodes without the blocklisted ones, and how many it left
+// out. Exempt addresses pass even when listed.
+func (b *Blocklist) Filter(nodes []ProxyNode, exempt map[string]struct{}, now time.Time) ([]ProxyNode, int) {
+	if b == nil {
+		return nodes, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireLocked(now)
+	if len(b.entries) == 0 {
+		return nodes, 0
+	}
+	out := nodes[:0:0]
+	for _, n := range nodes {
+		addr := n.Addr()
+		if _, ok := b.entries[addr]; ok {
+			if _, ok := exempt[addr]; !ok {
+				continue
+			}
+		}
+		out = append(out, n)
+	}
+	return out, len(nodes) - len(out)
+}
+
+// Record feeds a refresh's validation outcome: failed addresses earn a
+// strike and are blocklisted at after strikes; passed ones start over.
+// Addresses in neither were not tested and keep their count.
+func (b *Blocklist) Record(failed, passed []string, exempt map[string]struct{}, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireLocked(now)
+	for _, addr := range passed {
+		delete(b.strikes, addr)
+	}
+	for _, addr := range failed {
+		if _, ok := exempt[addr]; ok {
+			continue
+		}
+		if _, ok := b.entries[addr]; ok {
+			continue
+		}
+		s, ok := b.strikes[addr]
+		if !ok && len(b.strikes) >= maxBlocklistStrikes {
+			continue
+		}
+		if s+1 < b.after {
+			b.strikes[addr] = s + 1
+			continue
+		}
+		delete(b.strikes, addr)
+		b.addLocked(BlockEntry{Addr: addr, Since: now, Expires: now.Add(b.duration)})
+	}
+}
+
+func (b *Blocklist) addLocked(e BlockEntry) {
+	if len(b.entries) >= maxBlocklistEntries {
+		var oldest string
+		for addr, o := range b.entries {
+			if oldest == "" || o.Expires.Before(b.entries[oldest].Expires) {
+				oldest = addr
+			}
+		}
+		delete(b.entries, oldest)
+	}
+	b.entries[e.Addr] = e
+}
+
+func (b *Blocklist) expireLocked(now time.Time) {
+	for addr, e := range b.entries {
+		if !now.Before(e.Expires) {
+			delete(b.entries, addr)
+		}
+	}
+}
+
+// Remove unblocks addr and clears its strikes. It reports whether addr was
+// blocklisted.
+func (b *Blocklist) Remove(addr string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.strikes, addr)
+	_, ok := b.entries[addr]
+	delete(b.entries, addr)
+	return ok
+}
+
+// Entries returns the blocklisted addresses, soonest expiry first.
+func (b *Blocklist) Entries(now time.Time) []BlockEntry {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireLocked(now)
+	return b.sortedLocked()
+}
+
+func (b *Blocklist) sortedLocked() []BlockEntry {
+	out := make([]BlockEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Expires.Equal(out[j].Expires) {
+			return out[i].Expires.Before(out[j].Expires)
+		}
+		return out[i].Addr < out[j].Addr
+	})
+	return out
+}
+
+func (b *Blocklist) State() BlocklistState {
+	if b == nil {
+		return BlocklistState{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	strikes := make(map[string]int, len(b.strikes))
+	for addr, s := range b.strikes {
+		strikes[addr] = s
+	}
+	return BlocklistState{Strikes: strikes, Entries: b.sortedLocked()}
+}
+
+// Restore replaces the list with st, dropping entries expired at now.
+// Entries keep their expiry even if the duration changed since.
+func (b *Blocklist) Restore(st BlocklistState, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.strikes = make(map[string]int, len(st.Strikes))
+	for addr, s := range st.Strikes {
+		if len(b.strikes) >= maxBlocklistStrikes {
+			break
+		}
+		if s = min(s, b.after-1); s > 0 {
+			b.strikes[addr] = s
+		}
+	}
+	b.entries = make(map[string]BlockEntry, len(st.Entries))
+	for _, e := range st.Entries {
+		if e.Addr != "" && now.Before(e.Expires) {
+			b.addLocked(e)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package logic
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultPipeBufferSize matches io.Copy's buffer.
+const DefaultPipeBufferSize = 32 << 10
+
+var (
+	pipeBufferSize atomic.Int64
+	pipeBuffers    sync.Pool
+)
+
+// SetPipeBufferSize sets the buffer size CopyBuffered uses for tunnel
+// copies; n <= 0 restores DefaultPipeBufferSize. Buffers of the old size
+// are dropped as they come back to the pool.
+func SetPipeBufferSize(n int) {
+	if n <= 0 {
+		n = DefaultPipeBufferSize
+	}
+	pipeBufferSize.Store(int64(n))
+}
+
+func currentPipeBufferSize() int {
+	if n := pipeBufferSize.Load(); n > 0 {
+		return int(n)
+	}
+	return DefaultPipeBufferSize
+}
+
+// CopyBuffered is io.Copy with a pooled buffer, so many concurrent tunnels
+// don't each allocate (and leave to the GC) their own. As with io.Copy, the
+// buffer is bypassed when src or dst can copy directly, e.g. TCP splicing.
+func CopyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	size := currentPipeBufferSize()
+	bp, _ := pipeBuffers.Get().(*[]byte)
+	if bp == nil || len(*bp) != size {
+		b := make([]byte, size)
+		bp = &b
+	}
+	defer func() {
+		if len(*bp) == currentPipeBufferSize() {
+			pipeBuffers.Put(bp)
+		}
+	}()
+	return io.CopyBuffer(dst, src, *bp)
+}
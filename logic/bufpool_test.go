@@ -0,0 +1,79 @@
+package logic
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// loopbackPair returns the two ends of a fresh loopback TCP connection.
+func loopbackPair(b *testing.B, ln net.Listener) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c, <-accepted
+}
+
+// BenchmarkTunnelCopy copies a payload through one direction of a tunnel,
+// as pipe does, with io.Copy and with CopyBuffered. net.Pipe ends have no
+// ReadFrom/WriteTo, so every copy needs a buffer; loopback TCP splices and
+// skips it either way.
+func BenchmarkTunnelCopy(b *testing.B) {
+	payload := make([]byte, 256<<10)
+	copies := []struct {
+		name string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		{"io.Copy", io.Copy},
+		{"CopyBuffered", CopyBuffered},
+	}
+	for _, transport := range []string{"pipe", "loopback"} {
+		for _, c := range copies {
+			b.Run(transport+"/"+c.name, func(b *testing.B) {
+				newPair := func() (net.Conn, net.Conn) { return net.Pipe() }
+				if transport == "loopback" {
+					ln, err := net.Listen("tcp", "127.0.0.1:0")
+					if err != nil {
+						b.Fatal(err)
+					}
+					defer ln.Close()
+					newPair = func() (net.Conn, net.Conn) { return loopbackPair(b, ln) }
+				}
+				b.SetBytes(int64(len(payload)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					in, src := newPair()
+					dst, out := newPair()
+					go func() {
+						in.Write(payload)
+						in.Close()
+					}()
+					drained := make(chan struct{})
+					go func() {
+						buf := make([]byte, 4<<10)
+						for {
+							if _, err := out.Read(buf); err != nil {
+								break
+							}
+						}
+						close(drained)
+					}()
+					if n, err := c.copy(dst, src); err != nil || n != int64(len(payload)) {
+						b.Fatalf("copied %d bytes, %v", n, err)
+					}
+					dst.Close()
+					<-drained
+					src.Close()
+					out.Close()
+				}
+			})
+		}
+	}
+}
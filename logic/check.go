@@ -1,18 +1,48 @@
 package logic
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
-func CheckSOCKS5TCP(ctx context.Context, node ProxyNode, targetAddr string, timeout time.Duration) (valid bool, latencyMS int64, err error) {
-	if node.Type != ProxyTypeSOCKS5 {
-		return false, 0, fmt.Errorf("unsupported proxy type: %s", node.Type)
+// ProbeTiming is the latency breakdown of a single check. TotalMS covers the
+// whole probe, including the TLS handshake when one is performed.
+type ProbeTiming struct {
+	TotalMS int64 `json:"latency"`
+	DialTiming
+}
+
+// CheckSOCKS5TCP opens a tunnel to targetAddr through node. Despite the
+// name, the checks in this file work for every SupportedProxyType.
+func CheckSOCKS5TCP(ctx context.Context, node ProxyNode, targetAddr string, timeout time.Duration) (valid bool, timing ProbeTiming, err error) {
+	return checkSOCKS5TCP(ctx, node, targetAddr, timeout, false)
+}
+
+// ErrNoResponse is returned by CheckSOCKS5Forwarding when the tunnel opens
+// but nothing comes back through it.
+var ErrNoResponse = errors.New("no response through proxy")
+
+// CheckSOCKS5Forwarding is CheckSOCKS5TCP that also sends an HTTP HEAD
+// request through the tunnel and requires at least one byte back, catching
+// proxies that accept CONNECT but drop the data.
+func CheckSOCKS5Forwarding(ctx context.Context, node ProxyNode, targetAddr string, timeout time.Duration) (valid bool, timing ProbeTiming, err error) {
+	return checkSOCKS5TCP(ctx, node, targetAddr, timeout, true)
+}
+
+func checkSOCKS5TCP(ctx context.Context, node ProxyNode, targetAddr string, timeout time.Duration, probe bool) (valid bool, timing ProbeTiming, err error) {
+	if !SupportedProxyType(node.Type) {
+		return false, timing, fmt.Errorf("unsupported proxy type: %s", node.Type)
 	}
 
 	target := targetAddr
@@ -24,54 +54,194 @@ func CheckSOCKS5TCP(ctx context.Context, node ProxyNode, targetAddr string, time
 	}
 
 	start := time.Now()
-	defer func() { latencyMS = time.Since(start).Milliseconds() }()
+	defer func() { timing.TotalMS = time.Since(start).Milliseconds() }()
 
 	cctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	conn, err := DialViaProxy(cctx, node, "tcp", target, timeout)
+	conn, dt, err := DialViaProxyTimed(cctx, node, "tcp", target, timeout)
+	timing.DialTiming = dt
 	if err != nil {
-		return false, latencyMS, err
+		return false, timing, err
 	}
-	_ = conn.Close()
-	return true, latencyMS, nil
+	defer conn.Close()
+	if probe {
+		if err := expectResponse(cctx, conn, target); err != nil {
+			return false, timing, err
+		}
+	}
+	return true, timing, nil
 }
 
-func CheckSOCKS5TLS(ctx context.Context, node ProxyNode, targetAddr string, timeout time.Duration) (valid bool, latencyMS int64, err error) {
-	if node.Type != ProxyTypeSOCKS5 {
-		return false, 0, fmt.Errorf("unsupported proxy type: %s", node.Type)
+// expectResponse writes a HEAD request for target's host and waits for the
+// first byte of any reply; its content does not matter.
+func expectResponse(ctx context.Context, conn net.Conn, target string) error {
+	host, _, _ := net.SplitHostPort(target)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := io.WriteString(conn, "HEAD / HTTP/1.0\r\nHost: "+host+"\r\n\r\n"); err != nil {
+		return fmt.Errorf("%w: write: %v", ErrNoResponse, err)
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return fmt.Errorf("%w: %v", ErrNoResponse, err)
+	}
+	return nil
+}
+
+// TLSProbeOptions adjusts the handshake of TLS checks. The zero value keeps
+// crypto/tls defaults and the target host name as SNI.
+type TLSProbeOptions struct {
+	// ServerName, when set, is sent as SNI instead of the target host.
+	ServerName string
+	// MinVersion is a tls.VersionTLS* constant; 0 is the library default.
+	MinVersion uint16
+}
+
+// ParseTLSVersion maps "1.0" through "1.3" to their tls.VersionTLS*
+// constants; "" is 0.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q: want 1.0, 1.1, 1.2 or 1.3", s)
+}
+
+func CheckSOCKS5TLS(ctx context.Context, node ProxyNode, targetAddr string, timeout time.Duration) (valid bool, timing ProbeTiming, err error) {
+	return CheckSOCKS5TLSWith(ctx, node, targetAddr, timeout, TLSProbeOptions{})
+}
+
+// CheckSOCKS5TLSWith is CheckSOCKS5TLS with the handshake adjusted by opts.
+func CheckSOCKS5TLSWith(ctx context.Context, node ProxyNode, targetAddr string, timeout time.Duration, opts TLSProbeOptions) (valid bool, timing ProbeTiming, err error) {
+	if !SupportedProxyType(node.Type) {
+		return false, timing, fmt.Errorf("unsupported proxy type: %s", node.Type)
 	}
 
 	addr, serverName, port, err := ParseTargetAddr(targetAddr)
 	if err != nil {
-		return false, 0, err
+		return false, timing, err
 	}
 	if port == "" {
 		port = "443"
 	}
 
 	start := time.Now()
-	defer func() { latencyMS = time.Since(start).Milliseconds() }()
+	defer func() { timing.TotalMS = time.Since(start).Milliseconds() }()
 
 	cctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	conn, err := DialViaProxy(cctx, node, "tcp", addr, timeout)
+	conn, dt, err := DialViaProxyTimed(cctx, node, "tcp", addr, timeout)
+	timing.DialTiming = dt
 	if err != nil {
-		return false, latencyMS, err
+		return false, timing, err
 	}
 	defer conn.Close()
 
+	if opts.ServerName != "" {
+		serverName = opts.ServerName
+	}
 	cfg := &tls.Config{
 		ServerName: serverName,
+		MinVersion: opts.MinVersion,
 	}
 	tlsConn := tls.Client(conn, cfg)
 	_ = tlsConn.SetDeadline(time.Now().Add(timeout))
 	if err := tlsConn.HandshakeContext(cctx); err != nil {
-		return false, latencyMS, err
+		if isTimeout(err) {
+			return false, timing, classifyDialError(node.Addr(), err)
+		}
+		return false, timing, &DialError{Category: DialErrTLS, Proxy: node.Addr(), Err: err}
 	}
 	_ = tlsConn.Close()
-	return true, latencyMS, nil
+	return true, timing, nil
+}
+
+// ErrContentMismatch is returned by CheckSOCKS5Content when the body fetched
+// through the proxy differs from the expected one.
+var ErrContentMismatch = errors.New("content mismatch")
+
+// maxContentCheckBody bounds how much of the response CheckSOCKS5Content hashes.
+const maxContentCheckBody = 1 << 20
+
+// CheckSOCKS5Content GETs rawURL through node and compares the SHA-256 of the
+// body with expectSHA256 (hex). Redirects are not followed, so captive
+// portals fail the check.
+func CheckSOCKS5Content(ctx context.Context, node ProxyNode, rawURL string, expectSHA256 string, timeout time.Duration) error {
+	if rawURL == "" {
+		return errors.New("content check: empty url")
+	}
+	resp, err := getViaProxy(ctx, node, rawURL, timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status %d", ErrContentMismatch, resp.StatusCode)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(resp.Body, maxContentCheckBody)); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != expectSHA256 {
+		return fmt.Errorf("%w: sha256 %s", ErrContentMismatch, got)
+	}
+	return nil
+}
+
+// ErrNoExitIP is returned by CheckExitIP when the lookup URL does not
+// answer with an IP address.
+var ErrNoExitIP = errors.New("no exit ip")
+
+// CheckExitIP fetches rawURL, a "what is my IP" service answering with the
+// bare address (like api.ipify.org), through node and returns that address.
+func CheckExitIP(ctx context.Context, node ProxyNode, rawURL string, timeout time.Duration) (string, error) {
+	resp, err := getViaProxy(ctx, node, rawURL, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: status %d", ErrNoExitIP, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", fmt.Errorf("%w: unexpected body", ErrNoExitIP)
+	}
+	return ip.String(), nil
+}
+
+// getViaProxy GETs rawURL through node without following redirects.
+func getViaProxy(ctx context.Context, node ProxyNode, rawURL string, timeout time.Duration) (*http.Response, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return DialViaProxy(ctx, node, network, addr, timeout)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
 }
 
 func ParseTargetAddr(target string) (addr string, serverName string, port string, err error) {
@@ -116,3 +286,62 @@ func ParseTargetAddr(target string) (addr string, serverName string, port string
 	}
 	return net.JoinHostPort(host, p), host, p, nil
 }
+
+// maxTargetExpansion caps how many targets one ExpandTarget spec may yield.
+const maxTargetExpansion = 1024
+
+// ExpandTarget parses a probe target spec: a single target as accepted by
+// ParseTargetAddr, a port range such as "host:8440-8449", or a
+// comma-separated list of either. Single targets are returned as written;
+// ranges expand to one host:port per port, in order.
+func ExpandTarget(spec string) ([]string, error) {
+	var out []string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, fmt.Errorf("invalid target %q: empty entry", spec)
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil || strings.Contains(entry, "://") || !strings.Contains(port, "-") {
+			if _, _, _, err := ParseTargetAddr(entry); err != nil {
+				return nil, fmt.Errorf("invalid target %q: %w", entry, err)
+			}
+			out = append(out, entry)
+		} else {
+			lo, hi, err := parsePortRange(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %q: %w", entry, err)
+			}
+			if strings.TrimSpace(host) == "" {
+				return nil, fmt.Errorf("invalid target %q: empty host", entry)
+			}
+			if len(out)+hi-lo+1 > maxTargetExpansion {
+				return nil, fmt.Errorf("invalid target %q: expands to more than %d targets", spec, maxTargetExpansion)
+			}
+			for p := lo; p <= hi; p++ {
+				out = append(out, net.JoinHostPort(host, strconv.Itoa(p)))
+			}
+		}
+		if len(out) > maxTargetExpansion {
+			return nil, fmt.Errorf("invalid target %q: expands to more than %d targets", spec, maxTargetExpansion)
+		}
+	}
+	return out, nil
+}
+
+// parsePortRange parses "lo-hi" with 1 <= lo <= hi <= 65535.
+func parsePortRange(s string) (int, int, error) {
+	a, b, _ := strings.Cut(s, "-")
+	lo, err1 := strconv.Atoi(strings.TrimSpace(a))
+	hi, err2 := strconv.Atoi(strings.TrimSpace(b))
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("port range %q is not numeric", s)
+	}
+	if lo < 1 || hi > 65535 {
+		return 0, 0, fmt.Errorf("port range %q is outside 1-65535", s)
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("port range %q is reversed", s)
+	}
+	return lo, hi, nil
+}
@@ -0,0 +1,50 @@
+package logic
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExpandTarget(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []string
+		wantErr string
+	}{
+		// Single targets come back exactly as written.
+		{"example.com:443", []string{"example.com:443"}, ""},
+		{"example.com", []string{"example.com"}, ""},
+		{"https://example.com/health", []string{"https://example.com/health"}, ""},
+		{"[2001:db8::1]:80", []string{"[2001:db8::1]:80"}, ""},
+		{"svc.internal:8440-8443", []string{"svc.internal:8440", "svc.internal:8441", "svc.internal:8442", "svc.internal:8443"}, ""},
+		{"svc.internal:8440-8440", []string{"svc.internal:8440"}, ""},
+		{"[2001:db8::1]:80-81", []string{"[2001:db8::1]:80", "[2001:db8::1]:81"}, ""},
+		{"a.example:80, b.example:81-82", []string{"a.example:80", "b.example:81", "b.example:82"}, ""},
+		{"svc.internal:8449-8440", nil, "reversed"},
+		{"svc.internal:0-10", nil, "outside 1-65535"},
+		{"svc.internal:65535-65536", nil, "outside 1-65535"},
+		{"svc.internal:a-b", nil, "not numeric"},
+		{":8440-8449", nil, "empty host"},
+		{"a.example:80,,b.example:80", nil, "empty entry"},
+		{"svc.internal:1-2000", nil, "more than 1024"},
+		{"a.example:1-1000,b.example:1-1000", nil, "more than 1024"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ExpandTarget(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ExpandTarget(%q) = %v, %v; want error %q", tt.spec, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExpandTarget(%q) = %v", tt.spec, err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("ExpandTarget(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
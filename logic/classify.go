@@ -0,0 +1,262 @@
+package logic
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownProtocol is returned by ClassifyProxy when node answered none of
+// the probes.
+var ErrUnknownProtocol = errors.New("proxy protocol not recognized")
+
+// ClassifyProxy tells which protocol the proxy at node.Addr() speaks by
+// trying, each on a fresh connection, a SOCKS5 greeting, an HTTP CONNECT to
+// target and a SOCKS4a CONNECT to target. Only the reply's framing counts:
+// a SOCKS5 proxy refusing our auth methods or an HTTP proxy answering 407 is
+// still recognized. It returns ProxyTypeSOCKS5, ProxyTypeHTTP or
+// ProxyTypeSOCKS4.
+func ClassifyProxy(ctx context.Context, node ProxyNode, target string, timeout time.Duration) (string, error) {
+	probes := []struct {
+		typ   string
+		probe func(net.Conn) bool
+	}{
+		{ProxyTypeSOCKS5, probeSOCKS5},
+		{ProxyTypeHTTP, func(c net.Conn) bool { return probeHTTPConnect(c, target) }},
+		{ProxyTypeSOCKS4, func(c net.Conn) bool { return probeSOCKS4(c, target) }},
+	}
+	var lastErr error
+	for _, p := range probes {
+		ok, err := classifyProbe(ctx, node.Addr(), timeout, p.probe)
+		if ok {
+			return p.typ, nil
+		}
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+		}
+	}
+	if lastErr != nil {
+		return "", &UpstreamError{Proxy: node.Addr(), Err: lastErr}
+	}
+	return "", ErrUnknownProtocol
+}
+
+// classifyProbe dials addr and runs probe on it. A failed dial is returned
+// as the error; a probe that gets no recognizable reply is not an error.
+func classifyProbe(ctx context.Context, addr string, timeout time.Duration, probe func(net.Conn) bool) (bool, error) {
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := newDialer(timeout).DialContext(cctx, "tcp", addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	deadline, _ := cctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	return probe(conn), nil
+}
+
+func probeSOCKS5(c net.Conn) bool {
+	if _, err := c.Write([]byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}); err != nil {
+		return false
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(c, resp[:]); err != nil {
+		return false
+	}
+	return resp[0] == socks5Version
+}
+
+func probeHTTPConnect(c net.Conn, target string) bool {
+	if _, err := io.WriteString(c, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		return false
+	}
+	line, err := readConnectLine(bufio.NewReader(c))
+	return err == nil && (strings.HasPrefix(line, "HTTP/1.0 ") || strings.HasPrefix(line, "HTTP/1.1 "))
+}
+
+// probeSOCKS4 sends a SOCKS4a CONNECT (IP 0.0.0.1, host name appended) and
+// accepts any well-formed reply code.
+func probeSOCKS4(c net.Conn, target string) bool {
+	host, port, err := splitTarget(target)
+	if err != nil {
+		return false
+	}
+	b := []byte{0x04, 0x01, byte(port >> 8), byte(port), 0, 0, 0, 1, 0}
+	b = append(b, host...)
+	b = append(b, 0)
+	if _, err := c.Write(b); err != nil {
+		return false
+	}
+	var resp [8]byte
+	if _, err := io.ReadFull(c, resp[:]); err != nil {
+		return false
+	}
+	return resp[0] == 0x00 && resp[1] >= 0x5a && resp[1] <= 0x5d
+}
+
+// maxTypeCacheEntries caps a TypeCache; once full, new results are only
+// cached after expired ones make room.
+const maxTypeCacheEntries = 100_000
+
+// TypeCache remembers ClassifyProxy results by address for TTL, so "infer"
+// sources are not re-probed on every refresh. Failed classifications are
+// cached too, as "". A nil *TypeCache caches nothing.
+type TypeCache struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+	m  map[string]typeCacheEntry
+	// oldest is the earliest entry the last prune kept: nothing expires
+	// before oldest+ttl, so a full cache need not be rescanned until then.
+	oldest time.Time
+}
+
+type typeCacheEntry struct {
+	typ string
+	at  time.Time
+}
+
+func NewTypeCache(ttl time.Duration) *TypeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &TypeCache{ttl: ttl, m: make(map[string]typeCacheEntry)}
+}
+
+func (c *TypeCache) get(addr string, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[addr]
+	if !ok || now.Sub(e.at) > c.ttl {
+		return "", false
+	}
+	return e.typ, true
+}
+
+func (c *TypeCache) put(addr, typ string, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.m[addr]; !ok && len(c.m) >= maxTypeCacheEntries {
+		if c.oldest.IsZero() || now.Sub(c.oldest) > c.ttl {
+			c.pruneLocked(now)
+		}
+		if len(c.m) >= maxTypeCacheEntries {
+			return
+		}
+	}
+	c.m[addr] = typeCacheEntry{typ: typ, at: now}
+}
+
+func (c *TypeCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
+
+// prune drops expired entries.
+func (c *TypeCache) prune(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(now)
+}
+
+func (c *TypeCache) pruneLocked(now time.Time) {
+	var oldest time.Time
+	for addr, e := range c.m {
+		if now.Sub(e.at) > c.ttl {
+			delete(c.m, addr)
+		} else if oldest.IsZero() || e.at.Before(oldest) {
+			oldest = e.at
+		}
+	}
+	c.oldest = oldest
+}
+
+// inferProbeTimeout bounds each ClassifyProxy probe.
+const inferProbeTimeout = 3 * time.Second
+
+// inferTypes replaces ProxyTypeInfer on nodes with the detected type,
+// classifying up to concurrency nodes at a time. Nodes that cannot be
+// classified, or speak a protocol we cannot dial, are dropped. It returns
+// the kept nodes and the count per detected type ("unknown" for failures).
+func inferTypes(ctx context.Context, nodes []ProxyNode, cache *TypeCache, target string, concurrency int, timeout time.Duration) ([]ProxyNode, map[string]int) {
+	if timeout <= 0 || timeout > inferProbeTimeout {
+		timeout = inferProbeTimeout
+	}
+	if concurrency <= 0 {
+		concurrency = 32
+	}
+	if addr, _, _, err := ParseTargetAddr(target); err == nil {
+		target = addr
+	}
+	now := time.Now()
+	cache.prune(now)
+
+	types := make([]string, len(nodes))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		if n.Type != ProxyTypeInfer {
+			continue
+		}
+		if typ, ok := cache.get(n.Addr(), now); ok {
+			types[i] = typ
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, n ProxyNode) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			typ, err := ClassifyProxy(ctx, n, target, timeout)
+			if err != nil && ctx.Err() != nil {
+				// Cancelled: don't cache the non-answer.
+				return
+			}
+			types[i] = typ
+			cache.put(n.Addr(), typ, now)
+		}(i, n)
+	}
+	wg.Wait()
+
+	counts := make(map[string]int)
+	out := nodes[:0:0]
+	for i, n := range nodes {
+		if n.Type != ProxyTypeInfer {
+			out = append(out, n)
+			continue
+		}
+		typ := types[i]
+		if typ == "" {
+			counts["unknown"]++
+			continue
+		}
+		counts[typ]++
+		if SupportedProxyType(typ) {
+			n.Type = typ
+			out = append(out, n)
+		}
+	}
+	return out, counts
+}
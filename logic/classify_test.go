@@ -0,0 +1,162 @@
+package logic
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// protoServer answers every connection with handle and returns its node,
+// typed for inference.
+func protoServer(t *testing.T, handle func(c net.Conn, r *bufio.Reader)) ProxyNode {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+				handle(c, bufio.NewReader(c))
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	return ProxyNode{Type: ProxyTypeInfer, IP: host, Port: port}
+}
+
+// Each fake hangs up on a first byte that is not its protocol's, as real
+// servers do on garbage.
+func socks5Speaker(t *testing.T) ProxyNode {
+	return protoServer(t, func(c net.Conn, r *bufio.Reader) {
+		if b, err := r.Peek(1); err == nil && b[0] == socks5Version {
+			c.Write([]byte{socks5Version, 0xff}) // no acceptable methods
+		}
+	})
+}
+
+func httpSpeaker(t *testing.T) ProxyNode {
+	return protoServer(t, func(c net.Conn, r *bufio.Reader) {
+		if b, err := r.Peek(1); err == nil && b[0] == 'C' {
+			r.ReadString('\n')
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		}
+	})
+}
+
+func socks4Speaker(t *testing.T) ProxyNode {
+	return protoServer(t, func(c net.Conn, r *bufio.Reader) {
+		if b, err := r.Peek(1); err == nil && b[0] == 0x04 {
+			// VN CD DSTPORT DSTIP USERID\0 HOST\0
+			head := make([]byte, 8)
+			io.ReadFull(r, head)
+			r.ReadString(0)
+			r.ReadString(0)
+			c.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0}) // rejected, but well-formed
+		}
+	})
+}
+
+func silentSpeaker(t *testing.T) ProxyNode {
+	return protoServer(t, func(net.Conn, *bufio.Reader) {})
+}
+
+func TestClassifyProxy(t *testing.T) {
+	dead := deadUpstream(t)
+	tests := []struct {
+		name    string
+		node    ProxyNode
+		want    string
+		wantErr error
+	}{
+		{"socks5", socks5Speaker(t), ProxyTypeSOCKS5, nil},
+		{"http", httpSpeaker(t), ProxyTypeHTTP, nil},
+		{"socks4", socks4Speaker(t), ProxyTypeSOCKS4, nil},
+		{"silent", silentSpeaker(t), "", ErrUnknownProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ClassifyProxy(context.Background(), tt.node, "example.com:443", time.Second)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ClassifyProxy() = %q, %v; want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	_, err := ClassifyProxy(context.Background(), dead, "example.com:443", time.Second)
+	var upErr *UpstreamError
+	if !errors.As(err, &upErr) || upErr.Proxy != dead.Addr() {
+		t.Errorf("ClassifyProxy(dead) = %v, want an UpstreamError for %s", err, dead.Addr())
+	}
+}
+
+func TestInferTypes(t *testing.T) {
+	socks5, httpNode, socks4, silent := socks5Speaker(t), httpSpeaker(t), socks4Speaker(t), silentSpeaker(t)
+	static := node("192.0.2.1", "1080", 0)
+	nodes := []ProxyNode{socks5, static, httpNode, socks4, silent}
+	cache := NewTypeCache(time.Hour)
+
+	got, counts := inferTypes(context.Background(), nodes, cache, "https://example.com/", 4, time.Second)
+	// socks4 is recognized but cannot be dialed, so it is counted and dropped.
+	want := []string{
+		ProxyTypeSOCKS5 + " " + socks5.Addr(),
+		ProxyTypeSOCKS5 + " " + static.Addr(),
+		ProxyTypeHTTP + " " + httpNode.Addr(),
+	}
+	if fmt.Sprint(typedAddrs(got)) != fmt.Sprint(want) {
+		t.Errorf("inferTypes kept %v, want %v", typedAddrs(got), want)
+	}
+	wantCounts := map[string]int{ProxyTypeSOCKS5: 1, ProxyTypeHTTP: 1, ProxyTypeSOCKS4: 1, "unknown": 1}
+	if fmt.Sprint(counts) != fmt.Sprint(wantCounts) {
+		t.Errorf("counts = %v, want %v", counts, wantCounts)
+	}
+	if cache.Len() != 4 {
+		t.Errorf("cache holds %d results, want 4", cache.Len())
+	}
+
+	// Cached results, failures included, are not probed again.
+	cache.put(socks5.Addr(), ProxyTypeHTTP, time.Now())
+	got, counts = inferTypes(context.Background(), []ProxyNode{socks5, silent}, cache, "example.com:443", 4, time.Second)
+	if len(got) != 1 || got[0].Type != ProxyTypeHTTP || counts["unknown"] != 1 {
+		t.Errorf("inferTypes from cache = %v, %v; want the cached http type and one unknown", typedAddrs(got), counts)
+	}
+}
+
+func TestTypeCacheTTL(t *testing.T) {
+	if NewTypeCache(0) != nil {
+		t.Fatal("NewTypeCache(0) is not nil")
+	}
+	now := time.Unix(1000, 0)
+	c := NewTypeCache(time.Minute)
+	c.put("192.0.2.1:1080", ProxyTypeSOCKS5, now)
+	if typ, ok := c.get("192.0.2.1:1080", now.Add(time.Minute)); !ok || typ != ProxyTypeSOCKS5 {
+		t.Errorf("get() at the TTL = %q, %v; want socks5", typ, ok)
+	}
+	if _, ok := c.get("192.0.2.1:1080", now.Add(time.Minute+time.Second)); ok {
+		t.Error("get() past the TTL still hit")
+	}
+	c.prune(now.Add(2 * time.Minute))
+	if c.Len() != 0 {
+		t.Errorf("Len() after prune = %d, want 0", c.Len())
+	}
+}
+
+func typedAddrs(nodes []ProxyNode) []string {
+	out := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, n.Type+" "+n.Addr())
+	}
+	return out
+}
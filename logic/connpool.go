@@ -0,0 +1,311 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamPool keeps a few idle TCP connections per upstream proxy, opened
+// but before the SOCKS5 greeting, so a client dial only pays for the SOCKS5
+// negotiation. SOCKS5 cannot multiplex, so every connection is used once.
+//
+// A nil *UpstreamPool dials normally.
+type UpstreamPool struct {
+	size    int
+	idleTTL time.Duration
+
+	mu      sync.Mutex
+	idle    map[string][]pooledConn
+	wanted  map[string]ProxyNode
+	filling map[string]bool
+	// warm is kept filled even without traffic (see Warm).
+	warm        ProxyNode
+	warmTimeout time.Duration
+
+	// ctx ends with Run, cancelling background dials.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type pooledConn struct {
+	conn net.Conn
+	at   time.Time
+}
+
+// UpstreamPoolStats reports reuse of pre-opened upstream connections.
+type UpstreamPoolStats struct {
+	Size    int     `json:"size"`
+	Idle    int     `json:"idle"`
+	Warm    string  `json:"warm,omitempty"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	// Upstreams counts the proxies being kept filled.
+	Upstreams int `json:"upstreams"`
+}
+
+// NewUpstreamPool returns a pool keeping up to size idle connections per
+// upstream for at most idleTTL, or nil when size <= 0.
+func NewUpstreamPool(size int, idleTTL time.Duration) *UpstreamPool {
+	if size <= 0 {
+		return nil
+	}
+	if idleTTL <= 0 {
+		idleTTL = 30 * time.Second
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	return &UpstreamPool{
+		size:    size,
+		idleTTL: idleTTL,
+		idle:    make(map[string][]pooledConn),
+		wanted:  make(map[string]ProxyNode),
+		filling: make(map[string]bool),
+		ctx:     ctx,
+		stop:    stop,
+	}
+}
+
+// DialViaProxy is logic.DialViaProxy using a pooled connection to node when
+// one is available, and topping the pool back up in the background.
+func (p *UpstreamPool) DialViaProxy(ctx context.Context, node ProxyNode, network, addr string, timeout time.Duration) (Conn, error) {
+	if p == nil || node.Type != ProxyTypeSOCKS5 {
+		return DialViaProxy(ctx, node, network, addr, timeout)
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("socks5 upstream only supports tcp, got %q", network)
+	}
+	host, port, err := splitTarget(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	conn := p.take(node)
+	defer p.refill(node, timeout)
+	if conn != nil {
+		p.hits.Add(1)
+		c, _, err := socks5Negotiate(ctx, conn, node, host, port, timeout, start)
+		if err == nil {
+			return withIdleTimeout(c, currentDialOptions().IdleTimeout), nil
+		}
+		var upErr *UpstreamError
+		if !errors.As(err, &upErr) || ctx.Err() != nil {
+			return nil, classifyDialError(node.Addr(), err)
+		}
+		// The proxy may have dropped the idle socket since the liveness
+		// check; fall through to a fresh connection.
+		start = time.Now()
+	} else {
+		p.misses.Add(1)
+	}
+
+	conn, err = newDialer(timeout).DialContext(ctx, "tcp", node.Addr())
+	if err != nil {
+		return nil, classifyDialError(node.Addr(), &UpstreamError{Proxy: node.Addr(), Err: err})
+	}
+	c, _, err := socks5Negotiate(ctx, conn, node, host, port, timeout, start)
+	if err != nil {
+		return nil, classifyDialError(node.Addr(), err)
+	}
+	return withIdleTimeout(c, currentDialOptions().IdleTimeout), nil
+}
+
+// take returns a live idle connection to node, or nil, and marks node as
+// wanted so refill keeps its pool warm.
+func (p *UpstreamPool) take(node ProxyNode) net.Conn {
+	key := node.Addr()
+	p.mu.Lock()
+	p.wanted[key] = node
+	for len(p.idle[key]) > 0 {
+		list := p.idle[key]
+		pc := list[len(list)-1]
+		p.idle[key] = list[:len(list)-1]
+		if time.Since(pc.at) > p.idleTTL {
+			_ = pc.conn.Close()
+			continue
+		}
+		p.mu.Unlock()
+		if connAlive(pc.conn) {
+			return pc.conn
+		}
+		_ = pc.conn.Close()
+		p.mu.Lock()
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// connAlive does a read with an already-expired deadline: a live idle socket
+// times out, while one the proxy closed (or wrote to) returns immediately.
+func connAlive(c net.Conn) bool {
+	_ = c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := c.Read(b[:])
+	_ = c.SetReadDeadline(time.Time{})
+	return err != nil && isTimeout(err)
+}
+
+// refill opens connections to node until it has size idle ones. At most one
+// refill per node runs at a time, and none once Run has returned.
+func (p *UpstreamPool) refill(node ProxyNode, timeout time.Duration) {
+	key := node.Addr()
+	p.mu.Lock()
+	if p.filling[key] || p.ctx.Err() != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.filling[key] = true
+	p.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			delete(p.filling, key)
+			p.mu.Unlock()
+		}()
+		for {
+			p.mu.Lock()
+			_, wanted := p.wanted[key]
+			need := wanted && len(p.idle[key]) < p.size
+			p.mu.Unlock()
+			if !need {
+				return
+			}
+			conn, err := newDialer(timeout).DialContext(p.ctx, "tcp", key)
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			if _, ok := p.wanted[key]; !ok {
+				p.mu.Unlock()
+				_ = conn.Close()
+				return
+			}
+			p.idle[key] = append(p.idle[key], pooledConn{conn: conn, at: time.Now()})
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// Warm makes node the warm target: its idle connections are opened now and
+// kept filled even when no client is dialing, so the first request after a
+// rotation skips the TCP connect. It replaces the previous warm target.
+func (p *UpstreamPool) Warm(node ProxyNode, timeout time.Duration) {
+	if p == nil || node.Addr() == "" {
+		return
+	}
+	p.mu.Lock()
+	p.warm = node
+	p.warmTimeout = timeout
+	p.wanted[node.Addr()] = node
+	p.mu.Unlock()
+	p.refill(node, timeout)
+}
+
+// Drop closes and forgets the idle connections to addr, e.g. when the node
+// leaves the proxy pool.
+func (p *UpstreamPool) Drop(addr string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	list := p.idle[addr]
+	delete(p.idle, addr)
+	delete(p.wanted, addr)
+	if p.warm.Addr() == addr {
+		p.warm = ProxyNode{}
+	}
+	p.mu.Unlock()
+	for _, pc := range list {
+		_ = pc.conn.Close()
+	}
+}
+
+// Run closes expired idle connections until ctx is done, then cancels
+// background dials and closes all.
+func (p *UpstreamPool) Run(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	ticker := time.NewTicker(p.idleTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.stop()
+			p.mu.Lock()
+			for addr := range p.wanted {
+				delete(p.wanted, addr)
+			}
+			p.mu.Unlock()
+			p.sweep(time.Time{})
+			return
+		case now := <-ticker.C:
+			p.sweep(now.Add(-p.idleTTL))
+			p.mu.Lock()
+			warm, timeout := p.warm, p.warmTimeout
+			p.mu.Unlock()
+			if warm.Addr() != "" {
+				p.refill(warm, timeout)
+			}
+		}
+	}
+}
+
+// sweep closes idle connections opened before cutoff; a zero cutoff closes all.
+func (p *UpstreamPool) sweep(cutoff time.Time) {
+	var stale []net.Conn
+	p.mu.Lock()
+	for addr, list := range p.idle {
+		keep := list[:0]
+		for _, pc := range list {
+			if cutoff.IsZero() || pc.at.Before(cutoff) {
+				stale = append(stale, pc.conn)
+				continue
+			}
+			keep = append(keep, pc)
+		}
+		if len(keep) == 0 {
+			delete(p.idle, addr)
+		} else {
+			p.idle[addr] = keep
+		}
+	}
+	// Forget upstreams that went quiet, so wanted does not grow with every
+	// node ever dialed; the next dial marks them wanted again.
+	for addr := range p.wanted {
+		if len(p.idle[addr]) == 0 && !p.filling[addr] && addr != p.warm.Addr() {
+			delete(p.wanted, addr)
+		}
+	}
+	p.mu.Unlock()
+	for _, c := range stale {
+		_ = c.Close()
+	}
+}
+
+func (p *UpstreamPool) Stats() UpstreamPoolStats {
+	if p == nil {
+		return UpstreamPoolStats{}
+	}
+	st := UpstreamPoolStats{Size: p.size, Hits: p.hits.Load(), Misses: p.misses.Load()}
+	p.mu.Lock()
+	for _, list := range p.idle {
+		st.Idle += len(list)
+	}
+	st.Upstreams = len(p.wanted)
+	st.Warm = p.warm.Addr()
+	p.mu.Unlock()
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRate = float64(st.Hits) / float64(total)
+	}
+	return st
+}
@@ -0,0 +1,197 @@
+package logic
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns a loopback connection and the server's end of it.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// waitIdle waits until p holds n idle connections.
+func waitIdle(t *testing.T, p *UpstreamPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().Idle != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool holds %d idle connections, want %d", p.Stats().Idle, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnAlive(t *testing.T) {
+	live, _ := tcpPair(t)
+	if !connAlive(live) {
+		t.Error("connAlive() = false for an open idle socket")
+	}
+	// The check must not leave a deadline behind.
+	if !connAlive(live) {
+		t.Error("connAlive() = false on a second check")
+	}
+
+	closed, peer := tcpPair(t)
+	peer.Close()
+	if connAlive(closed) {
+		t.Error("connAlive() = true for a socket the peer closed")
+	}
+
+	chatty, peer := tcpPair(t)
+	peer.Write([]byte("x"))
+	if connAlive(chatty) {
+		t.Error("connAlive() = true for a socket the peer wrote to unasked")
+	}
+}
+
+// TestUpstreamPoolStaleFallsThrough leaves dead and expired sockets in the
+// pool: take discards them and the dial goes out on a fresh connection.
+func TestUpstreamPoolStaleFallsThrough(t *testing.T) {
+	srv := helloServer(t)
+	up, tunnels := fakeUpstream(t)
+	p := NewUpstreamPool(2, time.Minute)
+
+	dead, peer := tcpPair(t)
+	peer.Close()
+	expired, _ := tcpPair(t)
+	p.idle[up.Addr()] = []pooledConn{
+		{conn: expired, at: time.Now().Add(-time.Hour)},
+		{conn: dead, at: time.Now()},
+	}
+
+	c, err := p.DialViaProxy(context.Background(), up, "tcp", strings.TrimPrefix(srv.URL, "http://"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("DialViaProxy() = %v", err)
+	}
+	c.Close()
+	if got := tunnels.Load(); got != 1 {
+		t.Errorf("upstream opened %d tunnels, want 1", got)
+	}
+	if st := p.Stats(); st.Hits != 0 || st.Misses != 1 {
+		t.Errorf("Stats() = %+v, want the stale sockets counted as a miss", st)
+	}
+	for name, conn := range map[string]net.Conn{"dead": dead, "expired": expired} {
+		if _, err := conn.Write([]byte("x")); err == nil {
+			t.Errorf("the %s pooled socket was left open", name)
+		}
+	}
+}
+
+func TestUpstreamPoolHitRate(t *testing.T) {
+	srv := helloServer(t)
+	up, _ := fakeUpstream(t)
+	target := strings.TrimPrefix(srv.URL, "http://")
+	p := NewUpstreamPool(1, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	// The first dial finds nothing pooled and refills behind itself.
+	for i, want := range []UpstreamPoolStats{{Hits: 0, Misses: 1}, {Hits: 1, Misses: 1}} {
+		if i > 0 {
+			waitIdle(t, p, 1)
+		}
+		c, err := p.DialViaProxy(ctx, up, "tcp", target, 2*time.Second)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		c.Close()
+		if st := p.Stats(); st.Hits != want.Hits || st.Misses != want.Misses {
+			t.Fatalf("dial %d: Stats() = %+v, want %d hits and %d misses", i, st, want.Hits, want.Misses)
+		}
+	}
+	if st := p.Stats(); st.HitRate != 0.5 || st.Size != 1 || st.Upstreams != 1 {
+		t.Errorf("Stats() = %+v, want hit rate 0.5 over one upstream", st)
+	}
+
+	var none *UpstreamPool
+	if st := none.Stats(); st != (UpstreamPoolStats{}) {
+		t.Errorf("nil pool Stats() = %+v", st)
+	}
+}
+
+// TestUpstreamPoolDrop checks that a node leaving the proxy pool takes its
+// idle connections, and its warm status, with it.
+func TestUpstreamPoolDrop(t *testing.T) {
+	up, _ := fakeUpstream(t)
+	p := NewUpstreamPool(2, time.Minute)
+	p.Warm(up, 2*time.Second)
+	waitIdle(t, p, 2)
+	p.mu.Lock()
+	idle := append([]pooledConn(nil), p.idle[up.Addr()]...)
+	p.mu.Unlock()
+
+	p.Drop(up.Addr())
+	if st := p.Stats(); st.Idle != 0 || st.Upstreams != 0 || st.Warm != "" {
+		t.Errorf("Stats() after Drop = %+v, want nothing left", st)
+	}
+	for i, pc := range idle {
+		if _, err := pc.conn.Write([]byte("x")); err == nil {
+			t.Errorf("idle connection %d still open after Drop", i)
+		}
+	}
+}
+
+// TestUpstreamPoolRunStops checks that no background dial goes out once
+// Run's context is done.
+func TestUpstreamPoolRunStops(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			c.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	up := ProxyNode{Type: ProxyTypeSOCKS5, IP: host, Port: port}
+
+	p := NewUpstreamPool(2, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	p.Warm(up, 2*time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if n := accepted.Load(); n != 0 || p.Stats().Idle != 0 {
+		t.Errorf("after Run returned: %d dials, %d idle; want none", n, p.Stats().Idle)
+	}
+}
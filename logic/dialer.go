@@ -2,52 +2,265 @@ package logic
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"golang.org/x/net/proxy"
 )
 
 type Conn = net.Conn
 
+// DialOptions tune every outbound dial made by this package.
+type DialOptions struct {
+	// KeepAlive is the TCP keep-alive period; 0 uses the Go default and a
+	// negative value disables keep-alive probes.
+	KeepAlive time.Duration
+	// IdleTimeout closes established connections after this long without
+	// reads or writes; 0 disables it.
+	IdleTimeout time.Duration
+	// Mark sets SO_MARK on every outbound socket for policy routing; 0
+	// leaves sockets unmarked. Only Linux supports it.
+	Mark uint32
+}
+
+var dialOptions atomic.Pointer[DialOptions]
+
+// SetDialOptions replaces the options used by subsequent dials.
+func SetDialOptions(o DialOptions) { dialOptions.Store(&o) }
+
+func currentDialOptions() DialOptions {
+	if o := dialOptions.Load(); o != nil {
+		return *o
+	}
+	return DialOptions{}
+}
+
+func newDialer(timeout time.Duration) *net.Dialer {
+	o := currentDialOptions()
+	d := &net.Dialer{Timeout: timeout, KeepAlive: o.KeepAlive}
+	if o.Mark != 0 {
+		d.Control = fwmarkControl(o.Mark)
+	}
+	return d
+}
+
+// DialControl returns the socket control for dialers outside this package,
+// such as HTTP transports, so their sockets get the same mark; nil when no
+// mark is set.
+func DialControl() func(network, address string, c syscall.RawConn) error {
+	if o := currentDialOptions(); o.Mark != 0 {
+		return fwmarkControl(o.Mark)
+	}
+	return nil
+}
+
 func DialDirect(ctx context.Context, network, addr string, timeout time.Duration) (Conn, error) {
-	d := &net.Dialer{Timeout: timeout}
-	return d.DialContext(ctx, network, addr)
+	conn, err := newDialer(timeout).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return withIdleTimeout(conn, currentDialOptions().IdleTimeout), nil
+}
+
+// idleConn pushes the deadline forward on every read and write.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func withIdleTimeout(c net.Conn, idle time.Duration) net.Conn {
+	if idle <= 0 {
+		return c
+	}
+	_ = c.SetDeadline(time.Now().Add(idle))
+	return &idleConn{Conn: c, idle: idle}
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.idle))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.idle))
+	return c.Conn.Write(b)
+}
+
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// ResolveTarget resolves the host of addr with the local resolver, unless it
+// is already an IP or the name should go to the proxy: node.RemoteDNS
+// (socks5h) or remote set globally. dialViaSOCKS5 sends names unresolved.
+func ResolveTarget(ctx context.Context, node ProxyNode, addr string, remote bool) (string, error) {
+	if remote || node.RemoteDNS {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, err
+	}
+	ip, err := LocalResolve(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
 }
 
 func DialViaProxy(ctx context.Context, node ProxyNode, network, addr string, timeout time.Duration) (Conn, error) {
+	conn, _, err := DialViaProxyTimed(ctx, node, network, addr, timeout)
+	return conn, err
+}
+
+// DialViaProxyTimed is DialViaProxy that also reports how the dial time
+// splits between reaching the proxy and the proxy reaching addr.
+func DialViaProxyTimed(ctx context.Context, node ProxyNode, network, addr string, timeout time.Duration) (Conn, DialTiming, error) {
 	if node.Type == "" || node.Addr() == "" {
-		return nil, errors.New("invalid proxy node")
+		return nil, DialTiming{}, errors.New("invalid proxy node")
 	}
 	switch node.Type {
 	case ProxyTypeSOCKS5:
-		return dialViaSOCKS5(ctx, node, network, addr, timeout)
+		conn, timing, err := dialViaSOCKS5(ctx, node, network, addr, timeout)
+		return conn, timing, classifyDialError(node.Addr(), err)
+	case ProxyTypeHTTPS, ProxyTypeHTTP:
+		conn, timing, err := dialViaHTTPS(ctx, node, network, addr, timeout)
+		return conn, timing, classifyDialError(node.Addr(), err)
 	default:
-		return nil, fmt.Errorf("unsupported proxy type: %s", node.Type)
+		return nil, DialTiming{}, fmt.Errorf("unsupported proxy type: %s", node.Type)
 	}
 }
 
-func dialViaSOCKS5(ctx context.Context, node ProxyNode, network, addr string, timeout time.Duration) (Conn, error) {
+func dialViaSOCKS5(ctx context.Context, node ProxyNode, network, addr string, timeout time.Duration) (Conn, DialTiming, error) {
 	if network != "tcp" && network != "tcp4" && network != "tcp6" {
-		return nil, fmt.Errorf("socks5 upstream only supports tcp, got %q", network)
+		return nil, DialTiming{}, fmt.Errorf("socks5 upstream only supports tcp, got %q", network)
 	}
-	var auth *proxy.Auth
-	if node.User != "" || node.Pass != "" {
-		auth = &proxy.Auth{User: node.User, Password: node.Pass}
+	conn, timing, err := socks5Connect(ctx, node, addr, timeout)
+	if err != nil {
+		return nil, timing, err
 	}
+	return withIdleTimeout(conn, currentDialOptions().IdleTimeout), timing, nil
+}
 
-	// proxy.SOCKS5 may or may not honor DialContext depending on the forward dialer,
-	// so keep a hard timeout at the forward layer.
-	forward := &net.Dialer{Timeout: timeout}
-	d, err := proxy.SOCKS5("tcp", node.Addr(), auth, forward)
-	if err != nil {
-		return nil, err
+// Dial error categories reported by DialErrorCategory. SOCKS5 replies from
+// the upstream are reported as "socks5_<reply name>", HTTP CONNECT replies
+// as "http_<status code>".
+const (
+	DialErrDNS       = "dns"
+	DialErrRefused   = "connection_refused"
+	DialErrTimeout   = "timeout"
+	DialErrHandshake = "handshake_rejected"
+	DialErrAuth      = "auth_failed"
+	DialErrTLS       = "tls"
+	DialErrProxy     = "proxy_unreachable"
+	DialErrOther     = "other"
+)
+
+// DialError is a dial failure through the proxy at Proxy, tagged with its
+// category.
+type DialError struct {
+	Category string
+	Proxy    string
+	Err      error
+}
+
+func (e *DialError) Error() string { return e.Category + ": " + e.Err.Error() }
+
+func (e *DialError) Unwrap() error { return e.Err }
+
+// classifyDialError wraps err in a *DialError unless it already is one.
+func classifyDialError(proxy string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var de *DialError
+	if errors.As(err, &de) {
+		return err
+	}
+	return &DialError{Category: DialErrorCategory(err), Proxy: proxy, Err: err}
+}
+
+// DialErrorCategory returns the category of a dial or probe error.
+func DialErrorCategory(err error) string {
+	var (
+		de       *DialError
+		replyErr *SOCKS5ReplyError
+		httpErr  *HTTPConnectError
+		dnsErr   *net.DNSError
+		upErr    *UpstreamError
+		recErr   tls.RecordHeaderError
+		certErr  *tls.CertificateVerificationError
+		alertErr tls.AlertError
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &de):
+		return de.Category
+	case isTimeout(err):
+		return DialErrTimeout
+	case errors.As(err, &replyErr):
+		return "socks5_" + SOCKS5ReplyName(replyErr.Code)
+	case errors.As(err, &httpErr):
+		return "http_" + strconv.Itoa(httpErr.Code)
+	case errors.Is(err, ErrSOCKS5AuthFailed), errors.Is(err, ErrSOCKS5AuthRequired), errors.Is(err, ErrHTTPProxyAuth):
+		return DialErrAuth
+	case errors.Is(err, ErrSOCKS5Rejected), errors.Is(err, ErrHTTPConnectMalformed):
+		return DialErrHandshake
+	case errors.As(err, &dnsErr):
+		return DialErrDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialErrRefused
+	case errors.As(err, &certErr), errors.As(err, &recErr), errors.As(err, &alertErr), strings.HasPrefix(err.Error(), "tls:"):
+		return DialErrTLS
+	case errors.As(err, &upErr):
+		return DialErrProxy
+	default:
+		return DialErrOther
 	}
+}
+
+// IsAuthFailure reports whether err means the proxy refused the node's
+// credentials (or demanded ones the node does not have), as opposed to being
+// unreachable or broken.
+func IsAuthFailure(err error) bool {
+	return err != nil && DialErrorCategory(err) == DialErrAuth
+}
+
+// DialErrorStats counts dial errors by category.
+type DialErrorStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (s *DialErrorStats) Add(err error) {
+	if err == nil {
+		return
+	}
+	cat := DialErrorCategory(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = make(map[string]int64)
+	}
+	s.counts[cat]++
+}
 
-	if cd, ok := d.(proxy.ContextDialer); ok {
-		return cd.DialContext(ctx, network, addr)
+func (s *DialErrorStats) Snapshot() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int64, len(s.counts))
+	for k, v := range s.counts {
+		out[k] = v
 	}
-	return d.Dial(network, addr)
+	return out
 }
@@ -0,0 +1,95 @@
+package logic
+
+import (
+	"sort"
+	"time"
+)
+
+// PoolDiff describes the churn between two consecutive pools.
+type PoolDiff struct {
+	At       time.Time    `json:"at"`
+	Added    []string     `json:"added"`
+	Removed  []string     `json:"removed"`
+	Retained int          `json:"retained"`
+	Latency  LatencyDelta `json:"latency_delta"`
+}
+
+// LatencyDelta summarizes latency changes (next - prev) of retained nodes.
+// Only nodes with a known latency on both sides are counted.
+type LatencyDelta struct {
+	Samples int     `json:"samples"`
+	MinMS   int64   `json:"min_ms"`
+	MaxMS   int64   `json:"max_ms"`
+	MeanMS  float64 `json:"mean_ms"`
+}
+
+type PoolDiffSummary struct {
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Retained int `json:"retained"`
+}
+
+func (d PoolDiff) Summary() PoolDiffSummary {
+	return PoolDiffSummary{
+		Added:    len(d.Added),
+		Removed:  len(d.Removed),
+		Retained: d.Retained,
+	}
+}
+
+// DiffPools compares prev and next by address. It does not modify its inputs.
+func DiffPools(prev, next []ProxyNode) PoolDiff {
+	prevByAddr := make(map[string]ProxyNode, len(prev))
+	for _, n := range prev {
+		if addr := n.Addr(); addr != "" {
+			prevByAddr[addr] = n
+		}
+	}
+
+	d := PoolDiff{
+		Added:   []string{},
+		Removed: []string{},
+	}
+	seen := make(map[string]struct{}, len(next))
+	var sum int64
+	for _, n := range next {
+		addr := n.Addr()
+		if addr == "" {
+			continue
+		}
+		if _, dup := seen[addr]; dup {
+			continue
+		}
+		seen[addr] = struct{}{}
+
+		old, ok := prevByAddr[addr]
+		if !ok {
+			d.Added = append(d.Added, addr)
+			continue
+		}
+		d.Retained++
+		if old.LatencyMS < 0 || n.LatencyMS < 0 {
+			continue
+		}
+		delta := n.LatencyMS - old.LatencyMS
+		if d.Latency.Samples == 0 || delta < d.Latency.MinMS {
+			d.Latency.MinMS = delta
+		}
+		if d.Latency.Samples == 0 || delta > d.Latency.MaxMS {
+			d.Latency.MaxMS = delta
+		}
+		d.Latency.Samples++
+		sum += delta
+	}
+	if d.Latency.Samples > 0 {
+		d.Latency.MeanMS = float64(sum) / float64(d.Latency.Samples)
+	}
+
+	for addr := range prevByAddr {
+		if _, ok := seen[addr]; !ok {
+			d.Removed = append(d.Removed, addr)
+		}
+	}
+	sort.Strings(d.Removed)
+	return d
+}
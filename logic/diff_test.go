@@ -0,0 +1,109 @@
+package logic
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func node(ip, port string, latency int64) ProxyNode {
+	return ProxyNode{Type: ProxyTypeSOCKS5, IP: ip, Port: port, LatencyMS: latency}
+}
+
+func TestDiffPools(t *testing.T) {
+	a := node("203.0.113.1", "1080", 100)
+	b := node("203.0.113.2", "1080", 200)
+	c := node("203.0.113.3", "1080", 300)
+
+	tests := []struct {
+		name       string
+		prev, next []ProxyNode
+		want       PoolDiff
+	}{
+		{
+			name: "empty previous",
+			next: []ProxyNode{a, b},
+			want: PoolDiff{Added: []string{a.Addr(), b.Addr()}, Removed: []string{}},
+		},
+		{
+			name: "empty next",
+			prev: []ProxyNode{b, a},
+			want: PoolDiff{Added: []string{}, Removed: []string{a.Addr(), b.Addr()}},
+		},
+		{
+			name: "identical",
+			prev: []ProxyNode{a, b, c},
+			next: []ProxyNode{a, b, c},
+			want: PoolDiff{Added: []string{}, Removed: []string{}, Retained: 3, Latency: LatencyDelta{Samples: 3}},
+		},
+		{
+			name: "churn with latency changes",
+			prev: []ProxyNode{a, b},
+			next: []ProxyNode{node(b.IP, b.Port, 150), c, node(a.IP, a.Port, 160), c},
+			want: PoolDiff{
+				Added:    []string{c.Addr()},
+				Removed:  []string{},
+				Retained: 2,
+				Latency:  LatencyDelta{Samples: 2, MinMS: -50, MaxMS: 60, MeanMS: 5},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffPools(tt.prev, tt.next)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffPools() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffPoolsDoesNotModifyInputs(t *testing.T) {
+	prev := []ProxyNode{node("203.0.113.2", "1080", 1), node("203.0.113.1", "1080", 1)}
+	next := []ProxyNode{node("203.0.113.3", "1080", 1)}
+	want := append([]ProxyNode(nil), prev...)
+	DiffPools(prev, next)
+	if !reflect.DeepEqual(prev, want) {
+		t.Errorf("prev changed to %+v", prev)
+	}
+}
+
+func TestRefreshReturnsItsDiff(t *testing.T) {
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0)})
+	r := NewRefresher([]*ProxyManager{m}, nil, []string{"socks5://203.0.113.2:1080", "socks5://203.0.113.3:1080"}, ValidationConfig{}, 0)
+	r.AllowPrivate = true // documentation addresses
+
+	count, diff, err := r.Refresh(context.Background())
+	if count != 2 {
+		t.Fatalf("Refresh() count = %d (err %v), want 2", count, err)
+	}
+	if diff.At.IsZero() {
+		t.Fatal("Refresh() returned a zero diff for an applied pool")
+	}
+	if want := []string{"203.0.113.3:1080"}; !reflect.DeepEqual(diff.Added, want) {
+		t.Errorf("Added = %v, want %v", diff.Added, want)
+	}
+	if want := []string{"203.0.113.1:1080"}; !reflect.DeepEqual(diff.Removed, want) {
+		t.Errorf("Removed = %v, want %v", diff.Removed, want)
+	}
+	if last, _ := r.LastDiff(); !last.At.Equal(diff.At) {
+		t.Errorf("LastDiff().At = %v, want %v", last.At, diff.At)
+	}
+}
+
+func TestPoolable(t *testing.T) {
+	ok := node("203.0.113.1", "1080", 0)
+	nodes := []ProxyNode{
+		{Type: ProxyTypeSOCKS4, IP: "203.0.113.2", Port: "1080"},
+		ok,
+		{Type: ProxyTypeSOCKS5, IP: "203.0.113.3"},
+	}
+	if got := poolable(nodes); !reflect.DeepEqual(got, []ProxyNode{ok}) {
+		t.Errorf("poolable() = %+v, want only %s", got, ok.Addr())
+	}
+	all := []ProxyNode{ok}
+	if got := poolable(all); &got[0] != &all[0] {
+		t.Error("poolable() copied a slice that needed no filtering")
+	}
+}
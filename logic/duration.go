@@ -0,0 +1,58 @@
+package logic
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a JSON duration: a string such as "90s" or "1h30m", or a
+// number of seconds. It remembers whether it was set, so a zero can be
+// told from a missing value.
+type Duration struct {
+	d   time.Duration
+	set bool
+}
+
+func DurationValue(d time.Duration) Duration {
+	return Duration{d: d, set: true}
+}
+
+func (d Duration) Duration() time.Duration { return d.d }
+
+func (d Duration) IsSet() bool { return d.set }
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	d.set = true
+	d.d = 0
+
+	if len(b) == 0 || string(b) == "null" {
+		return nil
+	}
+	if b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		if s == "" {
+			d.d = 0
+			return nil
+		}
+		dd, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		d.d = dd
+		return nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(b, &seconds); err != nil {
+		return err
+	}
+	d.d = time.Duration(seconds * float64(time.Second))
+	return nil
+}
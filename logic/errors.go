@@ -0,0 +1,46 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Sentinel errors returned (usually wrapped) by the fetch, validation and
+// refresh pipeline. Test with errors.Is.
+var (
+	ErrEmptyPool          = errors.New("empty proxy list")
+	ErrNoSources          = errors.New("no sources")
+	ErrFetchFailed        = errors.New("fetch failed")
+	ErrValidationDisabled = errors.New("validation disabled")
+	ErrNoValidProxies     = errors.New("no valid proxies found")
+)
+
+// FetchError is a failed source download. StatusCode is set when the server
+// answered with a non-2xx status, Err otherwise.
+type FetchError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("fetch %s: http %d", RedactURL(e.URL), e.StatusCode)
+	}
+	return fmt.Sprintf("fetch %s: %v", RedactURL(e.URL), e.Err)
+}
+
+// RedactURL masks the password in raw, if it is a URL carrying one.
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); !ok {
+		return raw
+	}
+	return u.Redacted()
+}
+
+func (e *FetchError) Unwrap() error { return e.Err }
@@ -4,11 +4,12 @@ import (
 	"bufio"
 	"context"
 	"errors"
-	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
 	"time"
+	"unicode"
 )
 
 const (
@@ -19,40 +20,87 @@ func FetchDefaultSources(ctx context.Context) ([]ProxyNode, error) {
 	return FetchFromSources(ctx, DefaultSources())
 }
 
+// SourceStats reports the outcome of fetching a single source.
+type SourceStats struct {
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
 func FetchFromSources(ctx context.Context, sources Sources) ([]ProxyNode, error) {
+	nodes, _, err := FetchFromSourcesWithStats(ctx, sources)
+	return nodes, err
+}
+
+// FetchFromSourcesWithStats is FetchFromSources that also reports per-source results.
+func FetchFromSourcesWithStats(ctx context.Context, sources Sources) ([]ProxyNode, []SourceStats, error) {
 	if len(sources) == 0 {
-		return nil, errors.New("no sources")
+		return nil, nil, ErrNoSources
 	}
 
 	var all []ProxyNode
 	var errs []error
+	stats := make([]SourceStats, 0, len(sources))
 	okAny := false
 	for _, src := range sources {
-		nodes, err := FetchFromURL(ctx, src.URL, src.Type)
+		var nodes []ProxyNode
+		provider, err := NewSourceProvider(src)
+		if err == nil {
+			nodes, err = provider.Fetch(ctx)
+		}
 		if err != nil {
-			errs = append(errs, fmt.Errorf("%s: %w", src.URL, err))
+			stats = append(stats, SourceStats{URL: src.URL, Error: err.Error()})
+			var fe *FetchError
+			if !errors.As(err, &fe) {
+				err = &FetchError{URL: src.URL, Err: err}
+			}
+			errs = append(errs, err)
 			continue
 		}
 		okAny = true
+		// Providers other than the plain list don't know their URL.
+		for i := range nodes {
+			if nodes[i].Source == "" {
+				nodes[i].Source = src.URL
+			}
+		}
+		stats = append(stats, SourceStats{URL: src.URL, Count: len(nodes)})
 		all = append(all, nodes...)
 	}
 	all = MergeDedup(all)
 	if len(all) == 0 {
 		if okAny {
-			return nil, errors.New("empty proxy list")
+			return nil, stats, ErrEmptyPool
 		}
 		if len(errs) > 0 {
-			return nil, errors.Join(errs...)
+			return nil, stats, errors.Join(errs...)
 		}
-		return nil, errors.New("fetch failed")
+		return nil, stats, ErrFetchFailed
 	}
 	if len(errs) > 0 {
-		return all, errors.Join(errs...)
+		return all, stats, errors.Join(errs...)
 	}
-	return all, nil
+	return all, stats, nil
 }
 
 func FetchFromURL(ctx context.Context, url string, defaultType string) ([]ProxyNode, error) {
+	body, err := fetchSourceBody(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	out, err := parseProxyList(body, defaultType)
+	if err != nil {
+		return nil, &FetchError{URL: url, Err: err}
+	}
+	for i := range out {
+		out[i].Source = url
+	}
+	return out, nil
+}
+
+// fetchSourceBody GETs url and returns the body of a 2xx response.
+func fetchSourceBody(ctx context.Context, url string) (io.ReadCloser, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
@@ -61,30 +109,46 @@ func FetchFromURL(ctx context.Context, url string, defaultType string) ([]ProxyN
 	client := &http.Client{Timeout: 20 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, &FetchError{URL: url, Err: err}
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("fetch %s: http %d", url, resp.StatusCode)
+		resp.Body.Close()
+		return nil, &FetchError{URL: url, StatusCode: resp.StatusCode}
 	}
+	r, err := sourceReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, &FetchError{URL: url, Err: err}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, resp.Body}, nil
+}
+
+// maxListDedup caps the entries parseProxyList remembers to drop
+// duplicates; past it, duplicates are kept for MergeDedup to merge.
+const maxListDedup = 100_000
 
-	scanner := bufio.NewScanner(resp.Body)
+// parseProxyList parses a plain-text proxy list, one or more specs per line,
+// dropping duplicates within the list.
+func parseProxyList(r io.Reader, defaultType string) ([]ProxyNode, error) {
+	scanner := bufio.NewScanner(r)
 	out := make([]ProxyNode, 0, 1024)
 	seen := make(map[string]struct{}, 2048) // within this single source
 
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		node, ok := ParseProxySpec(line, defaultType)
-		if !ok {
-			continue
-		}
-		key := node.Type + "|" + node.ID
-		if _, exists := seen[key]; exists {
-			continue
-		}
-		seen[key] = struct{}{}
+		for _, node := range ParseProxyLine(scanner.Text(), defaultType) {
+			key := node.Type + "|" + node.ID
+			if _, exists := seen[key]; exists {
+				continue
+			}
+			if len(seen) < maxListDedup {
+				seen[key] = struct{}{}
+			}
 
-		out = append(out, node)
+			out = append(out, node)
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
@@ -92,29 +156,112 @@ func FetchFromURL(ctx context.Context, url string, defaultType string) ([]ProxyN
 	return out, nil
 }
 
+// ParseProxyLine parses one line of a proxy list. A line that is a single
+// spec parses as before; otherwise it is split on commas and whitespace and
+// every token that is a valid spec is returned.
+func ParseProxyLine(line string, defaultType string) []ProxyNode {
+	line = strings.TrimSpace(line)
+	if node, ok := ParseProxySpec(line, defaultType); ok {
+		return []ProxyNode{node}
+	}
+	if strings.HasPrefix(line, "#") {
+		return nil
+	}
+	var out []ProxyNode
+	for _, tok := range strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		if node, ok := ParseProxySpec(tok, defaultType); ok {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// MergeDedup concatenates lists, dropping invalid nodes and merging nodes of
+// the same type and address with mergeNodes. The result keeps first-seen
+// order, but a merged node does not depend on which copy came first.
 func MergeDedup(lists ...[]ProxyNode) []ProxyNode {
 	out := make([]ProxyNode, 0, 1024)
-	seen := make(map[string]struct{}, 4096)
+	seen := make(map[string]int, 4096)
 	for _, list := range lists {
 		for _, n := range list {
 			if n.IP == "" || n.Port == "" || n.Type == "" {
 				continue
 			}
-			key := n.Type + "|" + n.IP + ":" + n.Port
-			if _, ok := seen[key]; ok {
-				continue
-			}
-			seen[key] = struct{}{}
-			n.ID = n.IP + ":" + n.Port
+			n.ID = n.Addr()
 			if n.LatencyMS == 0 {
 				n.LatencyMS = -1
 			}
+			key := n.Type + "|" + n.ID
+			if i, ok := seen[key]; ok {
+				out[i] = mergeNodes(out[i], n)
+				continue
+			}
+			seen[key] = len(out)
 			out = append(out, n)
 		}
 	}
 	return out
 }
 
+// mergeNodes combines two copies of one proxy, keeping what either knows:
+// credentials, country, remote DNS, tags and the best measured latency.
+// Ties are broken on the values themselves, so mergeNodes(a, b) ==
+// mergeNodes(b, a), except for Source and DialTimeoutMS: lists are merged
+// in priority order, so a's wins.
+func mergeNodes(a, b ProxyNode) ProxyNode {
+	out := a
+	if out.Source == "" {
+		out.Source = b.Source
+	}
+	if out.DialTimeoutMS == 0 {
+		out.DialTimeoutMS = b.DialTimeoutMS
+	}
+	if credLess(b, a) {
+		out.User, out.Pass = b.User, b.Pass
+	}
+	if a.Country == "" || (b.Country != "" && b.Country < a.Country) {
+		out.Country = b.Country
+	}
+	out.RemoteDNS = a.RemoteDNS || b.RemoteDNS
+	out.GuessedType = a.GuessedType && b.GuessedType
+	out.Tags = mergeTags(a.Tags, b.Tags)
+	out.AuthFailed = a.AuthFailed && b.AuthFailed
+	if latencyLess(b, a) {
+		out.LatencyMS, out.HandshakeMS, out.ConnectMS = b.LatencyMS, b.HandshakeMS, b.ConnectMS
+	}
+	return out
+}
+
+// credLess orders credentials: set before unset, then lexically.
+func credLess(a, b ProxyNode) bool {
+	aSet, bSet := a.User != "" || a.Pass != "", b.User != "" || b.Pass != ""
+	if aSet != bSet {
+		return aSet
+	}
+	if a.User != b.User {
+		return a.User < b.User
+	}
+	return a.Pass < b.Pass
+}
+
+// latencyLess orders measurements: known (positive) before unknown, then
+// fastest, then by handshake and connect time.
+func latencyLess(a, b ProxyNode) bool {
+	aKnown, bKnown := a.LatencyMS > 0, b.LatencyMS > 0
+	if aKnown != bKnown {
+		return aKnown
+	}
+	if a.LatencyMS != b.LatencyMS {
+		return a.LatencyMS < b.LatencyMS
+	}
+	if a.HandshakeMS != b.HandshakeMS {
+		return a.HandshakeMS < b.HandshakeMS
+	}
+	return a.ConnectMS < b.ConnectMS
+}
+
 func splitHostPortLoose(s string) (host, port string, ok bool) {
 	if strings.Count(s, ":") == 1 {
 		parts := strings.SplitN(s, ":", 2)
@@ -0,0 +1,187 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProxyLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{"single", "1.2.3.4:1080", []string{"socks5://1.2.3.4:1080"}},
+		{"single padded", "  http://1.2.3.4:3128\t", []string{"http://1.2.3.4:3128"}},
+		// The tag list's comma is not a separator.
+		{"single with tags", "1.2.3.4:1080#tag=a,b", []string{"socks5://1.2.3.4:1080"}},
+		{"commas", "1.2.3.4:1080,5.6.7.8:1080", []string{"socks5://1.2.3.4:1080", "socks5://5.6.7.8:1080"}},
+		{"spaces", "1.2.3.4:1080 5.6.7.8:1080", []string{"socks5://1.2.3.4:1080", "socks5://5.6.7.8:1080"}},
+		{"mixed", "1.2.3.4:1080, http://5.6.7.8:3128\t9.9.9.9:1081 ,,", []string{"socks5://1.2.3.4:1080", "http://5.6.7.8:3128", "socks5://9.9.9.9:1081"}},
+		{"invalid tokens skipped", "1.2.3.4:1080, garbage, 5.6.7.8", []string{"socks5://1.2.3.4:1080"}},
+		{"comment", "# 1.2.3.4:1080, 5.6.7.8:1080", nil},
+		{"blank", "   ", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, n := range ParseProxyLine(tt.line, "") {
+				got = append(got, n.Type+"://"+n.Addr())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("ParseProxyLine(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchFromURLSeparators(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "1.2.3.4:1080\n5.6.7.8:1080,9.9.9.9:1080\n1.2.3.4:1080 8.8.8.8:1080\t8.8.4.4:1080\n")
+	}))
+	defer srv.Close()
+
+	nodes, err := FetchFromURL(context.Background(), srv.URL, ProxyTypeSOCKS5)
+	if err != nil {
+		t.Fatalf("FetchFromURL() = %v", err)
+	}
+	var got []string
+	for _, n := range nodes {
+		got = append(got, n.Addr())
+		if n.Source != srv.URL {
+			t.Errorf("%s: source = %q, want %q", n.Addr(), n.Source, srv.URL)
+		}
+	}
+	want := "1.2.3.4:1080 5.6.7.8:1080 9.9.9.9:1080 8.8.8.8:1080 8.8.4.4:1080"
+	if strings.Join(got, " ") != want {
+		t.Errorf("nodes = %v, want %s", got, want)
+	}
+}
+
+func TestMergeDedupOrderIndependent(t *testing.T) {
+	bare := node("1.2.3.4", "1080", 0)
+	creds := bare
+	creds.User, creds.Pass, creds.Tags = "alice", "s3cret", []string{"eu", "premium"}
+	otherCreds := creds
+	otherCreds.User, otherCreds.Pass = "bob", "hunter2"
+	fast, slow := node("1.2.3.4", "1080", 50), node("1.2.3.4", "1080", 200)
+	fast.Country, slow.Country = "DE", "FR"
+	slow.Tags = []string{"eu", "residential"}
+	dns := bare
+	dns.RemoteDNS, dns.GuessedType = true, true
+	failed := creds
+	failed.AuthFailed = true
+
+	pairs := []struct {
+		name string
+		a, b ProxyNode
+	}{
+		{"credentials vs bare", creds, bare},
+		{"two credentials", creds, otherCreds},
+		{"latency and country", fast, slow},
+		{"measured vs unmeasured", slow, bare},
+		{"tags union", creds, slow},
+		{"remote dns", dns, bare},
+		{"auth failed copy", failed, creds},
+		{"identical", creds, creds},
+	}
+	for _, p := range pairs {
+		t.Run(p.name, func(t *testing.T) {
+			ab := MergeDedup([]ProxyNode{p.a}, []ProxyNode{p.b})
+			ba := MergeDedup([]ProxyNode{p.b}, []ProxyNode{p.a})
+			if len(ab) != 1 || len(ba) != 1 {
+				t.Fatalf("merged into %d and %d nodes, want 1", len(ab), len(ba))
+			}
+			if !reflect.DeepEqual(ab[0], ba[0]) {
+				t.Errorf("merge(a, b) = %+v\nmerge(b, a) = %+v", ab[0], ba[0])
+			}
+			if ab[0].ID != "1.2.3.4:1080" {
+				t.Errorf("ID = %q", ab[0].ID)
+			}
+		})
+	}
+}
+
+func TestMergeDedupPrefersRicher(t *testing.T) {
+	static := node("1.2.3.4", "1080", 0)
+	static.User, static.Pass, static.Tags, static.Country = "alice", "s3cret", []string{"premium"}, "DE"
+	fetched := node("1.2.3.4", "1080", 120)
+	fetched.Tags = []string{"eu"}
+	fetched.Source = "https://lists.example/p.txt"
+	other := node("5.6.7.8", "1080", 0)
+
+	got := MergeDedup([]ProxyNode{fetched, other}, []ProxyNode{static})
+	if len(got) != 2 || got[0].Addr() != "1.2.3.4:1080" || got[1].Addr() != "5.6.7.8:1080" {
+		t.Fatalf("MergeDedup() = %v, want first-seen order", got)
+	}
+	n := got[0]
+	if n.User != "alice" || n.Pass != "s3cret" || n.Country != "DE" || n.LatencyMS != 120 || n.Source != fetched.Source {
+		t.Errorf("merged = %+v, want credentials and country from the static copy, latency and source from the fetched one", n)
+	}
+	if fmt.Sprint(n.Tags) != "[eu premium]" {
+		t.Errorf("tags = %v, want the union", n.Tags)
+	}
+	if got[1].LatencyMS != -1 {
+		t.Errorf("unmeasured latency = %d, want -1", got[1].LatencyMS)
+	}
+}
+
+// TestLargeSourceBounds runs a synthetic 500k-line source through parsing,
+// dedup, the sighting tracker and the type cache, checking each table stays
+// within its cap.
+func TestLargeSourceBounds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test")
+	}
+	const lines = 500_000
+	addr := func(i int) string { return fmt.Sprintf("1.%d.%d.%d:1080", i>>16&255, i>>8&255, i&255) }
+	var b strings.Builder
+	for i := 0; i < lines; i++ {
+		b.WriteString(addr(i))
+		b.WriteByte('\n')
+	}
+	// An early duplicate is still remembered and dropped; one past the
+	// dedup cap is kept for MergeDedup.
+	b.WriteString(addr(0) + "\n" + addr(400_000) + "\n")
+
+	nodes, err := parseProxyList(strings.NewReader(b.String()), ProxyTypeSOCKS5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != lines+1 {
+		t.Fatalf("parsed %d nodes, want %d", len(nodes), lines+1)
+	}
+	if merged := MergeDedup(nodes); len(merged) != lines {
+		t.Fatalf("MergeDedup left %d nodes, want %d", len(merged), lines)
+	}
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	seen := NewSeenTracker(0)
+	seen.Observe(nodes, now)
+	if got := seen.Len(); got != maxSeenEntries {
+		t.Errorf("SeenTracker.Len() = %d, want the cap %d", got, maxSeenEntries)
+	}
+	if _, ok := seen.Get(nodes[0].Addr()); !ok {
+		t.Error("SeenTracker dropped a node it had room for")
+	}
+
+	types := NewTypeCache(time.Hour)
+	for _, n := range nodes {
+		types.put(n.Addr(), ProxyTypeSOCKS5, now)
+	}
+	if got := types.Len(); got != maxTypeCacheEntries {
+		t.Errorf("TypeCache.Len() = %d, want the cap %d", got, maxTypeCacheEntries)
+	}
+	// Once the entries expire, a full cache makes room again.
+	types.put("9.9.9.9:1080", ProxyTypeHTTP, now.Add(time.Hour+time.Second))
+	if got, ok := types.get("9.9.9.9:1080", now.Add(time.Hour+time.Second)); !ok || got != ProxyTypeHTTP || types.Len() != 1 {
+		t.Errorf("put after expiry = %q, %v with %d entries; want only the new one", got, ok, types.Len())
+	}
+}
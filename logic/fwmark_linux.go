@@ -0,0 +1,47 @@
+//go:build linux
+
+package logic
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// FwmarkSupported reports whether DialOptions.Mark works on this platform.
+const FwmarkSupported = true
+
+func fwmarkControl(mark uint32) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			return fwmarkError(mark, serr)
+		}
+		return nil
+	}
+}
+
+// CheckFwmark sets mark on a throwaway socket, so a missing capability is
+// reported once at startup rather than on every dial.
+func CheckFwmark(mark uint32) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)); err != nil {
+		return fwmarkError(mark, err)
+	}
+	return nil
+}
+
+func fwmarkError(mark uint32, err error) error {
+	if err == syscall.EPERM {
+		return fmt.Errorf("set SO_MARK %#x on outbound socket: %w (needs CAP_NET_ADMIN)", mark, err)
+	}
+	return fmt.Errorf("set SO_MARK %#x on outbound socket: %w", mark, err)
+}
@@ -0,0 +1,127 @@
+//go:build linux
+
+package logic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withMark sets the dial options' mark for the rest of the test.
+func withMark(t *testing.T, mark uint32) {
+	t.Helper()
+	prev := currentDialOptions()
+	o := prev
+	o.Mark = mark
+	SetDialOptions(o)
+	t.Cleanup(func() { SetDialOptions(prev) })
+}
+
+func socketMark(t *testing.T, c net.Conn) int {
+	t.Helper()
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		t.Fatalf("%T has no socket", c)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	var gerr error
+	if err := raw.Control(func(fd uintptr) {
+		mark, gerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if gerr != nil {
+		t.Fatalf("getsockopt SO_MARK: %v", gerr)
+	}
+	return mark
+}
+
+// TestFwmarkControl dials with a mark set: with CAP_NET_ADMIN the socket
+// carries the mark, without it the dial fails naming the mark and the
+// capability.
+func TestFwmarkControl(t *testing.T) {
+	const mark = 0x2a
+	if DialControl() != nil {
+		t.Fatal("DialControl() without a mark is not nil")
+	}
+	if newDialer(time.Second).Control != nil {
+		t.Fatal("an unmarked dialer has a Control hook")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	withMark(t, mark)
+	if DialControl() == nil || newDialer(time.Second).Control == nil {
+		t.Fatal("a mark is set but dialers have no Control hook")
+	}
+
+	// The hook runs on the socket before connect; a recording wrapper
+	// around it sees every marked dial.
+	var calls []string
+	d := newDialer(time.Second)
+	hook := d.Control
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		calls = append(calls, network+" "+address)
+		return hook(network, address, c)
+	}
+	_, hookErr := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if len(calls) != 1 || calls[0] != "tcp4 "+ln.Addr().String() {
+		t.Errorf("Control hook calls = %v, want one for %s", calls, ln.Addr())
+	}
+
+	conn, err := DialDirect(context.Background(), "tcp", ln.Addr().String(), time.Second)
+	if CheckFwmark(mark) != nil {
+		// No CAP_NET_ADMIN here: every dial fails the same descriptive way.
+		for _, err := range []error{hookErr, err} {
+			if err == nil || !errors.Is(err, syscall.EPERM) || !strings.Contains(err.Error(), "0x2a") || !strings.Contains(err.Error(), "CAP_NET_ADMIN") {
+				t.Errorf("marked dial without CAP_NET_ADMIN = %v, want EPERM naming the mark and capability", err)
+			}
+		}
+		return
+	}
+	if hookErr != nil || err != nil {
+		t.Fatalf("marked dials = %v, %v", hookErr, err)
+	}
+	defer conn.Close()
+	if got := socketMark(t, conn); got != mark {
+		t.Errorf("SO_MARK = %#x, want %#x", got, mark)
+	}
+}
+
+func TestFwmarkError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{syscall.EPERM, "set SO_MARK 0x10 on outbound socket: operation not permitted (needs CAP_NET_ADMIN)"},
+		{syscall.EBADF, "set SO_MARK 0x10 on outbound socket: bad file descriptor"},
+	}
+	for _, tt := range tests {
+		err := fwmarkError(0x10, tt.err)
+		if err.Error() != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("fwmarkError(%v) = %q, want %q wrapping it", tt.err, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package logic
+
+import (
+	"errors"
+	"syscall"
+)
+
+// FwmarkSupported reports whether DialOptions.Mark works on this platform.
+const FwmarkSupported = false
+
+var errFwmarkUnsupported = errors.New("SO_MARK is only supported on Linux")
+
+func fwmarkControl(uint32) func(network, address string, c syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error { return errFwmarkUnsupported }
+}
+
+func CheckFwmark(uint32) error { return errFwmarkUnsupported }
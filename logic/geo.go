@@ -0,0 +1,141 @@
+package logic
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// euCountries are the EU member states, preferred for targets under .eu
+// and the members' own TLDs.
+var euCountries = []string{
+	"AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GR", "HR", "HU",
+	"IE", "IT", "LT", "LU", "LV", "MT", "NL", "PL", "PT", "RO", "SE", "SI", "SK",
+}
+
+// vanityTLDs are country-code TLDs mostly used without regard to the
+// country, so they imply no preference.
+var vanityTLDs = map[string]struct{}{
+	"ai": {}, "cc": {}, "co": {}, "fm": {}, "gg": {}, "io": {}, "ly": {},
+	"me": {}, "so": {}, "to": {}, "tv": {}, "ws": {},
+}
+
+// GeoAffinity maps client targets to the upstream countries preferred for
+// them. Host names match by their longest suffix in the table, then by
+// country-code TLD ("jp" prefers JP, EU members and "eu" prefer the EU);
+// they are never resolved. IP literals match the CIDR entries of the
+// table, then the country Lookup places them in, which prefers what that
+// country's TLD would. A nil *GeoAffinity prefers nothing.
+type GeoAffinity struct {
+	// Lookup, when set, places IP literals no CIDR entry matches, e.g. a
+	// GeoIP database reader.
+	Lookup CountryLookup
+
+	suffixes map[string][]string
+	prefixes []geoPrefix
+}
+
+// CountryLookup returns the ISO country code of an address, or false when
+// it does not know it. It must be safe for concurrent use.
+type CountryLookup interface {
+	Country(ip netip.Addr) (string, bool)
+}
+
+type geoPrefix struct {
+	p         netip.Prefix
+	countries []string
+}
+
+// NewGeoAffinity returns the default mapping extended by table, whose keys
+// are domain suffixes ("co.jp", ".example.com") or CIDRs ("203.0.113.0/24")
+// and whose values are country codes. An entry with no countries removes
+// the default for its suffix.
+func NewGeoAffinity(table map[string][]string) (*GeoAffinity, error) {
+	g := &GeoAffinity{suffixes: map[string][]string{"eu": euCountries, "uk": {"GB"}}}
+	for _, c := range euCountries {
+		g.suffixes[strings.ToLower(c)] = euCountries
+	}
+	for key, list := range table {
+		countries := make([]string, 0, len(list))
+		for _, c := range list {
+			c = strings.ToUpper(strings.TrimSpace(c))
+			if len(c) != 2 || c[0] < 'A' || c[0] > 'Z' || c[1] < 'A' || c[1] > 'Z' {
+				return nil, fmt.Errorf("geo table %q: invalid country code %q", key, c)
+			}
+			countries = append(countries, c)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.Contains(key, "/") {
+			p, err := netip.ParsePrefix(key)
+			if err != nil {
+				return nil, fmt.Errorf("geo table %q: %v", key, err)
+			}
+			g.prefixes = append(g.prefixes, geoPrefix{p: p.Masked(), countries: countries})
+			continue
+		}
+		key = strings.Trim(strings.TrimPrefix(key, "*"), ".")
+		if key == "" {
+			return nil, fmt.Errorf("geo table: empty domain suffix")
+		}
+		g.suffixes[key] = countries
+	}
+	return g, nil
+}
+
+// Countries returns the countries preferred for addr (host:port or host),
+// or nil for no preference.
+func (g *GeoAffinity) Countries(addr string) []string {
+	if g == nil {
+		return nil
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return g.forIP(ip.Unmap())
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for suffix := host; suffix != ""; {
+		if countries, ok := g.suffixes[suffix]; ok {
+			return countries
+		}
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	tld := host[strings.LastIndexByte(host, '.')+1:]
+	if _, ok := vanityTLDs[tld]; ok || len(tld) != 2 {
+		return nil
+	}
+	return []string{strings.ToUpper(tld)}
+}
+
+// forIP returns the countries of the longest CIDR entry containing ip, or
+// those of the country Lookup finds.
+func (g *GeoAffinity) forIP(ip netip.Addr) []string {
+	var best *geoPrefix
+	for i := range g.prefixes {
+		p := &g.prefixes[i]
+		if p.p.Contains(ip) && (best == nil || p.p.Bits() > best.p.Bits()) {
+			best = p
+		}
+	}
+	if best != nil {
+		return best.countries
+	}
+	if g.Lookup == nil {
+		return nil
+	}
+	c, ok := g.Lookup.Country(ip)
+	if !ok || len(c) != 2 {
+		return nil
+	}
+	if countries, ok := g.suffixes[strings.ToLower(c)]; ok {
+		return countries
+	}
+	return []string{strings.ToUpper(c)}
+}
@@ -0,0 +1,99 @@
+package logic
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// fakeLookup places addresses by a fixed table.
+type fakeLookup map[string]string
+
+func (f fakeLookup) Country(ip netip.Addr) (string, bool) {
+	c, ok := f[ip.String()]
+	return c, ok
+}
+
+func TestGeoAffinityCountries(t *testing.T) {
+	g, err := NewGeoAffinity(map[string][]string{
+		"example.com":     {"us"},
+		"*.shop.example":  {"FR", "BE"},
+		"de":              {},
+		"203.0.113.0/24":  {"JP"},
+		"203.0.113.64/26": {"KR"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Lookup = fakeLookup{"192.0.2.1": "fr", "192.0.2.2": "JP", "192.0.2.3": "DE", "203.0.113.70": "US"}
+
+	tests := []struct {
+		addr string
+		want []string
+	}{
+		{"www.yahoo.co.jp:443", []string{"JP"}},
+		{"news.bbc.co.uk", []string{"GB"}},
+		{"europa.eu:443", euCountries},
+		{"lemonde.fr:443", euCountries},
+		{"spiegel.de:443", []string{}},
+		{"api.example.com:443", []string{"US"}},
+		{"a.shop.example:80", []string{"FR", "BE"}},
+		{"github.io:443", nil},
+		{"example.org:443", nil},
+		{"localhost:80", nil},
+		{"203.0.113.5:443", []string{"JP"}},
+		{"203.0.113.70:443", []string{"KR"}},
+		{"192.0.2.1:443", euCountries},
+		{"192.0.2.2", []string{"JP"}},
+		{"192.0.2.3:80", []string{}},
+		{"192.0.2.9:443", nil},
+		{"[::ffff:192.0.2.2]:443", []string{"JP"}},
+	}
+	for _, tt := range tests {
+		if got := g.Countries(tt.addr); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Countries(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	var none *GeoAffinity
+	if got := none.Countries("yahoo.co.jp:443"); got != nil {
+		t.Errorf("nil GeoAffinity Countries() = %v, want nil", got)
+	}
+}
+
+func TestNewGeoAffinityRejects(t *testing.T) {
+	for _, table := range []map[string][]string{
+		{"example.com": {"USA"}},
+		{"example.com": {"1A"}},
+		{"203.0.113.0/33": {"JP"}},
+		{"*.": {"JP"}},
+	} {
+		if _, err := NewGeoAffinity(table); err == nil {
+			t.Errorf("NewGeoAffinity(%v) = nil error", table)
+		}
+	}
+}
+
+func TestNextPreferring(t *testing.T) {
+	jp := ProxyNode{Type: ProxyTypeSOCKS5, IP: "203.0.113.1", Port: "1080", Country: "JP"}
+	us := ProxyNode{Type: ProxyTypeSOCKS5, IP: "203.0.113.2", Port: "1080", Country: "US"}
+	unknown := node("203.0.113.3", "1080", 0)
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{us, jp, unknown})
+
+	for i := 0; i < 2; i++ {
+		if n, ok := m.NextPreferring([]string{"jp"}); !ok || n.Addr() != jp.Addr() {
+			t.Fatalf("NextPreferring(jp) = %s, %v; want %s", n.Addr(), ok, jp.Addr())
+		}
+	}
+	// No node from the preferred region: the caller falls back to Next.
+	if n, ok := m.NextPreferring(euCountries); ok {
+		t.Errorf("NextPreferring(EU) = %s, want no node", n.Addr())
+	}
+	if n, _ := m.Current(); n.Addr() != jp.Addr() {
+		t.Errorf("a failed NextPreferring moved the current node to %s", n.Addr())
+	}
+	if n, ok := m.NextPreferring(nil); ok {
+		t.Errorf("NextPreferring(nil) = %s, want no node", n.Addr())
+	}
+}
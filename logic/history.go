@@ -0,0 +1,62 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	RotationReasonScheduled     = "scheduled"
+	RotationReasonManualNext    = "manual_next"
+	RotationReasonManualPromote = "manual_promote"
+)
+
+type RotationEvent struct {
+	At     time.Time `json:"at"`
+	Mode   string    `json:"mode"`
+	From   string    `json:"from,omitempty"`
+	To     string    `json:"to,omitempty"`
+	Reason string    `json:"reason"`
+}
+
+// RotationHistory keeps the most recent rotation events in memory.
+type RotationHistory struct {
+	mu     sync.RWMutex
+	events []RotationEvent
+	max    int
+	total  int64
+}
+
+func NewRotationHistory(max int) *RotationHistory {
+	if max <= 0 {
+		max = 100
+	}
+	return &RotationHistory{max: max}
+}
+
+func (h *RotationHistory) Record(e RotationEvent) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+	h.total++
+	if len(h.events) > h.max {
+		h.events = append([]RotationEvent(nil), h.events[len(h.events)-h.max:]...)
+	}
+}
+
+// Events returns recorded events, oldest first.
+func (h *RotationHistory) Events() []RotationEvent {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]RotationEvent(nil), h.events...)
+}
+
+// Total returns how many events were recorded, including evicted ones.
+func (h *RotationHistory) Total() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.total
+}
@@ -0,0 +1,186 @@
+package logic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP CONNECT negotiation failures, wrapped in *UpstreamError by
+// dialViaHTTPS.
+var (
+	// ErrHTTPProxyAuth is a 407 reply: missing or rejected credentials.
+	ErrHTTPProxyAuth = errors.New("http connect: proxy authentication required")
+	// ErrHTTPConnectMalformed covers replies that are not HTTP.
+	ErrHTTPConnectMalformed = errors.New("http connect: malformed reply")
+)
+
+// HTTPConnectError is a non-2xx, non-407 reply to CONNECT.
+type HTTPConnectError struct {
+	Code   int
+	Status string
+}
+
+func (e *HTTPConnectError) Error() string {
+	return "http connect: " + strconv.Itoa(e.Code) + " " + e.Status
+}
+
+// maxConnectHeaderLines bounds the reply header a proxy may send.
+const maxConnectHeaderLines = 100
+
+// dialViaHTTPS connects to node over TLS (SNI from node.SNI, else its IP;
+// node.Insecure skips certificate verification), or plain TCP for
+// ProxyTypeHTTP, and asks it to CONNECT to addr.
+func dialViaHTTPS(ctx context.Context, node ProxyNode, network, addr string, timeout time.Duration) (Conn, DialTiming, error) {
+	var timing DialTiming
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, timing, fmt.Errorf("%s upstream only supports tcp, got %q", node.Type, network)
+	}
+	if _, _, err := splitTarget(addr); err != nil {
+		return nil, timing, err
+	}
+
+	start := time.Now()
+	raw, err := newDialer(timeout).DialContext(ctx, "tcp", node.Addr())
+	if err != nil {
+		return nil, timing, &UpstreamError{Proxy: node.Addr(), Err: err}
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if dl, ok := ctx.Deadline(); ok && (deadline.IsZero() || dl.Before(deadline)) {
+		deadline = dl
+	}
+	_ = raw.SetDeadline(deadline)
+
+	// Abort blocking reads/writes when ctx is cancelled.
+	stop := context.AfterFunc(ctx, func() { _ = raw.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	conn := raw
+	if node.Type == ProxyTypeHTTPS {
+		serverName := node.SNI
+		if serverName == "" {
+			serverName = node.IP
+		}
+		tc := tls.Client(raw, &tls.Config{ServerName: serverName, InsecureSkipVerify: node.Insecure})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = raw.Close()
+			if isTimeout(err) || ctx.Err() != nil {
+				return nil, timing, &UpstreamError{Proxy: node.Addr(), Err: ctxErrOr(ctx, err)}
+			}
+			return nil, timing, &DialError{Category: DialErrTLS, Proxy: node.Addr(), Err: err}
+		}
+		conn = tc
+	}
+	timing.HandshakeMS = time.Since(start).Milliseconds()
+
+	connectStart := time.Now()
+	br, err := httpConnect(conn, node, addr)
+	if err != nil {
+		_ = conn.Close()
+		var replyErr *HTTPConnectError
+		if errors.As(err, &replyErr) {
+			return nil, timing, err
+		}
+		return nil, timing, &UpstreamError{Proxy: node.Addr(), Err: ctxErrOr(ctx, err)}
+	}
+	timing.ConnectMS = time.Since(connectStart).Milliseconds()
+
+	if !stop() {
+		_ = conn.Close()
+		return nil, timing, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	var out net.Conn = conn
+	if br.Buffered() > 0 {
+		// The target may already have spoken; keep what was read ahead.
+		out = &bufferedConn{Conn: conn, r: br}
+	}
+	return withIdleTimeout(out, currentDialOptions().IdleTimeout), timing, nil
+}
+
+// httpConnect sends CONNECT addr on conn and reads the reply header. It
+// accepts HTTP/1.0 and HTTP/1.1 status lines and skips any header lines up
+// to the blank line, including non-header junk some proxies send there. The
+// returned reader may hold tunnel bytes read past the header.
+func httpConnect(conn net.Conn, node ProxyNode, addr string) (*bufio.Reader, error) {
+	var b strings.Builder
+	b.WriteString("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n")
+	if node.User != "" || node.Pass != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(node.User + ":" + node.Pass))
+		b.WriteString("Proxy-Authorization: Basic " + cred + "\r\n")
+	}
+	b.WriteString("\r\n")
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	line, err := readConnectLine(br)
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	if proto != "HTTP/1.0" && proto != "HTTP/1.1" {
+		return nil, fmt.Errorf("%w: %q", ErrHTTPConnectMalformed, line)
+	}
+	codeStr, status, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || code < 100 || code > 999 {
+		return nil, fmt.Errorf("%w: %q", ErrHTTPConnectMalformed, line)
+	}
+	for i := 0; ; i++ {
+		if i == maxConnectHeaderLines {
+			return nil, fmt.Errorf("%w: header too long", ErrHTTPConnectMalformed)
+		}
+		l, err := readConnectLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if l == "" {
+			break
+		}
+	}
+	switch {
+	case code == 407:
+		return nil, ErrHTTPProxyAuth
+	case code < 200 || code > 299:
+		return nil, &HTTPConnectError{Code: code, Status: status}
+	}
+	return br, nil
+}
+
+func readConnectLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: line too long", ErrHTTPConnectMalformed)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// bufferedConn reads from r before the underlying conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,153 @@
+package logic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a server config with httptest's self-signed
+// certificate for 127.0.0.1.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	s := httptest.NewUnstartedServer(nil)
+	s.StartTLS()
+	cfg := &tls.Config{Certificates: s.TLS.Certificates}
+	s.Close()
+	return cfg
+}
+
+// connectProxy is an HTTP CONNECT proxy over TLS (or plain TCP when cfg is
+// nil) that answers every CONNECT with reply, then echoes the tunnel. The
+// request header of the last CONNECT is sent on requests.
+func connectProxy(t *testing.T, cfg *tls.Config, reply string) (host, port string, requests <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if cfg != nil {
+		ln = tls.NewListener(ln, cfg)
+	}
+	reqs := make(chan string, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				var req strings.Builder
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					req.WriteString(line)
+					if line == "\r\n" {
+						break
+					}
+				}
+				reqs <- req.String()
+				io.WriteString(c, reply)
+				io.Copy(c, br)
+			}()
+		}
+	}()
+	host, port, _ = net.SplitHostPort(ln.Addr().String())
+	return host, port, reqs
+}
+
+func TestDialViaHTTPS(t *testing.T) {
+	cfg := testTLSConfig(t)
+	tests := []struct {
+		name     string
+		reply    string
+		plain    bool
+		wantErr  error
+		wantCat  string
+		wantRead string
+	}{
+		{name: "ok", reply: "HTTP/1.1 200 Connection established\r\n\r\n"},
+		{name: "HTTP/1.0 with headers", reply: "HTTP/1.0 200 OK\r\nProxy-Agent: test\r\nVia: 1.0 p\r\n\r\n"},
+		{name: "body before the blank line", reply: "HTTP/1.1 200 OK\r\nthis is not a header\r\n<html>tunnel ready</html>\r\n\r\n"},
+		{name: "tunnel bytes read ahead", reply: "HTTP/1.1 200 OK\r\n\r\nhello", wantRead: "hello"},
+		{name: "plain http", reply: "HTTP/1.1 200 OK\r\n\r\n", plain: true},
+		{name: "407", reply: "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n", wantErr: ErrHTTPProxyAuth, wantCat: DialErrAuth},
+		{name: "403", reply: "HTTP/1.1 403 Forbidden\r\n\r\n", wantCat: "http_403"},
+		{name: "not HTTP", reply: "SSH-2.0-OpenSSH_9.6\r\n\r\n", wantErr: ErrHTTPConnectMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srvCfg, typ := cfg, ProxyTypeHTTPS
+			if tt.plain {
+				srvCfg, typ = nil, ProxyTypeHTTP
+			}
+			host, port, reqs := connectProxy(t, srvCfg, tt.reply)
+			n := ProxyNode{Type: typ, IP: host, Port: port, User: "alice", Pass: "s3cret", Insecure: true}
+
+			conn, err := DialViaProxy(context.Background(), n, "tcp", "example.com:443", 2*time.Second)
+			if tt.wantErr != nil || tt.wantCat != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatal("DialViaProxy() succeeded")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("DialViaProxy() = %v, want %v", err, tt.wantErr)
+				}
+				if tt.wantCat != "" && DialErrorCategory(err) != tt.wantCat {
+					t.Errorf("category = %q, want %q", DialErrorCategory(err), tt.wantCat)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DialViaProxy() = %v", err)
+			}
+			defer conn.Close()
+			req := <-reqs
+			if !strings.HasPrefix(req, "CONNECT example.com:443 HTTP/1.1\r\n") || !strings.Contains(req, "Proxy-Authorization: Basic YWxpY2U6czNjcmV0\r\n") {
+				t.Errorf("request = %q", req)
+			}
+
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			want := tt.wantRead + "ping"
+			go conn.Write([]byte("ping"))
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != want {
+				t.Errorf("tunnel read %q, %v; want %q", got, err, want)
+			}
+		})
+	}
+}
+
+func TestDialViaHTTPSVerifiesCertificate(t *testing.T) {
+	host, port, _ := connectProxy(t, testTLSConfig(t), "HTTP/1.1 200 OK\r\n\r\n")
+	n := ProxyNode{Type: ProxyTypeHTTPS, IP: host, Port: port}
+	_, err := DialViaProxy(context.Background(), n, "tcp", "example.com:443", 2*time.Second)
+	if DialErrorCategory(err) != DialErrTLS {
+		t.Fatalf("DialViaProxy() to a self-signed proxy = %v, want a tls error", err)
+	}
+}
+
+func TestParseHTTPSSpec(t *testing.T) {
+	n, ok := ParseProxySpec("https://u:p@1.2.3.4:8443?sni=proxy.example&insecure=1", "")
+	if !ok {
+		t.Fatal("ParseProxySpec() rejected an https spec")
+	}
+	if n.Type != ProxyTypeHTTPS || n.Addr() != "1.2.3.4:8443" || n.SNI != "proxy.example" || !n.Insecure || n.User != "u" || n.Pass != "p" {
+		t.Errorf("ParseProxySpec() = %+v", n)
+	}
+	if n, _ := ParseProxySpec("https://1.2.3.4:8443", ""); n.SNI != "" || n.Insecure {
+		t.Errorf("ParseProxySpec() without options = %+v", n)
+	}
+}
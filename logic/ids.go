@@ -0,0 +1,41 @@
+package logic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type (
+	requestIDKey  struct{}
+	clientAddrKey struct{}
+)
+
+// NewRequestID returns a random 16-hex-digit identifier.
+func NewRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// WithRequestID attaches id to ctx for web requests and SOCKS connections alike.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the id stored by WithRequestID, or "".
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithClientAddr attaches the client's remote address to ctx.
+func WithClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddrFrom returns the address stored by WithClientAddr, or "".
+func ClientAddrFrom(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	return addr
+}
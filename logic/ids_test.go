@@ -0,0 +1,35 @@
+package logic
+
+import (
+	"context"
+	"regexp"
+	"testing"
+)
+
+func TestNewRequestID(t *testing.T) {
+	hex16 := regexp.MustCompile(`^[0-9a-f]{16}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewRequestID()
+		if !hex16.MatchString(id) {
+			t.Fatalf("NewRequestID() = %q, want 16 hex digits", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewRequestID() repeated %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRequestIDContext(t *testing.T) {
+	if id := RequestIDFrom(context.Background()); id != "" {
+		t.Errorf("RequestIDFrom(empty) = %q, want \"\"", id)
+	}
+	ctx := WithClientAddr(WithRequestID(context.Background(), "abc"), "10.0.0.1:5000")
+	if id := RequestIDFrom(ctx); id != "abc" {
+		t.Errorf("RequestIDFrom = %q, want abc", id)
+	}
+	if addr := ClientAddrFrom(ctx); addr != "10.0.0.1:5000" {
+		t.Errorf("ClientAddrFrom = %q, want 10.0.0.1:5000", addr)
+	}
+}
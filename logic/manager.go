@@ -1,14 +1,33 @@
 package logic
 
 import (
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
 	ProxyTypeSOCKS5 = "socks5"
+	// ProxyTypeHTTPS is HTTP CONNECT over a TLS connection to the proxy.
+	ProxyTypeHTTPS = "https"
+	// ProxyTypeHTTP is HTTP CONNECT over plain TCP.
+	ProxyTypeHTTP = "http"
+	// ProxyTypeSOCKS4 is only ever detected by ClassifyProxy; such nodes
+	// cannot be dialed and are dropped.
+	ProxyTypeSOCKS4 = "socks4"
+	// ProxyTypeInfer marks nodes from "infer" sources whose type is still
+	// to be detected.
+	ProxyTypeInfer = "infer"
 )
 
+// SupportedProxyType reports whether nodes of type t can be dialed.
+func SupportedProxyType(t string) bool {
+	return t == ProxyTypeSOCKS5 || t == ProxyTypeHTTPS || t == ProxyTypeHTTP
+}
+
 type ProxyNode struct {
 	ID      string `json:"id"`
 	Type    string `json:"type"`
@@ -17,22 +36,81 @@ type ProxyNode struct {
 	User    string `json:"user,omitempty"`
 	Pass    string `json:"pass,omitempty"`
 	Country string `json:"country,omitempty"`
+	// RemoteDNS makes the proxy resolve target host names (socks5h://).
+	RemoteDNS bool `json:"remote_dns,omitempty"`
+	// GuessedType marks a schemeless node typed SOCKS5 only by default;
+	// validation then also tries it as an HTTP proxy.
+	GuessedType bool `json:"-"`
+	// AuthFailed marks a node whose proxy rejected its credentials.
+	AuthFailed bool `json:"auth_failed,omitempty"`
+	// SNI overrides the TLS server name sent to https proxies (default: IP);
+	// Insecure skips verifying their certificate.
+	SNI      string `json:"sni,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+	// Source is the URL of the source list the node came from,
+	// SourceStatic for configured proxies or SourceAPI for added ones.
+	Source string `json:"source,omitempty"`
+	// Tags are free-form labels for grouping, given as a "#tag=a,b"
+	// fragment on the spec; kept normalized by NormalizeTags.
+	Tags []string `json:"tags,omitempty"`
+	// ExitIP is the address targets see, when validation looked it up
+	// (exit_ip_url).
+	ExitIP string `json:"exit_ip,omitempty"`
+	// DialTimeoutMS overrides the dial timeout for this node, given as a
+	// "#dial_timeout=2s" fragment on the spec; 0 leaves it to
+	// ProxyManager.DialTimeout.
+	DialTimeoutMS int64 `json:"dial_timeout_ms,omitempty"`
+	// Disabled marks a node taken out of selection under
+	// RemovalPolicyDisable; a successful probe re-enables it.
+	Disabled bool `json:"disabled,omitempty"`
 
 	LatencyMS int64 `json:"latency"`
+	// HandshakeMS is the time to reach the proxy itself (TCP + SOCKS5 greeting);
+	// ConnectMS is the time the proxy took to reach the test target.
+	HandshakeMS int64 `json:"handshake_ms"`
+	ConnectMS   int64 `json:"connect_ms"`
 }
 
+// Addr is the node's host:port, IPv6 hosts bracketed.
 func (n ProxyNode) Addr() string {
 	if n.IP == "" || n.Port == "" {
 		return ""
 	}
-	return n.IP + ":" + n.Port
+	return net.JoinHostPort(n.IP, n.Port)
 }
 
+// String is for display: the password, if any, shows as RedactedPassword.
 func (n ProxyNode) String() string {
+	addr := n.Addr()
+	if n.User != "" || n.Pass != "" {
+		addr = n.User + ":" + RedactedPassword + "@" + addr
+	}
 	if n.Type == "" {
-		return n.Addr()
+		return addr
 	}
-	return n.Type + "://" + n.Addr()
+	return n.Type + "://" + addr
+}
+
+// RedactedPassword stands in for proxy passwords in logs and API output.
+const RedactedPassword = "***"
+
+// Redacted returns n with its password, and any in its Source URL,
+// replaced by RedactedPassword.
+func (n ProxyNode) Redacted() ProxyNode {
+	if n.Pass != "" {
+		n.Pass = RedactedPassword
+	}
+	n.Source = RedactURL(n.Source)
+	return n
+}
+
+// RedactNodes returns a copy of nodes with passwords redacted.
+func RedactNodes(nodes []ProxyNode) []ProxyNode {
+	out := make([]ProxyNode, len(nodes))
+	for i, n := range nodes {
+		out[i] = n.Redacted()
+	}
+	return out
 }
 
 type Status struct {
@@ -44,17 +122,96 @@ type Status struct {
 
 	LastRefreshAt  time.Time `json:"last_refresh_at,omitempty"`
 	LastRefreshErr string    `json:"last_refresh_err,omitempty"`
+	// LastRefreshOKAt is the last refresh that produced a pool; a later
+	// LastRefreshAt means the refreshes since have failed.
+	LastRefreshOKAt time.Time `json:"last_refresh_ok_at,omitempty"`
+
+	OpenCircuits int `json:"open_circuits"`
+	Disabled     int `json:"disabled"`
+}
+
+// BreakerConfig configures the per-node circuit breaker. After Threshold
+// consecutive failures a node is "open" and skipped by Current and Next for
+// Cooldown; it is then "half-open" and admitted for a single probe, closing
+// on success and reopening on failure. A zero Threshold disables the breaker.
+type BreakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// Selection strategies for Next.
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyRandom     = "random"
+)
+
+// SelectionConfig configures how Next picks nodes. Strategy is
+// StrategyRoundRobin (the default), StrategyRandom or StrategyWeighted.
+// AvoidRepeat makes Next return a node other than the one it returned last
+// whenever the pool has more than one, and for a few picks skips nodes with
+// its exit IP too.
+//
+// For StrategyWeighted, a node's weight is its success rate divided by its
+// latency raised to LatencyExponent, and Explore is the share of picks
+// spread evenly over all nodes regardless of weight.
+type SelectionConfig struct {
+	Strategy    string
+	AvoidRepeat bool
+
+	LatencyExponent float64
+	Explore         float64
 }
 
+// What ReportFailure does with a node that reached its failure limit.
+const (
+	// RemovalPolicyRemove drops it from the pool until a refresh brings it
+	// back.
+	RemovalPolicyRemove = "remove"
+	// RemovalPolicyDisable keeps it in the pool, skipped by selection,
+	// until ReportSuccess, UpdateLatency or a refresh re-enables it.
+	RemovalPolicyDisable = "disable"
+)
+
+// maxRepeatTries bounds the reselections AvoidRepeat makes before stepping
+// to the neighbouring node.
+const maxRepeatTries = 4
+
 type ProxyManager struct {
+	// OnRemove, when set before use, is called (outside the lock) for every
+	// node dropped by ReportFailure or Remove, or disabled by ReportFailure.
+	OnRemove func(node ProxyNode)
+
 	mu sync.RWMutex
 
 	pool         []ProxyNode
 	currentIndex int
 	failures     map[string]int
 
+	breaker   BreakerConfig
+	openUntil map[string]time.Time
+
+	selection SelectionConfig
+	removal   string
+	// lastNext is the addr Next returned last, lastExit its exit IP.
+	lastNext string
+	lastExit string
+	// live holds per-node dial stats for StrategyWeighted and adaptive
+	// dial timeouts.
+	live     map[string]*liveStats
+	timeouts DialTimeoutConfig
+	// pinned, when set, is what Current returns (see Pin).
+	pinned *ProxyNode
+
+	// byType, byCountry and disabled (the count of Disabled nodes) are
+	// kept in step with pool so status reads don't have to walk or copy it.
+	byType    map[string]int
+	byCountry map[string]int
+	disabled  int
+
 	lastRefreshAt  time.Time
 	lastRefreshErr string
+	lastRefreshOKAt time.Time
+	lastSuccessAt  time.Time
 }
 
 func NewProxyManager() *ProxyManager { return &ProxyManager{} }
@@ -63,22 +220,257 @@ func NewProxyManagerAuto() *ProxyManager {
 	return &ProxyManager{currentIndex: -1}
 }
 
+// SetBreaker enables the circuit breaker. With the breaker on, ReportFailure
+// opens circuits instead of removing nodes.
+func (m *ProxyManager) SetBreaker(cfg BreakerConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cfg.Threshold > 0 && cfg.Cooldown <= 0 {
+		cfg.Cooldown = time.Minute
+	}
+	m.breaker = cfg
+}
+
+// SetSelection sets the strategy Next uses.
+func (m *ProxyManager) SetSelection(cfg SelectionConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.selection = cfg
+}
+
+// SetRemovalPolicy sets what ReportFailure does with failing nodes:
+// RemovalPolicyRemove (the default) or RemovalPolicyDisable.
+func (m *ProxyManager) SetRemovalPolicy(policy string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removal = policy
+}
+
+// admissibleLocked reports whether the breaker lets the node at addr be
+// selected at now: its circuit is closed, or open with the cooldown passed
+// (half-open). It changes nothing, so readers can ask it freely.
+func (m *ProxyManager) admissibleLocked(addr string, now time.Time) bool {
+	until, ok := m.openUntil[addr]
+	return !ok || !now.Before(until)
+}
+
+// admitLocked is admissibleLocked for a caller about to dial the node. A
+// half-open circuit is admitted once: it stays closed to other callers for
+// another cooldown while that probe runs.
+func (m *ProxyManager) admitLocked(addr string, now time.Time) bool {
+	if !m.admissibleLocked(addr, now) {
+		return false
+	}
+	if _, ok := m.openUntil[addr]; ok {
+		m.openUntil[addr] = now.Add(m.breaker.Cooldown)
+	}
+	return true
+}
+
+// selectLocked returns the first admissible index starting at start,
+// skipping disabled nodes and open circuits. With admit, the half-open node
+// it settles on is admitted for its probe; without, nothing changes and the
+// caller needs only the read lock. When every enabled node is open it
+// returns the first enabled one, so the pool degrades to no breaker rather
+// than to nothing; when every node is disabled it returns -1.
+func (m *ProxyManager) selectLocked(start int, admit bool) int {
+	if (m.breaker.Threshold <= 0 || len(m.openUntil) == 0) && m.disabled == 0 {
+		return start
+	}
+	now := time.Now()
+	fallback := -1
+	for i := 0; i < len(m.pool); i++ {
+		idx := (start + i) % len(m.pool)
+		if m.pool[idx].Disabled {
+			continue
+		}
+		if !m.admissibleLocked(m.pool[idx].Addr(), now) {
+			if fallback < 0 {
+				fallback = idx
+			}
+			continue
+		}
+		if admit {
+			m.admitLocked(m.pool[idx].Addr(), now)
+		}
+		return idx
+	}
+	return fallback
+}
+
 func (m *ProxyManager) SetPool(nodes []ProxyNode) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.pool = m.pool[:0]
+	m.pool = append(m.pool[:0], poolable(nodes)...)
+	m.recountLocked()
+
+	if m.currentIndex >= len(m.pool) {
+		m.currentIndex = 0
+	}
+	m.failures = make(map[string]int, 128)
+	m.openUntil = nil
+	m.pruneStateLocked()
+}
+
+// poolable returns the nodes a pool keeps: those of a supported type with
+// an address. It returns nodes itself when all qualify.
+func poolable(nodes []ProxyNode) []ProxyNode {
+	for i, n := range nodes {
+		if SupportedProxyType(n.Type) && n.Addr() != "" {
+			continue
+		}
+		out := append(make([]ProxyNode, 0, len(nodes)-1), nodes[:i]...)
+		for _, n := range nodes[i+1:] {
+			if SupportedProxyType(n.Type) && n.Addr() != "" {
+				out = append(out, n)
+			}
+		}
+		return out
+	}
+	return nodes
+}
+
+// MergeNodes adds the nodes missing from the pool and refreshes the latency
+// of those already in it, keeping failure counters, circuits and the current
+// node. When maxSize > 0 and the pool would grow past it, the worst of the
+// previously pooled nodes are evicted (failing ones first, then the slowest
+// by rankBy); the current node never is. New nodes are only dropped once no
+// old node is left to evict. It returns the evicted nodes.
+func (m *ProxyManager) MergeNodes(nodes []ProxyNode, maxSize int, rankBy string) []ProxyNode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index := make(map[string]int, len(m.pool))
+	for i, n := range m.pool {
+		index[n.Addr()] = i
+	}
+	var added []ProxyNode
 	for _, n := range nodes {
-		if n.Type != ProxyTypeSOCKS5 || n.Addr() == "" {
+		if !SupportedProxyType(n.Type) || n.Addr() == "" {
+			continue
+		}
+		i, ok := index[n.Addr()]
+		if !ok {
+			index[n.Addr()] = -1
+			added = append(added, n)
 			continue
 		}
-		m.pool = append(m.pool, n)
+		if i >= 0 {
+			// Found again by a refresh: back in rotation.
+			m.pool[i].Disabled = false
+		}
+		if i >= 0 && n.LatencyMS > 0 {
+			m.pool[i].LatencyMS = n.LatencyMS
+			m.pool[i].HandshakeMS = n.HandshakeMS
+			m.pool[i].ConnectMS = n.ConnectMS
+		}
 	}
 
+	current := ""
+	if m.currentIndex >= 0 && m.currentIndex < len(m.pool) {
+		current = m.pool[m.currentIndex].Addr()
+	}
+	var evicted []ProxyNode
+	if over := len(m.pool) + len(added) - maxSize; maxSize > 0 && over > 0 {
+		now := time.Now()
+		var worst []ProxyNode
+		for _, n := range m.pool {
+			if n.Addr() != current {
+				worst = append(worst, n)
+			}
+		}
+		SortNodes(worst, rankBy)
+		failing := func(n ProxyNode) bool {
+			until, open := m.openUntil[n.Addr()]
+			return n.Disabled || m.failures[n.Addr()] > 0 || (open && now.Before(until))
+		}
+		sort.SliceStable(worst, func(i, j int) bool { return !failing(worst[i]) && failing(worst[j]) })
+		for i := len(worst) - 1; i >= 0 && over > 0; i-- {
+			evicted = append(evicted, worst[i])
+			over--
+		}
+		if over > 0 {
+			SortNodes(added, rankBy)
+			added = added[:len(added)-over]
+		}
+	}
+
+	gone := make(map[string]struct{}, len(evicted))
+	for _, n := range evicted {
+		gone[n.Addr()] = struct{}{}
+		delete(m.failures, n.Addr())
+		delete(m.openUntil, n.Addr())
+	}
+	pool := make([]ProxyNode, 0, len(m.pool)+len(added))
+	for _, n := range m.pool {
+		if _, ok := gone[n.Addr()]; !ok {
+			pool = append(pool, n)
+		}
+	}
+	m.pool = append(pool, added...)
+	m.recountLocked()
+	m.pruneStateLocked()
+	if m.failures == nil {
+		m.failures = make(map[string]int, 128)
+	}
+	for i, n := range m.pool {
+		if n.Addr() == current {
+			m.currentIndex = i
+		}
+	}
 	if m.currentIndex >= len(m.pool) {
 		m.currentIndex = 0
 	}
-	m.failures = make(map[string]int, 128)
+	return evicted
+}
+
+// pruneStateLocked drops failure counts, circuits and live stats of nodes
+// no longer in the pool.
+func (m *ProxyManager) pruneStateLocked() {
+	if len(m.failures) == 0 && len(m.openUntil) == 0 && len(m.live) == 0 {
+		return
+	}
+	in := make(map[string]struct{}, len(m.pool))
+	for _, n := range m.pool {
+		in[n.Addr()] = struct{}{}
+	}
+	for addr := range m.failures {
+		if _, ok := in[addr]; !ok {
+			delete(m.failures, addr)
+		}
+	}
+	for addr := range m.openUntil {
+		if _, ok := in[addr]; !ok {
+			delete(m.openUntil, addr)
+		}
+	}
+	for addr := range m.live {
+		if _, ok := in[addr]; !ok {
+			delete(m.live, addr)
+		}
+	}
+}
+
+// ManagerMemory reports the sizes of a ProxyManager's per-node tables.
+type ManagerMemory struct {
+	Pool      int `json:"pool"`
+	Failures  int `json:"failures"`
+	Circuits  int `json:"circuits"`
+	Live      int `json:"live"`
+	Countries int `json:"countries"`
+}
+
+func (m *ProxyManager) Memory() ManagerMemory {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return ManagerMemory{
+		Pool:      len(m.pool),
+		Failures:  len(m.failures),
+		Circuits:  len(m.openUntil),
+		Live:      len(m.live),
+		Countries: len(m.byCountry),
+	}
 }
 
 func (m *ProxyManager) SetRefreshResult(at time.Time, err error) {
@@ -92,6 +484,13 @@ func (m *ProxyManager) SetRefreshResult(at time.Time, err error) {
 	}
 }
 
+// setRefreshOK records that the refresh at at replaced or topped up the pool.
+func (m *ProxyManager) setRefreshOK(at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastRefreshOKAt = at
+}
+
 func (m *ProxyManager) PoolSize() int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -110,30 +509,388 @@ func (m *ProxyManager) PoolSnapshot(limit int) []ProxyNode {
 	return out
 }
 
+// ForEach calls fn with every pool node in order, under the read lock,
+// until fn returns false. It spares read-only scans the copy PoolSnapshot
+// makes. fn must not call into the manager: a method taking the write lock
+// deadlocks, and one taking the read lock can once a writer is waiting.
+func (m *ProxyManager) ForEach(fn func(ProxyNode) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.pool {
+		if !fn(m.pool[i]) {
+			return
+		}
+	}
+}
+
+func (m *ProxyManager) recountLocked() {
+	m.byType = make(map[string]int, 1)
+	m.byCountry = make(map[string]int)
+	m.disabled = 0
+	for i := range m.pool {
+		m.byType[m.pool[i].Type]++
+		m.byCountry[m.pool[i].Country]++
+		if m.pool[i].Disabled {
+			m.disabled++
+		}
+	}
+}
+
+// PoolSizeByType returns the pool size per proxy type. The counts are
+// maintained on every pool change, so this never walks the pool.
+func (m *ProxyManager) PoolSizeByType() map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copyCounts(m.byType)
+}
+
+// CountByCountry returns the pool size per country ("" for unknown),
+// like PoolSizeByType.
+func (m *ProxyManager) CountByCountry() map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copyCounts(m.byCountry)
+}
+
+func copyCounts(in map[string]int) map[string]int {
+	out := make(map[string]int, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
+// Metrics is ComputePoolMetrics over the pool, computed under the read lock
+// instead of on a PoolSnapshot copy.
+func (m *ProxyManager) Metrics() PoolMetrics {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return ComputePoolMetrics(m.pool)
+}
+
+// Current returns the current node, or the next node with a closed circuit
+// when the current one is open or disabled; false when every node is
+// disabled. The current index is not moved, and a
+// half-open circuit is only looked at: status reads never use up its probe.
+// Callers about to dial the node use CurrentForDial.
 func (m *ProxyManager) Current() (ProxyNode, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.currentLocked(false)
+}
+
+// CurrentForDial is Current for a caller about to dial the node: a half-open
+// circuit it returns is admitted for its single probe, like Next does.
+func (m *ProxyManager) CurrentForDial() (ProxyNode, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.currentLocked(true)
+}
+
+func (m *ProxyManager) currentLocked(admit bool) (ProxyNode, bool) {
+	if m.pinned != nil {
+		return *m.pinned, true
+	}
 	if len(m.pool) == 0 {
 		return ProxyNode{}, false
 	}
 	if m.currentIndex < 0 || m.currentIndex >= len(m.pool) {
 		return ProxyNode{}, false
 	}
-	return m.pool[m.currentIndex], true
+	idx := m.selectLocked(m.currentIndex, admit)
+	if idx < 0 {
+		return ProxyNode{}, false
+	}
+	return m.pool[idx], true
 }
 
+// Next advances to the next node per the selection strategy, skipping
+// disabled nodes and open circuits. It returns false when the pool is empty
+// or every node in it is disabled.
 func (m *ProxyManager) Next() (ProxyNode, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pool) == 0 || !m.advanceLocked() {
+		return ProxyNode{}, false
+	}
+	if m.selection.AvoidRepeat && len(m.pool) > 1 {
+		for i := 0; i < maxRepeatTries && m.repeatsLocked(m.pool[m.currentIndex]); i++ {
+			m.advanceLocked()
+		}
+		if m.pool[m.currentIndex].Addr() == m.lastNext {
+			if idx := m.selectLocked((m.currentIndex+1)%len(m.pool), true); idx >= 0 {
+				m.currentIndex = idx
+			}
+		}
+	}
+	m.noteNextLocked(m.pool[m.currentIndex])
+	return m.pool[m.currentIndex], true
+}
+
+// repeatsLocked reports whether n is the node Next returned last, or shares
+// its exit IP: rotating between front-ends of one exit changes nothing seen
+// from outside.
+func (m *ProxyManager) repeatsLocked(n ProxyNode) bool {
+	return n.Addr() == m.lastNext || (n.ExitIP != "" && n.ExitIP == m.lastExit)
+}
+
+func (m *ProxyManager) noteNextLocked(n ProxyNode) {
+	m.lastNext, m.lastExit = n.Addr(), n.ExitIP
+}
+
+// advanceLocked moves the current index to the next admissible node
+// according to the selection strategy. It reports false, leaving the index
+// alone, when every node is disabled.
+func (m *ProxyManager) advanceLocked() bool {
+	var idx int
+	switch {
+	case m.selection.Strategy == StrategyWeighted:
+		idx = m.weightedIndexLocked()
+	case m.selection.Strategy == StrategyRandom:
+		idx = m.selectLocked(rand.IntN(len(m.pool)), true)
+	case m.currentIndex < 0:
+		idx = m.selectLocked(0, true)
+	default:
+		idx = m.selectLocked((m.currentIndex+1)%len(m.pool), true)
+	}
+	if idx < 0 {
+		return false
+	}
+	m.currentIndex = idx
+	return true
+}
+
+// NextHealthy advances like Next but skips nodes with recorded failures or an
+// open circuit, trying each node at most once. When none qualifies it returns
+// false and leaves the current index unchanged.
+func (m *ProxyManager) NextHealthy() (ProxyNode, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if len(m.pool) == 0 {
 		return ProxyNode{}, false
 	}
+	start := m.currentIndex + 1
 	if m.currentIndex < 0 {
-		m.currentIndex = 0
-	} else {
-		m.currentIndex = (m.currentIndex + 1) % len(m.pool)
+		start = 0
 	}
-	return m.pool[m.currentIndex], true
+	now := time.Now()
+	for i := 0; i < len(m.pool); i++ {
+		idx := (start + i) % len(m.pool)
+		addr := m.pool[idx].Addr()
+		if m.failures[addr] > 0 || m.pool[idx].Disabled {
+			continue
+		}
+		if until, ok := m.openUntil[addr]; ok && now.Before(until) {
+			continue
+		}
+		m.currentIndex = idx
+		m.noteNextLocked(m.pool[idx])
+		return m.pool[idx], true
+	}
+	return ProxyNode{}, false
+}
+
+// NextWithTag advances like NextHealthy, but to the next node carrying tag
+// that is enabled and not behind an open circuit. When none qualifies it
+// returns false and leaves the current index unchanged.
+func (m *ProxyManager) NextWithTag(tag string) (ProxyNode, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := m.currentIndex + 1
+	if m.currentIndex < 0 {
+		start = 0
+	}
+	now := time.Now()
+	for i := 0; i < len(m.pool); i++ {
+		idx := (start + i) % len(m.pool)
+		n := m.pool[idx]
+		if !n.HasTag(tag) || n.Disabled || !m.admitLocked(n.Addr(), now) {
+			continue
+		}
+		m.currentIndex = idx
+		m.noteNextLocked(n)
+		return n, true
+	}
+	return ProxyNode{}, false
+}
+
+// CurrentByType is CurrentForDial restricted to nodes of type typ: the
+// current node when it has that type, else the next enabled one that does,
+// past open circuits. The current index is not moved; a pin of another type
+// is ignored.
+func (m *ProxyManager) CurrentByType(typ string) (ProxyNode, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pinned != nil && m.pinned.Type == typ {
+		return *m.pinned, true
+	}
+	start := m.currentIndex
+	if start < 0 {
+		start = 0
+	}
+	return m.typedLocked(typ, start, false)
+}
+
+// NextByType advances like NextWithTag, but to the next node of type typ.
+// When none qualifies it returns false and leaves the current index
+// unchanged.
+func (m *ProxyManager) NextByType(typ string) (ProxyNode, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.typedLocked(typ, m.currentIndex+1, true)
+}
+
+// typedLocked returns the first enabled node of type typ from start whose
+// circuit admits a dial, admitting it. With move it becomes the current
+// node.
+func (m *ProxyManager) typedLocked(typ string, start int, move bool) (ProxyNode, bool) {
+	now := time.Now()
+	for i := 0; i < len(m.pool); i++ {
+		idx := (start + i) % len(m.pool)
+		n := m.pool[idx]
+		if n.Type != typ || n.Disabled || !m.admitLocked(n.Addr(), now) {
+			continue
+		}
+		if move {
+			m.currentIndex = idx
+			m.noteNextLocked(n)
+		}
+		return n, true
+	}
+	return ProxyNode{}, false
+}
+
+// NextPreferring advances like NextWithTag, but to the next node whose
+// country is one of countries (case-insensitive). When none qualifies it
+// returns false and leaves the current index unchanged, so callers can fall
+// back to Next.
+func (m *ProxyManager) NextPreferring(countries []string) (ProxyNode, bool) {
+	if len(countries) == 0 {
+		return ProxyNode{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := m.currentIndex + 1
+	if m.currentIndex < 0 {
+		start = 0
+	}
+	now := time.Now()
+	for i := 0; i < len(m.pool); i++ {
+		idx := (start + i) % len(m.pool)
+		n := m.pool[idx]
+		if n.Country == "" || !containsFold(countries, n.Country) || n.Disabled || !m.admitLocked(n.Addr(), now) {
+			continue
+		}
+		m.currentIndex = idx
+		m.noteNextLocked(n)
+		return n, true
+	}
+	return ProxyNode{}, false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCurrent points the current index at the pool node with the given addr.
+func (m *ProxyManager) SetCurrent(addr string) bool {
+	_, ok := m.SetCurrentByAddr(addr)
+	return ok
+}
+
+// SetCurrentByAddr is SetCurrent that also returns the selected node.
+func (m *ProxyManager) SetCurrentByAddr(addr string) (ProxyNode, bool) {
+	if addr == "" {
+		return ProxyNode{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, n := range m.pool {
+		if n.Addr() == addr {
+			m.currentIndex = i
+			return n, true
+		}
+	}
+	return ProxyNode{}, false
+}
+
+// Lookup returns the pool node with the given addr.
+func (m *ProxyManager) Lookup(addr string) (ProxyNode, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, n := range m.pool {
+		if n.Addr() == addr {
+			return n, true
+		}
+	}
+	return ProxyNode{}, false
+}
+
+// FindByCountry returns the first pool node whose Country matches
+// (case-insensitively), starting from the current index.
+func (m *ProxyManager) FindByCountry(country string) (ProxyNode, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if country == "" || len(m.pool) == 0 {
+		return ProxyNode{}, false
+	}
+	start := m.currentIndex
+	if start < 0 || start >= len(m.pool) {
+		start = 0
+	}
+	for i := 0; i < len(m.pool); i++ {
+		n := m.pool[(start+i)%len(m.pool)]
+		if strings.EqualFold(n.Country, country) {
+			return n, true
+		}
+	}
+	return ProxyNode{}, false
+}
+
+// Pin makes Current return node until Unpin, whatever happens to the pool
+// meanwhile: failures, circuits, removals and refreshes included. Next and
+// SetCurrent still move the index Current falls back to; callers holding a
+// pin are expected not to call them.
+func (m *ProxyManager) Pin(node ProxyNode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pinned = &node
+}
+
+// Pinned returns the pinned node, if any.
+func (m *ProxyManager) Pinned() (ProxyNode, bool) {
+	if m == nil {
+		return ProxyNode{}, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.pinned == nil {
+		return ProxyNode{}, false
+	}
+	return *m.pinned, true
+}
+
+// Unpin undoes Pin.
+func (m *ProxyManager) Unpin() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pinned = nil
+}
+
+// SetCurrentIndex points the current index at pool[i].
+func (m *ProxyManager) SetCurrentIndex(i int) (ProxyNode, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i < 0 || i >= len(m.pool) {
+		return ProxyNode{}, false
+	}
+	m.currentIndex = i
+	return m.pool[i], true
 }
 
 func (m *ProxyManager) ReportSuccess(node ProxyNode) {
@@ -143,9 +900,69 @@ func (m *ProxyManager) ReportSuccess(node ProxyNode) {
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.lastSuccessAt = time.Now()
 	if m.failures != nil {
 		delete(m.failures, key)
 	}
+	delete(m.openUntil, key)
+	m.setDisabledLocked(key, false)
+}
+
+// setDisabledLocked sets the Disabled flag of the pool node at addr and
+// reports whether it changed.
+func (m *ProxyManager) setDisabledLocked(addr string, disabled bool) bool {
+	for i := range m.pool {
+		if m.pool[i].Addr() == addr {
+			return m.setDisabledAtLocked(i, disabled)
+		}
+	}
+	return false
+}
+
+// setDisabledAtLocked is setDisabledLocked for pool[i].
+func (m *ProxyManager) setDisabledAtLocked(i int, disabled bool) bool {
+	if m.pool[i].Disabled == disabled {
+		return false
+	}
+	m.pool[i].Disabled = disabled
+	if disabled {
+		m.disabled++
+	} else {
+		m.disabled--
+	}
+	return true
+}
+
+// UpdateLatency records a fresh measurement for the pool node at addr and
+// re-enables it if it was disabled. It reports whether the node was found.
+func (m *ProxyManager) UpdateLatency(addr string, t ProbeTiming) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.pool {
+		if m.pool[i].Addr() == addr {
+			m.pool[i].LatencyMS = t.TotalMS
+			m.pool[i].HandshakeMS = t.HandshakeMS
+			m.pool[i].ConnectMS = t.ConnectMS
+			m.setDisabledAtLocked(i, false)
+			return true
+		}
+	}
+	return false
+}
+
+// CircuitOpen reports whether the breaker currently keeps addr out of selection.
+func (m *ProxyManager) CircuitOpen(addr string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	until, ok := m.openUntil[addr]
+	return ok && time.Now().Before(until)
+}
+
+// LastSuccess returns the time of the last ReportSuccess, or zero.
+func (m *ProxyManager) LastSuccess() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastSuccessAt
 }
 
 func (m *ProxyManager) ReportFailure(node ProxyNode, removeAfter int) bool {
@@ -154,16 +971,45 @@ func (m *ProxyManager) ReportFailure(node ProxyNode, removeAfter int) bool {
 		return false
 	}
 	m.mu.Lock()
-	defer m.mu.Unlock()
 	if m.failures == nil {
 		m.failures = make(map[string]int, 128)
 	}
+	// Failures of nodes already gone from the pool (a pinned node, a dial
+	// that outlived a refresh) would otherwise pile up between refreshes.
+	if len(m.failures) > 2*len(m.pool)+64 {
+		m.pruneStateLocked()
+	}
 	m.failures[key]++
+	if m.breaker.Threshold > 0 {
+		if m.failures[key] >= m.breaker.Threshold {
+			if m.openUntil == nil {
+				m.openUntil = make(map[string]time.Time)
+			}
+			m.openUntil[key] = time.Now().Add(m.breaker.Cooldown)
+		}
+		m.mu.Unlock()
+		return false
+	}
 	if removeAfter <= 0 || m.failures[key] < removeAfter {
+		m.mu.Unlock()
 		return false
 	}
 	delete(m.failures, key)
-	return m.removeLocked(key)
+	if m.removal == RemovalPolicyDisable {
+		disabled := m.setDisabledLocked(key, true)
+		m.mu.Unlock()
+		if disabled && m.OnRemove != nil {
+			node.Disabled = true
+			m.OnRemove(node)
+		}
+		return false
+	}
+	removed := m.removeLocked(key)
+	m.mu.Unlock()
+	if removed && m.OnRemove != nil {
+		m.OnRemove(node)
+	}
+	return removed
 }
 
 func (m *ProxyManager) Remove(node ProxyNode) bool {
@@ -172,11 +1018,34 @@ func (m *ProxyManager) Remove(node ProxyNode) bool {
 		return false
 	}
 	m.mu.Lock()
-	defer m.mu.Unlock()
 	if m.failures != nil {
 		delete(m.failures, key)
 	}
-	return m.removeLocked(key)
+	removed := m.removeLocked(key)
+	m.mu.Unlock()
+	if removed && m.OnRemove != nil {
+		m.OnRemove(node)
+	}
+	return removed
+}
+
+// ReportAuthFailure removes node right away, flagged AuthFailed for OnRemove:
+// retrying wrong credentials never helps.
+func (m *ProxyManager) ReportAuthFailure(node ProxyNode) bool {
+	node.AuthFailed = true
+	return m.Remove(node)
+}
+
+func (m *ProxyManager) uncountLocked(n ProxyNode) {
+	if m.byType[n.Type]--; m.byType[n.Type] <= 0 {
+		delete(m.byType, n.Type)
+	}
+	if m.byCountry[n.Country]--; m.byCountry[n.Country] <= 0 {
+		delete(m.byCountry, n.Country)
+	}
+	if n.Disabled {
+		m.disabled--
+	}
 }
 
 func (m *ProxyManager) removeLocked(addr string) bool {
@@ -188,6 +1057,7 @@ func (m *ProxyManager) removeLocked(addr string) bool {
 	for i, n := range m.pool {
 		if n.Addr() == addr {
 			removed = true
+			m.uncountLocked(n)
 			if i < m.currentIndex {
 				m.currentIndex--
 			}
@@ -198,6 +1068,8 @@ func (m *ProxyManager) removeLocked(addr string) bool {
 	if !removed {
 		return false
 	}
+	delete(m.openUntil, addr)
+	delete(m.live, addr)
 	m.pool = dst
 	if m.currentIndex < 0 {
 		m.currentIndex = 0
@@ -213,15 +1085,30 @@ func (m *ProxyManager) Status() Status {
 	defer m.mu.RUnlock()
 
 	var curSOCKS5 ProxyNode
-	if len(m.pool) > 0 && m.currentIndex >= 0 && m.currentIndex < len(m.pool) {
+	if m.pinned != nil {
+		curSOCKS5 = *m.pinned
+	} else if len(m.pool) > 0 && m.currentIndex >= 0 && m.currentIndex < len(m.pool) {
 		curSOCKS5 = m.pool[m.currentIndex]
 	}
 	return Status{
 		CurrentSOCKS5:      curSOCKS5.Addr(),
 		CurrentSOCKS5Index: m.currentIndex,
-		SOCKS5PoolSize:     len(m.pool),
+		SOCKS5PoolSize:     m.byType[ProxyTypeSOCKS5],
 		PoolSize:           len(m.pool),
 		LastRefreshAt:  m.lastRefreshAt,
 		LastRefreshErr: m.lastRefreshErr,
+		LastRefreshOKAt: m.lastRefreshOKAt,
+		OpenCircuits:   m.openCountLocked(time.Now()),
+		Disabled:       m.disabled,
+	}
+}
+
+func (m *ProxyManager) openCountLocked(now time.Time) int {
+	n := 0
+	for _, until := range m.openUntil {
+		if now.Before(until) {
+			n++
+		}
 	}
+	return n
 }
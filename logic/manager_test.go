@@ -0,0 +1,398 @@
+package logic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func breakerManager(t *testing.T, nodes ...ProxyNode) *ProxyManager {
+	t.Helper()
+	m := NewProxyManager()
+	m.SetBreaker(BreakerConfig{Threshold: 2, Cooldown: time.Hour})
+	m.SetPool(nodes)
+	return m
+}
+
+// cool makes addr's open circuit half-open, as if its cooldown had passed.
+func cool(m *ProxyManager, addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.openUntil[addr] = time.Now().Add(-time.Second)
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	a, b := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0)
+	m := breakerManager(t, a, b)
+
+	if m.ReportFailure(a, 1) {
+		t.Fatal("ReportFailure removed a node with the breaker on")
+	}
+	if m.CircuitOpen(a.Addr()) {
+		t.Fatal("circuit open below the threshold")
+	}
+	m.ReportFailure(a, 1)
+	if !m.CircuitOpen(a.Addr()) {
+		t.Fatal("circuit still closed at the threshold")
+	}
+	if got := m.PoolSize(); got != 2 {
+		t.Errorf("PoolSize() = %d, want the open node kept", got)
+	}
+	if n, _ := m.Current(); n.Addr() != b.Addr() {
+		t.Errorf("Current() = %s, want %s past the open circuit", n.Addr(), b.Addr())
+	}
+	for i := 0; i < 3; i++ {
+		if n, _ := m.Next(); n.Addr() != b.Addr() {
+			t.Errorf("Next() = %s, want %s past the open circuit", n.Addr(), b.Addr())
+		}
+	}
+	if st := m.Status(); st.OpenCircuits != 1 {
+		t.Errorf("Status().OpenCircuits = %d, want 1", st.OpenCircuits)
+	}
+}
+
+func TestBreakerReadsDoNotTakeTheProbe(t *testing.T) {
+	a, b := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0)
+	m := breakerManager(t, a, b)
+	m.ReportFailure(a, 1)
+	m.ReportFailure(a, 1)
+	cool(m, a.Addr())
+
+	for i := 0; i < 3; i++ {
+		if n, _ := m.Current(); n.Addr() != a.Addr() {
+			t.Fatalf("Current() = %s, want the half-open %s", n.Addr(), a.Addr())
+		}
+	}
+	if m.CircuitOpen(a.Addr()) {
+		t.Fatal("Current() used up the half-open probe")
+	}
+
+	// The dial takes the probe; nobody else gets the node meanwhile.
+	if n, _ := m.CurrentForDial(); n.Addr() != a.Addr() {
+		t.Fatalf("CurrentForDial() = %s, want the half-open %s", n.Addr(), a.Addr())
+	}
+	if !m.CircuitOpen(a.Addr()) {
+		t.Fatal("CurrentForDial() did not admit the probe")
+	}
+	if n, _ := m.CurrentForDial(); n.Addr() != b.Addr() {
+		t.Errorf("second CurrentForDial() = %s, want %s while the probe runs", n.Addr(), b.Addr())
+	}
+	if n, _ := m.Current(); n.Addr() != b.Addr() {
+		t.Errorf("Current() = %s, want %s while the probe runs", n.Addr(), b.Addr())
+	}
+}
+
+func TestBreakerHalfOpenOutcome(t *testing.T) {
+	a, b := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0)
+
+	t.Run("success closes", func(t *testing.T) {
+		m := breakerManager(t, a, b)
+		m.ReportFailure(a, 1)
+		m.ReportFailure(a, 1)
+		cool(m, a.Addr())
+		if n, _ := m.CurrentForDial(); n.Addr() != a.Addr() {
+			t.Fatalf("CurrentForDial() = %s, want %s", n.Addr(), a.Addr())
+		}
+		m.ReportSuccess(a)
+		if m.CircuitOpen(a.Addr()) {
+			t.Fatal("circuit still open after a successful probe")
+		}
+		// One failure is below the threshold again.
+		m.ReportFailure(a, 1)
+		if m.CircuitOpen(a.Addr()) {
+			t.Error("a closed circuit reopened below the threshold")
+		}
+	})
+
+	t.Run("failure reopens", func(t *testing.T) {
+		m := breakerManager(t, a, b)
+		m.ReportFailure(a, 1)
+		m.ReportFailure(a, 1)
+		cool(m, a.Addr())
+		if n, _ := m.Next(); n.Addr() != b.Addr() {
+			// Next moves off the current node first.
+			t.Fatalf("Next() = %s, want %s", n.Addr(), b.Addr())
+		}
+		if n, _ := m.Next(); n.Addr() != a.Addr() {
+			t.Fatalf("Next() = %s, want the half-open %s", n.Addr(), a.Addr())
+		}
+		m.ReportFailure(a, 1)
+		if !m.CircuitOpen(a.Addr()) {
+			t.Fatal("circuit closed after a failed probe")
+		}
+		if n, _ := m.Current(); n.Addr() != b.Addr() {
+			t.Errorf("Current() = %s, want %s past the reopened circuit", n.Addr(), b.Addr())
+		}
+	})
+}
+
+func TestBreakerAllOpenDegradesToNoBreaker(t *testing.T) {
+	a := node("203.0.113.1", "1080", 0)
+	m := breakerManager(t, a)
+	m.ReportFailure(a, 1)
+	m.ReportFailure(a, 1)
+	if n, ok := m.Current(); !ok || n.Addr() != a.Addr() {
+		t.Errorf("Current() = %s, %v; want the only node despite its open circuit", n.Addr(), ok)
+	}
+}
+
+func disableManager(t *testing.T, nodes ...ProxyNode) *ProxyManager {
+	t.Helper()
+	m := NewProxyManager()
+	m.SetRemovalPolicy(RemovalPolicyDisable)
+	m.SetPool(nodes)
+	return m
+}
+
+func TestDisablePolicyKeepsNodesOutOfSelection(t *testing.T) {
+	a, b, c := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0), node("203.0.113.3", "1080", 0)
+	m := disableManager(t, a, b, c)
+
+	if m.ReportFailure(a, 1) {
+		t.Error("ReportFailure reported a removal under the disable policy")
+	}
+	if got := m.PoolSize(); got != 3 {
+		t.Fatalf("PoolSize() = %d, want the disabled node kept", got)
+	}
+	if st := m.Status(); st.Disabled != 1 {
+		t.Errorf("Status().Disabled = %d, want 1", st.Disabled)
+	}
+	if n, _ := m.Current(); n.Addr() != b.Addr() {
+		t.Errorf("Current() = %s, want %s past the disabled node", n.Addr(), b.Addr())
+	}
+	for i := 0; i < 4; i++ {
+		if n, _ := m.Next(); n.Addr() == a.Addr() {
+			t.Fatalf("Next() returned the disabled %s", a.Addr())
+		}
+	}
+
+	m.ReportSuccess(a)
+	if st := m.Status(); st.Disabled != 0 {
+		t.Errorf("Status().Disabled = %d after ReportSuccess, want 0", st.Disabled)
+	}
+}
+
+func TestDisabledCountFollowsPoolChanges(t *testing.T) {
+	a, b, c := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0), node("203.0.113.3", "1080", 0)
+	m := disableManager(t, a, b, c)
+	m.ReportFailure(a, 1)
+	m.ReportFailure(b, 1)
+	m.ReportFailure(b, 1) // already disabled
+
+	steps := []struct {
+		name string
+		do   func()
+		want int
+	}{
+		{"disabled twice counts once", func() {}, 2},
+		{"UpdateLatency re-enables", func() { m.UpdateLatency(b.Addr(), ProbeTiming{TotalMS: 5}) }, 1},
+		{"Remove of a disabled node", func() { m.Remove(a) }, 0},
+		{"disable again", func() { m.ReportFailure(c, 1) }, 1},
+		{"MergeNodes re-enables refetched nodes", func() { m.MergeNodes([]ProxyNode{c}, 0, "") }, 0},
+		{"SetPool counts imported flags", func() {
+			d := node("203.0.113.4", "1080", 0)
+			d.Disabled = true
+			m.SetPool([]ProxyNode{b, d})
+		}, 1},
+	}
+	for _, st := range steps {
+		st.do()
+		if got := m.Status().Disabled; got != st.want {
+			t.Errorf("%s: Status().Disabled = %d, want %d", st.name, got, st.want)
+		}
+	}
+}
+
+func TestAllDisabledSelectsNothing(t *testing.T) {
+	a, b := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0)
+	for _, strategy := range []string{StrategyRoundRobin, StrategyRandom, StrategyWeighted} {
+		t.Run(strategy, func(t *testing.T) {
+			m := disableManager(t, a, b)
+			m.SetSelection(SelectionConfig{Strategy: strategy, AvoidRepeat: true})
+			m.ReportFailure(a, 1)
+			m.ReportFailure(b, 1)
+			if n, ok := m.Current(); ok {
+				t.Errorf("Current() = %s, want no node", n.Addr())
+			}
+			if n, ok := m.CurrentForDial(); ok {
+				t.Errorf("CurrentForDial() = %s, want no node", n.Addr())
+			}
+			if n, ok := m.Next(); ok {
+				t.Errorf("Next() = %s, want no node", n.Addr())
+			}
+			m.ReportSuccess(b)
+			if n, ok := m.Next(); !ok || n.Addr() != b.Addr() {
+				t.Errorf("Next() = %s, %v; want the re-enabled %s", n.Addr(), ok, b.Addr())
+			}
+		})
+	}
+}
+
+func TestNextHealthy(t *testing.T) {
+	a, b, c, d := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0), node("203.0.113.3", "1080", 0), node("203.0.113.4", "1080", 0)
+	m := breakerManager(t, a, b, c, d)
+	m.ReportFailure(b, 0) // a recent failure
+	m.ReportFailure(c, 0)
+	m.ReportFailure(c, 0) // an open circuit
+	m.SetCurrentByAddr(a.Addr())
+
+	for _, want := range []ProxyNode{d, a, d} {
+		if n, ok := m.NextHealthy(); !ok || n.Addr() != want.Addr() {
+			t.Fatalf("NextHealthy() = %s, %v; want %s", n.Addr(), ok, want.Addr())
+		}
+	}
+
+	// Every node unhealthy: no move.
+	m.ReportFailure(a, 0)
+	m.ReportFailure(d, 0)
+	if n, ok := m.NextHealthy(); ok {
+		t.Fatalf("NextHealthy() = %s with every node unhealthy", n.Addr())
+	}
+	if cur, _ := m.Current(); cur.Addr() != d.Addr() {
+		t.Errorf("current = %s after a failed NextHealthy, want %s kept", cur.Addr(), d.Addr())
+	}
+
+	m.ReportSuccess(b)
+	if n, ok := m.NextHealthy(); !ok || n.Addr() != b.Addr() {
+		t.Errorf("NextHealthy() = %s, %v; want the recovered %s", n.Addr(), ok, b.Addr())
+	}
+	if _, ok := NewProxyManager().NextHealthy(); ok {
+		t.Error("NextHealthy() on an empty pool = true")
+	}
+}
+
+func TestNextHealthyAvoidRepeat(t *testing.T) {
+	a := node("203.0.113.1", "1080", 0)
+	b, c := node("203.0.113.2", "1080", 0), node("203.0.113.3", "1080", 0)
+	b.ExitIP, c.ExitIP = "198.51.100.1", "198.51.100.1"
+	m := breakerManager(t, a, b, c)
+	m.SetSelection(SelectionConfig{Strategy: StrategyRoundRobin, AvoidRepeat: true})
+	m.SetCurrentByAddr(a.Addr())
+
+	if n, ok := m.NextHealthy(); !ok || n.Addr() != b.Addr() {
+		t.Fatalf("NextHealthy() = %s, %v; want %s", n.Addr(), ok, b.Addr())
+	}
+	// c shares b's exit, so Next steps past it as it would after Next.
+	if n, ok := m.Next(); !ok || n.Addr() != a.Addr() {
+		t.Errorf("Next() after NextHealthy = %s, %v; want %s", n.Addr(), ok, a.Addr())
+	}
+}
+
+func TestByTypeSelection(t *testing.T) {
+	s := node("203.0.113.1", "1080", 0)
+	h1 := ProxyNode{Type: ProxyTypeHTTP, IP: "203.0.113.2", Port: "8080"}
+	h2 := ProxyNode{Type: ProxyTypeHTTP, IP: "203.0.113.3", Port: "8080"}
+	m := breakerManager(t, s, h1, h2)
+
+	if n, ok := m.CurrentByType(ProxyTypeHTTP); !ok || n.Addr() != h1.Addr() {
+		t.Fatalf("CurrentByType() = %s, %v; want %s", n.Addr(), ok, h1.Addr())
+	}
+	if n, _ := m.Current(); n.Addr() != s.Addr() {
+		t.Errorf("CurrentByType moved the current node to %s", n.Addr())
+	}
+	for _, want := range []ProxyNode{h1, h2, h1} {
+		if n, ok := m.NextByType(ProxyTypeHTTP); !ok || n.Addr() != want.Addr() {
+			t.Fatalf("NextByType() = %s, %v; want %s", n.Addr(), ok, want.Addr())
+		}
+	}
+	if n, _ := m.CurrentByType(ProxyTypeHTTP); n.Addr() != h1.Addr() {
+		t.Errorf("CurrentByType() = %s, want the current %s", n.Addr(), h1.Addr())
+	}
+
+	m.ReportFailure(h1, 1)
+	m.ReportFailure(h1, 1)
+	if n, _ := m.CurrentByType(ProxyTypeHTTP); n.Addr() != h2.Addr() {
+		t.Errorf("CurrentByType() = %s, want %s past the open circuit", n.Addr(), h2.Addr())
+	}
+	if n, ok := m.NextByType(ProxyTypeHTTPS); ok {
+		t.Errorf("NextByType(https) = %s, want no node", n.Addr())
+	}
+}
+
+func TestSetCurrentByAddr(t *testing.T) {
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0), node("203.0.113.3", "1080", 0)})
+
+	n, ok := m.SetCurrentByAddr("203.0.113.3:1080")
+	if !ok || n.Addr() != "203.0.113.3:1080" {
+		t.Fatalf("SetCurrentByAddr() = %s, %v; want 203.0.113.3:1080", n.Addr(), ok)
+	}
+	if cur, _ := m.Current(); cur.Addr() != "203.0.113.3:1080" {
+		t.Errorf("Current() = %s after promoting 203.0.113.3:1080", cur.Addr())
+	}
+	for _, addr := range []string{"", "203.0.113.9:1080", "203.0.113.1"} {
+		if _, ok := m.SetCurrentByAddr(addr); ok {
+			t.Errorf("SetCurrentByAddr(%q) succeeded", addr)
+		}
+	}
+	if cur, _ := m.Current(); cur.Addr() != "203.0.113.3:1080" {
+		t.Errorf("Current() = %s after failed promotions, want it unchanged", cur.Addr())
+	}
+}
+
+// TestSetCurrentByAddrDuringRefresh promotes while refreshes swap the pool:
+// a promotion either finds its node in the pool of the moment or fails.
+func TestSetCurrentByAddrDuringRefresh(t *testing.T) {
+	a := []ProxyNode{node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0)}
+	b := []ProxyNode{node("203.0.113.3", "1080", 0), node("203.0.113.2", "1080", 0), node("203.0.113.4", "1080", 0)}
+	m := NewProxyManager()
+	m.SetPool(a)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				m.SetPool(b)
+			} else {
+				m.SetPool(a)
+			}
+		}
+	}()
+	addrs := []string{"203.0.113.1:1080", "203.0.113.2:1080", "203.0.113.4:1080"}
+	for i := 0; i < 2000; i++ {
+		addr := addrs[i%len(addrs)]
+		if n, ok := m.SetCurrentByAddr(addr); ok && n.Addr() != addr {
+			t.Fatalf("SetCurrentByAddr(%s) = %s", addr, n.Addr())
+		}
+		if cur, ok := m.Current(); !ok || cur.Addr() == "" {
+			t.Fatalf("Current() = %s, %v mid-refresh", cur.Addr(), ok)
+		}
+	}
+	close(stop)
+	<-done
+	// 203.0.113.2 is in both pools, so its promotion always sticks.
+	if n, ok := m.SetCurrentByAddr("203.0.113.2:1080"); !ok || n.Addr() != "203.0.113.2:1080" {
+		t.Fatalf("SetCurrentByAddr(203.0.113.2:1080) = %s, %v", n.Addr(), ok)
+	}
+}
+
+// TestFailuresStayBounded reports failures for nodes that left the pool, as
+// dials outliving a refresh do: the table is pruned rather than growing.
+func TestFailuresStayBounded(t *testing.T) {
+	a := node("192.0.2.1", "1080", 0)
+	m := breakerManager(t, a)
+	m.ReportFailure(a, 0)
+	for i := 0; i < 10_000; i++ {
+		m.ReportFailure(node("198.51.100.1", fmt.Sprint(1024+i), 0), 0)
+	}
+	mem := m.Memory()
+	if limit := 2*mem.Pool + 64 + 1; mem.Failures > limit || mem.Circuits > limit {
+		t.Fatalf("Memory() = %+v, want failures and circuits within %d", mem, limit)
+	}
+
+	// A refresh drops the state of nodes no longer listed.
+	b := node("192.0.2.2", "1080", 0)
+	m.SetPool([]ProxyNode{b})
+	m.ReportFailure(b, 0)
+	m.MergeNodes([]ProxyNode{a}, 0, "")
+	if mem := m.Memory(); mem.Pool != 2 || mem.Failures != 1 {
+		t.Errorf("Memory() after a merge = %+v, want 2 nodes and b's failure only", mem)
+	}
+}
@@ -0,0 +1,45 @@
+package logic
+
+import "sort"
+
+// PoolMetrics summarizes pool quality. Latency percentiles only count nodes
+// with a measured latency.
+type PoolMetrics struct {
+	Size      int            `json:"size"`
+	Measured  int            `json:"measured"`
+	MedianMS  int64          `json:"median_ms"`
+	P90MS     int64          `json:"p90_ms"`
+	Countries map[string]int `json:"countries,omitempty"`
+}
+
+func ComputePoolMetrics(nodes []ProxyNode) PoolMetrics {
+	m := PoolMetrics{Size: len(nodes)}
+	lat := make([]int64, 0, len(nodes))
+	for _, n := range nodes {
+		if n.LatencyMS >= 0 {
+			lat = append(lat, n.LatencyMS)
+		}
+		if n.Country != "" {
+			if m.Countries == nil {
+				m.Countries = make(map[string]int)
+			}
+			m.Countries[n.Country]++
+		}
+	}
+	m.Measured = len(lat)
+	if len(lat) > 0 {
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		m.MedianMS = percentile(lat, 50)
+		m.P90MS = percentile(lat, 90)
+	}
+	return m
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted.
+func percentile(sorted []int64, p int) int64 {
+	idx := (len(sorted)*p + 99) / 100
+	if idx < 1 {
+		idx = 1
+	}
+	return sorted[idx-1]
+}
@@ -0,0 +1,84 @@
+package logic
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		// RFC 1918 private
+		{"10.0.0.1", false},
+		{"10.255.255.255", false},
+		{"172.16.0.1", false},
+		{"172.31.255.254", false},
+		{"192.168.1.1", false},
+		// loopback, unspecified, "this network"
+		{"127.0.0.1", false},
+		{"127.8.9.10", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		// link-local and multicast
+		{"169.254.1.1", false},
+		{"224.0.0.1", false},
+		{"239.255.255.250", false},
+		// carrier-grade NAT, IETF protocol assignments, benchmarking
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"198.19.255.254", false},
+		// documentation
+		{"192.0.2.1", false},
+		{"198.51.100.7", false},
+		{"203.0.113.9", false},
+		// reserved and broadcast
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		// IPv6
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"ff02::1", false},
+		{"2001:db8::1", false},
+		{"::ffff:10.0.0.1", false},
+		// public
+		{"1.2.3.4", true},
+		{"8.8.8.8", true},
+		{"172.15.255.255", true},
+		{"172.32.0.1", true},
+		{"100.63.255.255", true},
+		{"100.128.0.1", true},
+		{"2606:4700:4700::1111", true},
+		{"::ffff:1.2.3.4", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := IsPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("IsPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+	if IsPublicIP(nil) {
+		t.Error("IsPublicIP(nil) = true, want false")
+	}
+}
+
+func TestFilterPublic(t *testing.T) {
+	nodes := []ProxyNode{
+		node("1.2.3.4", "1080", 0),
+		node("10.0.0.1", "1080", 0),
+		node("127.0.0.1", "1080", 0),
+		node("8.8.8.8", "1080", 0),
+		{Type: ProxyTypeSOCKS5, IP: "proxy.example.com", Port: "1080"},
+	}
+	got := FilterPublic(nodes)
+	if len(got) != 2 || got[0].IP != "1.2.3.4" || got[1].IP != "8.8.8.8" {
+		t.Fatalf("FilterPublic kept %v, want 1.2.3.4 and 8.8.8.8", got)
+	}
+}
@@ -1,24 +1,42 @@
 package logic
 
 import (
+	"fmt"
+	"math/rand/v2"
 	"net"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ParseProxySpec parses:
-// - socks5://ip:port
+// - socks5://ip:port (socks5h:// sets RemoteDNS)
+// - https://ip:port (?sni=name sets SNI, ?insecure=1 sets Insecure)
+// - http://ip:port
 // - user:pass@ip:port
 // - ip:port
 //
-// If the spec has no scheme, defaultType is used when it's "socks5".
-// If defaultType is empty/"auto", SOCKS5 is assumed.
+// Any form may end in a "#tag=a,b&dial_timeout=2s" fragment that sets
+// Tags and DialTimeoutMS.
+//
+// If the spec has no scheme, defaultType is used when it's "socks5",
+// "https", "http" or "infer". Otherwise SOCKS5 is assumed and GuessedType
+// set.
 func ParseProxySpec(spec string, defaultType string) (ProxyNode, bool) {
 	spec = strings.TrimSpace(spec)
 	if spec == "" || strings.HasPrefix(spec, "#") {
 		return ProxyNode{}, false
 	}
+	var opts specOptions
+	if i := strings.LastIndex(spec, "#"); i >= 0 {
+		o, ok := parseSpecFragment(spec[i+1:])
+		if !ok {
+			return ProxyNode{}, false
+		}
+		spec, opts = spec[:i], o
+	}
 
 	// Scheme-aware parse first.
 	if strings.Contains(spec, "://") {
@@ -27,9 +45,11 @@ func ParseProxySpec(spec string, defaultType string) (ProxyNode, bool) {
 			return ProxyNode{}, false
 		}
 		scheme := strings.ToLower(u.Scheme)
+		remoteDNS := scheme == "socks5h"
 		switch scheme {
 		case "socks5", "socks5h":
 			scheme = ProxyTypeSOCKS5
+		case ProxyTypeHTTPS, ProxyTypeHTTP:
 		default:
 			return ProxyNode{}, false
 		}
@@ -48,15 +68,24 @@ func ParseProxySpec(spec string, defaultType string) (ProxyNode, bool) {
 		}
 
 		id := host + ":" + port
-		return ProxyNode{
+		n := ProxyNode{
 			ID:        id,
 			Type:      scheme,
 			IP:        host,
 			Port:      port,
 			User:      user,
 			Pass:      pass,
+			RemoteDNS: remoteDNS,
+			Tags:      opts.tags,
 			LatencyMS: -1,
-		}, true
+		}
+		n.DialTimeoutMS = opts.dialTimeout.Milliseconds()
+		if scheme == ProxyTypeHTTPS {
+			q := u.Query()
+			n.SNI = q.Get("sni")
+			n.Insecure, _ = strconv.ParseBool(q.Get("insecure"))
+		}
+		return n, true
 	}
 
 	// No scheme: allow user:pass@host:port and host:port.
@@ -75,8 +104,11 @@ func ParseProxySpec(spec string, defaultType string) (ProxyNode, bool) {
 	}
 
 	pt := defaultType
-	if pt != ProxyTypeSOCKS5 {
-		pt = ProxyTypeSOCKS5
+	guessed := false
+	switch pt {
+	case ProxyTypeSOCKS5, ProxyTypeHTTPS, ProxyTypeHTTP, ProxyTypeInfer:
+	default:
+		pt, guessed = ProxyTypeSOCKS5, true
 	}
 
 	user := ""
@@ -88,18 +120,263 @@ func ParseProxySpec(spec string, defaultType string) (ProxyNode, bool) {
 		}
 	}
 
-	id := ip + ":" + port
+	id := net.JoinHostPort(ip, port)
 	return ProxyNode{
-		ID:        id,
-		Type:      pt,
-		IP:        ip,
-		Port:      port,
-		User:      user,
-		Pass:      pass,
-		LatencyMS: -1,
+		ID:            id,
+		Type:          pt,
+		GuessedType:   guessed,
+		IP:            ip,
+		Port:          port,
+		User:          user,
+		Pass:          pass,
+		Tags:          opts.tags,
+		DialTimeoutMS: opts.dialTimeout.Milliseconds(),
+		LatencyMS:     -1,
 	}, true
 }
 
+// DefaultMaxProxyRange caps how many addresses one proxy range may cover
+// (a /20) unless configured otherwise.
+const DefaultMaxProxyRange = 4096
+
+// ExpandProxySpec is ExpandProxySpecLimit with DefaultMaxProxyRange.
+func ExpandProxySpec(spec string, defaultType string) ([]ProxyNode, error) {
+	return ExpandProxySpecLimit(spec, defaultType, 0)
+}
+
+// ExpandProxySpecLimit is ParseProxySpec that also accepts a CIDR in place
+// of the host, e.g. socks5://10.0.0.0/28:1080 or
+// user:pass@[2001:db8::/124]:1080, and returns one candidate per host
+// address, for validation to keep the live ones. IPv4 ranges larger than
+// /31 skip their network and broadcast addresses. A "sample=N" fragment
+// option returns N random addresses of the range instead, drawn anew per
+// call. IPv4 ranges of more than maxRange addresses (0 means
+// DefaultMaxProxyRange) are rejected; larger IPv6 ranges must be sampled,
+// and a sample may not exceed maxRange either.
+func ExpandProxySpecLimit(spec string, defaultType string, maxRange int) ([]ProxyNode, error) {
+	spec = strings.TrimSpace(spec)
+	prefix, cidr, suffix, ok := splitCIDRSpec(spec)
+	if !ok {
+		n, ok := ParseProxySpec(spec, defaultType)
+		if !ok {
+			return nil, fmt.Errorf("invalid proxy spec %q", spec)
+		}
+		return []ProxyNode{n}, nil
+	}
+	if maxRange <= 0 {
+		maxRange = DefaultMaxProxyRange
+	}
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy range %q: %w", cidr, err)
+	}
+	p = p.Masked()
+	var sample int
+	if i := strings.LastIndex(suffix, "#"); i >= 0 {
+		if o, ok := parseSpecFragment(suffix[i+1:]); ok {
+			sample = o.sample
+		}
+	}
+	hostBits := p.Addr().BitLen() - p.Bits()
+	// Beyond 30 host bits the count would only matter for IPv6, which
+	// must sample then.
+	count := maxRange + 1
+	if hostBits <= 30 {
+		count = 1 << hostBits
+	}
+	skipEnds := p.Addr().Is4() && hostBits >= 2
+	if skipEnds {
+		count -= 2
+	}
+	switch {
+	case sample > maxRange:
+		return nil, fmt.Errorf("proxy range %s: sample of %d exceeds %d", p, sample, maxRange)
+	case count > maxRange && (p.Addr().Is4() || sample == 0):
+		if p.Addr().Is6() {
+			return nil, fmt.Errorf("proxy range %s has more than %d addresses; set a sample", p, maxRange)
+		}
+		return nil, fmt.Errorf("proxy range %s has more than %d addresses", p, maxRange)
+	}
+
+	var addrs []netip.Addr
+	if sample > 0 && sample < count {
+		addrs = sampleRange(p, sample, skipEnds)
+	} else {
+		addr := p.Addr()
+		if skipEnds {
+			addr = addr.Next()
+		}
+		addrs = make([]netip.Addr, 0, count)
+		for i := 0; i < count; i, addr = i+1, addr.Next() {
+			addrs = append(addrs, addr)
+		}
+	}
+	out := make([]ProxyNode, 0, len(addrs))
+	for _, addr := range addrs {
+		host := addr.String()
+		if addr.Is6() {
+			host = "[" + host + "]"
+		}
+		n, ok := ParseProxySpec(prefix+host+suffix, defaultType)
+		if !ok {
+			return nil, fmt.Errorf("invalid proxy spec %q", spec)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// sampleRange returns n distinct random addresses of p, which holds more
+// than n, skipping its first and last address when skipEnds is set.
+func sampleRange(p netip.Prefix, n int, skipEnds bool) []netip.Addr {
+	base := p.Addr().AsSlice()
+	seen := make(map[netip.Addr]struct{}, n)
+	out := make([]netip.Addr, 0, n)
+	b := make([]byte, len(base))
+	for len(out) < n {
+		for i := range b {
+			// Keep the prefix bits, randomize the rest.
+			keep := min(max(p.Bits()-8*i, 0), 8)
+			mask := byte(0xff << (8 - keep))
+			b[i] = base[i]&mask | byte(rand.IntN(256))&^mask
+		}
+		addr, _ := netip.AddrFromSlice(b)
+		if skipEnds && (addr == p.Addr() || !p.Contains(addr.Next())) {
+			continue
+		}
+		if _, dup := seen[addr]; dup {
+			continue
+		}
+		seen[addr] = struct{}{}
+		out = append(out, addr)
+	}
+	return out
+}
+
+// splitCIDRSpec splits spec around a CIDR host: prefix is the scheme and
+// userinfo, suffix the ":port" and anything after it. ok is false when the
+// host is not a range.
+func splitCIDRSpec(spec string) (prefix, cidr, suffix string, ok bool) {
+	start := 0
+	if i := strings.Index(spec, "://"); i >= 0 {
+		start = i + 3
+	}
+	if at := strings.LastIndex(spec[start:], "@"); at >= 0 {
+		start += at + 1
+	}
+	hostport := spec[start:]
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.Index(hostport, "]")
+		if end < 0 || !strings.Contains(hostport[:end], "/") {
+			return "", "", "", false
+		}
+		return spec[:start], hostport[1:end], hostport[end+1:], true
+	}
+	slash := strings.Index(hostport, "/")
+	if slash < 0 || strings.Contains(hostport[:slash], ":") {
+		return "", "", "", false
+	}
+	colon := strings.Index(hostport[slash:], ":")
+	if colon < 0 {
+		return "", "", "", false
+	}
+	end := slash + colon
+	return spec[:start], hostport[:end], hostport[end:], true
+}
+
+// FormatProxySpec renders n as a spec ParseProxySpec accepts, including credentials.
+func FormatProxySpec(n ProxyNode) string {
+	u := url.URL{Scheme: n.Type, Host: net.JoinHostPort(n.IP, n.Port)}
+	if u.Scheme == "" {
+		u.Scheme = ProxyTypeSOCKS5
+	}
+	if n.RemoteDNS && u.Scheme == ProxyTypeSOCKS5 {
+		u.Scheme = "socks5h"
+	}
+	if n.User != "" || n.Pass != "" {
+		u.User = url.UserPassword(n.User, n.Pass)
+	}
+	if n.Type == ProxyTypeHTTPS {
+		q := url.Values{}
+		if n.SNI != "" {
+			q.Set("sni", n.SNI)
+		}
+		if n.Insecure {
+			q.Set("insecure", "1")
+		}
+		u.RawQuery = q.Encode()
+	}
+	u.Fragment = formatSpecFragment(specOptions{tags: n.Tags, dialTimeout: time.Duration(n.DialTimeoutMS) * time.Millisecond})
+	return u.String()
+}
+
+// specOptions are the settings a spec carries in its "#" fragment.
+type specOptions struct {
+	tags        []string
+	dialTimeout time.Duration
+	// sample only applies to ranges (see ExpandProxySpecLimit).
+	sample int
+}
+
+// parseSpecFragment parses a spec fragment such as "tag=residential",
+// "tag=paid,datacenter&tag=eu", "dial_timeout=2s" or "sample=64". ok is
+// false for anything else.
+func parseSpecFragment(frag string) (opts specOptions, ok bool) {
+	q, err := url.ParseQuery(frag)
+	if err != nil || len(q) == 0 {
+		return specOptions{}, false
+	}
+	var tags []string
+	for k, vs := range q {
+		switch k {
+		case "tag", "tags":
+			for _, v := range vs {
+				tags = append(tags, strings.Split(v, ",")...)
+			}
+		case "dial_timeout":
+			d, err := time.ParseDuration(vs[len(vs)-1])
+			if err != nil || d <= 0 {
+				return specOptions{}, false
+			}
+			opts.dialTimeout = d
+		case "sample":
+			n, err := strconv.Atoi(vs[len(vs)-1])
+			if err != nil || n <= 0 {
+				return specOptions{}, false
+			}
+			opts.sample = n
+		default:
+			return specOptions{}, false
+		}
+	}
+	opts.tags = NormalizeTags(tags)
+	return opts, true
+}
+
+func formatSpecFragment(opts specOptions) string {
+	var parts []string
+	if len(opts.tags) > 0 {
+		parts = append(parts, "tag="+strings.Join(opts.tags, ","))
+	}
+	if opts.dialTimeout > 0 {
+		parts = append(parts, "dial_timeout="+opts.dialTimeout.String())
+	}
+	return strings.Join(parts, "&")
+}
+
+// WithSpecOptions adds tags and a dial timeout override to spec's fragment.
+func WithSpecOptions(spec string, tags []string, dialTimeout time.Duration) string {
+	frag := formatSpecFragment(specOptions{tags: NormalizeTags(tags), dialTimeout: dialTimeout})
+	switch {
+	case frag == "":
+		return spec
+	case strings.Contains(spec, "#"):
+		return spec + "&" + frag
+	default:
+		return spec + "#" + frag
+	}
+}
+
 func validPort(s string) bool {
 	n, err := strconv.Atoi(s)
 	if err != nil {
@@ -0,0 +1,265 @@
+package logic
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Fallbacks of a PoolDialer whose pool is empty.
+const (
+	PoolFallbackDirect = "direct"
+	PoolFallbackFail   = "fail"
+)
+
+// DefaultPoolDialTimeout is the dial budget of a PoolDialer without a
+// Timeout.
+const DefaultPoolDialTimeout = 15 * time.Second
+
+// PoolDialerOptions configure a PoolDialer. Hooks must be safe for
+// concurrent use: they are called from every dial.
+type PoolDialerOptions struct {
+	// Retry is how many nodes one dial tries, how long each may take and
+	// which failures move on to another; the zero value tries one. The
+	// attempts and backoff waits share the Timeout budget.
+	Retry RetryPolicy
+	// Timeout bounds a whole dial (default DefaultPoolDialTimeout). A
+	// single-attempt dial uses the node's own timeout (see
+	// ProxyManager.DialTimeout) in full instead.
+	Timeout time.Duration
+	// Sticky dials the manager's current node instead of rotating to the
+	// next one per attempt.
+	Sticky bool
+	// Fallback is PoolFallbackDirect (default), which dials without a proxy
+	// when the pool is empty, or PoolFallbackFail, which returns
+	// ErrEmptyPool.
+	Fallback string
+	// RemoteDNS sends host names to every upstream unresolved (see
+	// ResolveTarget).
+	RemoteDNS bool
+
+	// Select, when set, picks the node of each attempt (counted from 0);
+	// returning false leaves the pick to the manager.
+	Select func(ctx context.Context, addr string, attempt int) (ProxyNode, bool)
+	// Check, when set, vets the destination before dialing, and again once
+	// a host name was resolved locally. Its error ends the dial: another
+	// upstream would not change it.
+	Check func(addr string) error
+	// Dial opens the tunnel through node (default DialViaProxy), e.g. an
+	// UpstreamPool's.
+	Dial func(ctx context.Context, node ProxyNode, network, addr string, timeout time.Duration) (Conn, error)
+	// OnFailure, when set, is called for every failed attempt, after the
+	// failure was reported to the manager.
+	OnFailure func(ctx context.Context, node ProxyNode, addr string, attempt int, timeout time.Duration, err error)
+	// OnAbandon, when set, is called when ctx ends a dial.
+	OnAbandon func(ctx context.Context)
+}
+
+// PoolDialer dials through the nodes of a ProxyManager the way the SOCKS5
+// listeners do: it picks a node, dials through it within its timeout,
+// records the outcome with the manager (so failing nodes are rotated out)
+// and fails over to another node while attempts and budget remain. It is
+// safe for concurrent use and implements proxy.ContextDialer, so it can
+// back an http.Transport's DialContext.
+type PoolDialer struct {
+	m *ProxyManager
+	o PoolDialerOptions
+}
+
+var (
+	_ proxy.ContextDialer = (*PoolDialer)(nil)
+	_ proxy.Dialer        = (*PoolDialer)(nil)
+)
+
+func NewPoolDialer(m *ProxyManager, opts PoolDialerOptions) *PoolDialer {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultPoolDialTimeout
+	}
+	if opts.Fallback == "" {
+		opts.Fallback = PoolFallbackDirect
+	}
+	if opts.Dial == nil {
+		opts.Dial = DialViaProxy
+	}
+	return &PoolDialer{m: m, o: opts}
+}
+
+func (d *PoolDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *PoolDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, _, err := d.DialNode(ctx, network, addr)
+	return conn, err
+}
+
+// DialNode is DialContext that also returns the node of the last attempt;
+// it is zero when the dial went direct or failed before picking one.
+func (d *PoolDialer) DialNode(ctx context.Context, network, addr string) (conn Conn, via ProxyNode, err error) {
+	if d.o.Check != nil {
+		if err := d.o.Check(addr); err != nil {
+			return nil, ProxyNode{}, err
+		}
+	}
+	attempts := d.o.Retry.Attempts()
+	deadline := time.Now().Add(d.o.Timeout)
+	for i := 0; i < attempts; i++ {
+		if cerr := d.o.Retry.Wait(ctx, i); cerr != nil {
+			d.abandon(ctx)
+			return nil, via, cerr
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		node, ok := d.pick(ctx, addr, i)
+		if !ok {
+			if d.o.Fallback == PoolFallbackFail {
+				return nil, ProxyNode{}, ErrEmptyPool
+			}
+			conn, err := DialDirect(ctx, network, addr, remaining)
+			return conn, ProxyNode{}, err
+		}
+		via = node
+		// A node's own timeout may take more than an even share of what is
+		// left, but never more than all of it; a lone attempt has nothing
+		// to share with.
+		timeout := d.m.DialTimeout(node, d.o.Timeout)
+		if attempts > 1 {
+			timeout = min(d.m.DialTimeout(node, remaining/time.Duration(attempts-i)), remaining)
+		}
+		timeout = d.o.Retry.Timeout(timeout)
+		actx, cancel := context.WithTimeout(ctx, timeout)
+		target, rerr := ResolveTarget(actx, node, addr, d.o.RemoteDNS)
+		if rerr == nil && target != addr && d.o.Check != nil {
+			// The name passed; make sure it doesn't resolve somewhere refused.
+			rerr = d.o.Check(target)
+		}
+		if rerr != nil {
+			// Neither a failed lookup nor a refused address changes with
+			// another upstream.
+			cancel()
+			return nil, via, rerr
+		}
+		start := time.Now()
+		conn, err = d.o.Dial(actx, node, network, target, timeout)
+		cancel()
+		if err == nil {
+			d.m.RecordDial(node.Addr(), time.Since(start), true)
+			d.m.ReportSuccess(node)
+			return conn, via, nil
+		}
+		if ctx.Err() != nil {
+			d.abandon(ctx)
+			return nil, via, ctx.Err()
+		}
+		d.m.RecordDial(node.Addr(), 0, false)
+		if IsAuthFailure(err) {
+			d.m.ReportAuthFailure(node)
+		} else {
+			d.m.ReportFailure(node, 2)
+		}
+		if d.o.OnFailure != nil {
+			d.o.OnFailure(ctx, node, addr, i, timeout, err)
+		}
+		if !d.o.Retry.Retryable(err) {
+			return nil, via, err
+		}
+	}
+	if err == nil {
+		err = context.DeadlineExceeded
+	}
+	return nil, via, err
+}
+
+// Bind sets up a SOCKS5 BIND for peer through the pool the way DialNode
+// dials: attempts, budget, Check and outcome reporting are the same, but
+// only SOCKS5 nodes can take it (see ErrBindUnsupported). A pick of another
+// type, or a node refusing the command, is no fault of the node and moves
+// on without reporting it. There is no direct fallback: an empty pool is
+// ErrEmptyPool.
+func (d *PoolDialer) Bind(ctx context.Context, peer string) (bl BindListener, via ProxyNode, err error) {
+	if d.o.Check != nil {
+		if err := d.o.Check(peer); err != nil {
+			return nil, ProxyNode{}, err
+		}
+	}
+	attempts := d.o.Retry.Attempts()
+	deadline := time.Now().Add(d.o.Timeout)
+	for i := 0; i < attempts; i++ {
+		if cerr := d.o.Retry.Wait(ctx, i); cerr != nil {
+			d.abandon(ctx)
+			return nil, via, cerr
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		node, ok := d.pick(ctx, peer, i)
+		if !ok {
+			return nil, ProxyNode{}, ErrEmptyPool
+		}
+		via = node
+		if node.Type != ProxyTypeSOCKS5 {
+			err = ErrBindUnsupported
+			continue
+		}
+		timeout := d.m.DialTimeout(node, d.o.Timeout)
+		if attempts > 1 {
+			timeout = min(d.m.DialTimeout(node, remaining/time.Duration(attempts-i)), remaining)
+		}
+		timeout = d.o.Retry.Timeout(timeout)
+		actx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		bl, err = BindViaProxy(actx, node, peer, timeout)
+		cancel()
+		if err == nil {
+			d.m.RecordDial(node.Addr(), time.Since(start), true)
+			d.m.ReportSuccess(node)
+			return bl, via, nil
+		}
+		if ctx.Err() != nil {
+			d.abandon(ctx)
+			return nil, via, ctx.Err()
+		}
+		if SOCKS5ReplyCode(err) == SOCKS5ReplyCommandNotSupported {
+			continue
+		}
+		d.m.RecordDial(node.Addr(), 0, false)
+		if IsAuthFailure(err) {
+			d.m.ReportAuthFailure(node)
+		} else {
+			d.m.ReportFailure(node, 2)
+		}
+		if d.o.OnFailure != nil {
+			d.o.OnFailure(ctx, node, peer, i, timeout, err)
+		}
+		if !d.o.Retry.Retryable(err) {
+			return nil, via, err
+		}
+	}
+	if err == nil {
+		err = context.DeadlineExceeded
+	}
+	return nil, via, err
+}
+
+func (d *PoolDialer) pick(ctx context.Context, addr string, attempt int) (ProxyNode, bool) {
+	if d.o.Select != nil {
+		if n, ok := d.o.Select(ctx, addr, attempt); ok {
+			return n, true
+		}
+	}
+	if d.o.Sticky {
+		return d.m.CurrentForDial()
+	}
+	return d.m.Next()
+}
+
+func (d *PoolDialer) abandon(ctx context.Context) {
+	if d.o.OnAbandon != nil {
+		d.o.OnAbandon(ctx)
+	}
+}
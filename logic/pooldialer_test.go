@@ -0,0 +1,266 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeUpstream serves SOCKS5 on loopback, dialing targets directly, and
+// returns its node and a count of the tunnels it opened.
+func fakeUpstream(t *testing.T) (ProxyNode, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var tunnels atomic.Int32
+	s := &SOCKS5Server{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		tunnels.Add(1)
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}}
+	go s.Serve(ln)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	return ProxyNode{Type: ProxyTypeSOCKS5, IP: host, Port: port}, &tunnels
+}
+
+// deadUpstream is a SOCKS5 node nothing listens on.
+func deadUpstream(t *testing.T) ProxyNode {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+	return ProxyNode{Type: ProxyTypeSOCKS5, IP: host, Port: port}
+}
+
+// get fetches url with d plugged into an http.Transport.
+func get(d *PoolDialer, url string) (string, error) {
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{DialContext: d.DialContext, DisableKeepAlives: true},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// helloServer answers every request with "hello".
+func helloServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPoolDialerThroughUpstream(t *testing.T) {
+	srv := helloServer(t)
+	up, tunnels := fakeUpstream(t)
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{up})
+	d := NewPoolDialer(m, PoolDialerOptions{Timeout: 5 * time.Second})
+
+	if body, err := get(d, srv.URL); err != nil || body != "hello" {
+		t.Fatalf("GET = %q, %v; want hello", body, err)
+	}
+	if got := tunnels.Load(); got != 1 {
+		t.Errorf("upstream opened %d tunnels, want 1", got)
+	}
+}
+
+func TestPoolDialerFailover(t *testing.T) {
+	srv := helloServer(t)
+	dead := deadUpstream(t)
+	up, tunnels := fakeUpstream(t)
+	m := NewProxyManager()
+	m.SetBreaker(BreakerConfig{Threshold: 1, Cooldown: time.Hour})
+	m.SetPool([]ProxyNode{dead, up})
+
+	var failed []string
+	d := NewPoolDialer(m, PoolDialerOptions{
+		Retry:   RetryPolicy{MaxAttempts: 2},
+		Timeout: 5 * time.Second,
+		Sticky:  true,
+		OnFailure: func(_ context.Context, node ProxyNode, _ string, attempt int, _ time.Duration, _ error) {
+			failed = append(failed, node.Addr())
+		},
+	})
+	conn, via, err := d.DialNode(context.Background(), "tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("DialNode() error = %v, want a failover to %s", err, up.Addr())
+	}
+	conn.Close()
+	if via.Addr() != up.Addr() {
+		t.Errorf("DialNode() via %s, want %s", via.Addr(), up.Addr())
+	}
+	if len(failed) != 1 || failed[0] != dead.Addr() {
+		t.Errorf("OnFailure saw %v, want [%s]", failed, dead.Addr())
+	}
+	if !m.CircuitOpen(dead.Addr()) {
+		t.Error("the failed node was not reported to the manager")
+	}
+	if tunnels.Load() != 1 {
+		t.Errorf("upstream opened %d tunnels, want 1", tunnels.Load())
+	}
+
+	// One attempt does not fail over.
+	m = NewProxyManager()
+	m.SetPool([]ProxyNode{dead, up})
+	d = NewPoolDialer(m, PoolDialerOptions{Timeout: 5 * time.Second, Sticky: true})
+	if _, err := get(d, srv.URL); err == nil {
+		t.Error("GET through a single dead node succeeded")
+	}
+}
+
+func TestPoolDialerFallback(t *testing.T) {
+	srv := helloServer(t)
+
+	t.Run("direct", func(t *testing.T) {
+		d := NewPoolDialer(NewProxyManager(), PoolDialerOptions{Timeout: 5 * time.Second})
+		if body, err := get(d, srv.URL); err != nil || body != "hello" {
+			t.Fatalf("GET = %q, %v; want hello dialed directly", body, err)
+		}
+		conn, via, err := d.DialNode(context.Background(), "tcp", strings.TrimPrefix(srv.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if via.Addr() != "" {
+			t.Errorf("DialNode() via %s, want no node", via.Addr())
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		d := NewPoolDialer(NewProxyManager(), PoolDialerOptions{Timeout: 5 * time.Second, Fallback: PoolFallbackFail})
+		if _, err := get(d, srv.URL); !errors.Is(err, ErrEmptyPool) {
+			t.Errorf("GET error = %v, want ErrEmptyPool", err)
+		}
+	})
+}
+
+func TestPoolDialerCheckAndSelect(t *testing.T) {
+	srv := helloServer(t)
+	up, tunnels := fakeUpstream(t)
+	other, _ := fakeUpstream(t)
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{other})
+
+	refused := errors.New("refused")
+	d := NewPoolDialer(m, PoolDialerOptions{
+		Timeout: 5 * time.Second,
+		Check: func(addr string) error {
+			if strings.HasPrefix(addr, "blocked.") {
+				return refused
+			}
+			return nil
+		},
+		Select: func(context.Context, string, int) (ProxyNode, bool) { return up, true },
+	})
+	if _, _, err := d.DialNode(context.Background(), "tcp", "blocked.example:80"); !errors.Is(err, refused) {
+		t.Errorf("DialNode() error = %v, want the Check error", err)
+	}
+	if body, err := get(d, srv.URL); err != nil || body != "hello" {
+		t.Fatalf("GET = %q, %v; want hello", body, err)
+	}
+	if tunnels.Load() != 1 {
+		t.Errorf("the selected upstream opened %d tunnels, want 1", tunnels.Load())
+	}
+}
+
+func TestPoolDialerAbandon(t *testing.T) {
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0), node("203.0.113.3", "1080", 0)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var dials, failures, abandons atomic.Int32
+	d := NewPoolDialer(m, PoolDialerOptions{
+		Retry:   RetryPolicy{MaxAttempts: 3},
+		Timeout: 10 * time.Second,
+		Dial: func(actx context.Context, _ ProxyNode, _, _ string, _ time.Duration) (Conn, error) {
+			if dials.Add(1) == 1 {
+				return nil, syscall.ECONNREFUSED
+			}
+			// A slow upstream: the client hangs up while we wait on it.
+			cancel()
+			<-actx.Done()
+			return nil, actx.Err()
+		},
+		OnFailure: func(context.Context, ProxyNode, string, int, time.Duration, error) { failures.Add(1) },
+		OnAbandon: func(context.Context) { abandons.Add(1) },
+	})
+
+	start := time.Now()
+	_, _, err := d.DialNode(ctx, "tcp", "198.51.100.1:80")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("DialNode() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("DialNode() took %v after the client hung up", elapsed)
+	}
+	if got := dials.Load(); got != 2 {
+		t.Errorf("%d attempts started, want 2: none after the cancellation", got)
+	}
+	if failures.Load() != 1 || abandons.Load() != 1 {
+		t.Errorf("failures, abandons = %d, %d; want 1, 1", failures.Load(), abandons.Load())
+	}
+}
+
+func TestPoolDialerSharesBudget(t *testing.T) {
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0), node("203.0.113.3", "1080", 0)})
+	const budget = 600 * time.Millisecond
+
+	var timeouts []time.Duration
+	d := NewPoolDialer(m, PoolDialerOptions{
+		Retry:   RetryPolicy{MaxAttempts: 3},
+		Timeout: budget,
+		Dial: func(actx context.Context, _ ProxyNode, _, _ string, timeout time.Duration) (Conn, error) {
+			timeouts = append(timeouts, timeout)
+			<-actx.Done()
+			return nil, os.ErrDeadlineExceeded
+		},
+	})
+
+	start := time.Now()
+	if _, _, err := d.DialNode(context.Background(), "tcp", "198.51.100.1:80"); err == nil {
+		t.Fatal("DialNode() through timing-out nodes succeeded")
+	}
+	elapsed := time.Since(start)
+	if len(timeouts) != 3 {
+		t.Fatalf("%d attempts, want 3", len(timeouts))
+	}
+	var total time.Duration
+	for i, to := range timeouts {
+		// Each attempt gets about an even share of what is left.
+		if to > budget/3+10*time.Millisecond {
+			t.Errorf("attempt %d timeout %v, want at most a third of %v", i, to, budget)
+		}
+		total += to
+	}
+	if total > budget {
+		t.Errorf("attempt timeouts add up to %v, over the %v budget", total, budget)
+	}
+	if elapsed > budget+500*time.Millisecond {
+		t.Errorf("DialNode() took %v, want about %v", elapsed, budget)
+	}
+}
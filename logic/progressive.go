@@ -0,0 +1,81 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// A progressive refresh merges valid nodes into the pool in batches of
+	// progressiveBatch, or whatever has passed every progressiveEvery.
+	progressiveBatch = 20
+	progressiveEvery = 10 * time.Second
+)
+
+// progressiveApplier merges nodes into the managers while a refresh is
+// still validating, so a long validation does not leave the pool on old,
+// possibly dying nodes. The refresh's final SetPool or MergeNodes then
+// reconciles the pool.
+type progressiveApplier struct {
+	r *Refresher
+
+	mu      sync.Mutex
+	pending []ProxyNode
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (r *Refresher) startProgressive() *progressiveApplier {
+	p := &progressiveApplier{r: r, stop: make(chan struct{}), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+func (p *progressiveApplier) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(progressiveEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			p.flushLocked()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// Add queues n, merging the queue once it holds a full batch.
+func (p *progressiveApplier) Add(n ProxyNode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, n)
+	if len(p.pending) >= progressiveBatch {
+		p.flushLocked()
+	}
+}
+
+func (p *progressiveApplier) flushLocked() {
+	if len(p.pending) == 0 {
+		return
+	}
+	for _, m := range p.r.managers {
+		if m != nil {
+			m.MergeNodes(p.pending, p.r.MaxPoolSize, p.r.validation.RankBy)
+		}
+	}
+	p.pending = nil
+}
+
+// Stop ends the ticker and drops nodes not merged yet: the final
+// reconciliation applies them.
+func (p *progressiveApplier) Stop() {
+	close(p.stop)
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = nil
+}
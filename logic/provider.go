@@ -0,0 +1,263 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ProviderGenericJSON = "generic_json"
+
+// maxProviderPages bounds pagination so a misbehaving API can't loop forever.
+const maxProviderPages = 100
+
+// providerFieldKeys are the ProxyNode fields a provider response can map.
+var providerFieldKeys = map[string]struct{}{
+	"ip": {}, "port": {}, "user": {}, "pass": {}, "country": {},
+}
+
+// FetchFromProvider fetches every page of a provider API source and maps the
+// items into nodes. The API key is read from src.APIKeyEnv and only ever sent
+// in the request header; it never appears in returned errors.
+func FetchFromProvider(ctx context.Context, src ProxySource) ([]ProxyNode, error) {
+	if !strings.EqualFold(src.Provider, ProviderGenericJSON) {
+		return nil, fmt.Errorf("unsupported provider: %q", src.Provider)
+	}
+	headerName, headerValue, err := src.authHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 20 * time.Second}
+	out := make([]ProxyNode, 0, 256)
+	seen := make(map[string]struct{}, 256)
+	next := src.URL
+	for page := 0; next != "" && page < maxProviderPages; page++ {
+		items, listed, nextURL, err := fetchProviderPage(ctx, client, next, headerName, headerValue, src)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", page+1, err)
+		}
+		for _, node := range listed {
+			if _, dup := seen[node.ID]; dup {
+				continue
+			}
+			seen[node.ID] = struct{}{}
+			out = append(out, node)
+		}
+		for _, item := range items {
+			node, ok := src.mapProviderItem(item)
+			if !ok {
+				continue
+			}
+			if _, dup := seen[node.ID]; dup {
+				continue
+			}
+			seen[node.ID] = struct{}{}
+			out = append(out, node)
+		}
+		if nextURL == next {
+			break
+		}
+		next = nextURL
+	}
+	return out, nil
+}
+
+// authHeaderParts splits AuthHeader without expanding the key.
+func (s ProxySource) authHeaderParts() (name, value string, err error) {
+	if s.AuthHeader == "" {
+		return "", "", nil
+	}
+	name, value, ok := strings.Cut(s.AuthHeader, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return "", "", errors.New("auth_header must look like \"Name: value\"")
+	}
+	if strings.Contains(value, "$KEY") && s.APIKeyEnv == "" {
+		return "", "", errors.New("auth_header uses $KEY but api_key_env is empty")
+	}
+	return strings.TrimSpace(name), strings.TrimSpace(value), nil
+}
+
+// authHeader expands $KEY in src.AuthHeader with the env secret.
+func (s ProxySource) authHeader() (name, value string, err error) {
+	name, value, err = s.authHeaderParts()
+	if err != nil || name == "" {
+		return name, value, err
+	}
+	if strings.Contains(value, "$KEY") {
+		key := os.Getenv(s.APIKeyEnv)
+		if key == "" {
+			return "", "", fmt.Errorf("env %s is empty", s.APIKeyEnv)
+		}
+		value = strings.ReplaceAll(value, "$KEY", key)
+	}
+	return name, value, nil
+}
+
+// fetchProviderPage returns the page's items, plus any nodes from a
+// base64-decoded results field holding a plain-text list.
+func fetchProviderPage(ctx context.Context, client *http.Client, url, headerName, headerValue string, src ProxySource) ([]map[string]any, []ProxyNode, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	if headerName != "" {
+		req.Header.Set(headerName, headerValue)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, "", &FetchError{URL: url, StatusCode: resp.StatusCode}
+	}
+	r, err := sourceReader(resp.Body)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if !strings.EqualFold(src.Decode, SourceDecodeBase64) {
+		items, next, err := parseProviderPage(body, src.resultsField(), src.nextField())
+		return items, nil, next, err
+	}
+	return parseEncodedProviderPage(body, src)
+}
+
+// parseEncodedProviderPage handles a page whose results field is a base64
+// string holding either a JSON item array or a plain-text proxy list.
+func parseEncodedProviderPage(body []byte, src ProxySource) ([]map[string]any, []ProxyNode, string, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, nil, "", err
+	}
+	var next string
+	if raw, ok := obj[src.nextField()]; ok {
+		_ = json.Unmarshal(raw, &next)
+	}
+	raw, ok := obj[src.resultsField()]
+	if !ok {
+		return nil, nil, next, nil
+	}
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err != nil {
+		return nil, nil, "", fmt.Errorf("%s: expected a base64 string: %w", src.resultsField(), err)
+	}
+	decoded, err := decodeBase64([]byte(encoded))
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("%s: %w", src.resultsField(), err)
+	}
+	if trimmed := bytes.TrimSpace(decoded); len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []map[string]any
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, nil, "", fmt.Errorf("%s: %w", src.resultsField(), err)
+		}
+		return items, nil, next, nil
+	}
+	nodes, err := parseProxyList(bytes.NewReader(decoded), src.Type)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return nil, nodes, next, nil
+}
+
+// parseProviderPage accepts either a top-level array of items or an object
+// holding the items under resultsField and an optional next-page URL.
+func parseProviderPage(body []byte, resultsField, nextField string) ([]map[string]any, string, error) {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		var items []map[string]any
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, "", err
+		}
+		return items, "", nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, "", err
+	}
+	var items []map[string]any
+	if raw, ok := obj[resultsField]; ok {
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, "", fmt.Errorf("%s: %w", resultsField, err)
+		}
+	}
+	var next string
+	if raw, ok := obj[nextField]; ok {
+		_ = json.Unmarshal(raw, &next)
+	}
+	return items, next, nil
+}
+
+func (s ProxySource) resultsField() string {
+	if s.ResultsField != "" {
+		return s.ResultsField
+	}
+	return "results"
+}
+
+func (s ProxySource) nextField() string {
+	if s.NextField != "" {
+		return s.NextField
+	}
+	return "next"
+}
+
+func (s ProxySource) mapProviderItem(item map[string]any) (ProxyNode, bool) {
+	get := func(key string) string {
+		field := s.Fields[key]
+		if field == "" {
+			field = key
+		}
+		return providerString(item[field])
+	}
+	ip := get("ip")
+	port := get("port")
+	if net.ParseIP(ip) == nil || !validPort(port) {
+		return ProxyNode{}, false
+	}
+	typ, guessed := ProxyTypeSOCKS5, true
+	switch t := strings.ToLower(strings.TrimSpace(s.Type)); t {
+	case ProxyTypeSOCKS5:
+		guessed = false
+	case ProxyTypeHTTPS, ProxyTypeHTTP, ProxyTypeInfer:
+		typ, guessed = t, false
+	}
+	return ProxyNode{
+		ID:          ip + ":" + port,
+		Type:        typ,
+		GuessedType: guessed,
+		IP:          ip,
+		Port:        port,
+		User:        get("user"),
+		Pass:        get("pass"),
+		Country:     strings.ToUpper(get("country")),
+		LatencyMS:   -1,
+	}, true
+}
+
+func providerString(v any) string {
+	switch t := v.(type) {
+	case string:
+		return strings.TrimSpace(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case json.Number:
+		return t.String()
+	default:
+		return ""
+	}
+}
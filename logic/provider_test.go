@@ -0,0 +1,156 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchFromProviderPagination(t *testing.T) {
+	t.Setenv("TEST_PROVIDER_KEY", "s3cret")
+	pages := 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages++
+		if r.Header.Get("Authorization") != "Token s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Query().Get("page") {
+		case "":
+			fmt.Fprintf(w, `{"next": %q, "results": [
+				{"proxy_address": "1.2.3.4", "port": 8080, "username": "alice", "password": "pw1", "country_code": "de"},
+				{"proxy_address": "not-an-ip", "port": 8080}
+			]}`, srv.URL+"/?page=2")
+		case "2":
+			// The repeated node is listed once.
+			fmt.Fprintf(w, `{"next": %q, "results": [
+				{"proxy_address": "1.2.3.4", "port": 8080},
+				{"proxy_address": "5.6.7.8", "port": "1080", "username": "bob", "password": "pw2"}
+			]}`, srv.URL+"/?page=3")
+		case "3":
+			fmt.Fprint(w, `{"next": null, "results": [{"proxy_address": "9.9.9.9", "port": 3128}]}`)
+		}
+	}))
+	defer srv.Close()
+
+	src := ProxySource{
+		URL:        srv.URL,
+		Provider:   ProviderGenericJSON,
+		APIKeyEnv:  "TEST_PROVIDER_KEY",
+		AuthHeader: "Authorization: Token $KEY",
+		Fields:     map[string]string{"ip": "proxy_address", "user": "username", "pass": "password", "country": "country_code"},
+	}
+	if err := src.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	nodes, err := FetchFromProvider(context.Background(), src)
+	if err != nil {
+		t.Fatalf("FetchFromProvider() = %v", err)
+	}
+	if pages != 3 {
+		t.Errorf("fetched %d pages, want 3", pages)
+	}
+	want := []ProxyNode{
+		{ID: "1.2.3.4:8080", Type: ProxyTypeSOCKS5, GuessedType: true, IP: "1.2.3.4", Port: "8080", User: "alice", Pass: "pw1", Country: "DE", LatencyMS: -1},
+		{ID: "5.6.7.8:1080", Type: ProxyTypeSOCKS5, GuessedType: true, IP: "5.6.7.8", Port: "1080", User: "bob", Pass: "pw2", LatencyMS: -1},
+		{ID: "9.9.9.9:3128", Type: ProxyTypeSOCKS5, GuessedType: true, IP: "9.9.9.9", Port: "3128", LatencyMS: -1},
+	}
+	if len(nodes) != len(want) {
+		t.Fatalf("got %d nodes %+v, want %d", len(nodes), nodes, len(want))
+	}
+	for i := range want {
+		if fmt.Sprintf("%+v", nodes[i]) != fmt.Sprintf("%+v", want[i]) {
+			t.Errorf("node %d = %+v, want %+v", i, nodes[i], want[i])
+		}
+	}
+}
+
+func TestFetchFromProviderFieldMapping(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": [{"ip": "1.2.3.4", "port": "443", "login": "u", "secret": "p"}], "more": ""}`)
+	}))
+	defer srv.Close()
+
+	src := ProxySource{
+		URL:          srv.URL,
+		Type:         ProxyTypeHTTPS,
+		Provider:     ProviderGenericJSON,
+		Fields:       map[string]string{"user": "login", "pass": "secret"},
+		ResultsField: "data",
+		NextField:    "more",
+	}
+	nodes, err := FetchFromProvider(context.Background(), src)
+	if err != nil {
+		t.Fatalf("FetchFromProvider() = %v", err)
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("got %d nodes, want 1", len(nodes))
+	}
+	n := nodes[0]
+	if n.Type != ProxyTypeHTTPS || n.GuessedType || n.Addr() != "1.2.3.4:443" || n.User != "u" || n.Pass != "p" {
+		t.Errorf("node = %+v, want https://u:p@1.2.3.4:443", n)
+	}
+}
+
+func TestProviderSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	src := ProxySource{URL: srv.URL, Provider: ProviderGenericJSON, APIKeyEnv: "TEST_PROVIDER_KEY", AuthHeader: "X-Api-Key: $KEY"}
+
+	t.Setenv("TEST_PROVIDER_KEY", "")
+	if _, err := FetchFromProvider(context.Background(), src); err == nil || !strings.Contains(err.Error(), "TEST_PROVIDER_KEY") {
+		t.Errorf("FetchFromProvider() with the env unset = %v, want it named", err)
+	}
+
+	t.Setenv("TEST_PROVIDER_KEY", "s3cret")
+	_, err := FetchFromProvider(context.Background(), src)
+	if err == nil {
+		t.Fatal("FetchFromProvider() against a 401 succeeded")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error %q leaks the API key", err)
+	}
+	// /api/sources echoes the configured sources.
+	b, err := json.Marshal(Sources{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cret") {
+		t.Errorf("sources JSON %s leaks the API key", b)
+	}
+}
+
+func TestProviderSourceValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     ProxySource
+		wantErr string
+	}{
+		{"ok", ProxySource{URL: "https://p.example", Provider: ProviderGenericJSON, APIKeyEnv: "K", AuthHeader: "Authorization: Token $KEY"}, ""},
+		{"unknown provider", ProxySource{URL: "https://p.example", Provider: "nope"}, "unsupported provider"},
+		{"unknown field", ProxySource{URL: "https://p.example", Provider: ProviderGenericJSON, Fields: map[string]string{"password": "pw"}}, "unknown provider field"},
+		{"bad header", ProxySource{URL: "https://p.example", Provider: ProviderGenericJSON, AuthHeader: "Token $KEY"}, "auth_header"},
+		{"key without env", ProxySource{URL: "https://p.example", Provider: ProviderGenericJSON, AuthHeader: "Authorization: $KEY"}, "api_key_env"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.src.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newTokenBucket(10)
+	b.now = func() time.Time { return now }
+
+	steps := []struct {
+		advance time.Duration
+		want    time.Duration
+	}{
+		{0, 0},                                          // the initial token
+		{0, 100 * time.Millisecond},                     // one in debt
+		{0, 200 * time.Millisecond},                     // two in debt
+		{300 * time.Millisecond, 0},                     // debt paid off, one token refilled
+		{10 * time.Second, 0},                           // a long pause refills one token only...
+		{0, 100 * time.Millisecond},                     // ...so the next one waits
+		{50 * time.Millisecond, 150 * time.Millisecond}, // half a token back
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		got := b.reserve()
+		if diff := got - s.want; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Fatalf("step %d: reserve() = %v, want %v", i, got, s.want)
+		}
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	if b := newTokenBucket(0); b != nil {
+		t.Fatalf("newTokenBucket(0) = %v, want nil", b)
+	}
+	var b *tokenBucket
+	for i := 0; i < 1000; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatalf("nil bucket Wait: %v", err)
+		}
+	}
+}
+
+func TestTokenBucketWaitCancel(t *testing.T) {
+	b := newTokenBucket(0.001) // one token per 1000s
+	if err := b.Wait(context.Background()); err != nil {
+		t.Fatalf("first Wait: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Wait returned after %v, want it to stop at the deadline", elapsed)
+	}
+}
+
+func TestRunValidationRate(t *testing.T) {
+	const (
+		rate  = 50.0
+		nodes = 11
+	)
+	candidates := make([]ProxyNode, nodes)
+	for i := range candidates {
+		candidates[i] = node("203.0.113.1", string(rune('a'+i)), 0)
+	}
+	start := time.Now()
+	valid, tested, _, err := runValidation(context.Background(), candidates, nodes, 0, newTokenBucket(rate), nil, nil,
+		func(_ context.Context, n ProxyNode) (ProxyNode, error) { return n, nil })
+	elapsed := time.Since(start)
+	if err != nil || tested != nodes || len(valid) != nodes {
+		t.Fatalf("runValidation = %d valid, %d tested, %v; want %d, %d, nil", len(valid), tested, err, nodes, nodes)
+	}
+	// The first probe starts at once, the other ten 20ms apart.
+	if min := 150 * time.Millisecond; elapsed < min {
+		t.Fatalf("%d probes at %v/s took %v, want at least %v", nodes, rate, elapsed, min)
+	}
+	if elapsed > 2*time.Second {
+		t.Fatalf("%d probes at %v/s took %v", nodes, rate, elapsed)
+	}
+}
+
+func TestRunValidationRateCancel(t *testing.T) {
+	candidates := []ProxyNode{node("203.0.113.1", "1", 0), node("203.0.113.1", "2", 0), node("203.0.113.1", "3", 0)}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, tested, _, _ := runValidation(ctx, candidates, 3, 0, newTokenBucket(0.001), nil, nil,
+		func(_ context.Context, n ProxyNode) (ProxyNode, error) { return n, nil })
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("runValidation returned after %v, want shutdown not to wait for tokens", elapsed)
+	}
+	if tested != 1 {
+		t.Fatalf("tested = %d, want only the probe the first token allowed", tested)
+	}
+}
@@ -2,12 +2,46 @@ package logic
 
 import (
 	"context"
-	"errors"
 	"sync"
 	"time"
 )
 
+// Refresh modes: RefreshModeReplace swaps in the new pool, RefreshModeTopUp
+// merges it into the current one (see TopUp).
+const (
+	RefreshModeReplace = "replace"
+	RefreshModeTopUp   = "topup"
+)
+
 type Refresher struct {
+	// AllowPrivate keeps proxies on private/loopback/reserved IPs.
+	AllowPrivate bool
+	// TrustStatic keeps configured static proxies without validating them.
+	TrustStatic bool
+	// MaxPoolSize caps the pool a top-up may grow (0 = unlimited).
+	MaxPoolSize int
+	// TypeCache, when set before use, keeps the detected types of nodes
+	// from "infer" sources across refreshes.
+	TypeCache *TypeCache
+	// Seen, when set before use, records the candidates of every refresh
+	// (not dry runs), before validation.
+	Seen *SeenTracker
+	// Progressive merges nodes into the pool in batches as they pass
+	// validation, instead of only once validation is done. The end of the
+	// refresh still replaces (or tops up) the pool as usual. It has no
+	// effect with SelectFastest or DedupeExitIP, whose picks are only known
+	// at the end.
+	Progressive bool
+	// Self, when set before use, drops candidates that are this process's
+	// own listeners.
+	Self *SelfGuard
+	// Blocklist, when set before use, skips repeat offenders from
+	// validation and learns from every refresh (not dry runs).
+	Blocklist *Blocklist
+	// MaxProxyRange caps the static proxy ranges (see
+	// ExpandProxySpecLimit; 0 = DefaultMaxProxyRange).
+	MaxProxyRange int
+
 	managers []*ProxyManager
 	mu      sync.Mutex
 
@@ -15,8 +49,17 @@ type Refresher struct {
 	proxies []string
 	validation ValidationConfig
 	timeout    time.Duration
+
+	diffMu         sync.RWMutex
+	diffs          []PoolDiff
+	sourceStats    []SourceStats
+	lastValidation *ValidationSummary
+	lastInferred   map[string]int
 }
 
+// maxRefreshDiffs bounds how many past refresh diffs are kept in memory.
+const maxRefreshDiffs = 10
+
 func NewRefresher(managers []*ProxyManager, sources Sources, proxies []string, validation ValidationConfig, timeout time.Duration) *Refresher {
 	managers = append([]*ProxyManager(nil), managers...)
 	return &Refresher{
@@ -28,90 +71,478 @@ func NewRefresher(managers []*ProxyManager, sources Sources, proxies []string, v
 	}
 }
 
-func (r *Refresher) Refresh(ctx context.Context) (int, error) {
+// Sources returns the configured sources.
+func (r *Refresher) Sources() Sources {
+	// SetSources holds diffMu too, so this doesn't wait for a refresh.
+	r.diffMu.RLock()
+	defer r.diffMu.RUnlock()
+	return r.sources
+}
+
+// SetSources replaces the sources and static proxies; the next refresh
+// uses them. It waits for a running refresh to finish.
+func (r *Refresher) SetSources(sources Sources, proxies []string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.diffMu.Lock()
+	defer r.diffMu.Unlock()
+	r.sources = sources
+	r.proxies = append([]string(nil), proxies...)
+}
 
-	staticNodes := ParseProxySpecs(r.proxies, "auto")
-	fetched, fetchErr := FetchFromSources(ctx, r.sources)
-	if fetchErr != nil && len(staticNodes) == 0 {
+// RefreshOverride replaces parts of the refresher configuration for a dry run.
+// Nil fields keep the configured values.
+type RefreshOverride struct {
+	Sources    *Sources          `json:"sources,omitempty"`
+	Proxies    []string          `json:"proxies,omitempty"`
+	Validation *ValidationConfig `json:"validation,omitempty"`
+}
+
+// ValidationSummary is the outcome of the validation stage of a refresh.
+type ValidationSummary struct {
+	Tested   int            `json:"tested"`
+	Valid    int            `json:"valid"`
+	Failures map[string]int `json:"failures"`
+	// AuthFailed lists proxies that rejected their credentials; they are
+	// left out of the pool like any other failure.
+	AuthFailed []string `json:"auth_failed,omitempty"`
+	// Redetected counts schemeless proxies assumed SOCKS5 that turned out
+	// to be HTTP proxies.
+	Redetected int `json:"redetected_http,omitempty"`
+	// SameExit counts valid nodes dropped for sharing an exit IP with a
+	// faster one (dedupe_exit_ip).
+	SameExit int `json:"same_exit_dropped,omitempty"`
+	// Blocklisted counts candidates skipped as repeat offenders.
+	Blocklisted int `json:"blocklisted,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// RefreshReport describes a refresh, applied or not.
+type RefreshReport struct {
+	DryRun     bool               `json:"dry_run"`
+	PoolSize   int                `json:"pool_size"`
+	Diff       PoolDiff           `json:"diff"`
+	Sources    []SourceStats      `json:"sources"`
+	Validation *ValidationSummary `json:"validation,omitempty"`
+	// Inferred counts the detected types of nodes from "infer" sources.
+	Inferred map[string]int `json:"inferred,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+type refreshPlan struct {
+	sources    Sources
+	proxies    []string
+	validation ValidationConfig
+	// observe feeds the candidates to Refresher.Seen.
+	observe bool
+	// onValid, when set, gets each node as it passes validation.
+	onValid func(ProxyNode)
+}
+
+// Refresh fetches and validates the sources and replaces the pool. It
+// returns the new pool size and the diff it recorded; when the pool was
+// kept, the size is 0 and the diff is zero (At unset).
+func (r *Refresher) Refresh(ctx context.Context) (int, PoolDiff, error) {
+	return r.refresh(ctx, RefreshModeReplace)
+}
+
+// TopUp fetches and validates like Refresh, but merges the result into the
+// current pool with ProxyManager.MergeNodes instead of replacing it: nodes
+// missing from this fetch stay, and only MaxPoolSize evicts old ones. The
+// diff reports the added, evicted and retained nodes. It returns the pool
+// size.
+func (r *Refresher) TopUp(ctx context.Context) (int, PoolDiff, error) {
+	return r.refresh(ctx, RefreshModeTopUp)
+}
+
+func (r *Refresher) refresh(ctx context.Context, mode string) (int, PoolDiff, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The diff is against the pool from before any progressive merge.
+	prev := r.previousPool()
+	plan := refreshPlan{sources: r.sources, proxies: r.proxies, validation: r.validation, observe: true}
+	var progress *progressiveApplier
+	if r.Progressive && r.validation.Enabled {
+		progress = r.startProgressive()
+		plan.onValid = progress.Add
+	}
+	nodes, report, err := r.build(ctx, plan)
+	if progress != nil {
+		progress.Stop()
+	}
+	r.diffMu.Lock()
+	r.sourceStats = report.Sources
+	r.lastValidation = report.Validation
+	r.lastInferred = report.Inferred
+	r.diffMu.Unlock()
+	if len(nodes) == 0 {
+		// Keep the existing pool when the new one is unusable.
 		for _, m := range r.managers {
 			if m == nil {
 				continue
 			}
-			m.SetRefreshResult(time.Now(), fetchErr)
+			m.SetRefreshResult(time.Now(), err)
 		}
-		return 0, fetchErr
+		return 0, PoolDiff{}, err
+	}
+	if mode == RefreshModeTopUp {
+		size, diff := r.mergePool(prev, nodes, err)
+		return size, diff, err
+	}
+	nodes = poolable(nodes)
+	return len(nodes), r.applyPool(prev, nodes, err), err
+}
+
+// DryRun runs fetch and validation like Refresh but never touches the pool.
+// It shares Refresh's lock, so the two never interleave.
+func (r *Refresher) DryRun(ctx context.Context, override RefreshOverride) (RefreshReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	plan := refreshPlan{sources: r.sources, proxies: r.proxies, validation: r.validation}
+	if override.Sources != nil {
+		plan.sources = *override.Sources
+	}
+	if override.Proxies != nil {
+		plan.proxies = override.Proxies
+	}
+	if override.Validation != nil {
+		plan.validation = *override.Validation
+		plan.validation.ApplyDefaults()
+	}
+
+	nodes, report, err := r.build(ctx, plan)
+	report.DryRun = true
+	report.PoolSize = len(nodes)
+	if len(nodes) > 0 {
+		report.Diff = DiffPools(r.previousPool(), poolable(nodes))
+		report.Diff.At = time.Now()
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report, err
+}
+
+// build runs the fetch/filter/validate pipeline. An empty result means the
+// refresh failed and err says why; a non-empty result with err is a warning.
+func (r *Refresher) build(ctx context.Context, plan refreshPlan) ([]ProxyNode, RefreshReport, error) {
+	var report RefreshReport
+
+	staticNodes := parseProxySpecs(plan.proxies, "auto", r.MaxProxyRange)
+	for i := range staticNodes {
+		staticNodes[i].Source = SourceStatic
+	}
+	fetched, stats, fetchErr := FetchFromSourcesWithStats(ctx, plan.sources)
+	report.Sources = stats
+	if fetchErr != nil && len(staticNodes) == 0 {
+		return nil, report, fetchErr
 	}
 
 	nodes := MergeDedup(staticNodes, fetched)
+	if !r.AllowPrivate {
+		nodes = FilterPublic(nodes)
+	}
+	nodes = r.Self.Filter(nodes)
+	for _, n := range nodes {
+		if n.Type == ProxyTypeInfer {
+			nodes, report.Inferred = inferTypes(ctx, nodes, r.TypeCache, plan.validation.TestFor(ProxyTypeSOCKS5).Target, plan.validation.Concurrency, r.timeout)
+			nodes = MergeDedup(nodes)
+			break
+		}
+	}
 	if len(nodes) == 0 {
-		err := errors.New("empty proxy list")
+		err := ErrEmptyPool
 		if fetchErr != nil {
 			err = fetchErr
 		}
-		for _, m := range r.managers {
-			if m == nil {
-				continue
-			}
-			m.SetRefreshResult(time.Now(), err)
-		}
-		return 0, err
+		return nil, report, err
+	}
+	if plan.observe {
+		r.Seen.Observe(nodes, time.Now())
 	}
 
-	if r.validation.Enabled {
-		res, verr := ValidateAndFilter(ctx, nodes, r.validation, r.timeout)
-		if verr != nil && len(res.ValidSOCKS5) == 0 {
-			// Keep existing pool if new pool is unusable.
-			for _, m := range r.managers {
-				if m == nil {
-					continue
-				}
-				m.SetRefreshResult(time.Now(), verr)
-			}
-			return 0, verr
+	if !plan.validation.Enabled {
+		return nodes, report, fetchErr
+	}
+
+	exempt := r.blocklistExempt(staticNodes)
+	toValidate, blocklisted := r.Blocklist.Filter(nodes, exempt, time.Now())
+	var trusted []ProxyNode
+	if r.TrustStatic && len(staticNodes) > 0 {
+		trusted, toValidate = splitByAddr(toValidate, staticNodes)
+	}
+
+	var res ValidationResult
+	var verr error
+	if len(toValidate) > 0 {
+		res, verr = validateAndFilter(ctx, toValidate, plan.validation, r.timeout, r.previousAddrs(), plan.onValid)
+		report.Validation = &ValidationSummary{
+			Tested:     res.TestedSOCKS5 + res.TestedOther,
+			Valid:      res.ValidSOCKS5Count + len(res.ValidOther),
+			Failures:   res.Failures,
+			Redetected: res.Redetected,
+			SameExit:   res.SameExit,
 		}
-		nodes = MergeDedup(res.ValidSOCKS5)
-		if len(nodes) == 0 {
-			for _, m := range r.managers {
-				if m == nil {
-					continue
-				}
-				m.SetRefreshResult(time.Now(), verr)
-			}
-			return 0, verr
+		for _, n := range res.AuthFailed {
+			report.Validation.AuthFailed = append(report.Validation.AuthFailed, n.Addr())
 		}
-		// Surface partial validation errors as refresh error (warning), but still update pool.
 		if verr != nil {
-			for _, m := range r.managers {
-				if m == nil {
-					continue
-				}
-				m.SetPool(nodes)
-				m.SetRefreshResult(time.Now(), verr)
+			report.Validation.Error = verr.Error()
+		}
+		if plan.observe {
+			passed := make([]string, 0, len(res.ValidSOCKS5)+len(res.ValidOther))
+			for _, n := range res.ValidSOCKS5 {
+				passed = append(passed, n.Addr())
+			}
+			for _, n := range res.ValidOther {
+				passed = append(passed, n.Addr())
 			}
-			return len(nodes), verr
+			r.Blocklist.Record(res.Failed, passed, exempt, time.Now())
+		}
+	}
+	if blocklisted > 0 {
+		if report.Validation == nil {
+			report.Validation = &ValidationSummary{}
+		}
+		report.Validation.Blocklisted = blocklisted
+	}
+
+	if len(trusted) > 0 {
+		nodes = MergeDedup(trusted, res.ValidSOCKS5, res.ValidOther)
+		if verr != nil {
+			return nodes, report, verr
 		}
+		return nodes, report, fetchErr
 	}
 
+	nodes = MergeDedup(res.ValidSOCKS5, res.ValidOther)
+	if len(res.ValidOther) > 0 && len(res.ValidSOCKS5) > 0 {
+		SortNodes(nodes, plan.validation.RankBy)
+	}
+	if len(nodes) == 0 {
+		return nil, report, verr
+	}
+	// Surface partial validation errors as refresh error (warning), but still update pool.
+	if verr != nil {
+		return nodes, report, verr
+	}
+	return nodes, report, fetchErr
+}
+
+// blocklistExempt returns the addresses the blocklist must leave alone: the
+// static proxies and the nodes pinned as current.
+func (r *Refresher) blocklistExempt(static []ProxyNode) map[string]struct{} {
+	if r.Blocklist == nil {
+		return nil
+	}
+	set := make(map[string]struct{}, len(static)+len(r.managers))
+	for _, n := range static {
+		set[n.Addr()] = struct{}{}
+	}
+	for _, m := range r.managers {
+		if n, ok := m.Pinned(); ok {
+			set[n.Addr()] = struct{}{}
+		}
+	}
+	return set
+}
+
+// previousPool returns the pool of the first manager, which all managers share
+// after a refresh.
+func (r *Refresher) previousPool() []ProxyNode {
+	for _, m := range r.managers {
+		if m != nil {
+			return m.PoolSnapshot(0)
+		}
+	}
+	return nil
+}
+
+func (r *Refresher) previousAddrs() map[string]struct{} {
+	prev := r.previousPool()
+	set := make(map[string]struct{}, len(prev))
+	for _, n := range prev {
+		set[n.Addr()] = struct{}{}
+	}
+	return set
+}
+
+// applyPool replaces every manager's pool with nodes, which must already be
+// poolable so the recorded diff matches what the managers keep.
+func (r *Refresher) applyPool(prev, nodes []ProxyNode, err error) PoolDiff {
+	now := time.Now()
+	diff := DiffPools(prev, nodes)
+	diff.At = now
+	r.recordDiff(diff)
+
 	for _, m := range r.managers {
 		if m == nil {
 			continue
 		}
 		m.SetPool(nodes)
-		m.SetRefreshResult(time.Now(), fetchErr)
+		m.SetRefreshResult(now, err)
+		m.setRefreshOK(now)
+	}
+	return diff
+}
+
+// mergePool is applyPool for TopUp and returns the merged pool size.
+func (r *Refresher) mergePool(prev, nodes []ProxyNode, err error) (int, PoolDiff) {
+	now := time.Now()
+	for _, m := range r.managers {
+		if m == nil {
+			continue
+		}
+		m.MergeNodes(nodes, r.MaxPoolSize, r.validation.RankBy)
+		m.SetRefreshResult(now, err)
+		m.setRefreshOK(now)
 	}
-	return len(nodes), fetchErr
+	next := r.previousPool()
+	diff := DiffPools(prev, next)
+	diff.At = now
+	r.recordDiff(diff)
+	return len(next), diff
 }
 
+// Add merges nodes into the pool outside a refresh, tagged with tags. With
+// validate they are probed like refresh candidates and only those that pass
+// go in; otherwise they go in as given. Private addresses are dropped unless
+// AllowPrivate. The next replacing refresh drops them again unless a source
+// or the proxies setting lists them. It shares Refresh's lock, so every
+// manager sees the merge between the same two refreshes. It returns the
+// nodes added.
+func (r *Refresher) Add(ctx context.Context, nodes []ProxyNode, tags []string, validate bool) ([]ProxyNode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, timeout := r.validation, r.timeout
+
+	nodes = MergeDedup(nodes)
+	if !r.AllowPrivate {
+		nodes = FilterPublic(nodes)
+	}
+	nodes = poolable(r.Self.Filter(nodes))
+	if len(nodes) == 0 {
+		return nil, ErrEmptyPool
+	}
+	tags = NormalizeTags(tags)
+	for i := range nodes {
+		nodes[i].Source = SourceAPI
+		nodes[i].Tags = mergeTags(nodes[i].Tags, tags)
+	}
+	if validate {
+		cfg.Enabled = true
+		res, err := validateAndFilter(ctx, nodes, cfg, timeout, nil, nil)
+		nodes = MergeDedup(res.ValidSOCKS5, res.ValidOther)
+		if len(nodes) == 0 {
+			return nil, err
+		}
+	}
+	for _, m := range r.managers {
+		if m != nil {
+			m.MergeNodes(nodes, r.MaxPoolSize, cfg.RankBy)
+		}
+	}
+	return nodes, nil
+}
+
+func (r *Refresher) recordDiff(d PoolDiff) {
+	r.diffMu.Lock()
+	defer r.diffMu.Unlock()
+	r.diffs = append(r.diffs, d)
+	if len(r.diffs) > maxRefreshDiffs {
+		r.diffs = append([]PoolDiff(nil), r.diffs[len(r.diffs)-maxRefreshDiffs:]...)
+	}
+}
+
+// Diffs returns the most recent refresh diffs, newest last.
+func (r *Refresher) Diffs() []PoolDiff {
+	r.diffMu.RLock()
+	defer r.diffMu.RUnlock()
+	return append([]PoolDiff(nil), r.diffs...)
+}
+
+// LastDiff returns the diff of the most recent applied refresh.
+func (r *Refresher) LastDiff() (PoolDiff, bool) {
+	r.diffMu.RLock()
+	defer r.diffMu.RUnlock()
+	if len(r.diffs) == 0 {
+		return PoolDiff{}, false
+	}
+	return r.diffs[len(r.diffs)-1], true
+}
+
+// SourceStats returns the per-source results of the last applied or failed refresh.
+func (r *Refresher) SourceStats() []SourceStats {
+	r.diffMu.RLock()
+	defer r.diffMu.RUnlock()
+	return append([]SourceStats(nil), r.sourceStats...)
+}
+
+// LastValidation returns the validation summary of the last refresh, or nil
+// when it did not validate.
+func (r *Refresher) LastValidation() *ValidationSummary {
+	r.diffMu.RLock()
+	defer r.diffMu.RUnlock()
+	return r.lastValidation
+}
+
+// LastInferred returns the detected type counts of the last refresh, or nil
+// when it had no "infer" sources.
+func (r *Refresher) LastInferred() map[string]int {
+	r.diffMu.RLock()
+	defer r.diffMu.RUnlock()
+	return r.lastInferred
+}
+
+// SetSourceStats restores per-source results, e.g. from an imported state.
+func (r *Refresher) SetSourceStats(stats []SourceStats) {
+	r.diffMu.Lock()
+	defer r.diffMu.Unlock()
+	r.sourceStats = append([]SourceStats(nil), stats...)
+}
+
+// IfIdle runs fn while holding the refresh lock and reports true, or returns
+// false without running fn when a refresh or dry run is in progress.
+func (r *Refresher) IfIdle(fn func()) bool {
+	if !r.mu.TryLock() {
+		return false
+	}
+	defer r.mu.Unlock()
+	fn()
+	return true
+}
+
+// splitByAddr partitions nodes into those whose addr appears in ref and the rest.
+func splitByAddr(nodes, ref []ProxyNode) (in, out []ProxyNode) {
+	set := make(map[string]struct{}, len(ref))
+	for _, n := range ref {
+		set[n.Addr()] = struct{}{}
+	}
+	for _, n := range nodes {
+		if _, ok := set[n.Addr()]; ok {
+			in = append(in, n)
+		} else {
+			out = append(out, n)
+		}
+	}
+	return in, out
+}
+
+// ParseProxySpecs parses specs with ExpandProxySpec, skipping invalid ones.
 func ParseProxySpecs(specs []string, defaultType string) []ProxyNode {
+	return parseProxySpecs(specs, defaultType, 0)
+}
+
+func parseProxySpecs(specs []string, defaultType string, maxRange int) []ProxyNode {
 	out := make([]ProxyNode, 0, len(specs))
 	for _, s := range specs {
-		n, ok := ParseProxySpec(s, defaultType)
-		if !ok {
+		nodes, err := ExpandProxySpecLimit(s, defaultType, maxRange)
+		if err != nil {
 			continue
 		}
-		out = append(out, n)
+		out = append(out, nodes...)
 	}
 	return out
 }
@@ -0,0 +1,147 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefresherSetSources(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			io.WriteString(w, "1.2.3.4:1080\n")
+		case "/new":
+			io.WriteString(w, "5.6.7.8:1080\n")
+		}
+	}))
+	defer srv.Close()
+
+	m := NewProxyManager()
+	r := NewRefresher([]*ProxyManager{m}, Sources{{URL: srv.URL + "/old"}}, nil, ValidationConfig{}, time.Second)
+	next := Sources{{URL: srv.URL + "/new"}}
+	r.SetSources(next, []string{"9.9.9.9:3128"})
+	if got := r.Sources(); len(got) != 1 || got[0].URL != next[0].URL {
+		t.Fatalf("Sources() = %v, want %v", got, next)
+	}
+	if _, _, err := r.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	if got := fmt.Sprint(addrs(m.PoolSnapshot(0))); got != "[9.9.9.9:3128 5.6.7.8:1080]" && got != "[5.6.7.8:1080 9.9.9.9:3128]" {
+		t.Errorf("pool = %s, want the new source and static proxy only", got)
+	}
+}
+
+// TestRefresherProgressive validates a full batch of fast nodes and one
+// held back by a slow upstream: the batch reaches the pool while Refresh is
+// still waiting on the slow one.
+func TestRefresherProgressive(t *testing.T) {
+	srv := helloServer(t)
+	var proxies []string
+	for i := 0; i < progressiveBatch; i++ {
+		up, _ := fakeUpstream(t)
+		proxies = append(proxies, up.Addr())
+	}
+	release := make(chan struct{})
+	slow := &SOCKS5Server{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go slow.Serve(ln)
+	proxies = append(proxies, ln.Addr().String())
+
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join(proxies, "\n"))
+	}))
+	defer src.Close()
+
+	m := NewProxyManager()
+	cfg := ValidationConfig{Enabled: true, SOCKS5TestAddr: strings.TrimPrefix(srv.URL, "http://"), MaxSOCKS5: 100, Concurrency: len(proxies)}
+	r := NewRefresher([]*ProxyManager{m}, Sources{{URL: src.URL}}, nil, cfg, 10*time.Second)
+	r.AllowPrivate = true
+	r.Progressive = true
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := r.Refresh(context.Background())
+		done <- err
+	}()
+	deadline := time.After(5 * time.Second)
+	for m.PoolSize() < progressiveBatch {
+		select {
+		case err := <-done:
+			t.Fatalf("Refresh() = %v before the batch was published", err)
+		case <-deadline:
+			t.Fatalf("pool size = %d, want the first batch of %d merged early", m.PoolSize(), progressiveBatch)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	if got := m.PoolSize(); got != len(proxies) {
+		t.Errorf("pool size after Refresh = %d, want %d", got, len(proxies))
+	}
+}
+
+// TestRefresherAddHoldsLock holds Add in validation and checks that a
+// refresh cannot run until the merge is done.
+func TestRefresherAddHoldsLock(t *testing.T) {
+	srv := helloServer(t)
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	slow := &SOCKS5Server{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go slow.Serve(ln)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	fixed, auto := NewProxyManager(), NewProxyManager()
+	cfg := ValidationConfig{SOCKS5TestAddr: strings.TrimPrefix(srv.URL, "http://"), MaxSOCKS5: 10}
+	r := NewRefresher([]*ProxyManager{fixed, auto}, nil, nil, cfg, 10*time.Second)
+	r.AllowPrivate = true
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Add(context.Background(), []ProxyNode{node(host, port, 0)}, nil, true)
+		done <- err
+	}()
+	<-entered
+	if r.IfIdle(func() {}) {
+		t.Error("IfIdle() ran while Add was validating")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	if fixed.PoolSize() != 1 || auto.PoolSize() != 1 {
+		t.Errorf("pools = %d, %d after Add, want 1 each", fixed.PoolSize(), auto.PoolSize())
+	}
+}
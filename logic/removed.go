@@ -0,0 +1,66 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	RemovedReasonFailed     = "failed"
+	RemovedReasonAuthFailed = "auth_failed"
+	// RemovedReasonDisabled is a node kept in the pool but taken out of
+	// rotation (RemovalPolicyDisable).
+	RemovedReasonDisabled = "disabled"
+)
+
+// RemovedNode records a proxy dropped from a pool, or rejected by
+// validation, and why.
+type RemovedNode struct {
+	At     time.Time `json:"at"`
+	Proxy  string    `json:"proxy"`
+	Reason string    `json:"reason"`
+}
+
+// RemovedLog keeps the most recent removals in memory. A nil *RemovedLog
+// records nothing.
+type RemovedLog struct {
+	mu    sync.RWMutex
+	items []RemovedNode
+	max   int
+}
+
+func NewRemovedLog(max int) *RemovedLog {
+	if max <= 0 {
+		max = 200
+	}
+	return &RemovedLog{max: max}
+}
+
+func (l *RemovedLog) Record(proxy, reason string) {
+	if l == nil || proxy == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.items = append(l.items, RemovedNode{At: time.Now(), Proxy: proxy, Reason: reason})
+	if len(l.items) > l.max {
+		l.items = append([]RemovedNode(nil), l.items[len(l.items)-l.max:]...)
+	}
+}
+
+// Items returns recorded removals, oldest first, optionally only those with
+// the given reason.
+func (l *RemovedLog) Items(reason string) []RemovedNode {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]RemovedNode, 0, len(l.items))
+	for _, it := range l.items {
+		if reason == "" || it.Reason == reason {
+			out = append(out, it)
+		}
+	}
+	return out
+}
@@ -0,0 +1,122 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRetryAttempts is how many upstreams a retried dial or round trip
+// tries unless configured otherwise.
+const DefaultRetryAttempts = 3
+
+// RetryPolicy is how a failed upstream operation is retried on another
+// node: up to MaxAttempts tries in all, each within AttemptTimeout, waiting
+// Backoff before the second and twice as long before each next one, up to
+// MaxBackoff. The zero value tries once.
+type RetryPolicy struct {
+	MaxAttempts int
+	// AttemptTimeout caps each attempt; 0 leaves it to the caller.
+	AttemptTimeout time.Duration
+	Backoff        time.Duration
+	MaxBackoff     time.Duration
+	// RetryOn lists the failure categories (see FailureCategory) worth
+	// another node; empty retries every failure but a cancelled context.
+	RetryOn []string
+}
+
+// DefaultRetryPolicy tries DefaultRetryAttempts nodes back to back.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: DefaultRetryAttempts}
+}
+
+// Attempts returns MaxAttempts, at least 1.
+func (p RetryPolicy) Attempts() int {
+	return max(p.MaxAttempts, 1)
+}
+
+// Timeout returns the timeout of one attempt: AttemptTimeout when set and
+// shorter than fallback, fallback otherwise.
+func (p RetryPolicy) Timeout(fallback time.Duration) time.Duration {
+	if p.AttemptTimeout > 0 && (fallback <= 0 || p.AttemptTimeout < fallback) {
+		return p.AttemptTimeout
+	}
+	return fallback
+}
+
+// Retryable reports whether a failure with err is worth another node.
+func (p RetryPolicy) Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	cat := FailureCategory(err)
+	for _, c := range p.RetryOn {
+		if c == cat {
+			return true
+		}
+	}
+	return false
+}
+
+// KnownFailureCategory reports whether FailureCategory can return c,
+// upstream replies ("socks5_<reply name>", "http_<status code>") included.
+func KnownFailureCategory(c string) bool {
+	switch c {
+	case DialErrDNS, DialErrRefused, DialErrTimeout, DialErrHandshake, DialErrAuth,
+		DialErrTLS, DialErrProxy, DialErrOther, FailureContentMismatch, FailureNoResponse, FailureNoExitIP:
+		return true
+	}
+	if name, ok := strings.CutPrefix(c, "socks5_"); ok {
+		for code := 0; code < 256; code++ {
+			if SOCKS5ReplyName(byte(code)) == name {
+				return true
+			}
+		}
+		return false
+	}
+	if status, ok := strings.CutPrefix(c, "http_"); ok {
+		code, err := strconv.Atoi(status)
+		return err == nil && code >= 100 && code <= 599 && strconv.Itoa(code) == status
+	}
+	return false
+}
+
+// Delay returns the wait before attempt (counted from 0).
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt <= 0 || p.Backoff <= 0 {
+		return 0
+	}
+	d := p.Backoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return d
+}
+
+// Wait sleeps Delay(attempt), returning early with ctx.Err() once ctx is
+// done.
+func (p RetryPolicy) Wait(ctx context.Context, attempt int) error {
+	d := p.Delay(attempt)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,65 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestKnownFailureCategory(t *testing.T) {
+	tests := []struct {
+		cat  string
+		want bool
+	}{
+		{DialErrTimeout, true},
+		{DialErrHandshake, true},
+		{FailureContentMismatch, true},
+		{FailureNoExitIP, true},
+		{"socks5_host_unreachable", true},
+		{"socks5_general_failure", true},
+		{"socks5_code_200", true},
+		{"socks5_succeeded", true},
+		{"socks5_", false},
+		{"socks5_nope", false},
+		{"http_502", true},
+		{"http_407", true},
+		{"http_", false},
+		{"http_99", false},
+		{"http_600", false},
+		{"http_0502", false},
+		{"http_bad", false},
+		{"bogus", false},
+	}
+	for _, tt := range tests {
+		if got := KnownFailureCategory(tt.cat); got != tt.want {
+			t.Errorf("KnownFailureCategory(%q) = %v, want %v", tt.cat, got, tt.want)
+		}
+	}
+}
+
+// TestRetryOnUpstreamReplies checks that every reply category
+// DialErrorCategory reports can be named in RetryOn.
+func TestRetryOnUpstreamReplies(t *testing.T) {
+	replies := []error{
+		&SOCKS5ReplyError{Code: SOCKS5ReplyHostUnreachable},
+		&SOCKS5ReplyError{Code: 0xc8},
+		&HTTPConnectError{Code: 502, Status: "Bad Gateway"},
+	}
+	for _, err := range replies {
+		wrapped := fmt.Errorf("dial: %w", err)
+		cat := FailureCategory(wrapped)
+		if !KnownFailureCategory(cat) {
+			t.Errorf("category %q of %v is not accepted by retry_on", cat, err)
+		}
+		p := RetryPolicy{RetryOn: []string{cat}}
+		if !p.Retryable(wrapped) {
+			t.Errorf("RetryOn %v does not retry %v", p.RetryOn, err)
+		}
+		if (RetryPolicy{RetryOn: []string{DialErrTimeout}}).Retryable(wrapped) {
+			t.Errorf("RetryOn [timeout] retries %v", err)
+		}
+	}
+	if (RetryPolicy{}).Retryable(context.Canceled) {
+		t.Error("a cancelled dial is retried")
+	}
+}
@@ -0,0 +1,305 @@
+package logic
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type RotationConfig struct {
+	Interval time.Duration
+	// Jitter is the ±fraction of Interval applied randomly per tick, in [0, 1).
+	Jitter    float64
+	TestAddr  string
+	TLSVerify bool
+	// TLS adjusts the handshake when TLSVerify is set.
+	TLS     TLSProbeOptions
+	Timeout time.Duration
+	// Retry caps the nodes a rotation health-checks before giving up
+	// (MaxAttempts, 0 = every node) and the time each check may take.
+	// Checks move on without backoff; a stale check tries at most 5.
+	Retry RetryPolicy
+	// NewTimer, when set, replaces time.NewTimer for the rotation schedule,
+	// returning the tick channel and a stop function. Tests use it to fire
+	// ticks by hand.
+	NewTimer func(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+// RotationController periodically advances the manager's current node and
+// health-checks the new one, skipping to the next node until one passes.
+type RotationController struct {
+	manager *ProxyManager
+
+	// OnRotate, when set before Start, is called after every rotation tick
+	// with the node before and after the tick.
+	OnRotate func(from, to ProxyNode)
+	// Hold, when set before Start, is asked before a scheduled rotation
+	// ("rotate") or a stale check ("stale_check"); returning true skips it.
+	Hold func(action string) bool
+
+	mu        sync.Mutex
+	interval  time.Duration
+	jitter    float64
+	testAddr  string
+	tlsVerify bool
+	tlsOpts   TLSProbeOptions
+	timeout   time.Duration
+	retry     RetryPolicy
+	newTimer  func(d time.Duration) (<-chan time.Time, func() bool)
+
+	// staleMu serializes CheckStale so a burst of connections after an idle
+	// period triggers a single health check. lastStaleCheck, under staleMu,
+	// is when the last check ran, or when the first call found no success
+	// to measure from.
+	staleMu        sync.Mutex
+	lastStaleCheck time.Time
+
+	resetCh chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewRotationController(manager *ProxyManager, cfg RotationConfig) *RotationController {
+	timeout := cfg.Timeout
+	if timeout <= 0 || timeout > 10*time.Second {
+		timeout = 10 * time.Second
+	}
+	jitter := cfg.Jitter
+	if jitter < 0 {
+		jitter = 0
+	}
+	if jitter >= 1 {
+		jitter = 0.99
+	}
+	newTimer := cfg.NewTimer
+	if newTimer == nil {
+		newTimer = func(d time.Duration) (<-chan time.Time, func() bool) {
+			t := time.NewTimer(d)
+			return t.C, t.Stop
+		}
+	}
+	return &RotationController{
+		manager:   manager,
+		interval:  cfg.Interval,
+		jitter:    jitter,
+		testAddr:  cfg.TestAddr,
+		tlsVerify: cfg.TLSVerify,
+		tlsOpts:   cfg.TLS,
+		retry:     cfg.Retry,
+		timeout:   timeout,
+		newTimer:  newTimer,
+		resetCh:   make(chan struct{}, 1),
+	}
+}
+
+// Start runs the rotation loop until ctx is done or Stop is called. The loop
+// runs even when the interval is 0 so it can be enabled later via SetInterval.
+func (r *RotationController) Start(ctx context.Context) {
+	r.mu.Lock()
+	if r.cancel != nil {
+		r.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	done := r.done
+	r.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		r.loop(ctx)
+	}()
+}
+
+// Stop ends the rotation loop and waits for it to exit.
+func (r *RotationController) Stop() {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.cancel, r.done = nil, nil
+	r.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (r *RotationController) Interval() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.interval
+}
+
+// SetInterval changes the rotation interval; the running loop reschedules
+// immediately. A non-positive interval pauses rotation.
+func (r *RotationController) SetInterval(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	r.mu.Lock()
+	r.interval = d
+	r.mu.Unlock()
+	select {
+	case r.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+// nextDelay returns the interval with jitter applied, or 0 when disabled.
+func (r *RotationController) nextDelay() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return jitterDuration(r.interval, r.jitter, rand.Float64())
+}
+
+// jitterDuration scales d by 1 ± jitter, with u in [0, 1) picking the point.
+func jitterDuration(d time.Duration, jitter float64, u float64) time.Duration {
+	if d <= 0 || jitter <= 0 {
+		return d
+	}
+	f := 1 + jitter*(2*u-1)
+	return time.Duration(float64(d) * f)
+}
+
+func (r *RotationController) loop(ctx context.Context) {
+	for {
+		delay := r.nextDelay()
+		var tick <-chan time.Time
+		var stop func() bool
+		if delay > 0 {
+			tick, stop = r.newTimer(delay)
+		}
+		select {
+		case <-ctx.Done():
+			if stop != nil {
+				stop()
+			}
+			return
+		case <-r.resetCh:
+			if stop != nil {
+				stop()
+			}
+		case <-tick:
+			r.Rotate(ctx)
+		}
+	}
+}
+
+// Rotate advances to the next healthy node (or simply the next one when none
+// is) and makes sure it passes a health check.
+func (r *RotationController) Rotate(ctx context.Context) {
+	if r.Hold != nil && r.Hold("rotate") {
+		return
+	}
+	from, _ := r.manager.Current()
+	if _, ok := r.manager.NextHealthy(); !ok {
+		_, _ = r.manager.Next()
+	}
+	r.EnsureValidCurrent(ctx)
+	if r.OnRotate != nil {
+		to, _ := r.manager.Current()
+		r.OnRotate(from, to)
+	}
+}
+
+// EnsureValidCurrent checks the current node and moves forward until one
+// passes or every node has been tried once.
+func (r *RotationController) EnsureValidCurrent(ctx context.Context) {
+	r.ensureValidCurrent(ctx, r.timeout, r.retry.MaxAttempts)
+}
+
+const (
+	staleCheckTimeout  = 3 * time.Second
+	staleCheckMaxTries = 5
+)
+
+// CheckStale health-checks the current node when the manager has not seen a
+// successful dial for longer than after, rotating away from it if it is dead.
+// A check that finds every node dead still counts: the next one waits
+// another after. Before the first success, the first call starts the clock.
+// fired reports whether a check ran and rotated whether the current node
+// changed. A non-positive after disables the check.
+func (r *RotationController) CheckStale(ctx context.Context, after time.Duration, now time.Time) (fired, rotated bool) {
+	if after <= 0 {
+		return false, false
+	}
+	if last := r.manager.LastSuccess(); !last.IsZero() && now.Sub(last) <= after {
+		return false, false
+	}
+	if r.Hold != nil && r.Hold("stale_check") {
+		return false, false
+	}
+	r.staleMu.Lock()
+	defer r.staleMu.Unlock()
+	// Another connection may have refreshed it, or run a check, while we
+	// waited.
+	last := r.manager.LastSuccess()
+	if last.Before(r.lastStaleCheck) {
+		last = r.lastStaleCheck
+	}
+	if last.IsZero() {
+		r.lastStaleCheck = now
+		return false, false
+	}
+	if now.Sub(last) <= after {
+		return false, false
+	}
+	from, ok := r.manager.Current()
+	if !ok {
+		return false, false
+	}
+	r.lastStaleCheck = now
+	tries := staleCheckMaxTries
+	if r.retry.MaxAttempts > 0 {
+		tries = min(tries, r.retry.MaxAttempts)
+	}
+	r.ensureValidCurrent(ctx, minDuration(r.timeout, staleCheckTimeout), tries)
+	to, _ := r.manager.Current()
+	return true, to.Addr() != from.Addr()
+}
+
+func (r *RotationController) ensureValidCurrent(ctx context.Context, timeout time.Duration, maxTries int) {
+	tries := r.manager.PoolSize()
+	if maxTries > 0 && tries > maxTries {
+		tries = maxTries
+	}
+	if tries <= 0 {
+		return
+	}
+	for i := 0; i < tries; i++ {
+		// The check is a dial: it takes a half-open circuit's probe.
+		current, ok := r.manager.CurrentForDial()
+		if !ok {
+			return
+		}
+		// An adaptive timeout may shorten the check, never lengthen it.
+		t := r.retry.Timeout(minDuration(r.manager.DialTimeout(current, timeout), timeout))
+		cctx, cancel := context.WithTimeout(ctx, t)
+		var ok2 bool
+		var err error
+		if r.tlsVerify {
+			ok2, _, err = CheckSOCKS5TLSWith(cctx, current, r.testAddr, t, r.tlsOpts)
+		} else {
+			ok2, _, err = CheckSOCKS5TCP(cctx, current, r.testAddr, t)
+		}
+		cancel()
+		if err == nil && ok2 {
+			r.manager.ReportSuccess(current)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		r.manager.ReportFailure(current, 1)
+		_, _ = r.manager.Next()
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
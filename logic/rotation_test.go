@@ -0,0 +1,284 @@
+package logic
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJitterDuration(t *testing.T) {
+	tests := []struct {
+		name   string
+		d      time.Duration
+		jitter float64
+		u      float64
+		want   time.Duration
+	}{
+		{"no jitter", time.Minute, 0, 0.9, time.Minute},
+		{"disabled", 0, 0.5, 0.9, 0},
+		{"low end", time.Minute, 0.25, 0, 45 * time.Second},
+		{"middle", time.Minute, 0.25, 0.5, time.Minute},
+		{"high end", time.Minute, 0.25, 1, 75 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jitterDuration(tt.d, tt.jitter, tt.u); got != tt.want {
+				t.Errorf("jitterDuration(%v, %v, %v) = %v, want %v", tt.d, tt.jitter, tt.u, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotationNextDelayBounds(t *testing.T) {
+	r := NewRotationController(NewProxyManager(), RotationConfig{Interval: 10 * time.Second, Jitter: 0.2})
+	lo, hi := 8*time.Second, 12*time.Second
+	var spread bool
+	for i := 0; i < 1000; i++ {
+		d := r.nextDelay()
+		if d < lo || d > hi {
+			t.Fatalf("nextDelay() = %v, want within [%v, %v]", d, lo, hi)
+		}
+		spread = spread || d != 10*time.Second
+	}
+	if !spread {
+		t.Error("nextDelay() never jittered")
+	}
+}
+
+func TestRotationJitterClamp(t *testing.T) {
+	for _, tt := range []struct{ in, want float64 }{{-1, 0}, {0.5, 0.5}, {1, 0.99}, {3, 0.99}} {
+		if got := NewRotationController(NewProxyManager(), RotationConfig{Jitter: tt.in}).jitter; got != tt.want {
+			t.Errorf("jitter %v clamped to %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// fakeTimers stands in for time.NewTimer in the rotation loop: every timer
+// the loop starts is handed to the test, which fires or watches it.
+type fakeTimers chan *fakeTimer
+
+type fakeTimer struct {
+	d       time.Duration
+	c       chan time.Time
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (f fakeTimers) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	tm := &fakeTimer{d: d, c: make(chan time.Time, 1), stopped: make(chan struct{})}
+	f <- tm
+	return tm.c, func() bool {
+		tm.once.Do(func() { close(tm.stopped) })
+		return true
+	}
+}
+
+// next returns the loop's next timer, which must be for d.
+func (f fakeTimers) next(t *testing.T, d time.Duration) *fakeTimer {
+	t.Helper()
+	select {
+	case tm := <-f:
+		if tm.d != d {
+			t.Fatalf("timer started for %v, want %v", tm.d, d)
+		}
+		return tm
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no timer started, want one for %v", d)
+		return nil
+	}
+}
+
+// TestRotationSetInterval steps the rotation loop through fake timers and
+// counts ticks through Hold, which skips the rotation itself.
+func TestRotationSetInterval(t *testing.T) {
+	timers := make(fakeTimers, 16)
+	r := NewRotationController(NewProxyManager(), RotationConfig{Interval: 10 * time.Millisecond, NewTimer: timers.NewTimer})
+	ticks := make(chan string, 16)
+	r.Hold = func(action string) bool {
+		ticks <- action
+		return true
+	}
+	r.Start(context.Background())
+	defer r.Stop()
+
+	tm := timers.next(t, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if len(ticks) != 0 {
+			t.Fatalf("tick %d: rotated before the timer fired", i)
+		}
+		tm.c <- time.Now()
+		if a := <-ticks; a != "rotate" {
+			t.Fatalf("tick %d = %q, want rotate", i, a)
+		}
+		tm = timers.next(t, 10*time.Millisecond)
+	}
+
+	r.SetInterval(-time.Second)
+	select {
+	case <-tm.stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pausing did not stop the pending timer")
+	}
+	if got := r.Interval(); got != 0 {
+		t.Fatalf("Interval() = %v after a negative SetInterval, want 0", got)
+	}
+	// At interval 0 the loop starts no timer until the next SetInterval.
+	r.SetInterval(20 * time.Millisecond)
+	timers.next(t, 20*time.Millisecond)
+	if got := r.Interval(); got != 20*time.Millisecond {
+		t.Fatalf("Interval() = %v, want 20ms", got)
+	}
+	if len(ticks) != 0 {
+		t.Errorf("%d ticks while paused", len(ticks))
+	}
+}
+
+func TestRotationStop(t *testing.T) {
+	r := NewRotationController(NewProxyManager(), RotationConfig{Interval: time.Hour})
+	r.Start(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Stop()
+		r.Stop() // a second Stop is a no-op
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+}
+
+func TestRotationEnsureValidCurrent(t *testing.T) {
+	srv := helloServer(t)
+	live, _ := fakeUpstream(t)
+	dead := deadUpstream(t)
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{dead, live})
+	r := NewRotationController(m, RotationConfig{TestAddr: strings.TrimPrefix(srv.URL, "http://"), Timeout: 2 * time.Second})
+	var from, to ProxyNode
+	r.OnRotate = func(f, t ProxyNode) { from, to = f, t }
+
+	r.EnsureValidCurrent(context.Background())
+	if cur, ok := m.Current(); !ok || cur.Addr() != live.Addr() {
+		t.Fatalf("current = %v, %v; want %s", cur.Addr(), ok, live.Addr())
+	}
+
+	// Rotating from the only healthy node comes back to it.
+	r.Rotate(context.Background())
+	if from.Addr() != live.Addr() || to.Addr() != live.Addr() {
+		t.Fatalf("OnRotate(%s, %s), want both %s", from.Addr(), to.Addr(), live.Addr())
+	}
+}
+
+// TestRotationCheckStale drives CheckStale with a fake now against the
+// manager's LastSuccess.
+func TestRotationCheckStale(t *testing.T) {
+	srv := helloServer(t)
+	live, _ := fakeUpstream(t)
+	dead := deadUpstream(t)
+	const after = time.Minute
+	cfg := RotationConfig{TestAddr: strings.TrimPrefix(srv.URL, "http://"), Timeout: 2 * time.Second}
+	setLastSuccess := func(m *ProxyManager, at time.Time) {
+		m.mu.Lock()
+		m.lastSuccessAt = at
+		m.mu.Unlock()
+	}
+
+	t.Run("first connection starts the clock", func(t *testing.T) {
+		m := NewProxyManager()
+		m.SetPool([]ProxyNode{dead, live})
+		r := NewRotationController(m, cfg)
+		t0 := time.Now()
+		for _, at := range []time.Time{t0, t0.Add(after)} {
+			if fired, _ := r.CheckStale(context.Background(), after, at); fired {
+				t.Fatalf("CheckStale(%v after start) fired with no success yet", at.Sub(t0))
+			}
+		}
+		fired, rotated := r.CheckStale(context.Background(), after, t0.Add(after+time.Second))
+		if !fired || !rotated {
+			t.Fatalf("CheckStale() past after = %v, %v; want a check that rotates", fired, rotated)
+		}
+		if cur, _ := m.Current(); cur.Addr() != live.Addr() {
+			t.Errorf("current = %s, want %s", cur.Addr(), live.Addr())
+		}
+	})
+
+	t.Run("recent success", func(t *testing.T) {
+		m := NewProxyManager()
+		m.SetPool([]ProxyNode{dead, live})
+		r := NewRotationController(m, cfg)
+		t0 := time.Now()
+		setLastSuccess(m, t0)
+		tests := []struct {
+			name  string
+			after time.Duration
+			now   time.Time
+			fired bool
+		}{
+			{"disabled", 0, t0.Add(time.Hour), false},
+			{"within after", after, t0.Add(after), false},
+			{"past after", after, t0.Add(after + time.Second), true},
+		}
+		for _, tt := range tests {
+			if fired, _ := r.CheckStale(context.Background(), tt.after, tt.now); fired != tt.fired {
+				t.Errorf("%s: fired = %v, want %v", tt.name, fired, tt.fired)
+			}
+		}
+	})
+
+	t.Run("every node dead", func(t *testing.T) {
+		m := NewProxyManager()
+		// A breaker keeps failed nodes in the pool for the next check.
+		m.SetBreaker(BreakerConfig{Threshold: 100, Cooldown: time.Hour})
+		m.SetPool([]ProxyNode{dead, deadUpstream(t)})
+		r := NewRotationController(m, cfg)
+		var holds int
+		r.Hold = func(action string) bool {
+			if action == "stale_check" {
+				holds++
+			}
+			return false
+		}
+		t0 := time.Now()
+		setLastSuccess(m, t0.Add(-time.Hour))
+		tests := []struct {
+			now   time.Time
+			fired bool
+		}{
+			{t0, true},
+			// The failed check stands in for a success until after passes.
+			{t0.Add(time.Second), false},
+			{t0.Add(after), false},
+			{t0.Add(after + time.Second), true},
+		}
+		for _, tt := range tests {
+			if fired, _ := r.CheckStale(context.Background(), after, tt.now); fired != tt.fired {
+				t.Errorf("CheckStale(t0+%v) fired = %v, want %v", tt.now.Sub(t0), fired, tt.fired)
+			}
+		}
+		if !m.LastSuccess().Equal(t0.Add(-time.Hour)) {
+			t.Errorf("LastSuccess moved to %v without a passing check", m.LastSuccess())
+		}
+		if holds != len(tests) {
+			t.Errorf("Hold asked %d times, want %d", holds, len(tests))
+		}
+	})
+
+	t.Run("held", func(t *testing.T) {
+		m := NewProxyManager()
+		m.SetPool([]ProxyNode{dead, live})
+		r := NewRotationController(m, cfg)
+		r.Hold = func(string) bool { return true }
+		t0 := time.Now()
+		setLastSuccess(m, t0.Add(-time.Hour))
+		if fired, _ := r.CheckStale(context.Background(), after, t0); fired {
+			t.Error("CheckStale() fired while held")
+		}
+		if cur, _ := m.Current(); cur.Addr() != dead.Addr() {
+			t.Errorf("current = %s, want %s left alone", cur.Addr(), dead.Addr())
+		}
+	})
+}
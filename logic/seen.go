@@ -0,0 +1,134 @@
+package logic
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultSeenRetention is how long SeenTracker keeps nodes no source lists.
+const DefaultSeenRetention = 7 * 24 * time.Hour
+
+// maxSeenEntries caps a SeenTracker: once full, nodes it does not track yet
+// are not recorded until retention frees room.
+const maxSeenEntries = 200_000
+
+// Sighting is how long a node has been continuously listed by the sources.
+type Sighting struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Survival counts the refreshes since FirstSeen that listed the node.
+	// A refresh that misses it starts it over.
+	Survival int `json:"refresh_survival"`
+}
+
+// SeenState is a SeenTracker's persistent form.
+type SeenState struct {
+	LastRefresh time.Time           `json:"last_refresh"`
+	Nodes       map[string]Sighting `json:"nodes"`
+}
+
+// SeenTracker records, per address, when refreshes have listed a node,
+// whether or not it then passed validation. Nodes not listed for retention
+// are forgotten. A nil *SeenTracker records nothing.
+type SeenTracker struct {
+	retention time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+	m    map[string]Sighting
+}
+
+func NewSeenTracker(retention time.Duration) *SeenTracker {
+	if retention <= 0 {
+		retention = DefaultSeenRetention
+	}
+	return &SeenTracker{retention: retention, m: make(map[string]Sighting)}
+}
+
+// Observe records the candidates of a refresh that ran at now.
+func (t *SeenTracker) Observe(nodes []ProxyNode, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := now.Add(-t.retention)
+	for addr, s := range t.m {
+		if s.LastSeen.Before(cutoff) {
+			delete(t.m, addr)
+		}
+	}
+	for _, n := range nodes {
+		addr := n.Addr()
+		s, ok := t.m[addr]
+		switch {
+		case ok && !t.last.IsZero() && s.LastSeen.Equal(t.last):
+			s.Survival++
+			s.LastSeen = now
+		case !ok && len(t.m) >= maxSeenEntries:
+			continue
+		default:
+			s = Sighting{FirstSeen: now, LastSeen: now}
+		}
+		t.m[addr] = s
+	}
+	t.last = now
+}
+
+// Get returns the sighting of addr, if it is being tracked.
+func (t *SeenTracker) Get(addr string) (Sighting, bool) {
+	if t == nil {
+		return Sighting{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.m[addr]
+	return s, ok
+}
+
+// Survival returns how many refreshes in a row have listed addr; 0 for
+// unknown nodes.
+func (t *SeenTracker) Survival(addr string) int {
+	s, _ := t.Get(addr)
+	return s.Survival
+}
+
+func (t *SeenTracker) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.m)
+}
+
+func (t *SeenTracker) State() SeenState {
+	if t == nil {
+		return SeenState{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	nodes := make(map[string]Sighting, len(t.m))
+	for addr, s := range t.m {
+		nodes[addr] = s
+	}
+	return SeenState{LastRefresh: t.last, Nodes: nodes}
+}
+
+// Restore replaces the tracked nodes with st, dropping those already past
+// retention at now.
+func (t *SeenTracker) Restore(st SeenState, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = st.LastRefresh
+	t.m = make(map[string]Sighting, len(st.Nodes))
+	cutoff := now.Add(-t.retention)
+	for addr, s := range st.Nodes {
+		if !s.LastSeen.Before(cutoff) {
+			t.m[addr] = s
+		}
+	}
+}
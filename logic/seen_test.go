@@ -0,0 +1,121 @@
+package logic
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSeenTrackerObserve(t *testing.T) {
+	a, b := node("1.2.3.4", "1080", 0), node("5.6.7.8", "1080", 0)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+	tr := NewSeenTracker(0)
+
+	tr.Observe([]ProxyNode{a, b}, at(0))
+	tr.Observe([]ProxyNode{a, b}, at(1))
+	tr.Observe([]ProxyNode{a}, at(2))
+	// b was missed by the refresh at 2h, so its streak starts over.
+	tr.Observe([]ProxyNode{a, b}, at(3))
+
+	tests := []struct {
+		addr  string
+		first time.Time
+		last  time.Time
+		surv  int
+	}{
+		{a.Addr(), at(0), at(3), 3},
+		{b.Addr(), at(3), at(3), 0},
+	}
+	for _, tt := range tests {
+		s, ok := tr.Get(tt.addr)
+		if !ok || !s.FirstSeen.Equal(tt.first) || !s.LastSeen.Equal(tt.last) || s.Survival != tt.surv {
+			t.Errorf("Get(%s) = %+v, %v; want first %v, last %v, survival %d", tt.addr, s, ok, tt.first, tt.last, tt.surv)
+		}
+		if got := tr.Survival(tt.addr); got != tt.surv {
+			t.Errorf("Survival(%s) = %d, want %d", tt.addr, got, tt.surv)
+		}
+	}
+	if got := tr.Survival("9.9.9.9:1080"); got != 0 {
+		t.Errorf("Survival of an unknown node = %d, want 0", got)
+	}
+}
+
+func TestSeenTrackerEviction(t *testing.T) {
+	a, b := node("1.2.3.4", "1080", 0), node("5.6.7.8", "1080", 0)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := NewSeenTracker(24 * time.Hour)
+	tr.Observe([]ProxyNode{a, b}, start)
+	tr.Observe([]ProxyNode{a}, start.Add(24*time.Hour))
+	if tr.Len() != 2 {
+		t.Fatalf("Len() = %d at exactly the retention, want 2", tr.Len())
+	}
+	tr.Observe([]ProxyNode{a}, start.Add(25*time.Hour))
+	if _, ok := tr.Get(b.Addr()); ok || tr.Len() != 1 {
+		t.Errorf("Len() = %d, node unseen for 25h still tracked = %v; want it evicted", tr.Len(), ok)
+	}
+	if got := tr.Survival(a.Addr()); got != 2 {
+		t.Errorf("Survival(a) = %d, want 2", got)
+	}
+}
+
+func TestSeenTrackerRestore(t *testing.T) {
+	a, b := node("1.2.3.4", "1080", 0), node("5.6.7.8", "1080", 0)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := NewSeenTracker(48 * time.Hour)
+	tr.Observe([]ProxyNode{a, b}, start)
+	tr.Observe([]ProxyNode{a}, start.Add(24*time.Hour))
+	st := tr.State()
+
+	restored := NewSeenTracker(48 * time.Hour)
+	restored.Restore(st, start.Add(50*time.Hour))
+	if _, ok := restored.Get(b.Addr()); ok {
+		t.Error("Restore kept a node past retention")
+	}
+	if s, ok := restored.Get(a.Addr()); !ok || s.Survival != 1 {
+		t.Fatalf("restored a = %+v, %v; want survival 1", s, ok)
+	}
+	// The restored last refresh keeps the streak going.
+	restored.Observe([]ProxyNode{a}, start.Add(51*time.Hour))
+	if got := restored.Survival(a.Addr()); got != 2 {
+		t.Errorf("Survival(a) after a restore and a refresh = %d, want 2", got)
+	}
+
+	var none *SeenTracker
+	none.Observe([]ProxyNode{a}, start)
+	none.Restore(st, start)
+	if _, ok := none.Get(a.Addr()); ok || none.Len() != 0 || len(none.State().Nodes) != 0 {
+		t.Error("nil SeenTracker recorded something")
+	}
+}
+
+// TestRefresherSeen checks that refreshes feed the tracker and dry runs
+// don't.
+func TestRefresherSeen(t *testing.T) {
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "1.2.3.4:1080\n5.6.7.8:1080\n")
+	}))
+	defer src.Close()
+
+	r := NewRefresher([]*ProxyManager{NewProxyManager()}, Sources{{URL: src.URL}}, nil, ValidationConfig{}, time.Second)
+	r.Seen = NewSeenTracker(0)
+	if _, err := r.DryRun(context.Background(), RefreshOverride{}); err != nil {
+		t.Fatalf("DryRun() = %v", err)
+	}
+	if r.Seen.Len() != 0 {
+		t.Fatalf("a dry run recorded %d sightings", r.Seen.Len())
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := r.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh() = %v", err)
+		}
+	}
+	for _, addr := range []string{"1.2.3.4:1080", "5.6.7.8:1080"} {
+		if got := r.Seen.Survival(addr); got != 1 {
+			t.Errorf("Survival(%s) = %d after two refreshes, want 1", addr, got)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrSelfTarget is returned for destinations that are this process's own
+// listeners: following them would loop connections back into the proxy.
+var ErrSelfTarget = errors.New("target is one of our own listeners")
+
+// SelfGuard recognizes this process's own listen addresses, so that neither
+// client targets nor pool candidates can point back at the proxy. A
+// listener bound to 0.0.0.0 or :: is reachable on every loopback and
+// interface address, so its port matches on all of those. Host names are
+// matched only for "localhost"; others must be resolved first. A nil
+// *SelfGuard matches nothing.
+type SelfGuard struct {
+	mu    sync.RWMutex
+	exact map[netip.AddrPort]struct{}
+	// anyPorts are ports bound on an unspecified address, matched on
+	// loopback, unspecified and local interface addresses.
+	anyPorts map[uint16]struct{}
+	local    map[netip.Addr]struct{}
+	// extra are configured self addresses, e.g. a NAT's public side;
+	// extraIPs match on any of our listen ports.
+	extra    map[netip.AddrPort]struct{}
+	extraIPs map[netip.Addr]struct{}
+}
+
+// NewSelfGuard parses extra, a list of "ip:port" or bare "ip" entries
+// naming this host as others see it; bare IPs match on any listen port.
+func NewSelfGuard(extra []string) (*SelfGuard, error) {
+	g := &SelfGuard{
+		exact:    make(map[netip.AddrPort]struct{}),
+		anyPorts: make(map[uint16]struct{}),
+		local:    make(map[netip.Addr]struct{}),
+		extra:    make(map[netip.AddrPort]struct{}),
+		extraIPs: make(map[netip.Addr]struct{}),
+	}
+	for _, e := range extra {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(strings.Trim(e, "[]")); err == nil {
+			g.extraIPs[ip.Unmap()] = struct{}{}
+			continue
+		}
+		ap, err := netip.ParseAddrPort(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid self address %q: want ip or ip:port", e)
+		}
+		g.extra[netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())] = struct{}{}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil {
+				g.local[p.Addr().Unmap()] = struct{}{}
+			}
+		}
+	}
+	return g, nil
+}
+
+// SetListeners replaces the listen addresses ("host:port" as bound, e.g.
+// from net.Listener.Addr) the guard protects. Unix sockets and entries that
+// are not IP addresses are ignored.
+func (g *SelfGuard) SetListeners(addrs []string) {
+	if g == nil {
+		return
+	}
+	exact := make(map[netip.AddrPort]struct{})
+	anyPorts := make(map[uint16]struct{})
+	for _, a := range addrs {
+		host, port, err := net.SplitHostPort(a)
+		if err != nil {
+			continue
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			continue
+		}
+		if host == "" {
+			anyPorts[uint16(p)] = struct{}{}
+			continue
+		}
+		if strings.EqualFold(host, "localhost") {
+			host = "127.0.0.1"
+		}
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			continue
+		}
+		if ip.IsUnspecified() {
+			anyPorts[uint16(p)] = struct{}{}
+			continue
+		}
+		exact[netip.AddrPortFrom(ip.Unmap(), uint16(p))] = struct{}{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.exact, g.anyPorts = exact, anyPorts
+}
+
+// Check returns an error wrapping ErrSelfTarget when addr (host:port) is
+// one of our listeners.
+func (g *SelfGuard) Check(addr string) error {
+	if g.IsSelf(addr) {
+		return fmt.Errorf("%w: %s", ErrSelfTarget, addr)
+	}
+	return nil
+}
+
+// IsSelf reports whether addr (host:port) reaches one of our listeners.
+func (g *SelfGuard) IsSelf(addr string) bool {
+	if g == nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	var ips []netip.Addr
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		ips = []netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1}), netip.IPv6Loopback()}
+	} else if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip.Unmap().WithZone("")}
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, ip := range ips {
+		if g.isSelfLocked(ip, uint16(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *SelfGuard) isSelfLocked(ip netip.Addr, port uint16) bool {
+	ap := netip.AddrPortFrom(ip, port)
+	if _, ok := g.extra[ap]; ok {
+		return true
+	}
+	if _, ok := g.exact[ap]; ok {
+		return true
+	}
+	_, wildcard := g.anyPorts[port]
+	if _, ok := g.extraIPs[ip]; ok && (wildcard || g.listensOnLocked(port)) {
+		return true
+	}
+	if !wildcard {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	_, ok := g.local[ip]
+	return ok
+}
+
+func (g *SelfGuard) listensOnLocked(port uint16) bool {
+	for ap := range g.exact {
+		if ap.Port() == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns nodes without those whose address is one of our
+// listeners.
+func (g *SelfGuard) Filter(nodes []ProxyNode) []ProxyNode {
+	if g == nil {
+		return nodes
+	}
+	out := nodes[:0:0]
+	for _, n := range nodes {
+		if !g.IsSelf(n.Addr()) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
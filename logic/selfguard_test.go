@@ -0,0 +1,151 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSelfGuardIsSelf(t *testing.T) {
+	g, err := NewSelfGuard([]string{"203.0.113.5:2080", "198.51.100.9", "[2001:db8::9]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fixed interface address keeps the test independent of the host.
+	g.local[netip.MustParseAddr("192.0.2.10")] = struct{}{}
+	g.local[netip.MustParseAddr("fe80::10")] = struct{}{}
+	g.SetListeners([]string{"127.0.0.1:1080", "0.0.0.0:1081", "[::]:1082", "[::1]:1083", ":1084", "localhost:1085", "/run/lp.sock", "proxy.example:1086"})
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		// Exact binds match only their own address.
+		{"127.0.0.1:1080", true},
+		{"127.0.0.2:1080", false},
+		{"[::1]:1080", false},
+		{"[::1]:1083", true},
+		{"127.0.0.1:1083", false},
+		{"127.0.0.1:1085", true},
+		{"127.0.0.1:9999", false},
+		// Unspecified binds match loopback, unspecified and local addresses.
+		{"127.0.0.1:1081", true},
+		{"127.8.9.10:1081", true},
+		{"0.0.0.0:1081", true},
+		{"[::1]:1081", true},
+		{"[::ffff:127.0.0.1]:1081", true},
+		{"192.0.2.10:1082", true},
+		{"[fe80::10%eth0]:1084", true},
+		{"8.8.8.8:1081", false},
+		{"192.0.2.11:1084", false},
+		// localhost matches by name; other names are not resolved.
+		{"localhost:1080", true},
+		{"LOCALHOST.:1081", true},
+		{"app.localhost:1083", true},
+		{"localhost:1086", false},
+		{"example.com:1081", false},
+		{"proxy.example:1086", false},
+		// Configured NAT addresses: ip:port exactly, bare IPs on any listen port.
+		{"203.0.113.5:2080", true},
+		{"203.0.113.5:1080", false},
+		{"198.51.100.9:1080", true},
+		{"198.51.100.9:1084", true},
+		{"198.51.100.9:9999", false},
+		{"[2001:db8::9]:1083", true},
+		// Not host:port at all.
+		{"127.0.0.1", false},
+		{"127.0.0.1:http", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := g.IsSelf(tt.addr); got != tt.want {
+				t.Errorf("IsSelf(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+			err := g.Check(tt.addr)
+			if got := errors.Is(err, ErrSelfTarget); got != tt.want {
+				t.Errorf("Check(%s) = %v", tt.addr, err)
+			}
+		})
+	}
+
+	// Rebinding replaces the listeners.
+	g.SetListeners([]string{"127.0.0.1:2000"})
+	if g.IsSelf("127.0.0.1:1080") || g.IsSelf("127.0.0.1:1081") || !g.IsSelf("127.0.0.1:2000") {
+		t.Error("SetListeners did not replace the previous listeners")
+	}
+}
+
+func TestSelfGuardFilter(t *testing.T) {
+	g, err := NewSelfGuard([]string{"1.2.3.4:1080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetListeners([]string{"0.0.0.0:1080"})
+	nodes := []ProxyNode{node("1.2.3.4", "1080", 0), node("1.2.3.4", "1081", 0), node("127.0.0.1", "1080", 0), node("5.6.7.8", "1080", 0)}
+	got := g.Filter(nodes)
+	if fmt.Sprint(addrs(got)) != "[1.2.3.4:1081 5.6.7.8:1080]" {
+		t.Errorf("Filter kept %v", addrs(got))
+	}
+
+	var none *SelfGuard
+	if len(none.Filter(nodes)) != len(nodes) || none.IsSelf("127.0.0.1:1080") || none.Check("127.0.0.1:1080") != nil {
+		t.Error("nil SelfGuard matched something")
+	}
+}
+
+func TestRefresherDropsSelf(t *testing.T) {
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "127.0.0.1:1080\nlocalhost:1080\n127.0.0.1:1081\n1.2.3.4:1080\n")
+	}))
+	defer src.Close()
+	g, err := NewSelfGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetListeners([]string{"[::]:1080"})
+
+	m := NewProxyManager()
+	r := NewRefresher([]*ProxyManager{m}, Sources{{URL: src.URL}}, nil, ValidationConfig{}, time.Second)
+	r.AllowPrivate = true
+	r.Self = g
+	if _, _, err := r.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	if got := fmt.Sprint(addrs(m.PoolSnapshot(0))); got != "[127.0.0.1:1081 1.2.3.4:1080]" {
+		t.Errorf("pool = %s, want our own listener dropped", got)
+	}
+}
+
+func TestNewSelfGuardInvalid(t *testing.T) {
+	for _, extra := range []string{"nat.example:1080", "1.2.3.4:http", "1.2.3.4:99999"} {
+		if _, err := NewSelfGuard([]string{extra}); err == nil {
+			t.Errorf("NewSelfGuard(%q) succeeded", extra)
+		}
+	}
+}
+
+func TestSelfTargetReply(t *testing.T) {
+	g, err := NewSelfGuard(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetListeners([]string{"127.0.0.1:1080"})
+	err = fmt.Errorf("dial: %w", g.Check("127.0.0.1:1080"))
+	if got := SOCKS5ReplyCode(err); got != SOCKS5ReplyNotAllowed {
+		t.Errorf("SOCKS5ReplyCode(%v) = %#x, want not allowed", err, got)
+	}
+}
+
+func addrs(nodes []ProxyNode) []string {
+	out := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, n.Addr())
+	}
+	return out
+}
@@ -0,0 +1,264 @@
+package logic
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Shaped conns move at most one chunk per token grab: a tenth of a
+	// second's worth of the tightest limit, within these bounds.
+	minShapeChunk = 512
+	maxShapeChunk = 32 << 10
+)
+
+// Shaper caps the bandwidth of one listener's tunnels: limit bytes per
+// second shared by all of them and perConn bytes per second for each. Both
+// count the two directions together. A nil *Shaper shapes nothing.
+type Shaper struct {
+	shared  *byteBucket
+	limit   int64
+	perConn int64
+
+	bytes     atomic.Int64
+	throttled atomic.Int64
+
+	mu       sync.Mutex
+	winStart time.Time
+	winBytes int64
+	rate     float64
+}
+
+// NewShaper returns nil when both limits are <= 0.
+func NewShaper(limit, perConn int64) *Shaper {
+	if limit <= 0 && perConn <= 0 {
+		return nil
+	}
+	s := &Shaper{limit: max(limit, 0), perConn: max(perConn, 0)}
+	if limit > 0 {
+		s.shared = newByteBucket(limit)
+	}
+	return s
+}
+
+// WrapDial shapes the conns returned by dial.
+func (s *Shaper) WrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return s.Wrap(c), nil
+	}
+}
+
+// WrapBind shapes the conns accepted by the BINDs of bind.
+func (s *Shaper) WrapBind(bind func(ctx context.Context, addr string) (BindListener, error)) func(ctx context.Context, addr string) (BindListener, error) {
+	if s == nil {
+		return bind
+	}
+	return func(ctx context.Context, addr string) (BindListener, error) {
+		bl, err := bind(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &shapedBind{BindListener: bl, s: s}, nil
+	}
+}
+
+type shapedBind struct {
+	BindListener
+	s *Shaper
+}
+
+func (b *shapedBind) Accept(ctx context.Context) (net.Conn, error) {
+	c, err := b.BindListener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return b.s.Wrap(c), nil
+}
+
+// Wrap throttles reads and writes on c.
+func (s *Shaper) Wrap(c net.Conn) net.Conn {
+	if s == nil {
+		return c
+	}
+	sc := &shapedConn{Conn: c, s: s, done: make(chan struct{})}
+	if s.perConn > 0 {
+		sc.own = newByteBucket(s.perConn)
+	}
+	sc.chunk = min(sc.own.chunk(), s.shared.chunk())
+	return sc
+}
+
+// ShaperStats is a Shaper's configuration and usage.
+type ShaperStats struct {
+	Limit        int64 `json:"limit"`
+	PerConnLimit int64 `json:"per_conn_limit"`
+	Bytes        int64 `json:"bytes"`
+	// Throughput is the byte rate over the last full second.
+	Throughput float64 `json:"throughput"`
+	// ThrottleEvents counts token grabs that had to wait.
+	ThrottleEvents int64 `json:"throttle_events"`
+}
+
+func (s *Shaper) Stats() ShaperStats {
+	if s == nil {
+		return ShaperStats{}
+	}
+	st := ShaperStats{
+		Limit:          s.limit,
+		PerConnLimit:   s.perConn,
+		Bytes:          s.bytes.Load(),
+		ThrottleEvents: s.throttled.Load(),
+	}
+	s.mu.Lock()
+	// An idle shaper has no window to roll over; don't report a stale rate.
+	if time.Since(s.winStart) < 2*time.Second {
+		st.Throughput = s.rate
+	}
+	s.mu.Unlock()
+	return st
+}
+
+// record adds n bytes moved at now to the throughput meter.
+func (s *Shaper) record(n int, now time.Time) {
+	s.bytes.Add(int64(n))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elapsed := now.Sub(s.winStart); elapsed >= time.Second {
+		if elapsed < 2*time.Second {
+			s.rate = float64(s.winBytes) / elapsed.Seconds()
+		} else {
+			s.rate = 0
+		}
+		s.winStart, s.winBytes = now, 0
+	}
+	s.winBytes += int64(n)
+}
+
+// byteBucket is a token bucket of bytes. Like tokenBucket it goes into debt
+// rather than blocking under its lock, so callers sleep independently and
+// the two directions of a tunnel cannot hold each other up. A nil
+// *byteBucket is unlimited.
+type byteBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(perSecond int64) *byteBucket {
+	b := &byteBucket{rate: float64(perSecond)}
+	b.burst = float64(b.chunk())
+	b.tokens = b.burst
+	return b
+}
+
+func (b *byteBucket) chunk() int {
+	if b == nil {
+		return maxShapeChunk
+	}
+	return min(max(int(b.rate/10), minShapeChunk), maxShapeChunk)
+}
+
+// reserve takes n bytes and returns how long the caller must wait before
+// moving them.
+func (b *byteBucket) reserve(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// shapedConn charges every chunk read or written to its listener's shared
+// bucket and its own. Reads are capped at one chunk and charged after the
+// fact; writes are split into chunks and charged before each.
+type shapedConn struct {
+	net.Conn
+	s     *Shaper
+	own   *byteBucket
+	chunk int
+
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.pace(n)
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		k := min(len(p), c.chunk)
+		if !c.pace(k) {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(p[:k])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[k:]
+	}
+	return written, nil
+}
+
+// pace charges n bytes and sleeps off any debt. It returns false when the
+// conn was closed meanwhile.
+func (c *shapedConn) pace(n int) bool {
+	now := time.Now()
+	wait := max(c.s.shared.reserve(n, now), c.own.reserve(n, now))
+	c.s.record(n, now)
+	if wait <= 0 {
+		return true
+	}
+	c.s.throttled.Add(1)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *shapedConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *shapedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestByteBucketReserve(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newByteBucket(10 << 10) // 10 KiB/s, 1 KiB chunks and burst
+	if got := b.chunk(); got != 1024 {
+		t.Fatalf("chunk() = %d, want 1024", got)
+	}
+	steps := []struct {
+		advance time.Duration
+		n       int
+		want    time.Duration
+	}{
+		{0, 1024, 0},                              // the burst
+		{0, 1024, 100 * time.Millisecond},         // one chunk in debt
+		{100 * time.Millisecond, 0, 0},            // paid off
+		{time.Hour, 2048, 100 * time.Millisecond}, // a long pause refills one burst only
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		got := b.reserve(s.n, now)
+		if diff := got - s.want; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Fatalf("step %d: reserve(%d) = %v, want %v", i, s.n, got, s.want)
+		}
+	}
+
+	var unlimited *byteBucket
+	if got := unlimited.reserve(1<<30, now); got != 0 {
+		t.Errorf("nil bucket reserve = %v, want 0", got)
+	}
+	if got := newByteBucket(100).chunk(); got != minShapeChunk {
+		t.Errorf("chunk() at 100 B/s = %d, want %d", got, minShapeChunk)
+	}
+	if got := newByteBucket(100 << 20).chunk(); got != maxShapeChunk {
+		t.Errorf("chunk() at 100 MiB/s = %d, want %d", got, maxShapeChunk)
+	}
+}
+
+func TestShaperDisabled(t *testing.T) {
+	s := NewShaper(0, -1)
+	if s != nil {
+		t.Fatalf("NewShaper(0, -1) = %+v, want nil", s)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if s.Wrap(a) != a {
+		t.Error("nil Shaper wrapped the conn")
+	}
+	if (s.Stats() != ShaperStats{}) {
+		t.Errorf("nil Shaper Stats() = %+v", s.Stats())
+	}
+}
+
+// shapedDuplex moves size bytes each way through a conn wrapped by s at
+// the same time and returns how long both directions took.
+func shapedDuplex(t *testing.T, s *Shaper, size int) time.Duration {
+	t.Helper()
+	a, b := net.Pipe()
+	sa := s.Wrap(a)
+	defer sa.Close()
+	defer b.Close()
+	payload := bytes.Repeat([]byte("x"), size)
+
+	start := time.Now()
+	errs := make(chan error, 4)
+	send := func(w io.Writer) {
+		_, err := w.Write(payload)
+		errs <- err
+	}
+	recv := func(r io.Reader) {
+		n, err := io.CopyN(io.Discard, r, int64(size))
+		if err == nil && n != int64(size) {
+			err = io.ErrShortBuffer
+		}
+		errs <- err
+	}
+	go send(sa)
+	go recv(b)
+	go send(b)
+	go recv(sa)
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatalf("transfer: %v", err)
+			}
+		case <-timeout:
+			t.Fatal("shaped transfer stalled")
+		}
+	}
+	return time.Since(start)
+}
+
+func TestShaperListenerLimit(t *testing.T) {
+	const limit = 64 << 10
+	s := NewShaper(limit, 0)
+	// 48 KiB each way is 1.5s at 64 KiB/s, less the initial burst; long
+	// enough for the throughput meter to close a window.
+	elapsed := shapedDuplex(t, s, 48<<10)
+	if elapsed < 1200*time.Millisecond || elapsed > 4*time.Second {
+		t.Errorf("96 KiB at %d B/s took %v, want about 1.5s", limit, elapsed)
+	}
+	st := s.Stats()
+	if st.Bytes != 96<<10 || st.Limit != limit || st.PerConnLimit != 0 {
+		t.Errorf("Stats() = %+v", st)
+	}
+	if st.ThrottleEvents == 0 {
+		t.Error("ThrottleEvents = 0, want the transfer throttled")
+	}
+	if st.Throughput <= 0 || st.Throughput > 2*limit {
+		t.Errorf("Throughput = %v, want within (0, %d]", st.Throughput, 2*limit)
+	}
+}
+
+// TestShaperPerConnLimit runs two conns at once: each gets its own
+// allowance, so together they take no longer than one.
+func TestShaperPerConnLimit(t *testing.T) {
+	const perConn = 32 << 10
+	s := NewShaper(0, perConn)
+	done := make(chan time.Duration, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- shapedDuplex(t, s, 16<<10) }()
+	}
+	for i := 0; i < 2; i++ {
+		if elapsed := <-done; elapsed < 700*time.Millisecond || elapsed > 3*time.Second {
+			t.Errorf("conn %d: 32 KiB at %d B/s took %v, want about 1s", i, perConn, elapsed)
+		}
+	}
+	if got := s.Stats().Bytes; got != 64<<10 {
+		t.Errorf("Bytes = %d, want %d", got, 64<<10)
+	}
+}
+
+func TestShapedCloseUnblocksWrite(t *testing.T) {
+	s := NewShaper(512, 0)
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	sa := s.Wrap(a)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sa.Write(make([]byte, 64<<10)) // two minutes at 512 B/s
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	sa.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Write after Close = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not unblock a throttled Write")
+	}
+}
+
+func TestShaperWrapDial(t *testing.T) {
+	s := NewShaper(1<<20, 0)
+	a, b := net.Pipe()
+	defer b.Close()
+	dial := s.WrapDial(func(context.Context, string, string) (net.Conn, error) { return a, nil })
+	c, err := dial(context.Background(), "tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*shapedConn); !ok {
+		t.Errorf("WrapDial returned %T, want a shaped conn", c)
+	}
+	failing := s.WrapDial(func(context.Context, string, string) (net.Conn, error) { return nil, io.EOF })
+	if c, err := failing(context.Background(), "tcp", "192.0.2.1:80"); c != nil || err != io.EOF {
+		t.Errorf("failing dial = %v, %v; want nil, EOF", c, err)
+	}
+}
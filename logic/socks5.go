@@ -0,0 +1,270 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect = 0x01
+	socks5CmdBind    = 0x02
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+)
+
+// DialTiming splits an upstream dial into the part spent reaching the proxy
+// (TCP connect + SOCKS5 greeting/auth) and the part spent on the CONNECT
+// request until the proxy reported the target connected.
+type DialTiming struct {
+	HandshakeMS int64 `json:"handshake_ms"`
+	ConnectMS   int64 `json:"connect_ms"`
+}
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Connect dials node and asks it to CONNECT to addr.
+func socks5Connect(ctx context.Context, node ProxyNode, addr string, timeout time.Duration) (Conn, DialTiming, error) {
+	var timing DialTiming
+	host, port, err := splitTarget(addr)
+	if err != nil {
+		return nil, timing, err
+	}
+
+	start := time.Now()
+	conn, err := newDialer(timeout).DialContext(ctx, "tcp", node.Addr())
+	if err != nil {
+		return nil, timing, &UpstreamError{Proxy: node.Addr(), Err: err}
+	}
+	return socks5Negotiate(ctx, conn, node, host, port, timeout, start)
+}
+
+// SOCKS5ConnectOver runs the SOCKS5 greeting and a CONNECT to addr on conn,
+// already connected to node, for callers that need the connection before
+// the handshake, e.g. its local address. conn is closed on failure.
+func SOCKS5ConnectOver(ctx context.Context, conn net.Conn, node ProxyNode, addr string, timeout time.Duration) (Conn, error) {
+	host, port, err := splitTarget(addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c, _, err := socks5Negotiate(ctx, conn, node, host, port, timeout, time.Now())
+	return c, err
+}
+
+// socks5Negotiate runs the SOCKS5 greeting and CONNECT on an already
+// connected conn, closing it on failure. start is when the dial began.
+func socks5Negotiate(ctx context.Context, conn net.Conn, node ProxyNode, host string, port int, timeout time.Duration, start time.Time) (Conn, DialTiming, error) {
+	var timing DialTiming
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if dl, ok := ctx.Deadline(); ok && (deadline.IsZero() || dl.Before(deadline)) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+
+	// Abort blocking reads/writes when ctx is cancelled.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if err := socks5Handshake(conn, node); err != nil {
+		_ = conn.Close()
+		return nil, timing, &UpstreamError{Proxy: node.Addr(), Err: ctxErrOr(ctx, err)}
+	}
+	timing.HandshakeMS = time.Since(start).Milliseconds()
+
+	connectStart := time.Now()
+	if _, err := socks5Request(conn, socks5CmdConnect, host, port); err != nil {
+		_ = conn.Close()
+		var replyErr *SOCKS5ReplyError
+		if errors.As(err, &replyErr) {
+			return nil, timing, err
+		}
+		return nil, timing, &UpstreamError{Proxy: node.Addr(), Err: ctxErrOr(ctx, err)}
+	}
+	timing.ConnectMS = time.Since(connectStart).Milliseconds()
+
+	if !stop() {
+		_ = conn.Close()
+		return nil, timing, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, timing, nil
+}
+
+func splitTarget(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port: %q", portStr)
+	}
+	return host, port, nil
+}
+
+// SOCKS5 negotiation failures, wrapped in *UpstreamError by socks5Connect.
+var (
+	ErrSOCKS5AuthRequired = errors.New("socks5: proxy requires authentication")
+	ErrSOCKS5AuthFailed   = errors.New("socks5: authentication failed")
+	// ErrSOCKS5Rejected covers protocol-level refusals: wrong version, no
+	// acceptable method, malformed replies.
+	ErrSOCKS5Rejected = errors.New("socks5: handshake rejected")
+)
+
+func ctxErrOr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func socks5Handshake(conn net.Conn, node ProxyNode) error {
+	method := byte(socks5AuthNone)
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if node.User != "" || node.Pass != "" {
+		method = socks5AuthPassword
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("%w: unexpected protocol version %d", ErrSOCKS5Rejected, resp[0])
+	}
+	switch resp[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if method != socks5AuthPassword {
+			return ErrSOCKS5AuthRequired
+		}
+		return socks5Authenticate(conn, node.User, node.Pass)
+	case socks5AuthNoAccept:
+		if method == socks5AuthPassword {
+			// Refusing the credentials we offered is an auth failure, not a dead proxy.
+			return fmt.Errorf("%w: credentials not accepted", ErrSOCKS5AuthFailed)
+		}
+		return fmt.Errorf("%w: no acceptable authentication methods", ErrSOCKS5Rejected)
+	default:
+		return fmt.Errorf("%w: unsupported authentication method %d", ErrSOCKS5Rejected, resp[1])
+	}
+}
+
+func socks5Authenticate(conn net.Conn, user, pass string) error {
+	if len(user) > 255 || len(pass) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+	b := make([]byte, 0, 3+len(user)+len(pass))
+	b = append(b, 0x01, byte(len(user)))
+	b = append(b, user...)
+	b = append(b, byte(len(pass)))
+	b = append(b, pass...)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return ErrSOCKS5AuthFailed
+	}
+	return nil
+}
+
+// socks5Request sends cmd for host:port and reads the proxy's reply,
+// returning the address it reports.
+func socks5Request(conn net.Conn, cmd byte, host string, port int) (net.Addr, error) {
+	b := []byte{socks5Version, cmd, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5: host name too long")
+		}
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	return readSOCKS5Reply(conn)
+}
+
+// readSOCKS5Reply reads one reply and returns its address. A domain address
+// comes back as a *net.TCPAddr with no IP, only the port.
+func readSOCKS5Reply(conn net.Conn) (net.Addr, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("%w: unexpected protocol version %d", ErrSOCKS5Rejected, hdr[0])
+	}
+	if hdr[1] != 0x00 {
+		return nil, &SOCKS5ReplyError{Code: hdr[1]}
+	}
+	var addr []byte
+	switch hdr[3] {
+	case socks5AtypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socks5AtypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		addr = make([]byte, l[0])
+	default:
+		return nil, fmt.Errorf("%w: unknown address type %d", ErrSOCKS5Rejected, hdr[3])
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, p[:]); err != nil {
+		return nil, err
+	}
+	bound := &net.TCPAddr{Port: int(p[0])<<8 | int(p[1])}
+	if hdr[3] != socks5AtypDomain {
+		bound.IP = net.IP(addr)
+	}
+	return bound, nil
+}
@@ -0,0 +1,152 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authUpstream is a SOCKS5 node that answers the method negotiation with
+// method and, when that is username/password, the credentials with status.
+func authUpstream(t *testing.T, method, status byte) ProxyNode {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var hdr [2]byte
+				if _, err := io.ReadFull(c, hdr[:]); err != nil {
+					return
+				}
+				io.CopyN(io.Discard, c, int64(hdr[1]))
+				c.Write([]byte{socks5Version, method})
+				if method != socks5AuthPassword {
+					return
+				}
+				var ver, n [1]byte
+				io.ReadFull(c, ver[:])
+				io.ReadFull(c, n[:])
+				io.CopyN(io.Discard, c, int64(n[0]))
+				io.ReadFull(c, n[:])
+				io.CopyN(io.Discard, c, int64(n[0]))
+				c.Write([]byte{0x01, status})
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	return ProxyNode{Type: ProxyTypeSOCKS5, IP: host, Port: port}
+}
+
+func withCreds(n ProxyNode) ProxyNode {
+	n.User, n.Pass = "alice", "wrong"
+	return n
+}
+
+func TestSOCKS5AuthClassification(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     ProxyNode
+		wantErr  error
+		wantAuth bool
+		wantCat  string
+	}{
+		{"credentials rejected", withCreds(authUpstream(t, socks5AuthPassword, 0x01)), ErrSOCKS5AuthFailed, true, DialErrAuth},
+		{"credentials method refused", withCreds(authUpstream(t, socks5AuthNoAccept, 0)), ErrSOCKS5AuthFailed, true, DialErrAuth},
+		{"credentials required", authUpstream(t, socks5AuthPassword, 0), ErrSOCKS5AuthRequired, true, DialErrAuth},
+		{"no method accepted", authUpstream(t, socks5AuthNoAccept, 0), ErrSOCKS5Rejected, false, DialErrHandshake},
+		{"dead", withCreds(deadUpstream(t)), nil, false, DialErrRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DialViaProxy(context.Background(), tt.node, "tcp", "example.com:80", time.Second)
+			if err == nil {
+				t.Fatal("DialViaProxy() succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("DialViaProxy() = %v, want %v", err, tt.wantErr)
+			}
+			if got := IsAuthFailure(err); got != tt.wantAuth {
+				t.Errorf("IsAuthFailure(%v) = %v, want %v", err, got, tt.wantAuth)
+			}
+			if got := DialErrorCategory(err); got != tt.wantCat {
+				t.Errorf("DialErrorCategory(%v) = %q, want %q", err, got, tt.wantCat)
+			}
+		})
+	}
+}
+
+func TestValidationReportsAuthFailures(t *testing.T) {
+	srv := helloServer(t)
+	live, _ := fakeUpstream(t)
+	rejecting := withCreds(authUpstream(t, socks5AuthPassword, 0x01))
+	dead := deadUpstream(t)
+	cfg := ValidationConfig{Enabled: true, SOCKS5TestAddr: strings.TrimPrefix(srv.URL, "http://"), MaxSOCKS5: 10, Concurrency: 3}
+
+	res, err := ValidateAndFilter(context.Background(), []ProxyNode{rejecting, live, dead}, cfg, 2*time.Second)
+	if err != nil {
+		t.Fatalf("ValidateAndFilter() = %v", err)
+	}
+	if len(res.ValidSOCKS5) != 1 || res.ValidSOCKS5[0].Addr() != live.Addr() {
+		t.Errorf("valid = %v, want only %s", res.ValidSOCKS5, live.Addr())
+	}
+	if len(res.AuthFailed) != 1 || res.AuthFailed[0].Addr() != rejecting.Addr() || !res.AuthFailed[0].AuthFailed {
+		t.Errorf("auth failed = %+v, want %s flagged", res.AuthFailed, rejecting.Addr())
+	}
+	if len(res.Failed) != 2 {
+		t.Errorf("failed = %v, want the rejecting and the dead node", res.Failed)
+	}
+}
+
+func TestReportAuthFailure(t *testing.T) {
+	a, b := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0)
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{a, b})
+	var removed []ProxyNode
+	m.OnRemove = func(n ProxyNode) { removed = append(removed, n) }
+
+	if !m.ReportAuthFailure(a) {
+		t.Fatal("ReportAuthFailure() = false, want the node removed at once")
+	}
+	if m.PoolSize() != 1 {
+		t.Errorf("pool size = %d, want 1", m.PoolSize())
+	}
+	if len(removed) != 1 || !removed[0].AuthFailed {
+		t.Errorf("OnRemove saw %+v, want %s flagged AuthFailed", removed, a.Addr())
+	}
+}
+
+func TestRemovedLog(t *testing.T) {
+	l := NewRemovedLog(3)
+	l.Record("203.0.113.1:1080", RemovedReasonFailed)
+	l.Record("203.0.113.2:1080", RemovedReasonAuthFailed)
+	l.Record("", RemovedReasonFailed) // ignored
+	l.Record("203.0.113.3:1080", RemovedReasonFailed)
+	l.Record("203.0.113.4:1080", RemovedReasonAuthFailed)
+
+	all := l.Items("")
+	if len(all) != 3 || all[0].Proxy != "203.0.113.2:1080" {
+		t.Fatalf("Items() = %+v, want the last three", all)
+	}
+	auth := l.Items(RemovedReasonAuthFailed)
+	if len(auth) != 2 || auth[1].Proxy != "203.0.113.4:1080" {
+		t.Errorf("Items(auth_failed) = %+v", auth)
+	}
+	var nilLog *RemovedLog
+	nilLog.Record("203.0.113.1:1080", RemovedReasonFailed)
+	if nilLog.Items("") != nil {
+		t.Error("nil RemovedLog returned items")
+	}
+}
@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DefaultBindTimeout is how long a SOCKS5Server waits for the peer of a
+// BIND without a BindTimeout.
+const DefaultBindTimeout = 2 * time.Minute
+
+// ErrBindUnsupported is returned for a BIND through an upstream that cannot
+// carry one. Only SOCKS5 upstreams have the command; HTTP CONNECT proxies
+// have no equivalent. Many SOCKS5 proxies refuse it as well, replying
+// "command not supported" (0x07): servers implementing RFC 1928 in full,
+// such as Dante and 3proxy, accept it, while ssh -D, most proxy libraries
+// and most public list proxies do not.
+var ErrBindUnsupported = errors.New("upstream does not support BIND")
+
+// BindListener is a SOCKS5 BIND in progress: a listener for one inbound
+// connection, such as an active FTP data channel.
+type BindListener interface {
+	// Addr is where the peer is to connect, as reported by the upstream.
+	Addr() net.Addr
+	// Accept waits for the peer until ctx ends. The returned conn's
+	// RemoteAddr is the peer's address; Accept must not be called again.
+	Accept(ctx context.Context) (net.Conn, error)
+	// Close abandons the BIND, or closes the accepted conn.
+	Close() error
+}
+
+// BindViaProxy asks the SOCKS5 proxy node to listen for one connection from
+// peer, the address the client expects it from (port 0 means any). The
+// proxy's own listener address is in the result's Addr. Other proxy types
+// fail with ErrBindUnsupported.
+func BindViaProxy(ctx context.Context, node ProxyNode, peer string, timeout time.Duration) (BindListener, error) {
+	if node.Type != ProxyTypeSOCKS5 {
+		return nil, ErrBindUnsupported
+	}
+	host, portStr, err := net.SplitHostPort(peer)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port: %q", portStr)
+	}
+	conn, err := newDialer(timeout).DialContext(ctx, "tcp", node.Addr())
+	if err != nil {
+		return nil, classifyDialError(node.Addr(), &UpstreamError{Proxy: node.Addr(), Err: err})
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if dl, ok := ctx.Deadline(); ok && (deadline.IsZero() || dl.Before(deadline)) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if err := socks5Handshake(conn, node); err != nil {
+		_ = conn.Close()
+		return nil, classifyDialError(node.Addr(), &UpstreamError{Proxy: node.Addr(), Err: ctxErrOr(ctx, err)})
+	}
+	addr, err := socks5Request(conn, socks5CmdBind, host, port)
+	if err != nil {
+		_ = conn.Close()
+		var replyErr *SOCKS5ReplyError
+		if !errors.As(err, &replyErr) {
+			err = &UpstreamError{Proxy: node.Addr(), Err: ctxErrOr(ctx, err)}
+		}
+		return nil, classifyDialError(node.Addr(), err)
+	}
+	if !stop() {
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if tcp, ok := addr.(*net.TCPAddr); ok && (tcp.IP == nil || tcp.IP.IsUnspecified()) {
+		// The proxy listens on all its addresses; the one we reached it on
+		// is the best guess for the peer.
+		if ra, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			addr = &net.TCPAddr{IP: ra.IP, Port: tcp.Port}
+		}
+	}
+	return &socks5Bind{conn: conn, addr: addr, proxy: node.Addr()}, nil
+}
+
+type socks5Bind struct {
+	conn  net.Conn
+	addr  net.Addr
+	proxy string
+}
+
+func (b *socks5Bind) Addr() net.Addr { return b.addr }
+
+func (b *socks5Bind) Close() error { return b.conn.Close() }
+
+// Accept reads the proxy's second reply, sent once the peer connected; the
+// control connection then carries the peer's data.
+func (b *socks5Bind) Accept(ctx context.Context) (net.Conn, error) {
+	dl, _ := ctx.Deadline()
+	_ = b.conn.SetDeadline(dl)
+	stop := context.AfterFunc(ctx, func() { _ = b.conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	peer, err := readSOCKS5Reply(b.conn)
+	if err != nil {
+		_ = b.conn.Close()
+		var replyErr *SOCKS5ReplyError
+		if errors.As(err, &replyErr) {
+			return nil, err
+		}
+		return nil, &UpstreamError{Proxy: b.proxy, Err: ctxErrOr(ctx, err)}
+	}
+	if !stop() {
+		_ = b.conn.Close()
+		return nil, ctx.Err()
+	}
+	_ = b.conn.SetDeadline(time.Time{})
+	return withIdleTimeout(&boundConn{Conn: b.conn, remote: peer}, currentDialOptions().IdleTimeout), nil
+}
+
+// boundConn is an accepted BIND connection, reporting the peer as its
+// remote end.
+type boundConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *boundConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *boundConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
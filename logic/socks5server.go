@@ -0,0 +1,428 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 reply codes (RFC 1928 section 6).
+const (
+	SOCKS5ReplySucceeded           byte = 0x00
+	SOCKS5ReplyGeneralFailure      byte = 0x01
+	SOCKS5ReplyNotAllowed          byte = 0x02
+	SOCKS5ReplyNetworkUnreachable  byte = 0x03
+	SOCKS5ReplyHostUnreachable     byte = 0x04
+	SOCKS5ReplyConnectionRefused   byte = 0x05
+	SOCKS5ReplyTTLExpired          byte = 0x06
+	SOCKS5ReplyCommandNotSupported byte = 0x07
+	SOCKS5ReplyAddrNotSupported    byte = 0x08
+)
+
+// SOCKS5ReplyError is a non-success reply received from an upstream proxy.
+type SOCKS5ReplyError struct {
+	Code byte
+}
+
+func (e *SOCKS5ReplyError) Error() string {
+	if msg, ok := socks5Replies[e.Code]; ok {
+		return "socks5: " + msg
+	}
+	return fmt.Sprintf("socks5: unknown reply code %d", e.Code)
+}
+
+// UpstreamError wraps failures reaching or negotiating with the upstream
+// proxy itself, as opposed to the proxy failing to reach the target.
+type UpstreamError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *UpstreamError) Error() string { return "upstream " + e.Proxy + ": " + e.Err.Error() }
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// SOCKS5ReplyCode maps a dial error to the reply code sent to SOCKS5 clients.
+func SOCKS5ReplyCode(err error) byte {
+	if err == nil {
+		return SOCKS5ReplySucceeded
+	}
+	var replyErr *SOCKS5ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+	if isTimeout(err) {
+		return SOCKS5ReplyTTLExpired
+	}
+	if errors.Is(err, ErrBindUnsupported) {
+		return SOCKS5ReplyCommandNotSupported
+	}
+	var blockedErr *TargetBlockedError
+	if errors.As(err, &blockedErr) || errors.Is(err, ErrSelfTarget) {
+		return SOCKS5ReplyNotAllowed
+	}
+	var upErr *UpstreamError
+	if errors.As(err, &upErr) {
+		// The target was never tried; don't blame it.
+		return SOCKS5ReplyGeneralFailure
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return SOCKS5ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return SOCKS5ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return SOCKS5ReplyHostUnreachable
+	}
+	return SOCKS5ReplyGeneralFailure
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// SOCKS5ReplyName returns a short name for a reply code, used as a stats key.
+func SOCKS5ReplyName(code byte) string {
+	switch code {
+	case SOCKS5ReplySucceeded:
+		return "succeeded"
+	case SOCKS5ReplyGeneralFailure:
+		return "general_failure"
+	case SOCKS5ReplyNotAllowed:
+		return "not_allowed"
+	case SOCKS5ReplyNetworkUnreachable:
+		return "network_unreachable"
+	case SOCKS5ReplyHostUnreachable:
+		return "host_unreachable"
+	case SOCKS5ReplyConnectionRefused:
+		return "connection_refused"
+	case SOCKS5ReplyTTLExpired:
+		return "ttl_expired"
+	case SOCKS5ReplyCommandNotSupported:
+		return "command_not_supported"
+	case SOCKS5ReplyAddrNotSupported:
+		return "address_not_supported"
+	default:
+		return "code_" + strconv.Itoa(int(code))
+	}
+}
+
+// ReplyStats counts SOCKS5 replies sent to clients by code.
+type ReplyStats struct {
+	counts [256]atomic.Int64
+}
+
+func (s *ReplyStats) Add(code byte) { s.counts[code].Add(1) }
+
+// Snapshot returns non-zero counters keyed by SOCKS5ReplyName.
+func (s *ReplyStats) Snapshot() map[string]int64 {
+	out := make(map[string]int64, 8)
+	for i := range s.counts {
+		if v := s.counts[i].Load(); v > 0 {
+			out[SOCKS5ReplyName(byte(i))] = v
+		}
+	}
+	return out
+}
+
+// SOCKS5Server is a minimal no-auth SOCKS5 server supporting CONNECT. Dial
+// errors are translated to reply codes with SOCKS5ReplyCode.
+type SOCKS5Server struct {
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Resolve, when set, resolves domain targets locally before Dial.
+	// When nil, host names are passed to Dial unchanged.
+	Resolve func(ctx context.Context, host string) (net.IP, error)
+	Logger  *log.Logger
+	// OnReply, when set, is called with every reply code sent to a client.
+	OnReply func(code byte)
+	// Bind, when set, serves the BIND command, for the peer address the
+	// client names; without it BIND is refused as not supported.
+	// BindTimeout bounds the wait for the peer (default
+	// DefaultBindTimeout).
+	Bind        func(ctx context.Context, addr string) (BindListener, error)
+	BindTimeout time.Duration
+}
+
+// LocalResolve resolves host with the system resolver.
+func LocalResolve(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs[0].IP, nil
+}
+
+// Serve accepts connections on ln until it is closed.
+func (s *SOCKS5Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			id := NewRequestID()
+			if err := s.serveConn(WithRequestID(connContext(conn), id), conn); err != nil && s.Logger != nil {
+				s.Logger.Printf("[ERR] socks: conn=%s %v", id, err)
+			}
+		}()
+	}
+}
+
+// ServeConn handles a single client connection and closes it when done.
+// The context passed to Dial carries a fresh connection ID (RequestIDFrom)
+// and the client's address (ClientAddrFrom).
+func (s *SOCKS5Server) ServeConn(conn net.Conn) error {
+	return s.serveConn(WithRequestID(connContext(conn), NewRequestID()), conn)
+}
+
+func connContext(conn net.Conn) context.Context {
+	ctx := context.Background()
+	if ra := conn.RemoteAddr(); ra != nil {
+		ctx = WithClientAddr(ctx, ra.String())
+	}
+	return ctx
+}
+
+func (s *SOCKS5Server) serveConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := s.negotiate(conn); err != nil {
+		return err
+	}
+
+	cmd, host, port, err := readSOCKS5Request(conn)
+	if err != nil {
+		var replyErr *SOCKS5ReplyError
+		if errors.As(err, &replyErr) {
+			_ = s.reply(conn, replyErr.Code, nil)
+		}
+		return err
+	}
+	if cmd == socks5CmdBind && s.Bind != nil {
+		return s.serveBind(ctx, conn, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	if cmd != socks5CmdConnect {
+		_ = s.reply(conn, SOCKS5ReplyCommandNotSupported, nil)
+		return fmt.Errorf("unsupported command: %d", cmd)
+	}
+
+	if s.Resolve != nil && net.ParseIP(host) == nil {
+		ip, err := s.Resolve(ctx, host)
+		if err != nil {
+			_ = s.reply(conn, SOCKS5ReplyHostUnreachable, nil)
+			return fmt.Errorf("resolve %s: %w", host, err)
+		}
+		host = ip.String()
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(port))
+
+	dial := s.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	target, err := dial(ctx, "tcp", dest)
+	if err != nil {
+		_ = s.reply(conn, SOCKS5ReplyCode(err), nil)
+		return fmt.Errorf("connect to %s failed: %w", dest, err)
+	}
+	defer target.Close()
+
+	if err := s.reply(conn, SOCKS5ReplySucceeded, target.LocalAddr()); err != nil {
+		return fmt.Errorf("send reply: %w", err)
+	}
+	return proxyConns(conn, target)
+}
+
+// serveBind sets up a BIND for peer and relays the one connection it
+// accepts. Per RFC 1928 the client gets two replies: the address to hand
+// the peer, then the peer's address once it connected. peer is only a
+// hint, so it is never resolved.
+func (s *SOCKS5Server) serveBind(ctx context.Context, conn net.Conn, peer string) error {
+	bl, err := s.Bind(ctx, peer)
+	if err != nil {
+		_ = s.reply(conn, SOCKS5ReplyCode(err), nil)
+		return fmt.Errorf("bind for %s failed: %w", peer, err)
+	}
+	defer bl.Close()
+	if err := s.reply(conn, SOCKS5ReplySucceeded, bl.Addr()); err != nil {
+		return fmt.Errorf("send reply: %w", err)
+	}
+
+	timeout := s.BindTimeout
+	if timeout <= 0 {
+		timeout = DefaultBindTimeout
+	}
+	actx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// A client that hangs up gives up on the peer. The watch stops once the
+	// peer is in; a byte it read early belongs to the peer.
+	var early []byte
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		b := make([]byte, 1)
+		n, err := conn.Read(b)
+		early = b[:n]
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+	target, err := bl.Accept(actx)
+	_ = conn.SetReadDeadline(time.Unix(1, 0))
+	<-watched
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = s.reply(conn, SOCKS5ReplyCode(err), nil)
+		return fmt.Errorf("bind for %s: accept: %w", peer, err)
+	}
+	defer target.Close()
+	if err := s.reply(conn, SOCKS5ReplySucceeded, target.RemoteAddr()); err != nil {
+		return fmt.Errorf("send reply: %w", err)
+	}
+	if len(early) > 0 {
+		if _, err := target.Write(early); err != nil {
+			return err
+		}
+	}
+	return proxyConns(conn, target)
+}
+
+func (s *SOCKS5Server) negotiate(conn net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return fmt.Errorf("read greeting: %w", err)
+	}
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("read methods: %w", err)
+	}
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			_, err := conn.Write([]byte{socks5Version, socks5AuthNone})
+			return err
+		}
+	}
+	_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+	return errors.New("no supported authentication method")
+}
+
+// readSOCKS5Request reads a client request. Unsupported address types are
+// returned as *SOCKS5ReplyError so the caller can reply with its code.
+func readSOCKS5Request(conn net.Conn) (cmd byte, host string, port int, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return 0, "", 0, fmt.Errorf("read request: %w", err)
+	}
+	if hdr[0] != socks5Version {
+		return 0, "", 0, fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+	switch hdr[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return 0, "", 0, fmt.Errorf("read address: %w", err)
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return 0, "", 0, fmt.Errorf("read address: %w", err)
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return 0, "", 0, fmt.Errorf("read address: %w", err)
+		}
+		host = string(name)
+	default:
+		return 0, "", 0, &SOCKS5ReplyError{Code: SOCKS5ReplyAddrNotSupported}
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(conn, p[:]); err != nil {
+		return 0, "", 0, fmt.Errorf("read port: %w", err)
+	}
+	return hdr[1], host, int(p[0])<<8 | int(p[1]), nil
+}
+
+func (s *SOCKS5Server) reply(conn net.Conn, code byte, bind net.Addr) error {
+	if s.OnReply != nil {
+		s.OnReply(code)
+	}
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcp, ok := bind.(*net.TCPAddr); ok {
+		if ip4 := tcp.IP.To4(); ip4 != nil {
+			ip = ip4
+		} else if tcp.IP != nil {
+			ip = tcp.IP.To16()
+		}
+		port = tcp.Port
+	}
+	atyp := byte(socks5AtypIPv4)
+	if len(ip) == net.IPv6len {
+		atyp = socks5AtypIPv6
+	}
+	b := make([]byte, 0, 6+len(ip))
+	b = append(b, socks5Version, code, 0x00, atyp)
+	b = append(b, ip...)
+	b = append(b, byte(port>>8), byte(port))
+	_, err := conn.Write(b)
+	return err
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// proxyConns copies in both directions until both sides are done, half-closing
+// the write side of each peer when its source reaches EOF.
+func proxyConns(client, target net.Conn) error {
+	var wg sync.WaitGroup
+	errCh := make(chan error, 2)
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := CopyBuffered(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+		errCh <- err
+	}
+	wg.Add(2)
+	go cp(target, client)
+	go cp(client, target)
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
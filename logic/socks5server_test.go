@@ -0,0 +1,192 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveOne runs s on one end of a pipe and returns the client end and a
+// channel with ServeConn's result.
+func serveOne(t *testing.T, s *SOCKS5Server) (net.Conn, <-chan error) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- s.ServeConn(server) }()
+	t.Cleanup(func() { client.Close() })
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, done
+}
+
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	return b
+}
+
+// connectRequest is a CONNECT to a domain target.
+func connectRequest(host string, port int) []byte {
+	b := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypDomain, byte(len(host))}
+	b = append(b, host...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func TestSOCKS5ServerHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		greeting []byte
+		want     []byte
+		wantErr  bool
+	}{
+		{"no auth offered", []byte{socks5Version, 1, socks5AuthNone}, []byte{socks5Version, socks5AuthNone}, false},
+		{"no auth among others", []byte{socks5Version, 2, socks5AuthPassword, socks5AuthNone}, []byte{socks5Version, socks5AuthNone}, false},
+		{"password only", []byte{socks5Version, 1, socks5AuthPassword}, []byte{socks5Version, socks5AuthNoAccept}, true},
+		{"SOCKS4", []byte{0x04, 1, 0x00}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, done := serveOne(t, &SOCKS5Server{})
+			go client.Write(tt.greeting)
+			if tt.want != nil {
+				if got := readN(t, client, 2); !bytes.Equal(got, tt.want) {
+					t.Errorf("method reply = %x, want %x", got, tt.want)
+				}
+			}
+			if tt.wantErr {
+				if err := <-done; err == nil {
+					t.Error("ServeConn() = nil, want a handshake error")
+				}
+			}
+		})
+	}
+}
+
+func TestSOCKS5ServerConnect(t *testing.T) {
+	var gotAddr string
+	var codes []byte
+	s := &SOCKS5Server{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			gotAddr = addr
+			if ClientAddrFrom(ctx) == "" {
+				t.Error("Dial context carries no client address")
+			}
+			if RequestIDFrom(ctx) == "" {
+				t.Error("Dial context carries no connection ID")
+			}
+			local, remote := net.Pipe()
+			go func() {
+				defer remote.Close()
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(remote, b); err == nil {
+					remote.Write(bytes.ToUpper(b))
+				}
+			}()
+			return local, nil
+		},
+		OnReply: func(code byte) { codes = append(codes, code) },
+	}
+	client, done := serveOne(t, s)
+	go client.Write(append([]byte{socks5Version, 1, socks5AuthNone}, connectRequest("example.com", 443)...))
+	readN(t, client, 2)
+	reply := readN(t, client, 10)
+	if reply[1] != SOCKS5ReplySucceeded {
+		t.Fatalf("reply code = %d, want succeeded", reply[1])
+	}
+	if gotAddr != "example.com:443" {
+		t.Errorf("Dial addr = %q, want example.com:443", gotAddr)
+	}
+
+	go client.Write([]byte("ping"))
+	if got := readN(t, client, 4); string(got) != "PING" {
+		t.Errorf("relayed %q, want PING", got)
+	}
+	client.Close()
+	<-done
+	if len(codes) != 1 || codes[0] != SOCKS5ReplySucceeded {
+		t.Errorf("OnReply saw %v, want one succeeded", codes)
+	}
+}
+
+func TestSOCKS5ServerReplyCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		dialErr error
+		want    byte
+	}{
+		{"refused", connectRequest("example.com", 80), syscall.ECONNREFUSED, SOCKS5ReplyConnectionRefused},
+		{"blocked", connectRequest("example.com", 80), &TargetBlockedError{Host: "example.com"}, SOCKS5ReplyNotAllowed},
+		{"upstream down", connectRequest("example.com", 80), &UpstreamError{Proxy: "203.0.113.1:1080", Err: syscall.ECONNREFUSED}, SOCKS5ReplyGeneralFailure},
+		{"bind without Bind", []byte{socks5Version, socks5CmdBind, 0x00, socks5AtypIPv4, 192, 0, 2, 1, 0, 80}, nil, SOCKS5ReplyCommandNotSupported},
+		{"unknown address type", []byte{socks5Version, socks5CmdConnect, 0x00, 0x09}, nil, SOCKS5ReplyAddrNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen []byte
+			s := &SOCKS5Server{
+				Dial: func(context.Context, string, string) (net.Conn, error) {
+					if tt.dialErr == nil {
+						return nil, errors.New("unexpected dial")
+					}
+					return nil, tt.dialErr
+				},
+				OnReply: func(code byte) { seen = append(seen, code) },
+			}
+			client, done := serveOne(t, s)
+			go client.Write(append([]byte{socks5Version, 1, socks5AuthNone}, tt.request...))
+			readN(t, client, 2)
+			if reply := readN(t, client, 4); reply[1] != tt.want {
+				t.Errorf("reply code = %s, want %s", SOCKS5ReplyName(reply[1]), SOCKS5ReplyName(tt.want))
+			}
+			client.Close()
+			if err := <-done; err == nil {
+				t.Error("ServeConn() = nil, want the failure")
+			}
+			if len(seen) != 1 || seen[0] != tt.want {
+				t.Errorf("OnReply saw %v, want [%d]", seen, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{nil, SOCKS5ReplySucceeded},
+		{&SOCKS5ReplyError{Code: SOCKS5ReplyHostUnreachable}, SOCKS5ReplyHostUnreachable},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), SOCKS5ReplyTTLExpired},
+		{ErrBindUnsupported, SOCKS5ReplyCommandNotSupported},
+		{ErrSelfTarget, SOCKS5ReplyNotAllowed},
+		{&UpstreamError{Proxy: "p", Err: syscall.EHOSTUNREACH}, SOCKS5ReplyGeneralFailure},
+		{syscall.ENETUNREACH, SOCKS5ReplyNetworkUnreachable},
+		{&net.DNSError{Err: "no such host", Name: "x.invalid"}, SOCKS5ReplyHostUnreachable},
+		{errors.New("boom"), SOCKS5ReplyGeneralFailure},
+	}
+	for _, tt := range tests {
+		if got := SOCKS5ReplyCode(tt.err); got != tt.want {
+			t.Errorf("SOCKS5ReplyCode(%v) = %s, want %s", tt.err, SOCKS5ReplyName(got), SOCKS5ReplyName(tt.want))
+		}
+	}
+}
+
+func TestReplyStats(t *testing.T) {
+	var s ReplyStats
+	s.Add(SOCKS5ReplySucceeded)
+	s.Add(SOCKS5ReplySucceeded)
+	s.Add(0x42)
+	got := s.Snapshot()
+	if got["succeeded"] != 2 || got["code_66"] != 1 || len(got) != 2 {
+		t.Errorf("Snapshot() = %v", got)
+	}
+}
@@ -0,0 +1,190 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// SourceProvider fetches the nodes of one configured source.
+type SourceProvider interface {
+	Fetch(ctx context.Context) ([]ProxyNode, error)
+}
+
+// SourceProviderFunc adapts a function to SourceProvider.
+type SourceProviderFunc func(ctx context.Context) ([]ProxyNode, error)
+
+func (f SourceProviderFunc) Fetch(ctx context.Context) ([]ProxyNode, error) { return f(ctx) }
+
+// SourceProviderFactory builds the provider for a source using its format.
+type SourceProviderFactory func(src ProxySource) (SourceProvider, error)
+
+const (
+	SourceFormatText   = "text"
+	SourceFormatBase64 = "base64"
+	SourceFormatJSON   = "json"
+)
+
+// SourceDecodeBase64 on ProxySource.Decode base64-decodes the list (or, for
+// JSON sources, the results field) before parsing.
+const SourceDecodeBase64 = "base64"
+
+// maxSourceBody bounds how much of a source response is read, measured after
+// decompression.
+const maxSourceBody = 32 << 20
+
+// ErrSourceTooLarge is returned when a source body exceeds maxSourceBody.
+var ErrSourceTooLarge = errors.New("source body too large")
+
+var (
+	sourceProvidersMu sync.RWMutex
+	sourceProviders   = map[string]SourceProviderFactory{
+		SourceFormatText: func(src ProxySource) (SourceProvider, error) {
+			return SourceProviderFunc(func(ctx context.Context) ([]ProxyNode, error) {
+				if strings.EqualFold(src.Decode, SourceDecodeBase64) {
+					return fetchBase64List(ctx, src.URL, src.Type)
+				}
+				return FetchFromURL(ctx, src.URL, src.Type)
+			}), nil
+		},
+		SourceFormatBase64: func(src ProxySource) (SourceProvider, error) {
+			return SourceProviderFunc(func(ctx context.Context) ([]ProxyNode, error) {
+				return fetchBase64List(ctx, src.URL, src.Type)
+			}), nil
+		},
+		ProviderGenericJSON: newJSONProvider,
+		SourceFormatJSON:    newJSONProvider,
+	}
+)
+
+func newJSONProvider(src ProxySource) (SourceProvider, error) {
+	src.Provider = ProviderGenericJSON
+	return SourceProviderFunc(func(ctx context.Context) ([]ProxyNode, error) {
+		return FetchFromProvider(ctx, src)
+	}), nil
+}
+
+// RegisterSourceProvider makes sources with format name use factory. It
+// replaces any provider of that name, built-ins included, and is meant to be
+// called at startup before sources are validated.
+func RegisterSourceProvider(name string, factory SourceProviderFactory) {
+	sourceProvidersMu.Lock()
+	defer sourceProvidersMu.Unlock()
+	sourceProviders[strings.ToLower(name)] = factory
+}
+
+func sourceProviderRegistered(name string) bool {
+	sourceProvidersMu.RLock()
+	defer sourceProvidersMu.RUnlock()
+	_, ok := sourceProviders[name]
+	return ok
+}
+
+// NewSourceProvider returns the provider for src: its Provider when set,
+// otherwise its Format (default "text").
+func NewSourceProvider(src ProxySource) (SourceProvider, error) {
+	name := src.providerName()
+	sourceProvidersMu.RLock()
+	factory, ok := sourceProviders[name]
+	sourceProvidersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported source format: %q", name)
+	}
+	return factory(src)
+}
+
+func (s ProxySource) providerName() string {
+	if p := strings.ToLower(strings.TrimSpace(s.Provider)); p != "" {
+		return p
+	}
+	if f := strings.ToLower(strings.TrimSpace(s.Format)); f != "" {
+		return f
+	}
+	return SourceFormatText
+}
+
+// sourceReader transparently gunzips a body that starts with the gzip magic
+// bytes (lists served as .txt.gz without Content-Encoding) and caps what can be
+// read from it, so a small compressed body cannot expand without bound.
+func sourceReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return &cappedReader{r: zr, left: maxSourceBody}, nil
+	}
+	return &cappedReader{r: br, left: maxSourceBody}, nil
+}
+
+// cappedReader fails with ErrSourceTooLarge instead of silently truncating.
+type cappedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.left <= 0 {
+		// Distinguish "exactly at the cap" from "more data follows".
+		var b [1]byte
+		if n, _ := c.r.Read(b[:]); n > 0 {
+			return 0, ErrSourceTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	return n, err
+}
+
+// fetchBase64List fetches a base64-encoded text list, the usual shape of
+// subscription URLs.
+func fetchBase64List(ctx context.Context, url string, defaultType string) ([]ProxyNode, error) {
+	body, err := fetchSourceBody(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, &FetchError{URL: url, Err: err}
+	}
+	decoded, err := decodeBase64(raw)
+	if err != nil {
+		return nil, &FetchError{URL: url, Err: err}
+	}
+	out, err := parseProxyList(bytes.NewReader(decoded), defaultType)
+	if err != nil {
+		return nil, &FetchError{URL: url, Err: err}
+	}
+	return out, nil
+}
+
+// decodeBase64 accepts standard or URL-safe base64, padded or not, with
+// embedded line breaks.
+func decodeBase64(b []byte) ([]byte, error) {
+	s := strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, string(b))
+	s = strings.TrimRight(s, "=")
+	for _, enc := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		if out, err := enc.DecodeString(s); err == nil {
+			return out, nil
+		}
+	}
+	return nil, errors.New("invalid base64 payload")
+}
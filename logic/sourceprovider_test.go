@@ -0,0 +1,148 @@
+package logic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const sourceFixture = "1.2.3.4:1080\n5.6.7.8:1080\n"
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// serveBytes serves each body at its path, with no Content-Encoding.
+func serveBytes(t *testing.T, bodies map[string][]byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSourcePayloads(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString([]byte(sourceFixture))
+	srv := serveBytes(t, map[string][]byte{
+		"/list.txt":    []byte(sourceFixture),
+		"/list.txt.gz": gzipped(t, sourceFixture),
+		"/list.b64":    []byte(b64[:20] + "\n" + b64[20:]),
+		"/list.b64.gz": gzipped(t, base64.RawURLEncoding.EncodeToString([]byte(sourceFixture))),
+		"/list.json":   []byte(`{"results": "` + b64 + `", "next": null}`),
+	})
+
+	tests := []struct {
+		name string
+		src  ProxySource
+	}{
+		{"plain", ProxySource{URL: srv.URL + "/list.txt"}},
+		{"gzip without encoding header", ProxySource{URL: srv.URL + "/list.txt.gz"}},
+		{"decode base64", ProxySource{URL: srv.URL + "/list.b64", Decode: SourceDecodeBase64}},
+		{"base64 format", ProxySource{URL: srv.URL + "/list.b64", Format: SourceFormatBase64}},
+		{"gzipped base64", ProxySource{URL: srv.URL + "/list.b64.gz", Decode: SourceDecodeBase64}},
+		{"base64 json field", ProxySource{URL: srv.URL + "/list.json", Format: SourceFormatJSON, Decode: SourceDecodeBase64}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewSourceProvider(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nodes, err := p.Fetch(context.Background())
+			if err != nil {
+				t.Fatalf("Fetch() = %v", err)
+			}
+			if len(nodes) != 2 || nodes[0].Addr() != "1.2.3.4:1080" || nodes[1].Addr() != "5.6.7.8:1080" {
+				t.Errorf("Fetch() = %v, want the two fixture nodes", nodes)
+			}
+		})
+	}
+}
+
+func TestCorruptSourceFailsAlone(t *testing.T) {
+	gz := gzipped(t, strings.Repeat(sourceFixture, 100))
+	srv := serveBytes(t, map[string][]byte{
+		"/truncated.gz": gz[:len(gz)/2],
+		"/bad.b64":      []byte("%%% not base64 %%%"),
+		"/good.txt":     []byte("9.9.9.9:1080\n"),
+	})
+
+	nodes, stats, err := FetchFromSourcesWithStats(context.Background(), Sources{
+		{URL: srv.URL + "/truncated.gz"},
+		{URL: srv.URL + "/bad.b64", Decode: SourceDecodeBase64},
+		{URL: srv.URL + "/good.txt"},
+	})
+	if len(nodes) != 1 || nodes[0].Addr() != "9.9.9.9:1080" {
+		t.Fatalf("nodes = %v, want the good source's node", nodes)
+	}
+	var fe *FetchError
+	if !errors.As(err, &fe) {
+		t.Errorf("err = %v, want the failed sources reported", err)
+	}
+	if len(stats) != 3 || stats[0].Error == "" || stats[1].Error == "" || stats[2].Error != "" || stats[2].Count != 1 {
+		t.Errorf("stats = %+v, want only the good source to succeed", stats)
+	}
+}
+
+func TestCappedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr error
+	}{
+		{"under the cap", "123456789", nil},
+		{"at the cap", "1234567890", nil},
+		{"over the cap", "12345678901", ErrSourceTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := io.ReadAll(&cappedReader{r: strings.NewReader(tt.body), left: 10})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadAll() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestSourceReaderCapsDecompressed checks the cap applies to what a gzip
+// body expands to, not to the compressed bytes.
+func TestSourceReaderCapsDecompressed(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zeros := make([]byte, 1<<20)
+	for i := 0; i < maxSourceBody>>20+1; i++ {
+		zw.Write(zeros)
+	}
+	zw.Close()
+	if buf.Len() >= maxSourceBody/100 {
+		t.Fatalf("compressed fixture is %d bytes", buf.Len())
+	}
+	r, err := sourceReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, r); !errors.Is(err, ErrSourceTooLarge) {
+		t.Fatalf("reading a gzip bomb = %v, want ErrSourceTooLarge", err)
+	}
+}
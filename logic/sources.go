@@ -7,18 +7,71 @@ import (
 	"strings"
 )
 
+// SourceStatic is the ProxyNode.Source of proxies from the config's
+// proxies list.
+const SourceStatic = "config"
+
+// SourceAPI is the ProxyNode.Source of proxies added with Refresher.Add.
+const SourceAPI = "api"
+
 type ProxySource struct {
-	URL  string `json:"url"`
-	Type string `json:"type,omitempty"` // socks5 | auto (or empty)
+	URL string `json:"url"`
+	// Type is socks5 (the default), https, http, or infer to probe each
+	// schemeless entry for its protocol (see ClassifyProxy). Left unset or
+	// "auto", schemeless entries that fail SOCKS5 validation are retried as
+	// HTTP proxies.
+	Type string `json:"type,omitempty"`
+	// Format selects the SourceProvider: "text" (default), "base64" or
+	// "json", or any name added with RegisterSourceProvider.
+	Format string `json:"format,omitempty"`
+	// Decode is "base64" for lists (or JSON results fields) that are
+	// base64-encoded. Gzip bodies are detected without configuration.
+	Decode string `json:"decode,omitempty"`
+
+	// Provider switches the source to a JSON provider API (generic_json).
+	Provider string `json:"provider,omitempty"`
+	// APIKeyEnv names the env var holding the API key; the key itself is
+	// never stored in config.
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// AuthHeader is "Name: value" where $KEY expands to the API key.
+	AuthHeader string `json:"auth_header,omitempty"`
+	// Fields maps node fields (ip, port, user, pass, country) to item keys.
+	Fields       map[string]string `json:"fields,omitempty"`
+	ResultsField string            `json:"results_field,omitempty"`
+	NextField    string            `json:"next_field,omitempty"`
 }
 
 func (s ProxySource) Validate() error {
 	switch strings.ToLower(strings.TrimSpace(s.Type)) {
-	case "", "auto", ProxyTypeSOCKS5:
-		return nil
+	case "", "auto", ProxyTypeSOCKS5, ProxyTypeHTTPS, ProxyTypeHTTP, ProxyTypeInfer:
 	default:
 		return fmt.Errorf("unsupported source type: %q", s.Type)
 	}
+	switch strings.ToLower(strings.TrimSpace(s.Decode)) {
+	case "", SourceDecodeBase64:
+	default:
+		return fmt.Errorf("unsupported source decode: %q", s.Decode)
+	}
+	if !sourceProviderRegistered(s.providerName()) {
+		if s.Provider != "" {
+			return fmt.Errorf("unsupported provider: %q", s.Provider)
+		}
+		return fmt.Errorf("unsupported source format: %q", s.Format)
+	}
+	switch s.providerName() {
+	case ProviderGenericJSON, SourceFormatJSON:
+	default:
+		return nil
+	}
+	for k := range s.Fields {
+		if _, ok := providerFieldKeys[k]; !ok {
+			return fmt.Errorf("unknown provider field %q", k)
+		}
+	}
+	if _, _, err := s.authHeaderParts(); err != nil {
+		return err
+	}
+	return nil
 }
 
 type Sources []ProxySource
@@ -0,0 +1,107 @@
+package logic
+
+import "time"
+
+// ManagerState is the serializable state of a ProxyManager, used to move a
+// running instance to another host.
+type ManagerState struct {
+	Pool         []ProxyNode `json:"pool"`
+	CurrentIndex int         `json:"current_index"`
+	// Failures holds consecutive failure counts by addr.
+	Failures map[string]int `json:"failures,omitempty"`
+	// OpenUntil holds circuit breaker quarantine ends by addr.
+	OpenUntil map[string]time.Time `json:"open_until,omitempty"`
+
+	LastRefreshAt  time.Time `json:"last_refresh_at,omitempty"`
+	LastRefreshErr string    `json:"last_refresh_err,omitempty"`
+	LastSuccessAt  time.Time `json:"last_success_at,omitempty"`
+}
+
+// Export copies the manager state under the lock.
+func (m *ProxyManager) Export() ManagerState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	st := ManagerState{
+		Pool:           append([]ProxyNode(nil), m.pool...),
+		CurrentIndex:   m.currentIndex,
+		LastRefreshAt:  m.lastRefreshAt,
+		LastRefreshErr: m.lastRefreshErr,
+		LastSuccessAt:  m.lastSuccessAt,
+	}
+	if len(m.failures) > 0 {
+		st.Failures = make(map[string]int, len(m.failures))
+		for k, v := range m.failures {
+			st.Failures[k] = v
+		}
+	}
+	if len(m.openUntil) > 0 {
+		st.OpenUntil = make(map[string]time.Time, len(m.openUntil))
+		for k, v := range m.openUntil {
+			st.OpenUntil[k] = v
+		}
+	}
+	return st
+}
+
+// Redacted returns st with the pool's passwords redacted.
+func (st ManagerState) Redacted() ManagerState {
+	st.Pool = RedactNodes(st.Pool)
+	return st
+}
+
+// Import replaces the manager state. Nodes SetPool would reject are dropped,
+// counters for addrs outside the pool are ignored and an out-of-range
+// current index is reset. Redacted passwords are taken from the node with
+// the same addr and user in the current pool, when there is one.
+func (m *ProxyManager) Import(st ManagerState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := make(map[string]ProxyNode, len(m.pool))
+	for _, n := range m.pool {
+		current[n.Addr()] = n
+	}
+	pool := make([]ProxyNode, 0, len(st.Pool))
+	inPool := make(map[string]struct{}, len(st.Pool))
+	for _, n := range st.Pool {
+		if !SupportedProxyType(n.Type) || n.Addr() == "" {
+			continue
+		}
+		if n.Pass == RedactedPassword {
+			if cur, ok := current[n.Addr()]; ok && cur.User == n.User {
+				n.Pass = cur.Pass
+			}
+		}
+		pool = append(pool, n)
+		inPool[n.Addr()] = struct{}{}
+	}
+	m.pool = pool
+	m.recountLocked()
+	m.pruneStateLocked()
+
+	m.currentIndex = st.CurrentIndex
+	if m.currentIndex >= len(m.pool) || m.currentIndex < -1 {
+		m.currentIndex = 0
+	}
+
+	m.failures = make(map[string]int, 128)
+	for k, v := range st.Failures {
+		if _, ok := inPool[k]; ok && v > 0 {
+			m.failures[k] = v
+		}
+	}
+	m.openUntil = nil
+	for k, v := range st.OpenUntil {
+		if _, ok := inPool[k]; !ok {
+			continue
+		}
+		if m.openUntil == nil {
+			m.openUntil = make(map[string]time.Time)
+		}
+		m.openUntil[k] = v
+	}
+
+	m.lastRefreshAt = st.LastRefreshAt
+	m.lastRefreshErr = st.LastRefreshErr
+	m.lastSuccessAt = st.LastSuccessAt
+}
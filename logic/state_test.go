@@ -0,0 +1,108 @@
+package logic
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestManagerStateRoundTrip(t *testing.T) {
+	a, b, c := node("203.0.113.1", "1080", 10), node("203.0.113.2", "1080", 20), node("203.0.113.3", "1080", 30)
+	a.User, a.Pass = "alice", "s3cret"
+	src := breakerManager(t, a, b, c)
+	src.ReportFailure(b, 0)
+	src.ReportFailure(c, 0)
+	src.ReportFailure(c, 0) // opens c's circuit
+	src.SetCurrentByAddr(b.Addr())
+
+	blob, err := json.Marshal(src.Export())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st ManagerState
+	if err := json.Unmarshal(blob, &st); err != nil {
+		t.Fatal(err)
+	}
+	dst := breakerManager(t)
+	dst.Import(st)
+
+	got := dst.Export()
+	if len(got.Pool) != 3 || got.Pool[0].Pass != "s3cret" {
+		t.Fatalf("imported pool = %+v, want all three nodes with credentials", got.Pool)
+	}
+	if cur, ok := dst.Current(); !ok || cur.Addr() != b.Addr() {
+		t.Errorf("current = %s, %v; want %s", cur.Addr(), ok, b.Addr())
+	}
+	if got.Failures[b.Addr()] != 1 {
+		t.Errorf("failures = %v, want %s at 1", got.Failures, b.Addr())
+	}
+	if until, ok := got.OpenUntil[c.Addr()]; !ok || !until.After(time.Now()) {
+		t.Errorf("open_until = %v, want %s quarantined", got.OpenUntil, c.Addr())
+	}
+}
+
+func TestManagerStateImportRedacted(t *testing.T) {
+	a := node("203.0.113.1", "1080", 0)
+	a.User, a.Pass = "alice", "s3cret"
+	b := node("203.0.113.2", "1080", 0)
+	b.User, b.Pass = "bob", "hunter2"
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{a, b})
+
+	st := m.Export().Redacted()
+	st.Pool[1].User = "mallory" // a different user does not get bob's password
+	m.Import(st)
+	pool := m.PoolSnapshot(0)
+	if pool[0].Pass != "s3cret" {
+		t.Errorf("alice's password = %q, want it kept", pool[0].Pass)
+	}
+	if pool[1].Pass != RedactedPassword {
+		t.Errorf("mallory's password = %q, want it left redacted", pool[1].Pass)
+	}
+}
+
+// TestManagerStateOlderFixture imports a document written before failure
+// counts and quarantines were exported, with a field this version no longer
+// knows about.
+func TestManagerStateOlderFixture(t *testing.T) {
+	const fixture = `{
+		"pool": [
+			{"id": "203.0.113.1:1080", "type": "socks5", "ip": "203.0.113.1", "port": "1080", "latency_ms": 12},
+			{"id": "203.0.113.2:8080", "type": "gopher", "ip": "203.0.113.2", "port": "8080"},
+			{"id": "203.0.113.3:3128", "type": "http", "ip": "203.0.113.3", "port": "3128"}
+		],
+		"current_index": 7,
+		"scores": {"203.0.113.1:1080": 0.9}
+	}`
+	var st ManagerState
+	if err := json.Unmarshal([]byte(fixture), &st); err != nil {
+		t.Fatalf("unmarshal older fixture: %v", err)
+	}
+	m := breakerManager(t, node("198.51.100.1", "1080", 0))
+	m.ReportFailure(node("198.51.100.1", "1080", 0), 0)
+	m.Import(st)
+
+	got := m.Export()
+	if len(got.Pool) != 2 || got.Pool[0].Addr() != "203.0.113.1:1080" || got.Pool[1].Type != ProxyTypeHTTP {
+		t.Fatalf("pool = %+v, want the socks5 and http nodes only", got.Pool)
+	}
+	if got.CurrentIndex != 0 {
+		t.Errorf("current index = %d, want an out-of-range index reset to 0", got.CurrentIndex)
+	}
+	if len(got.Failures) != 0 || len(got.OpenUntil) != 0 {
+		t.Errorf("failures = %v, open_until = %v; want the missing fields defaulted to empty", got.Failures, got.OpenUntil)
+	}
+}
+
+func TestRefresherIfIdle(t *testing.T) {
+	r := NewRefresher([]*ProxyManager{NewProxyManager()}, nil, nil, ValidationConfig{}, time.Second)
+	r.mu.Lock() // as Refresh holds it
+	if r.IfIdle(func() { t.Error("fn ran during a refresh") }) {
+		t.Error("IfIdle() = true during a refresh")
+	}
+	r.mu.Unlock()
+	ran := false
+	if !r.IfIdle(func() { ran = true }) || !ran {
+		t.Error("IfIdle() did not run fn while idle")
+	}
+}
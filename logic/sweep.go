@@ -0,0 +1,148 @@
+package logic
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencySweepConfig configures a LatencySweeper.
+type LatencySweepConfig struct {
+	// Every is the time between batches; each batch measures up to
+	// Concurrency nodes (default 4).
+	Every       time.Duration
+	Concurrency int
+	TestAddr    string
+	Timeout     time.Duration
+}
+
+// LatencySweeper re-measures pool latencies a few nodes at a time, cycling
+// through the pool across ticks. Unlike validation it never removes a node for
+// being slow or for a failed target connect; only proxies that cannot be
+// reached at all count as failures.
+type LatencySweeper struct {
+	managers []*ProxyManager
+	cfg      LatencySweepConfig
+
+	// Logger, when set before Run, receives a summary line per full pass.
+	Logger *log.Logger
+
+	mu       sync.Mutex
+	cursor   int
+	measured int
+	deltas   []int64
+}
+
+// NewLatencySweeper sweeps the pool of managers[0] and records the results in
+// every manager, which share one pool after a refresh.
+func NewLatencySweeper(managers []*ProxyManager, cfg LatencySweepConfig) *LatencySweeper {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 4
+	}
+	if cfg.Timeout <= 0 || cfg.Timeout > 10*time.Second {
+		cfg.Timeout = 10 * time.Second
+	}
+	return &LatencySweeper{managers: append([]*ProxyManager(nil), managers...), cfg: cfg}
+}
+
+// Run sweeps one batch per cfg.Every until ctx is done.
+func (s *LatencySweeper) Run(ctx context.Context) {
+	if s == nil || s.cfg.Every <= 0 || len(s.managers) == 0 {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.Every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweepBatch(ctx)
+		}
+	}
+}
+
+func (s *LatencySweeper) sweepBatch(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pool := s.managers[0].PoolSnapshot(0)
+	if len(pool) == 0 {
+		return
+	}
+	if s.cursor >= len(pool) {
+		// The pool shrank since the last batch; start a new pass.
+		s.cursor = 0
+	}
+	var batch []ProxyNode
+	for s.cursor < len(pool) && len(batch) < s.cfg.Concurrency {
+		n := pool[s.cursor]
+		s.cursor++
+		if s.managers[0].CircuitOpen(n.Addr()) {
+			continue
+		}
+		batch = append(batch, n)
+	}
+
+	type result struct {
+		node   ProxyNode
+		timing ProbeTiming
+		err    error
+	}
+	results := make([]result, len(batch))
+	var wg sync.WaitGroup
+	for i, n := range batch {
+		wg.Add(1)
+		go func(i int, n ProxyNode) {
+			defer wg.Done()
+			_, timing, err := CheckSOCKS5TCP(ctx, n, s.cfg.TestAddr, s.managers[0].DialTimeout(n, s.cfg.Timeout))
+			results[i] = result{node: n, timing: timing, err: err}
+		}(i, n)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	for _, r := range results {
+		if r.err != nil {
+			if proxyUnreachable(r.err) {
+				for _, m := range s.managers {
+					m.ReportFailure(r.node, 2)
+				}
+			}
+			continue
+		}
+		for _, m := range s.managers {
+			m.UpdateLatency(r.node.Addr(), r.timing)
+		}
+		s.measured++
+		if r.node.HandshakeMS > 0 {
+			s.deltas = append(s.deltas, r.timing.HandshakeMS-r.node.HandshakeMS)
+		}
+	}
+
+	if s.cursor >= len(pool) {
+		if s.Logger != nil {
+			var median int64
+			if len(s.deltas) > 0 {
+				sort.Slice(s.deltas, func(i, j int) bool { return s.deltas[i] < s.deltas[j] })
+				median = percentile(s.deltas, 50)
+			}
+			s.Logger.Printf("latency sweep: %d/%d nodes measured, median handshake delta %+dms", s.measured, len(pool), median)
+		}
+		s.cursor, s.measured, s.deltas = 0, 0, s.deltas[:0]
+	}
+}
+
+// proxyUnreachable reports whether err means the proxy itself could not be
+// reached, as opposed to a slow or failing target.
+func proxyUnreachable(err error) bool {
+	switch DialErrorCategory(err) {
+	case DialErrRefused, DialErrProxy:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package logic
+
+import (
+	"slices"
+	"strings"
+)
+
+// NormalizeTags trims and lowercases tags, drops empty ones and returns the
+// rest sorted without duplicates; nil when none remain.
+func NormalizeTags(tags []string) []string {
+	var out []string
+	for _, t := range tags {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			out = append(out, t)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// HasTag reports whether n carries tag, compared case-insensitively.
+func (n ProxyNode) HasTag(tag string) bool {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	return slices.Contains(n.Tags, tag)
+}
+
+// FilterByTag returns the nodes carrying tag, or nodes itself when tag is
+// empty.
+func FilterByTag(nodes []ProxyNode, tag string) []ProxyNode {
+	if tag == "" {
+		return nodes
+	}
+	out := make([]ProxyNode, 0, len(nodes))
+	for _, n := range nodes {
+		if n.HasTag(tag) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// mergeTags is the union of a and b.
+func mergeTags(a, b []string) []string {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+	return NormalizeTags(append(slices.Clone(a), b...))
+}
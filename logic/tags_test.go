@@ -0,0 +1,106 @@
+package logic
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{" ", ""}, nil},
+		{[]string{"Paid", " eu ", "paid", "DataCenter"}, []string{"datacenter", "eu", "paid"}},
+	}
+	for _, tt := range tests {
+		if got := NormalizeTags(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NormalizeTags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSpecTags(t *testing.T) {
+	n, ok := ParseProxySpec("socks5://203.0.113.1:1080#tag=Residential,eu&tag=paid", "auto")
+	if !ok {
+		t.Fatal("ParseProxySpec rejected a tagged spec")
+	}
+	if want := []string{"eu", "paid", "residential"}; !reflect.DeepEqual(n.Tags, want) {
+		t.Errorf("Tags = %q, want %q", n.Tags, want)
+	}
+	if !n.HasTag(" EU ") || n.HasTag("datacenter") {
+		t.Errorf("HasTag disagrees with Tags %q", n.Tags)
+	}
+	if _, ok := ParseProxySpec("socks5://203.0.113.1:1080#color=red", "auto"); ok {
+		t.Error("ParseProxySpec accepted an unknown fragment option")
+	}
+}
+
+func TestTagsSurviveDedupe(t *testing.T) {
+	a := node("203.0.113.1", "1080", 0)
+	a.Tags = []string{"paid"}
+	b := node("203.0.113.1", "1080", 0)
+	b.Tags = []string{"eu"}
+	got := MergeDedup([]ProxyNode{a}, []ProxyNode{b})
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Tags, []string{"eu", "paid"}) {
+		t.Errorf("MergeDedup() = %+v, want one node tagged eu and paid", got)
+	}
+}
+
+func TestNextWithTag(t *testing.T) {
+	a, b, c := node("203.0.113.1", "1080", 0), node("203.0.113.2", "1080", 0), node("203.0.113.3", "1080", 0)
+	b.Tags, c.Tags = []string{"paid"}, []string{"paid"}
+	m := NewProxyManager()
+	m.SetPool([]ProxyNode{a, b, c})
+	for _, want := range []ProxyNode{b, c, b} {
+		if n, ok := m.NextWithTag("PAID"); !ok || n.Addr() != want.Addr() {
+			t.Fatalf("NextWithTag() = %s, %v; want %s", n.Addr(), ok, want.Addr())
+		}
+	}
+	if n, ok := m.NextWithTag("free"); ok {
+		t.Errorf("NextWithTag(free) = %s, want no node", n.Addr())
+	}
+	if got := FilterByTag(m.PoolSnapshot(0), "paid"); len(got) != 2 {
+		t.Errorf("FilterByTag() kept %d nodes, want 2", len(got))
+	}
+}
+
+func TestRefresherAdd(t *testing.T) {
+	fixed, auto := NewProxyManager(), NewProxyManager()
+	fixed.SetPool([]ProxyNode{node("203.0.113.1", "1080", 0)})
+	auto.SetPool([]ProxyNode{node("203.0.113.1", "1080", 0)})
+	r := NewRefresher([]*ProxyManager{fixed, auto}, nil, nil, ValidationConfig{}, 0)
+
+	tagged := node("1.2.3.4", "1080", 0) // public: the private filter is on
+	tagged.Tags = []string{"eu"}
+	added, err := r.Add(context.Background(), []ProxyNode{
+		tagged,
+		node("10.0.0.1", "1080", 0), // private
+		{Type: ProxyTypeSOCKS4, IP: "1.2.3.5", Port: "1080"},
+	}, []string{"Paid"}, false)
+	if err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	if len(added) != 1 || added[0].Addr() != tagged.Addr() {
+		t.Fatalf("Add() added %+v, want only %s", added, tagged.Addr())
+	}
+	for name, m := range map[string]*ProxyManager{"fixed": fixed, "auto": auto} {
+		n, ok := m.Lookup(tagged.Addr())
+		if !ok {
+			t.Errorf("%s: added node not in the pool", name)
+			continue
+		}
+		if !reflect.DeepEqual(n.Tags, []string{"eu", "paid"}) || n.Source != SourceAPI {
+			t.Errorf("%s: added node = %+v, want tags eu, paid from %s", name, n, SourceAPI)
+		}
+		if m.PoolSize() != 2 {
+			t.Errorf("%s: PoolSize() = %d, want 2", name, m.PoolSize())
+		}
+	}
+
+	if _, err := r.Add(context.Background(), []ProxyNode{node("10.0.0.1", "1080", 0)}, nil, false); err == nil {
+		t.Error("Add() of only private nodes succeeded")
+	}
+}
@@ -0,0 +1,175 @@
+package logic
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TargetMatcher matches destination hosts against exact host names,
+// wildcard domains ("*.example.com" matches subdomains only, ".example.com"
+// the domain and its subdomains), IPs and CIDRs. Host names are matched by
+// name and never resolved.
+type TargetMatcher struct {
+	hosts    map[string]struct{}
+	suffixes []string
+	apexes   map[string]struct{}
+	nets     []*net.IPNet
+}
+
+// NewTargetMatcher compiles patterns. A nil matcher matches nothing.
+func NewTargetMatcher(patterns []string) (*TargetMatcher, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	m := &TargetMatcher{hosts: map[string]struct{}{}, apexes: map[string]struct{}{}}
+	for _, p := range patterns {
+		// A trailing dot (a fully qualified name) is dropped like in Match.
+		p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), ".")
+		switch {
+		case p == "":
+			continue
+		case strings.Contains(p, "/"):
+			_, n, err := net.ParseCIDR(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %w", p, err)
+			}
+			m.nets = append(m.nets, n)
+		case net.ParseIP(p) != nil:
+			ip := net.ParseIP(p)
+			bits := 8 * len(ip.To16())
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			m.nets = append(m.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case strings.HasPrefix(p, "*."):
+			m.suffixes = append(m.suffixes, p[1:])
+		case strings.HasPrefix(p, "."):
+			m.suffixes = append(m.suffixes, p)
+			m.apexes[p[1:]] = struct{}{}
+		default:
+			m.hosts[p] = struct{}{}
+		}
+	}
+	return m, nil
+}
+
+// Match reports whether host (a name or IP literal, without port) matches.
+func (m *TargetMatcher) Match(host string) bool {
+	if m == nil {
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range m.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if _, ok := m.hosts[host]; ok {
+		return true
+	}
+	if _, ok := m.apexes[host]; ok {
+		return true
+	}
+	for _, s := range m.suffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetBlockedError is returned for destinations rejected by a TargetPolicy.
+type TargetBlockedError struct {
+	Host string
+}
+
+func (e *TargetBlockedError) Error() string { return "target not allowed: " + e.Host }
+
+// maxBlockedHosts bounds the per-host blocked counters.
+const maxBlockedHosts = 100
+
+// TargetPolicy enforces a destination blocklist and optional allowlist. When
+// the allowlist is set, only matching targets pass; the blocklist always wins.
+type TargetPolicy struct {
+	Allow *TargetMatcher
+	Block *TargetMatcher
+	// TrackHosts records the blocked host names in Stats.
+	TrackHosts bool
+
+	blocked atomic.Int64
+	mu      sync.Mutex
+	hosts   map[string]int64
+}
+
+func NewTargetPolicy(allow, block []string) (*TargetPolicy, error) {
+	a, err := NewTargetMatcher(allow)
+	if err != nil {
+		return nil, fmt.Errorf("target_allowlist: %w", err)
+	}
+	b, err := NewTargetMatcher(block)
+	if err != nil {
+		return nil, fmt.Errorf("target_blocklist: %w", err)
+	}
+	return &TargetPolicy{Allow: a, Block: b}, nil
+}
+
+// Check returns a *TargetBlockedError when addr (host:port or host) is not
+// allowed. A nil policy allows everything.
+func (p *TargetPolicy) Check(addr string) error {
+	if p == nil || (p.Allow == nil && p.Block == nil) {
+		return nil
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if p.Block.Match(host) || (p.Allow != nil && !p.Allow.Match(host)) {
+		p.record(host)
+		return &TargetBlockedError{Host: host}
+	}
+	return nil
+}
+
+func (p *TargetPolicy) record(host string) {
+	p.blocked.Add(1)
+	if !p.TrackHosts {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hosts == nil {
+		p.hosts = make(map[string]int64)
+	}
+	if _, ok := p.hosts[host]; !ok && len(p.hosts) >= maxBlockedHosts {
+		return
+	}
+	p.hosts[host]++
+}
+
+// TargetPolicyStats is the blocked-attempt counters of a TargetPolicy.
+type TargetPolicyStats struct {
+	Blocked int64            `json:"blocked"`
+	Hosts   map[string]int64 `json:"hosts,omitempty"`
+}
+
+func (p *TargetPolicy) Stats() TargetPolicyStats {
+	if p == nil {
+		return TargetPolicyStats{}
+	}
+	st := TargetPolicyStats{Blocked: p.blocked.Load()}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.hosts) > 0 {
+		st.Hosts = make(map[string]int64, len(p.hosts))
+		for h, n := range p.hosts {
+			st.Hosts[h] = n
+		}
+	}
+	return st
+}
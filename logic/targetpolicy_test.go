@@ -0,0 +1,155 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestTargetMatcher(t *testing.T) {
+	m, err := NewTargetMatcher([]string{
+		"10.0.0.0/8",
+		"192.0.2.7",
+		"2001:db8::/32",
+		"::1",
+		"*.wild.example",
+		".apex.example",
+		"Exact.Example.",
+		"*.fqdn.example.",
+		"  ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		// IPs and CIDRs match by address, never by name.
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"::ffff:10.1.2.3", true},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"2001:db8::1", true},
+		{"[2001:db8::1]", true},
+		{"[2001:db9::1]", false},
+		{"::1", true},
+		{"[::1]", true},
+		{"0:0:0:0:0:0:0:1", true},
+		// "*.x" matches subdomains only, ".x" the domain too.
+		{"a.wild.example", true},
+		{"a.b.wild.example", true},
+		{"wild.example", false},
+		{"notwild.example", false},
+		{"apex.example", true},
+		{"a.apex.example", true},
+		{"badapex.example", false},
+		// Names are case-insensitive and a trailing dot is ignored, in
+		// hosts and patterns alike.
+		{"exact.example", true},
+		{"EXACT.EXAMPLE.", true},
+		{"a.exact.example", false},
+		{"A.Wild.Example.", true},
+		{"a.fqdn.example", true},
+		{"fqdn.example", false},
+		// Names are not resolved.
+		{"localhost", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	var none *TargetMatcher
+	if none.Match("10.0.0.1") {
+		t.Error("nil matcher matched")
+	}
+	if m, err := NewTargetMatcher(nil); m != nil || err != nil {
+		t.Errorf("NewTargetMatcher(nil) = %v, %v; want nil", m, err)
+	}
+	for _, bad := range []string{"10.0.0.0/33", "example.com/8"} {
+		if _, err := NewTargetMatcher([]string{bad}); err == nil {
+			t.Errorf("NewTargetMatcher(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestTargetPolicyCheck(t *testing.T) {
+	p, err := NewTargetPolicy([]string{".example.com", "203.0.113.0/24"}, []string{"admin.example.com", "203.0.113.9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"example.com:443", true},
+		{"www.example.com:80", true},
+		{"203.0.113.5:22", true},
+		{"[203.0.113.5]:22", true},
+		{"www.example.com", true},
+		// Not on the allowlist.
+		{"example.org:443", false},
+		{"198.51.100.1:443", false},
+		// The blocklist wins over the allowlist.
+		{"admin.example.com:443", false},
+		{"ADMIN.example.com.:443", false},
+		{"203.0.113.9:80", false},
+	}
+	for _, tt := range tests {
+		err := p.Check(tt.addr)
+		var blocked *TargetBlockedError
+		if got := !errors.As(err, &blocked); got != tt.allowed {
+			t.Errorf("Check(%s) = %v, want allowed %v", tt.addr, err, tt.allowed)
+		}
+	}
+	if st := p.Stats(); st.Blocked != 5 || st.Hosts != nil {
+		t.Errorf("Stats() = %+v, want 5 blocked and no hosts tracked", st)
+	}
+
+	blockOnly, err := NewTargetPolicy(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockOnly.Check("10.1.1.1:80") == nil || blockOnly.Check("example.org:80") != nil {
+		t.Error("a blocklist without an allowlist must only block matches")
+	}
+	var none *TargetPolicy
+	if none.Check("10.1.1.1:80") != nil {
+		t.Error("nil policy blocked")
+	}
+	if _, err := NewTargetPolicy([]string{"1.2.3.4/99"}, nil); err == nil {
+		t.Error("NewTargetPolicy accepted a bad allowlist CIDR")
+	}
+}
+
+func TestTargetPolicyTrackHostsCap(t *testing.T) {
+	p, err := NewTargetPolicy(nil, []string{".blocked.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.TrackHosts = true
+	for i := 0; i < maxBlockedHosts+20; i++ {
+		_ = p.Check(fmt.Sprintf("h%d.blocked.example:443", i))
+	}
+	// Hosts already tracked keep counting once the table is full.
+	_ = p.Check("h0.blocked.example:443")
+	_ = p.Check("late.blocked.example:443")
+
+	st := p.Stats()
+	if st.Blocked != maxBlockedHosts+22 {
+		t.Errorf("Blocked = %d, want %d", st.Blocked, maxBlockedHosts+22)
+	}
+	if len(st.Hosts) != maxBlockedHosts {
+		t.Errorf("tracking %d hosts, want the cap of %d", len(st.Hosts), maxBlockedHosts)
+	}
+	if st.Hosts["h0.blocked.example"] != 2 {
+		t.Errorf("h0 count = %d, want 2", st.Hosts["h0.blocked.example"])
+	}
+	if _, ok := st.Hosts["late.blocked.example"]; ok {
+		t.Error("tracked a host past the cap")
+	}
+}
@@ -0,0 +1,49 @@
+package logic
+
+import "time"
+
+// DialTimeoutConfig derives per-node dial timeouts from live latency: a
+// node's timeout is Multiplier times its EWMA dial latency (see RecordDial),
+// clamped to [Min, Max]. A zero Multiplier disables it.
+type DialTimeoutConfig struct {
+	Multiplier float64
+	Min        time.Duration
+	Max        time.Duration
+}
+
+func (m *ProxyManager) SetDialTimeouts(cfg DialTimeoutConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeouts = cfg
+}
+
+// DialTimeout returns the timeout for dialing through n: its
+// DialTimeoutMS override, else the adaptive timeout when n has live
+// latency, else fallback.
+func (m *ProxyManager) DialTimeout(n ProxyNode, fallback time.Duration) time.Duration {
+	if n.DialTimeoutMS > 0 {
+		return time.Duration(n.DialTimeoutMS) * time.Millisecond
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.dialTimeoutLocked(n.Addr(), fallback)
+}
+
+func (m *ProxyManager) dialTimeoutLocked(addr string, fallback time.Duration) time.Duration {
+	cfg := m.timeouts
+	if cfg.Multiplier <= 0 {
+		return fallback
+	}
+	st := m.live[addr]
+	if st == nil || st.latencyMS <= 0 {
+		return fallback
+	}
+	d := time.Duration(cfg.Multiplier * st.latencyMS * float64(time.Millisecond))
+	if cfg.Min > 0 && d < cfg.Min {
+		d = cfg.Min
+	}
+	if cfg.Max > 0 && d > cfg.Max {
+		d = cfg.Max
+	}
+	return d
+}
@@ -2,24 +2,158 @@ package logic
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Probe methods for ProtocolTest.Method.
+const (
+	// ProbeConnect only opens a tunnel to the target.
+	ProbeConnect = "connect"
+	// ProbeResponse sends a HEAD request through the tunnel and waits for a
+	// reply (see CheckSOCKS5Forwarding).
+	ProbeResponse = "response"
+)
+
+// Target orders for ProtocolTest.Order.
+const (
+	TargetOrderRoundRobin = "round_robin"
+	TargetOrderRandom     = "random"
+)
+
+// ProtocolTest is how proxies of one type are probed: the target(s), whether
+// to complete a TLS handshake through the tunnel, and the probe method.
+type ProtocolTest struct {
+	// Target and Targets entries may be port ranges or comma-separated
+	// lists (see ExpandTarget); ApplyDefaults expands them into Targets.
+	Target string `json:"target,omitempty"`
+	// Targets spreads probes across several targets in Order. Falls back
+	// to Target.
+	Targets []string `json:"targets,omitempty"`
+	// Order is TargetOrderRoundRobin (default) or TargetOrderRandom.
+	Order string `json:"order,omitempty"`
+	// TLS defaults to true for port 443 targets.
+	TLS    *bool  `json:"tls,omitempty"`
+	Method string `json:"method,omitempty"`
+}
+
+// TLSFor reports whether probes to target complete a TLS handshake.
+func (t ProtocolTest) TLSFor(target string) bool {
+	if t.TLS != nil {
+		return *t.TLS
+	}
+	_, _, port, err := ParseTargetAddr(target)
+	if err != nil {
+		return false
+	}
+	return port == "443"
+}
+
+// TestTargets returns the probe destinations in rotation order.
+func (t ProtocolTest) TestTargets() []string {
+	if len(t.Targets) > 0 {
+		return append([]string(nil), t.Targets...)
+	}
+	return []string{t.Target}
+}
+
 type ValidationConfig struct {
 	Enabled        bool   `json:"enabled"`
 	SOCKS5TestAddr string `json:"socks5_test_addr"`
 	SOCKS5TLSVerify *bool `json:"socks5_tls_verify,omitempty"`
 	MaxSOCKS5      int    `json:"max_socks5"`
 	Concurrency    int    `json:"concurrency"`
+	// AdaptiveConcurrency starts probing at a quarter of Concurrency and
+	// adapts to timeouts between MinConcurrency (default 4) and Concurrency:
+	// halving when most probes time out, ramping up while few do.
+	AdaptiveConcurrency bool `json:"adaptive_concurrency,omitempty"`
+	MinConcurrency      int  `json:"min_concurrency,omitempty"`
+
+	// SOCKS5TestAddrs spreads probes round-robin across several targets so no
+	// single destination sees the full burst. Falls back to SOCKS5TestAddr.
+	SOCKS5TestAddrs []string `json:"socks5_test_addrs,omitempty"`
+	// SOCKS5TestOrder is how probes pick among the socks5 targets:
+	// TargetOrderRoundRobin (default) or TargetOrderRandom.
+	SOCKS5TestOrder string `json:"socks5_test_order,omitempty"`
+	// ProbesPerSecond caps probe starts across all workers (0 = unlimited).
+	ProbesPerSecond float64 `json:"probes_per_second,omitempty"`
+	// RankBy selects the sort key for validated nodes: "handshake" (default) or "latency".
+	RankBy string `json:"rank_by,omitempty"`
+	// MaxPortsPerIP caps how many candidates one host may contribute (0 = unlimited).
+	MaxPortsPerIP int `json:"max_ports_per_ip,omitempty"`
+	// CandidateMultiplier * MaxSOCKS5 candidates are tested (default 10), up
+	// to CandidateCap (default 5000, or 2000 when MaxSOCKS5 is unlimited).
+	CandidateMultiplier int `json:"candidate_multiplier,omitempty"`
+	CandidateCap        int `json:"candidate_cap,omitempty"`
+	// SelectFastest collects 2*MaxSOCKS5 valid nodes and keeps the
+	// MaxSOCKS5 with the lowest latency instead of the first to pass.
+	SelectFastest bool `json:"select_fastest,omitempty"`
+	// Candidates are shuffled before the candidate limit is applied. A
+	// non-zero ShuffleSeed makes the order reproducible.
+	ShuffleSeed int64 `json:"shuffle_seed,omitempty"`
+	// PreferNew tests addresses missing from the previous pool first.
+	PreferNew bool `json:"prefer_new,omitempty"`
+	// ExpectURL and ExpectSHA256 enable a content check after the
+	// connectivity probe: the body fetched through the proxy must hash to
+	// ExpectSHA256 (hex), which drops proxies that inject or redirect.
+	ExpectURL    string `json:"expect_url,omitempty"`
+	ExpectSHA256 string `json:"expect_sha256,omitempty"`
+	// ExitIPURL, when set, is fetched through every node that passed to
+	// record its ExitIP; it must answer with the bare address, like
+	// https://api.ipify.org. Nodes that cannot fetch it fail. DedupeExitIP
+	// then keeps only the fastest node per exit IP.
+	ExitIPURL    string `json:"exit_ip_url,omitempty"`
+	DedupeExitIP bool   `json:"dedupe_exit_ip,omitempty"`
+	// RequireResponse makes plain TCP probes send a HEAD request and wait for
+	// a reply, failing proxies that open tunnels but forward nothing.
+	RequireResponse bool `json:"require_response,omitempty"`
+	// TLSServerName overrides the SNI of TLS probes, which is the target's
+	// host by default. TLSMinVersion ("1.0" to "1.3") raises or lowers the
+	// lowest version they offer; empty keeps the crypto/tls default.
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	TLSMinVersion string `json:"tls_min_version,omitempty"`
+	// Tests holds the probe settings per proxy type. The socks5 entry
+	// defaults to the socks5_* fields and require_response above.
+	Tests map[string]ProtocolTest `json:"tests,omitempty"`
 }
 
 func (c *ValidationConfig) ApplyDefaults() {
+	addrs := c.SOCKS5TestAddrs[:0:0]
+	for _, a := range c.SOCKS5TestAddrs {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	c.SOCKS5TestAddrs = addrs
+	if c.SOCKS5TestAddr == "" && len(c.SOCKS5TestAddrs) > 0 {
+		c.SOCKS5TestAddr = c.SOCKS5TestAddrs[0]
+	}
 	if c.SOCKS5TestAddr == "" {
 		c.SOCKS5TestAddr = "example.com:443"
 	}
+	if c.ProbesPerSecond < 0 {
+		c.ProbesPerSecond = 0
+	}
+	if c.RankBy == "" {
+		c.RankBy = RankByHandshake
+	}
+	if c.MaxPortsPerIP < 0 {
+		c.MaxPortsPerIP = 0
+	}
+	c.ExpectURL = strings.TrimSpace(c.ExpectURL)
+	c.ExpectSHA256 = strings.ToLower(strings.TrimSpace(c.ExpectSHA256))
+	c.ExitIPURL = strings.TrimSpace(c.ExitIPURL)
 	if c.MaxSOCKS5 == 0 {
 		c.MaxSOCKS5 = 200
 	}
@@ -29,110 +163,545 @@ func (c *ValidationConfig) ApplyDefaults() {
 	if c.Concurrency > 256 {
 		c.Concurrency = 256
 	}
+	if c.MinConcurrency <= 0 {
+		c.MinConcurrency = 4
+	}
+	if c.MinConcurrency > c.Concurrency {
+		c.MinConcurrency = c.Concurrency
+	}
+
+	tests := make(map[string]ProtocolTest, len(c.Tests)+1)
+	for typ, t := range c.Tests {
+		tests[strings.ToLower(strings.TrimSpace(typ))] = t.withDefaults()
+	}
+	socks, ok := tests[ProxyTypeSOCKS5]
+	if !ok {
+		socks = ProtocolTest{Target: c.SOCKS5TestAddr, Targets: c.SOCKS5TestAddrs, TLS: c.SOCKS5TLSVerify, Order: c.SOCKS5TestOrder}
+		if c.RequireResponse {
+			socks.Method = ProbeResponse
+		}
+	}
+	if socks.Target == "" && len(socks.Targets) == 0 {
+		socks.Target, socks.Targets = c.SOCKS5TestAddr, c.SOCKS5TestAddrs
+	}
+	tests[ProxyTypeSOCKS5] = socks.withDefaults()
+	c.Tests = tests
 }
 
-func (c ValidationConfig) TLSVerifyEnabled() bool {
-	if c.SOCKS5TLSVerify != nil {
-		return *c.SOCKS5TLSVerify
+// withDefaults expands ranges and lists in Target and Targets. Specs that
+// do not parse are kept as written for Validate to report.
+func (t ProtocolTest) withDefaults() ProtocolTest {
+	t.Target = strings.TrimSpace(t.Target)
+	targets := t.Targets[:0:0]
+	for _, a := range t.Targets {
+		if a = strings.TrimSpace(a); a != "" {
+			targets = append(targets, expandOrKeep(a)...)
+		}
 	}
-	_, _, port, err := ParseTargetAddr(c.SOCKS5TestAddr)
-	if err != nil {
-		return false
+	if t.Target != "" {
+		if expanded := expandOrKeep(t.Target); len(expanded) > 1 {
+			t.Target = expanded[0]
+			if len(targets) == 0 {
+				targets = expanded
+			}
+		}
 	}
-	return port == "443"
+	t.Targets = targets
+	if t.Target == "" && len(t.Targets) > 0 {
+		t.Target = t.Targets[0]
+	}
+	if t.Target == "" {
+		t.Target = "example.com:443"
+	}
+	t.Method = strings.ToLower(strings.TrimSpace(t.Method))
+	if t.Method == "" {
+		t.Method = ProbeConnect
+	}
+	t.Order = strings.ToLower(strings.TrimSpace(t.Order))
+	if t.Order == "" {
+		t.Order = TargetOrderRoundRobin
+	}
+	return t
+}
+
+func expandOrKeep(spec string) []string {
+	if expanded, err := ExpandTarget(spec); err == nil {
+		return expanded
+	}
+	return []string{spec}
+}
+
+// Validate reports unknown probe methods and orders, and malformed targets.
+func (c ValidationConfig) Validate() error {
+	if err := validateTargets("socks5_test_addr", c.SOCKS5TestAddr); err != nil {
+		return err
+	}
+	if err := validateTargets("socks5_test_addrs", c.SOCKS5TestAddrs...); err != nil {
+		return err
+	}
+	if err := validateTargetOrder("socks5_test_order", c.SOCKS5TestOrder); err != nil {
+		return err
+	}
+	if _, err := ParseTLSVersion(c.TLSMinVersion); err != nil {
+		return fmt.Errorf("tls_min_version: %w", err)
+	}
+	if c.ExpectSHA256 != "" {
+		if c.ExpectURL == "" {
+			return fmt.Errorf("expect_url is required with expect_sha256")
+		}
+		if b, err := hex.DecodeString(c.ExpectSHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("expect_sha256 must be a hex SHA-256 digest")
+		}
+	}
+	if c.ExitIPURL != "" {
+		if p, err := url.Parse(c.ExitIPURL); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("exit_ip_url must be an http(s) URL")
+		}
+	} else if c.DedupeExitIP {
+		return fmt.Errorf("exit_ip_url is required with dedupe_exit_ip")
+	}
+	for typ, t := range c.Tests {
+		switch strings.ToLower(strings.TrimSpace(t.Method)) {
+		case "", ProbeConnect, ProbeResponse:
+		default:
+			return fmt.Errorf("tests.%s.method must be %q or %q", typ, ProbeConnect, ProbeResponse)
+		}
+		if err := validateTargetOrder("tests."+typ+".order", t.Order); err != nil {
+			return err
+		}
+		if err := validateTargets("tests."+typ+".target", t.Target); err != nil {
+			return err
+		}
+		if err := validateTargets("tests."+typ+".targets", t.Targets...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateTargets(field string, specs ...string) error {
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		if _, err := ExpandTarget(spec); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+func validateTargetOrder(field, order string) error {
+	switch strings.ToLower(strings.TrimSpace(order)) {
+	case "", TargetOrderRoundRobin, TargetOrderRandom:
+		return nil
+	}
+	return fmt.Errorf("%s must be %q or %q", field, TargetOrderRoundRobin, TargetOrderRandom)
+}
+
+// NextTarget picks the target of probe number seq (counting from 0).
+func (t ProtocolTest) NextTarget(targets []string, seq uint64) string {
+	if t.Order == TargetOrderRandom {
+		return targets[rand.Intn(len(targets))]
+	}
+	return targets[seq%uint64(len(targets))]
+}
+
+// TestFor returns the probe settings for proxies of type typ, falling back to
+// the socks5 ones. Call ApplyDefaults first.
+func (c ValidationConfig) TestFor(typ string) ProtocolTest {
+	if t, ok := c.Tests[typ]; ok {
+		return t
+	}
+	return c.Tests[ProxyTypeSOCKS5]
+}
+
+// TLSProbe returns the handshake options of TLS probes. Call Validate
+// first: an unknown TLSMinVersion is treated as unset.
+func (c ValidationConfig) TLSProbe() TLSProbeOptions {
+	v, _ := ParseTLSVersion(c.TLSMinVersion)
+	return TLSProbeOptions{ServerName: strings.TrimSpace(c.TLSServerName), MinVersion: v}
+}
+
+func (c ValidationConfig) TLSVerifyEnabled() bool {
+	t := c.TestFor(ProxyTypeSOCKS5)
+	return t.TLSFor(t.Target)
 }
 
 type ValidationResult struct {
 	ValidSOCKS5      []ProxyNode
 	TestedSOCKS5     int
 	ValidSOCKS5Count int
-	Errors           error
+	// ValidOther and TestedOther cover the other supported types (https,
+	// http); max_socks5 caps each type separately.
+	ValidOther  []ProxyNode
+	TestedOther int
+	// Failures counts failed probes by category (see FailureCategory).
+	Failures map[string]int
+	// AuthFailed lists the candidates whose proxy rejected their credentials.
+	AuthFailed []ProxyNode
+	// Failed lists the addresses whose probe ran to the end and failed,
+	// auth failures included; candidates never tested are in neither list.
+	Failed []string
+	// Redetected counts nodes assumed SOCKS5 that passed as HTTP proxies;
+	// they are in ValidOther.
+	Redetected int
+	// SameExit counts valid nodes dropped by DedupeExitIP for sharing an
+	// exit IP with a faster one.
+	SameExit int
+	Errors   error
 }
 
 func ValidateAndFilter(ctx context.Context, nodes []ProxyNode, cfg ValidationConfig, timeout time.Duration) (ValidationResult, error) {
+	return validateAndFilter(ctx, nodes, cfg, timeout, nil, nil)
+}
+
+// validateAndFilter is ValidateAndFilter with the previous pool's addresses,
+// used by cfg.PreferNew. onValid, when set, is called with every node that
+// passes, as it passes.
+func validateAndFilter(ctx context.Context, nodes []ProxyNode, cfg ValidationConfig, timeout time.Duration, previous map[string]struct{}, onValid func(ProxyNode)) (ValidationResult, error) {
 	if !cfg.Enabled {
-		return ValidationResult{}, errors.New("validation disabled")
+		return ValidationResult{}, ErrValidationDisabled
 	}
 	cfg.ApplyDefaults()
+	onValid = publishable(cfg, onValid)
 
 	socksNodes := make([]ProxyNode, 0, 1024)
+	otherNodes := make(map[string][]ProxyNode)
 	for _, n := range nodes {
 		switch n.Type {
 		case ProxyTypeSOCKS5:
 			socksNodes = append(socksNodes, n)
+		case ProxyTypeHTTPS, ProxyTypeHTTP:
+			otherNodes[n.Type] = append(otherNodes[n.Type], n)
 		}
 	}
 
 	var res ValidationResult
 	var errList []error
 
-	validSOCKS, testedSOCKS, err := validateSOCKS5(ctx, socksNodes, cfg, timeout)
+	validSOCKS, testedSOCKS, failures, authFailed, failed, err := validateType(ctx, socksNodes, ProxyTypeSOCKS5, cfg, timeout, previous, onValid)
 	if err != nil {
 		errList = append(errList, fmt.Errorf("socks5 validation: %w", err))
 	}
+	// Nodes with a guessed type may have passed as HTTP proxies instead.
+	socksOnly := validSOCKS[:0]
+	for _, n := range validSOCKS {
+		if n.Type == ProxyTypeSOCKS5 {
+			socksOnly = append(socksOnly, n)
+		} else {
+			res.ValidOther = append(res.ValidOther, n)
+			res.Redetected++
+		}
+	}
+	validSOCKS = socksOnly
 	res.ValidSOCKS5 = validSOCKS
 	res.TestedSOCKS5 = testedSOCKS
 	res.ValidSOCKS5Count = len(validSOCKS)
+	res.Failures = failures
+	res.AuthFailed = authFailed
+	res.Failed = failed
+
+	for _, typ := range []string{ProxyTypeHTTPS, ProxyTypeHTTP} {
+		if len(otherNodes[typ]) == 0 {
+			continue
+		}
+		valid, tested, failures, authFailed, failed, err := validateType(ctx, otherNodes[typ], typ, cfg, timeout, previous, onValid)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("%s validation: %w", typ, err))
+		}
+		res.ValidOther = append(res.ValidOther, valid...)
+		res.TestedOther += tested
+		for k, v := range failures {
+			res.Failures[k] += v
+		}
+		res.AuthFailed = append(res.AuthFailed, authFailed...)
+		res.Failed = append(res.Failed, failed...)
+	}
 
 	if len(errList) > 0 {
 		res.Errors = errors.Join(errList...)
 	}
+	if cfg.DedupeExitIP {
+		res.ValidSOCKS5, res.ValidOther, res.SameExit = dedupeExitIPs(res.ValidSOCKS5, res.ValidOther)
+		res.ValidSOCKS5Count = len(res.ValidSOCKS5)
+	}
 
-	merged := MergeDedup(res.ValidSOCKS5)
+	merged := MergeDedup(res.ValidSOCKS5, res.ValidOther)
 	if len(merged) == 0 {
 		if res.Errors != nil {
 			return res, res.Errors
 		}
-		return res, errors.New("no valid proxies found")
+		return res, ErrNoValidProxies
 	}
 	return res, res.Errors
 }
 
-func validateSOCKS5(ctx context.Context, candidates []ProxyNode, cfg ValidationConfig, timeout time.Duration) ([]ProxyNode, int, error) {
+// publishable narrows onValid to nodes the final filters keep. Nothing is
+// published early in SelectFastest mode, where the oversampled half that is
+// trimmed is not known until validation ends, nor with DedupeExitIP, where a
+// faster node behind the same exit IP may still arrive.
+func publishable(cfg ValidationConfig, onValid func(ProxyNode)) func(ProxyNode) {
+	if cfg.SelectFastest && cfg.MaxSOCKS5 > 0 || cfg.DedupeExitIP {
+		return nil
+	}
+	return onValid
+}
+
+// dedupeExitIPs keeps the lowest-latency node of every exit IP across both
+// lists, and returns how many it dropped. Nodes without an ExitIP stay.
+func dedupeExitIPs(socks, other []ProxyNode) ([]ProxyNode, []ProxyNode, int) {
+	best := make(map[string]ProxyNode)
+	for _, list := range [][]ProxyNode{socks, other} {
+		for _, n := range list {
+			if n.ExitIP == "" {
+				continue
+			}
+			if b, ok := best[n.ExitIP]; !ok || n.LatencyMS < b.LatencyMS {
+				best[n.ExitIP] = n
+			}
+		}
+	}
+	dropped := 0
+	keep := func(list []ProxyNode) []ProxyNode {
+		out := list[:0]
+		for _, n := range list {
+			if n.ExitIP == "" || best[n.ExitIP].Addr() == n.Addr() {
+				out = append(out, n)
+			} else {
+				dropped++
+			}
+		}
+		return out
+	}
+	socks, other = keep(socks), keep(other)
+	return socks, other, dropped
+}
+
+// validateType probes candidates of type typ with cfg.TestFor(typ).
+func validateType(ctx context.Context, candidates []ProxyNode, typ string, cfg ValidationConfig, timeout time.Duration, previous map[string]struct{}, onValid func(ProxyNode)) ([]ProxyNode, int, map[string]int, []ProxyNode, []string, error) {
 	keep := cfg.MaxSOCKS5
 	if keep < 0 {
 		keep = 0
 	}
-	testLimit := candidateLimit(len(candidates), keep)
+	// In SelectFastest mode oversample, then keep the lowest-latency half.
+	collect := keep
+	if cfg.SelectFastest && keep > 0 {
+		collect = keep * 2
+	}
+	candidates = orderCandidates(candidates, cfg.ShuffleSeed, cfg.PreferNew, previous)
+	candidates = capPortsPerIP(candidates, cfg.MaxPortsPerIP)
+	testLimit := candidateLimit(len(candidates), collect, cfg.CandidateMultiplier, cfg.CandidateCap)
 	candidates = candidates[:testLimit]
-	return runValidation(ctx, candidates, cfg.Concurrency, keep, func(ctx context.Context, n ProxyNode) (ProxyNode, bool) {
-		start := time.Now()
+	test := cfg.TestFor(typ)
+	targets := test.TestTargets()
+	httpTest := cfg.TestFor(ProxyTypeHTTP)
+	httpTargets := httpTest.TestTargets()
+	tlsOpts := cfg.TLSProbe()
+	var probeSeq atomic.Uint64
+	limiter := newTokenBucket(cfg.ProbesPerSecond)
+	var gate *aimdGate
+	if cfg.AdaptiveConcurrency {
+		gate = newAIMDGate(cfg.MinConcurrency, cfg.Concurrency)
+	}
+	var (
+		authMu     sync.Mutex
+		authFailed []ProxyNode
+		failed     []string
+	)
+	probe := func(ctx context.Context, n ProxyNode) (ProxyNode, error) {
+		seq := probeSeq.Add(1) - 1
 		cctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
-		if cfg.TLSVerifyEnabled() {
-			ok, _, err := CheckSOCKS5TLS(cctx, n, cfg.SOCKS5TestAddr, timeout)
-			if err != nil || !ok {
-				return ProxyNode{}, false
+		ok, timing, err := probeNode(cctx, n, test, test.NextTarget(targets, seq), timeout, tlsOpts)
+		if err != nil && typ == ProxyTypeSOCKS5 && n.GuessedType && socks5Mismatch(err) {
+			h := n
+			h.Type = ProxyTypeHTTP
+			if hok, htiming, herr := probeNode(cctx, h, httpTest, httpTest.NextTarget(httpTargets, seq), timeout, tlsOpts); herr == nil && hok {
+				n, ok, timing, err = h, hok, htiming, nil
 			}
-		} else {
-			conn, err := DialViaProxy(cctx, n, "tcp", cfg.SOCKS5TestAddr, timeout)
+		}
+		if err != nil {
+			if IsAuthFailure(err) {
+				n.AuthFailed = true
+				authMu.Lock()
+				authFailed = append(authFailed, n)
+				authMu.Unlock()
+			}
+			return ProxyNode{}, err
+		}
+		if !ok {
+			return ProxyNode{}, errors.New("check failed")
+		}
+		if cfg.ExpectSHA256 != "" {
+			if err := CheckSOCKS5Content(cctx, n, cfg.ExpectURL, cfg.ExpectSHA256, timeout); err != nil {
+				return ProxyNode{}, err
+			}
+		}
+		if cfg.ExitIPURL != "" {
+			ip, err := CheckExitIP(cctx, n, cfg.ExitIPURL, timeout)
 			if err != nil {
-				return ProxyNode{}, false
+				return ProxyNode{}, err
 			}
-			_ = conn.Close()
+			n.ExitIP = ip
+		}
+		n.GuessedType = false
+		n.LatencyMS = timing.TotalMS
+		n.HandshakeMS = timing.HandshakeMS
+		n.ConnectMS = timing.ConnectMS
+		return n, nil
+	}
+	valid, tested, failures, err := runValidation(ctx, candidates, cfg.Concurrency, collect, limiter, gate, onValid, func(ctx context.Context, n ProxyNode) (ProxyNode, error) {
+		v, err := probe(ctx, n)
+		// Probes cut short once enough passed say nothing about the node.
+		if err != nil && !errors.Is(ctx.Err(), context.Canceled) {
+			authMu.Lock()
+			failed = append(failed, n.Addr())
+			authMu.Unlock()
+		}
+		return v, err
+	})
+	if cfg.SelectFastest && keep > 0 {
+		SortNodes(valid, RankByLatency)
+		if len(valid) > keep {
+			valid = valid[:keep]
+		}
+	}
+	SortNodes(valid, cfg.RankBy)
+	return valid, tested, failures, authFailed, failed, err
+}
+
+// probeNode runs test's probe of n against target.
+func probeNode(ctx context.Context, n ProxyNode, test ProtocolTest, target string, timeout time.Duration, tlsOpts TLSProbeOptions) (bool, ProbeTiming, error) {
+	if test.TLSFor(target) {
+		return CheckSOCKS5TLSWith(ctx, n, target, timeout, tlsOpts)
+	}
+	if test.Method == ProbeResponse {
+		return CheckSOCKS5Forwarding(ctx, n, target, timeout)
+	}
+	return CheckSOCKS5TCP(ctx, n, target, timeout)
+}
+
+// socks5Mismatch reports whether a failed SOCKS5 probe may have reached a
+// proxy speaking another protocol: it answered the greeting with something
+// other than SOCKS5 (see ErrSOCKS5Rejected). Timeouts, resets, refusals and
+// SOCKS5 replies say nothing about the protocol and rule that out.
+func socks5Mismatch(err error) bool {
+	return errors.Is(err, ErrSOCKS5Rejected)
+}
+
+// Probe failure categories FailureCategory adds to DialErrorCategory's.
+const (
+	FailureContentMismatch = "content_mismatch"
+	FailureNoResponse      = "no_response"
+	FailureNoExitIP        = "no_exit_ip"
+)
+
+// FailureCategory buckets a probe error for reporting: a DialErrorCategory,
+// FailureContentMismatch for the content check, FailureNoResponse when a
+// ProbeResponse probe got nothing back or FailureNoExitIP when the exit IP
+// lookup failed.
+func FailureCategory(err error) string {
+	if errors.Is(err, ErrContentMismatch) {
+		return FailureContentMismatch
+	}
+	if errors.Is(err, ErrNoResponse) {
+		return FailureNoResponse
+	}
+	if errors.Is(err, ErrNoExitIP) {
+		return FailureNoExitIP
+	}
+	return DialErrorCategory(err)
+}
+
+const (
+	RankByHandshake = "handshake"
+	RankByLatency   = "latency"
+)
+
+// SortNodes orders nodes fastest first. RankByHandshake (the default) uses the
+// proxy-proximity signal and breaks ties on total latency; RankByLatency uses
+// the total probe latency only. Unknown latencies sort last, and remaining ties
+// are broken by address so equal inputs always give the same order, however
+// the probes finished.
+func SortNodes(nodes []ProxyNode, rankBy string) {
+	key := func(n ProxyNode) int64 {
+		if rankBy == RankByLatency {
+			return n.LatencyMS
+		}
+		return n.HandshakeMS
+	}
+	known := func(v int64) bool { return v > 0 }
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := key(nodes[i]), key(nodes[j])
+		if known(a) != known(b) {
+			return known(a)
+		}
+		if a != b {
+			return a < b
+		}
+		if nodes[i].LatencyMS != nodes[j].LatencyMS {
+			return nodes[i].LatencyMS < nodes[j].LatencyMS
 		}
-		n.LatencyMS = time.Since(start).Milliseconds()
-		return n, true
+		return addrLess(nodes[i], nodes[j])
 	})
 }
 
-func candidateLimit(total int, keep int) int {
+// addrLess orders nodes by IP (numerically when both parse), then port.
+func addrLess(a, b ProxyNode) bool {
+	if a.IP != b.IP {
+		ipA, errA := netip.ParseAddr(a.IP)
+		ipB, errB := netip.ParseAddr(b.IP)
+		if errA == nil && errB == nil {
+			return ipA.Less(ipB)
+		}
+		return a.IP < b.IP
+	}
+	pa, _ := strconv.Atoi(a.Port)
+	pb, _ := strconv.Atoi(b.Port)
+	if pa != pb {
+		return pa < pb
+	}
+	return a.Type < b.Type
+}
+
+const (
+	defaultCandidateMultiplier = 10
+	defaultCandidateCap        = 5000
+	// defaultCandidateCapUnbounded applies when max_socks5 is negative (keep all).
+	defaultCandidateCapUnbounded = 2000
+	candidateFloor               = 200
+)
+
+// candidateLimit returns how many of total candidates to test in order to
+// keep roughly keep valid nodes. multiplier and maxCap fall back to the
+// defaults when <= 0.
+func candidateLimit(total int, keep int, multiplier int, maxCap int) int {
 	if total <= 0 {
 		return 0
 	}
 	if keep <= 0 {
-		if total > 2000 {
-			return 2000
+		if maxCap <= 0 {
+			maxCap = defaultCandidateCapUnbounded
+		}
+		if total > maxCap {
+			return maxCap
 		}
 		return total
 	}
-	budget := keep * 10
-	if budget < 200 {
-		budget = 200
+	if multiplier <= 0 {
+		multiplier = defaultCandidateMultiplier
 	}
-	if budget > 5000 {
-		budget = 5000
+	if maxCap <= 0 {
+		maxCap = defaultCandidateCap
+	}
+	budget := keep * multiplier
+	if budget < candidateFloor {
+		budget = candidateFloor
+	}
+	if budget > maxCap {
+		budget = maxCap
 	}
 	if budget > total {
 		budget = total
@@ -140,11 +709,87 @@ func candidateLimit(total int, keep int) int {
 	return budget
 }
 
-type validateFn func(ctx context.Context, n ProxyNode) (ProxyNode, bool)
+// orderCandidates returns a shuffled copy of nodes so the candidate limit does
+// not always cut the same tail of a list. With preferNew, nodes whose address
+// is not in previous are moved to the front (keeping their shuffled order).
+func orderCandidates(nodes []ProxyNode, seed int64, preferNew bool, previous map[string]struct{}) []ProxyNode {
+	out := append([]ProxyNode(nil), nodes...)
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	if preferNew && len(previous) > 0 {
+		sort.SliceStable(out, func(i, j int) bool {
+			_, oldI := previous[out[i].Addr()]
+			_, oldJ := previous[out[j].Addr()]
+			return !oldI && oldJ
+		})
+	}
+	return out
+}
+
+// commonSOCKS5Ports are tried first when a host has to be trimmed to a few ports.
+var commonSOCKS5Ports = map[string]struct{}{
+	"1080": {}, "1081": {}, "4145": {}, "9050": {}, "5678": {},
+}
+
+// capPortsPerIP keeps at most limit nodes per IP, preferring common SOCKS5
+// ports and otherwise the original order. The order of kept nodes is preserved.
+func capPortsPerIP(nodes []ProxyNode, limit int) []ProxyNode {
+	if limit <= 0 {
+		return nodes
+	}
+	byIP := make(map[string][]int, len(nodes))
+	for i, n := range nodes {
+		byIP[n.IP] = append(byIP[n.IP], i)
+	}
+	keep := make([]bool, len(nodes))
+	for _, idxs := range byIP {
+		if len(idxs) <= limit {
+			for _, i := range idxs {
+				keep[i] = true
+			}
+			continue
+		}
+		left := limit
+		for _, i := range idxs {
+			if left == 0 {
+				break
+			}
+			if _, ok := commonSOCKS5Ports[nodes[i].Port]; ok {
+				keep[i] = true
+				left--
+			}
+		}
+		for _, i := range idxs {
+			if left == 0 {
+				break
+			}
+			if !keep[i] {
+				keep[i] = true
+				left--
+			}
+		}
+	}
+	out := make([]ProxyNode, 0, len(nodes))
+	for i, n := range nodes {
+		if keep[i] {
+			out = append(out, n)
+		}
+	}
+	return out
+}
 
-func runValidation(ctx context.Context, candidates []ProxyNode, concurrency int, keep int, fn validateFn) ([]ProxyNode, int, error) {
+type validateFn func(ctx context.Context, n ProxyNode) (ProxyNode, error)
+
+// runValidation probes candidates with up to concurrency workers; gate, when
+// not nil, limits how many of them probe at once. Valid nodes are also passed
+// to onValid, when set, as they come in.
+func runValidation(ctx context.Context, candidates []ProxyNode, concurrency int, keep int, limiter *tokenBucket, gate *aimdGate, onValid func(ProxyNode), fn validateFn) ([]ProxyNode, int, map[string]int, error) {
+	failures := make(map[string]int)
 	if len(candidates) == 0 {
-		return nil, 0, nil
+		return nil, 0, failures, nil
 	}
 	if concurrency <= 0 {
 		concurrency = 32
@@ -155,11 +800,15 @@ func runValidation(ctx context.Context, candidates []ProxyNode, concurrency int,
 
 	type result struct {
 		node ProxyNode
-		ok   bool
+		err  error
+		// aborted marks probes cut short by our own cancellation.
+		aborted bool
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	stopWake := context.AfterFunc(ctx, gate.wake)
+	defer stopWake()
 
 	workCh := make(chan ProxyNode)
 	resCh := make(chan result, concurrency)
@@ -170,11 +819,19 @@ func runValidation(ctx context.Context, candidates []ProxyNode, concurrency int,
 		go func() {
 			defer wg.Done()
 			for n := range workCh {
+				if err := limiter.Wait(ctx); err != nil {
+					return
+				}
+				if err := gate.acquire(ctx); err != nil {
+					return
+				}
 				cctx, cancel := context.WithTimeout(ctx, 20*time.Second)
-				v, ok := fn(cctx, n)
+				v, err := fn(cctx, n)
 				cancel()
+				aborted := err != nil && ctx.Err() != nil
+				gate.release(err != nil && !aborted && FailureCategory(err) == DialErrTimeout)
 				select {
-				case resCh <- result{node: v, ok: ok}:
+				case resCh <- result{node: v, err: err, aborted: aborted}:
 				case <-ctx.Done():
 					return
 				}
@@ -202,14 +859,21 @@ func runValidation(ctx context.Context, candidates []ProxyNode, concurrency int,
 	tested := 0
 	for r := range resCh {
 		tested++
-		if r.ok {
-			out = append(out, r.node)
-			if keep > 0 && len(out) >= keep {
-				cancel()
+		if r.err != nil {
+			if !r.aborted {
+				failures[FailureCategory(r.err)]++
 			}
+			continue
+		}
+		out = append(out, r.node)
+		if onValid != nil {
+			onValid(r.node)
+		}
+		if keep > 0 && len(out) >= keep {
+			cancel()
 		}
 	}
-	return out, tested, nil
+	return out, tested, failures, nil
 }
 
 func minInt(a, b int) int {
@@ -0,0 +1,339 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSOCKS5Mismatch(t *testing.T) {
+	up := func(err error) error { return &UpstreamError{Proxy: "203.0.113.1:1080", Err: err} }
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"wrong version", up(fmt.Errorf("%w: unexpected protocol version 72", ErrSOCKS5Rejected)), true},
+		{"classified wrong version", classifyDialError("p", up(fmt.Errorf("%w: no acceptable method", ErrSOCKS5Rejected))), true},
+		{"timeout", up(os.ErrDeadlineExceeded), false},
+		{"context deadline", context.DeadlineExceeded, false},
+		{"reset", up(syscall.ECONNRESET), false},
+		{"refused", up(syscall.ECONNREFUSED), false},
+		{"eof", up(io.EOF), false},
+		{"socks5 reply", &SOCKS5ReplyError{Code: 0x05}, false},
+		{"auth", up(ErrSOCKS5AuthFailed), false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := socks5Mismatch(tt.err); got != tt.want {
+				t.Errorf("socks5Mismatch(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishable(t *testing.T) {
+	exit := func(ip, exitIP string) ProxyNode {
+		n := node(ip, "1080", 0)
+		n.ExitIP = exitIP
+		return n
+	}
+	arrivals := []ProxyNode{
+		exit("203.0.113.1", "198.51.100.1"),
+		exit("203.0.113.2", "198.51.100.1"),
+		exit("203.0.113.3", ""),
+		exit("203.0.113.4", ""),
+		exit("203.0.113.5", "198.51.100.2"),
+	}
+	tests := []struct {
+		name string
+		cfg  ValidationConfig
+		want int
+	}{
+		{"plain", ValidationConfig{MaxSOCKS5: 10}, 5},
+		{"dedupe exit IP", ValidationConfig{MaxSOCKS5: 10, DedupeExitIP: true}, 0},
+		{"select fastest", ValidationConfig{MaxSOCKS5: 10, SelectFastest: true}, 0},
+		{"select fastest without a cap", ValidationConfig{SelectFastest: true}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []ProxyNode
+			if fn := publishable(tt.cfg, func(n ProxyNode) { got = append(got, n) }); fn != nil {
+				for _, n := range arrivals {
+					fn(n)
+				}
+			}
+			if len(got) != tt.want {
+				t.Errorf("published %d nodes, want %d", len(got), tt.want)
+			}
+		})
+	}
+	if publishable(ValidationConfig{}, nil) != nil {
+		t.Error("publishable(nil) is not nil")
+	}
+}
+
+func TestNextTarget(t *testing.T) {
+	rr := ProtocolTest{Target: "example.com:443", Targets: []string{"a.example:443", "b.example:443", "c.example:80"}}
+	targets := rr.TestTargets()
+	var got []string
+	for seq := uint64(0); seq < 5; seq++ {
+		got = append(got, rr.NextTarget(targets, seq))
+	}
+	want := []string{"a.example:443", "b.example:443", "c.example:80", "a.example:443", "b.example:443"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("round robin = %v, want %v", got, want)
+	}
+
+	single := ProtocolTest{Target: "example.com:443"}
+	if got := single.NextTarget(single.TestTargets(), 7); got != "example.com:443" {
+		t.Errorf("single target = %q, want example.com:443", got)
+	}
+}
+
+func TestValidationTargetRanges(t *testing.T) {
+	c := ValidationConfig{SOCKS5TestAddr: "svc.internal:8440-8442"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	c.ApplyDefaults()
+	socks := c.TestFor(ProxyTypeSOCKS5)
+	want := []string{"svc.internal:8440", "svc.internal:8441", "svc.internal:8442"}
+	if got := socks.TestTargets(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("TestTargets() = %v, want %v", got, want)
+	}
+	if socks.Order != TargetOrderRoundRobin {
+		t.Errorf("Order = %q, want %q", socks.Order, TargetOrderRoundRobin)
+	}
+	var got []string
+	for seq := uint64(0); seq < 4; seq++ {
+		got = append(got, socks.NextTarget(socks.TestTargets(), seq))
+	}
+	if want := append(want, want[0]); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("round robin = %v, want %v", got, want)
+	}
+
+	random := ValidationConfig{SOCKS5TestAddrs: []string{"a.example:80-81", "b.example:90"}, SOCKS5TestOrder: "Random"}
+	random.ApplyDefaults()
+	rt := random.TestFor(ProxyTypeSOCKS5)
+	targets := rt.TestTargets()
+	seen := map[string]bool{}
+	for seq := uint64(0); seq < 300; seq++ {
+		seen[rt.NextTarget(targets, seq)] = true
+	}
+	if len(seen) != 3 || !seen["a.example:80"] || !seen["a.example:81"] || !seen["b.example:90"] {
+		t.Errorf("random order picked %v, want all of %v", seen, targets)
+	}
+
+	single := ValidationConfig{SOCKS5TestAddr: "example.com:443"}
+	single.ApplyDefaults()
+	if st := single.TestFor(ProxyTypeSOCKS5); st.Target != "example.com:443" || len(st.Targets) != 0 {
+		t.Errorf("single target = %q %v, want example.com:443 alone", st.Target, st.Targets)
+	}
+}
+
+func TestValidationConfigValidateTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ValidationConfig
+		wantErr string
+	}{
+		{"reversed range", ValidationConfig{SOCKS5TestAddr: "svc.internal:8449-8440"}, "socks5_test_addr"},
+		{"bad list entry", ValidationConfig{SOCKS5TestAddrs: []string{"a.example:80", "b.example:0-5"}}, "socks5_test_addrs"},
+		{"bad order", ValidationConfig{SOCKS5TestOrder: "sticky"}, "socks5_test_order"},
+		{"bad per-type target", ValidationConfig{Tests: map[string]ProtocolTest{ProxyTypeHTTP: {Target: "h.example:90-80"}}}, "tests.http.target"},
+		{"bad per-type order", ValidationConfig{Tests: map[string]ProtocolTest{ProxyTypeHTTP: {Order: "sticky"}}}, "tests.http.order"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error naming %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidationConfigValidateExpect(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		cfg     ValidationConfig
+		wantErr string
+	}{
+		{"content check", ValidationConfig{ExpectURL: "http://example.com/", ExpectSHA256: digest}, ""},
+		{"no digest", ValidationConfig{ExpectURL: "http://example.com/"}, ""},
+		{"digest without url", ValidationConfig{ExpectSHA256: digest}, "expect_url is required"},
+		{"short digest", ValidationConfig{ExpectURL: "http://example.com/", ExpectSHA256: "abcd"}, "expect_sha256 must be"},
+		{"not hex", ValidationConfig{ExpectURL: "http://example.com/", ExpectSHA256: strings.Repeat("zz", 32)}, "expect_sha256 must be"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidationConfigValidateExitIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ValidationConfig
+		wantErr string
+	}{
+		{"lookup and dedupe", ValidationConfig{ExitIPURL: "https://ip.example/", DedupeExitIP: true}, ""},
+		{"lookup only", ValidationConfig{ExitIPURL: "http://ip.example/plain"}, ""},
+		{"dedupe without lookup", ValidationConfig{DedupeExitIP: true}, "exit_ip_url is required"},
+		{"not http", ValidationConfig{ExitIPURL: "ftp://ip.example/"}, "exit_ip_url must be"},
+		{"no host", ValidationConfig{ExitIPURL: "https:///ip"}, "exit_ip_url must be"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCandidateLimit(t *testing.T) {
+	tests := []struct {
+		name                     string
+		total, keep, mult, limit int
+		want                     int
+	}{
+		{"empty", 0, 10, 0, 0, 0},
+		{"floor", 1000, 10, 0, 0, candidateFloor},
+		{"multiplier", 5000, 100, 5, 0, 500},
+		{"cap", 5000, 100, 5, 300, 300},
+		{"fewer than the budget", 50, 100, 0, 0, 50},
+		{"unbounded keep", 5000, 0, 0, 1000, 1000},
+		{"unbounded keep under the cap", 500, 0, 0, 1000, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := candidateLimit(tt.total, tt.keep, tt.mult, tt.limit); got != tt.want {
+				t.Errorf("candidateLimit(%d, %d, %d, %d) = %d, want %d", tt.total, tt.keep, tt.mult, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderCandidatesReachesTail(t *testing.T) {
+	const total, budget = 1000, 200
+	nodes := make([]ProxyNode, total)
+	for i := range nodes {
+		nodes[i] = node(fmt.Sprintf("203.0.%d.%d", i/250, i%250+1), "1080", 0)
+	}
+	orig := append([]ProxyNode(nil), nodes...)
+	tail := make(map[string]bool)
+	for _, n := range nodes[total-100:] {
+		tail[n.Addr()] = true
+	}
+
+	seedsReachingTail := 0
+	for seed := int64(1); seed <= 20; seed++ {
+		picked := orderCandidates(nodes, seed, false, nil)[:budget]
+		for _, n := range picked {
+			if tail[n.Addr()] {
+				seedsReachingTail++
+				break
+			}
+		}
+	}
+	// A uniform shuffle picks none of the last 100 with odds of about 1e-10.
+	if seedsReachingTail != 20 {
+		t.Errorf("%d of 20 seeds tested any of the last 100 candidates with a budget of %d", seedsReachingTail, budget)
+	}
+	if fmt.Sprint(nodes) != fmt.Sprint(orig) {
+		t.Error("orderCandidates modified its input")
+	}
+	a, b := orderCandidates(nodes, 42, false, nil), orderCandidates(nodes, 42, false, nil)
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Error("the same seed gave two orders")
+	}
+}
+
+func TestOrderCandidatesPreferNew(t *testing.T) {
+	var nodes []ProxyNode
+	previous := make(map[string]struct{})
+	for i := 0; i < 50; i++ {
+		n := node(fmt.Sprintf("203.0.113.%d", i+1), "1080", 0)
+		nodes = append(nodes, n)
+		if i < 40 {
+			previous[n.Addr()] = struct{}{}
+		}
+	}
+	got := orderCandidates(nodes, 7, true, previous)
+	for i, n := range got {
+		_, old := previous[n.Addr()]
+		if old != (i >= 10) {
+			t.Fatalf("position %d holds %s (seen before: %v); want the 10 new nodes first", i, n.Addr(), old)
+		}
+	}
+	if len(got) != len(nodes) {
+		t.Fatalf("orderCandidates returned %d nodes, want %d", len(got), len(nodes))
+	}
+}
+
+func TestSortNodesStable(t *testing.T) {
+	hs := func(ip, port string, handshake, latency int64) ProxyNode {
+		n := node(ip, port, latency)
+		n.HandshakeMS = handshake
+		return n
+	}
+	nodes := []ProxyNode{
+		hs("10.0.0.10", "1080", 5, 50),
+		hs("10.0.0.2", "1080", 5, 50),
+		hs("10.0.0.2", "443", 5, 50),
+		hs("10.0.0.1", "1080", 5, 40),
+		hs("10.0.0.3", "1080", 3, 90),
+		hs("10.0.0.4", "1080", 0, -1),
+		hs("10.0.0.0", "1080", 0, -1),
+	}
+	tests := []struct {
+		rankBy string
+		want   string
+	}{
+		{RankByHandshake, "[10.0.0.3:1080 10.0.0.1:1080 10.0.0.2:443 10.0.0.2:1080 10.0.0.10:1080 10.0.0.0:1080 10.0.0.4:1080]"},
+		{RankByLatency, "[10.0.0.1:1080 10.0.0.2:443 10.0.0.2:1080 10.0.0.10:1080 10.0.0.3:1080 10.0.0.0:1080 10.0.0.4:1080]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rankBy, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < 50; i++ {
+				shuffled := append([]ProxyNode(nil), nodes...)
+				rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+				SortNodes(shuffled, tt.rankBy)
+				var got []string
+				for _, n := range shuffled {
+					got = append(got, n.Addr())
+				}
+				if fmt.Sprint(got) != tt.want {
+					t.Fatalf("permutation %d sorted to %v, want %s", i, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	EventRefreshCompleted = "refresh_completed"
+	EventPoolBelowFloor   = "pool_below_floor"
+	EventProxyRemoved     = "proxy_removed"
+)
+
+type Event struct {
+	Type          string    `json:"type"`
+	At            time.Time `json:"at"`
+	FixedPoolSize int       `json:"fixed_pool_size"`
+	AutoPoolSize  int       `json:"auto_pool_size"`
+	CurrentSOCKS5 string    `json:"current_socks5,omitempty"`
+	Proxy         string    `json:"proxy,omitempty"`
+	Count         int       `json:"count,omitempty"`
+	Floor         int       `json:"floor,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// Webhook POSTs events as JSON to a URL from a single background worker.
+// Notify never blocks: events are dropped when the queue is full.
+type Webhook struct {
+	url    string
+	client *http.Client
+	logger *log.Logger
+	queue  chan Event
+}
+
+func NewWebhook(url string, timeout time.Duration, logger *log.Logger) *Webhook {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		logger: logger,
+		queue:  make(chan Event, 64),
+	}
+}
+
+// Run delivers queued events until ctx is done.
+func (w *Webhook) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-w.queue:
+			if err := w.send(ctx, ev); err != nil && w.logger != nil {
+				w.logger.Printf("webhook %s: %v", ev.Type, err)
+			}
+		}
+	}
+}
+
+func (w *Webhook) Notify(ev Event) {
+	if w == nil {
+		return
+	}
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	select {
+	case w.queue <- ev:
+	default:
+		if w.logger != nil {
+			w.logger.Printf("webhook queue full, dropping %s event", ev.Type)
+		}
+	}
+}
+
+func (w *Webhook) send(ctx context.Context, ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("http %d", resp.StatusCode)
+	}
+	return nil
+}
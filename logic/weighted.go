@@ -0,0 +1,138 @@
+package logic
+
+import (
+	"math"
+	"time"
+)
+
+// StrategyWeighted selects nodes by smooth weighted round-robin, weighting
+// each by its live latency and success rate (see RecordDial).
+const StrategyWeighted = "weighted"
+
+const (
+	// DefaultLatencyExponent and DefaultExplore are the SelectionConfig
+	// defaults for StrategyWeighted.
+	DefaultLatencyExponent = 1.0
+	DefaultExplore         = 0.1
+
+	// liveAlpha is the EWMA smoothing factor of live latency and success.
+	liveAlpha = 0.2
+	// unknownLatencyMS stands in for nodes never measured.
+	unknownLatencyMS = 1000
+	// minLatencyMS keeps one very fast sample from taking all the weight.
+	minLatencyMS = 10
+)
+
+// liveStats are a node's dial outcomes as seen by RecordDial.
+type liveStats struct {
+	latencyMS float64 // EWMA over successful dials; 0 until the first
+	success   float64 // EWMA of 1 (success) and 0 (failure)
+	// current is the smooth weighted round-robin counter.
+	current float64
+}
+
+// RecordDial feeds a client dial through the node at addr into its live
+// stats: latency counts only when ok. Nodes not in the pool are ignored.
+func (m *ProxyManager) RecordDial(addr string, latency time.Duration, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.live[addr]
+	if st == nil {
+		if !m.inPoolLocked(addr) {
+			return
+		}
+		if m.live == nil {
+			m.live = make(map[string]*liveStats)
+		}
+		st = &liveStats{success: 1}
+		m.live[addr] = st
+	}
+	outcome := 0.0
+	if ok {
+		outcome = 1
+		ms := float64(latency) / float64(time.Millisecond)
+		if st.latencyMS == 0 {
+			st.latencyMS = ms
+		} else {
+			st.latencyMS += liveAlpha * (ms - st.latencyMS)
+		}
+	}
+	st.success += liveAlpha * (outcome - st.success)
+}
+
+func (m *ProxyManager) inPoolLocked(addr string) bool {
+	for _, n := range m.pool {
+		if n.Addr() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// weightLocked is n's share before exploration: success rate over latency
+// raised to the configured exponent. Nodes without live samples use their
+// validation latency.
+func (m *ProxyManager) weightLocked(n ProxyNode) float64 {
+	latency, success := float64(n.LatencyMS), 1.0
+	if st := m.live[n.Addr()]; st != nil {
+		success = st.success
+		if st.latencyMS > 0 {
+			latency = st.latencyMS
+		}
+	}
+	if latency <= 0 {
+		latency = unknownLatencyMS
+	}
+	latency = math.Max(latency, minLatencyMS)
+	return success / math.Pow(latency, m.selection.LatencyExponent)
+}
+
+// weightedIndexLocked picks the next node by smooth weighted round-robin
+// over the enabled nodes whose circuit is not open. Each node's effective
+// weight mixes its normalized weight with an even share of Explore, so
+// every admissible node keeps getting some traffic and fresh stats. When none is
+// admissible it falls back to selectLocked, which returns -1 when every node
+// is disabled.
+func (m *ProxyManager) weightedIndexLocked() int {
+	now := time.Now()
+	idx := make([]int, 0, len(m.pool))
+	weights := make([]float64, 0, len(m.pool))
+	var sum float64
+	for i, n := range m.pool {
+		if until, ok := m.openUntil[n.Addr()]; n.Disabled || (ok && now.Before(until)) {
+			continue
+		}
+		w := m.weightLocked(n)
+		idx = append(idx, i)
+		weights = append(weights, w)
+		sum += w
+	}
+	if len(idx) == 0 {
+		return m.selectLocked((m.currentIndex+1)%len(m.pool), true)
+	}
+	if m.live == nil {
+		m.live = make(map[string]*liveStats)
+	}
+	explore := m.selection.Explore
+	best, bestIdx := math.Inf(-1), idx[0]
+	for j, i := range idx {
+		share := 1 / float64(len(idx))
+		if sum > 0 {
+			share = (1-explore)*weights[j]/sum + explore/float64(len(idx))
+		}
+		addr := m.pool[i].Addr()
+		st := m.live[addr]
+		if st == nil {
+			st = &liveStats{success: 1}
+			m.live[addr] = st
+		}
+		st.current += share
+		if st.current > best {
+			best, bestIdx = st.current, i
+		}
+	}
+	// The shares sum to 1, so that is what the winner gives back.
+	m.live[m.pool[bestIdx].Addr()].current--
+	m.admitLocked(m.pool[bestIdx].Addr(), now)
+	return bestIdx
+}
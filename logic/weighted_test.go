@@ -0,0 +1,110 @@
+package logic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func weightedManager(t *testing.T, latencies ...int64) (*ProxyManager, []ProxyNode) {
+	t.Helper()
+	nodes := make([]ProxyNode, len(latencies))
+	for i, ms := range latencies {
+		nodes[i] = node(fmt.Sprintf("203.0.113.%d", i+1), "1080", ms)
+	}
+	m := NewProxyManager()
+	m.SetSelection(SelectionConfig{Strategy: StrategyWeighted, LatencyExponent: DefaultLatencyExponent, Explore: DefaultExplore})
+	m.SetPool(nodes)
+	return m, nodes
+}
+
+// picks returns how often Next chose each node over n picks, and the
+// longest run of picks any node went without being chosen.
+func picks(t *testing.T, m *ProxyManager, nodes []ProxyNode, n int) (map[string]int, int) {
+	t.Helper()
+	counts := make(map[string]int, len(nodes))
+	last := make(map[string]int, len(nodes))
+	maxGap := 0
+	for i := 0; i < n; i++ {
+		got, ok := m.Next()
+		if !ok {
+			t.Fatalf("Next() found no node at pick %d", i)
+		}
+		counts[got.Addr()]++
+		if gap := i - last[got.Addr()]; gap > maxGap {
+			maxGap = gap
+		}
+		last[got.Addr()] = i
+	}
+	for _, nd := range nodes {
+		if gap := n - last[nd.Addr()]; gap > maxGap {
+			maxGap = gap
+		}
+	}
+	return counts, maxGap
+}
+
+// TestWeightedSelectionShares simulates 10k picks over a pool with known
+// latencies. With exponent 1 and 10% exploration the expected shares are
+// about 52%, 27%, 12%, 7% and 2.5%.
+func TestWeightedSelectionShares(t *testing.T) {
+	m, nodes := weightedManager(t, 100, 200, 500, 1000, 10000)
+	const n = 10000
+	counts, maxGap := picks(t, m, nodes, n)
+	share := func(i int) float64 { return float64(counts[nodes[i].Addr()]) / n }
+
+	tests := []struct {
+		name   string
+		got    float64
+		lo, hi float64
+	}{
+		{"fastest", share(0), 0.49, 0.55},
+		{"fastest two", share(0) + share(1), 0.75, 0.82},
+		{"500ms", share(2), 0.10, 0.14},
+		{"slowest", share(4), 0.015, 0.035},
+	}
+	for _, tt := range tests {
+		if tt.got < tt.lo || tt.got > tt.hi {
+			t.Errorf("%s share = %.3f, want within [%.3f, %.3f]", tt.name, tt.got, tt.lo, tt.hi)
+		}
+	}
+	for i := 1; i < len(nodes); i++ {
+		if share(i) > share(i-1) {
+			t.Errorf("node %d (%dms) got more picks than the faster node %d", i, nodes[i].LatencyMS, i-1)
+		}
+	}
+	// Exploration keeps even the 10s node in steady, if rare, use.
+	if maxGap > 60 {
+		t.Errorf("a node went %d picks without traffic, want at most 60", maxGap)
+	}
+}
+
+func TestWeightedSelectionFollowsLiveStats(t *testing.T) {
+	m, nodes := weightedManager(t, 100, 100)
+	// The first node starts failing, the second turns out slower than
+	// validation measured but keeps working.
+	for i := 0; i < 20; i++ {
+		m.RecordDial(nodes[0].Addr(), 0, false)
+		m.RecordDial(nodes[1].Addr(), 400*time.Millisecond, true)
+	}
+	m.RecordDial("198.51.100.1:1080", time.Millisecond, true) // not in the pool
+
+	counts, _ := picks(t, m, nodes, 1000)
+	if failing, working := counts[nodes[0].Addr()], counts[nodes[1].Addr()]; failing >= working || failing < 40 {
+		t.Errorf("failing node got %d picks, working one %d; want the failing one well behind but still explored", failing, working)
+	}
+}
+
+func TestWeightedSelectionSkipsUnavailable(t *testing.T) {
+	m, nodes := weightedManager(t, 50, 500, 5000)
+	m.SetBreaker(BreakerConfig{Threshold: 1, Cooldown: time.Hour})
+	m.ReportFailure(nodes[0], 0) // opens the fastest node's circuit
+
+	counts, _ := picks(t, m, nodes, 500)
+	if got := counts[nodes[0].Addr()]; got != 0 {
+		t.Errorf("node behind an open circuit got %d picks", got)
+	}
+	if counts[nodes[1].Addr()] <= counts[nodes[2].Addr()] {
+		t.Errorf("picks = %v, want the faster remaining node preferred", counts)
+	}
+}
@@ -3,42 +3,83 @@ package main
 import (
 	"context"
 	"embed"
-	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	socks5 "github.com/armon/go-socks5"
 	"github.com/gin-gonic/gin"
 
+	"lite-proxy/api"
+	"lite-proxy/httpproxy"
 	"lite-proxy/logic"
 )
 
-//go:embed static/index.html
+//go:embed static
 var staticFS embed.FS
 
 func main() {
+	started := time.Now()
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+
 	var socksFixedAddr string
 	var socksAutoAddr string
 	var webAddr string
+	var httpProxyAddr string
 	var refreshEvery time.Duration
 	var rotateEvery time.Duration
+	var rotateJitter float64
+	var refreshJitter time.Duration
 	var dialTimeout time.Duration
+	var upstreamKeepAlive time.Duration
+	var idleConnTimeout time.Duration
+	var allowPrivate bool
+	var maxClients int
+	var webTLSCert string
+	var webTLSKey string
+	var webTLSClientCA string
 	var configPath string
-
-	flag.StringVar(&socksFixedAddr, "socks", "127.0.0.1:1080", "local SOCKS5 (fixed) listen address")
-	flag.StringVar(&socksAutoAddr, "socks-auto", "127.0.0.1:1081", "local SOCKS5 (auto) listen address (rotates upstream per connection)")
-	flag.StringVar(&webAddr, "web", "127.0.0.1:8088", "web UI/API listen address")
+	var checkConfig bool
+	var unhealthyExitAfter time.Duration
+	var exposeCredentials bool
+	var webAssetsDir string
+
+	flag.StringVar(&socksFixedAddr, "socks", "127.0.0.1:1080", "local SOCKS5 (fixed) listen address (\"off\" disables)")
+	flag.StringVar(&socksAutoAddr, "socks-auto", "127.0.0.1:1081", "local SOCKS5 (auto) listen address (rotates upstream per connection, \"off\" disables)")
+	flag.StringVar(&webAddr, "web", "127.0.0.1:8088", "web UI/API listen address (\"off\" disables)")
+	flag.StringVar(&httpProxyAddr, "http-proxy", "off", "local HTTP proxy listen address, through the auto pool (\"off\" disables)")
 	flag.DurationVar(&refreshEvery, "refresh-every", 30*time.Minute, "refresh proxy pool interval (0 disables)")
 	flag.DurationVar(&rotateEvery, "rotate-every", 0, "rotate fixed SOCKS5 upstream interval (0 disables)")
+	flag.DurationVar(&refreshJitter, "refresh-jitter", 0, "random ±duration applied to each refresh interval")
+	flag.Float64Var(&rotateJitter, "rotate-jitter", 0, "random ±fraction applied to each rotation interval (0..1)")
 	flag.DurationVar(&dialTimeout, "dial-timeout", 15*time.Second, "upstream dial timeout")
+	flag.DurationVar(&upstreamKeepAlive, "upstream-keepalive", 0, "TCP keep-alive period for upstream dials (0 = Go default, <0 disables)")
+	flag.DurationVar(&idleConnTimeout, "idle-conn-timeout", 0, "close upstream connections idle this long (0 disables)")
+	flag.IntVar(&maxClients, "max-clients", 0, "max concurrent client connections per SOCKS listener (0 = unlimited)")
+	flag.DurationVar(&unhealthyExitAfter, "unhealthy-exit-after", 0, "exit when the pool has been empty or refreshes have failed this long (0 disables)")
+	flag.BoolVar(&exposeCredentials, "expose-credentials", false, "include proxy passwords in /api/pool and state exports")
+	flag.BoolVar(&allowPrivate, "allow-private-proxies", false, "keep proxies on private/loopback/reserved IPs")
+	flag.StringVar(&webTLSCert, "web-tls-cert", "", "TLS certificate file for the web UI/API (enables HTTPS)")
+	flag.StringVar(&webTLSKey, "web-tls-key", "", "TLS private key file for the web UI/API")
+	flag.StringVar(&webTLSClientCA, "web-tls-client-ca", "", "CA bundle for verifying web client certificates (enables mutual TLS)")
+	flag.StringVar(&webAssetsDir, "web-assets-dir", "", "serve web UI files from this directory, falling back to the embedded ones")
 	flag.StringVar(&configPath, "config", "", "path to JSON config (overrides flags when set)")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate -config, print the resolved config (secrets redacted) and exit")
 	flag.Parse()
+	if checkConfig {
+		os.Exit(runCheckConfig(configPath))
+	}
 
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 	fixedManager := logic.NewProxyManager()
@@ -58,8 +99,10 @@ func main() {
 		socksFixedAddr = cfg.SOCKSListen
 		socksAutoAddr = cfg.SOCKSAutoListen
 		webAddr = cfg.WebListen
+		httpProxyAddr = cfg.HTTPProxyListen
 		refreshEvery = cfg.RefreshEvery.Duration()
 		rotateEvery = cfg.RotateEvery.Duration()
+		rotateJitter = cfg.RotateJitter
 		dialTimeout = cfg.DialTimeout.Duration()
 	} else {
 		ds := logic.DefaultSources()
@@ -67,365 +110,839 @@ func main() {
 			SOCKSListen:  socksFixedAddr,
 			SOCKSAutoListen: socksAutoAddr,
 			WebListen:    webAddr,
+			HTTPProxyListen: httpProxyAddr,
 			RefreshEvery: DurationValue(refreshEvery),
+			RefreshJitter: DurationValue(refreshJitter),
 			RotateEvery:  DurationValue(rotateEvery),
+			RotateJitter: rotateJitter,
 			DialTimeout:  DurationValue(dialTimeout),
+			UpstreamKeepAlive: DurationValue(upstreamKeepAlive),
+			IdleConnTimeout:   DurationValue(idleConnTimeout),
 			Sources:      &ds,
+			AllowPrivateProxies: allowPrivate,
+			MaxClients:   maxClients,
+			UnhealthyExitAfter: DurationValue(unhealthyExitAfter),
+			ExposeCredentials: exposeCredentials,
+			WebTLSCert:   webTLSCert,
+			WebTLSKey:    webTLSKey,
+			WebTLSClientCA: webTLSClientCA,
+			WebAssetsDir: webAssetsDir,
 		}
 		cfg.ApplyDefaults()
+		if err := cfg.Validate(); err != nil {
+			logger.Fatalf("invalid flags: %v", err)
+		}
 	}
 
-	dialFixed := func(ctx context.Context, network, addr string) (conn logic.Conn, err error) {
-		current, ok := fixedManager.Current()
-		if !ok {
-			return logic.DialDirect(ctx, network, addr, dialTimeout)
+	logic.SetDialOptions(logic.DialOptions{
+		KeepAlive:   cfg.UpstreamKeepAlive.Duration(),
+		IdleTimeout: cfg.IdleConnTimeout.Duration(),
+		Mark:        cfg.OutboundFwmark,
+	})
+	if cfg.OutboundFwmark != 0 {
+		if err := logic.CheckFwmark(cfg.OutboundFwmark); err != nil {
+			logger.Fatalf("outbound_fwmark: %v", err)
+		}
+	}
+	logic.SetPipeBufferSize(cfg.PipeBufferSize)
+
+	audit, err := api.NewAuditLog(cfg.AuditLogPath, logger)
+	if err != nil {
+		logger.Fatalf("audit log: %v", err)
+	}
+
+	var webhook *logic.Webhook
+	if cfg.WebhookURL != "" {
+		webhook = logic.NewWebhook(cfg.WebhookURL, cfg.WebhookTimeout.Duration(), logger)
+	}
+	var belowFloor atomic.Bool
+	emit := func(ev logic.Event) {
+		if webhook == nil {
+			return
+		}
+		fixed := fixedManager.Status()
+		ev.FixedPoolSize = fixed.PoolSize
+		ev.AutoPoolSize = autoManager.PoolSize()
+		ev.CurrentSOCKS5 = fixed.CurrentSOCKS5
+		webhook.Notify(ev)
+
+		// Fire pool_below_floor once per crossing, not on every event.
+		if cfg.WebhookPoolFloor <= 0 {
+			return
+		}
+		if ev.FixedPoolSize >= cfg.WebhookPoolFloor {
+			belowFloor.Store(false)
+			return
+		}
+		if belowFloor.CompareAndSwap(false, true) {
+			floorEv := ev
+			floorEv.Type = logic.EventPoolBelowFloor
+			floorEv.Proxy = ""
+			floorEv.Floor = cfg.WebhookPoolFloor
+			webhook.Notify(floorEv)
+		}
+	}
+	upstreamPool := logic.NewUpstreamPool(cfg.UpstreamConnPoolSize, cfg.UpstreamConnPoolTTL.Duration())
+
+	removedLog := logic.NewRemovedLog(200)
+	fixedManager.OnRemove = func(n logic.ProxyNode) {
+		reason := logic.RemovedReasonFailed
+		switch {
+		case n.AuthFailed:
+			reason = logic.RemovedReasonAuthFailed
+		case n.Disabled:
+			reason = logic.RemovedReasonDisabled
+		}
+		removedLog.Record(n.Addr(), reason)
+		upstreamPool.Drop(n.Addr())
+		emit(logic.Event{Type: logic.EventProxyRemoved, Proxy: n.Addr()})
+	}
+	autoManager.OnRemove = fixedManager.OnRemove
+	breaker := logic.BreakerConfig{Threshold: cfg.BreakerThreshold, Cooldown: cfg.BreakerCooldown.Duration()}
+	fixedManager.SetBreaker(breaker)
+	autoManager.SetBreaker(breaker)
+	fixedManager.SetRemovalPolicy(cfg.RemovalPolicy)
+	dialTimeouts := logic.DialTimeoutConfig{
+		Multiplier: cfg.DialTimeoutMultiplier,
+		Min:        cfg.DialTimeoutMin.Duration(),
+		Max:        cfg.DialTimeoutMax.Duration(),
+	}
+	fixedManager.SetDialTimeouts(dialTimeouts)
+	autoManager.SetDialTimeouts(dialTimeouts)
+	autoManager.SetRemovalPolicy(cfg.RemovalPolicy)
+	autoManager.SetSelection(logic.SelectionConfig{
+		Strategy:        cfg.AutoStrategy,
+		AvoidRepeat:     cfg.AutoAvoidRepeat,
+		LatencyExponent: cfg.AutoLatencyExponent,
+		Explore:         cfg.AutoExplore,
+	})
+
+	rotation := logic.NewRotationController(fixedManager, logic.RotationConfig{
+		Interval:  rotateEvery,
+		Jitter:    rotateJitter,
+		TestAddr:  cfg.Validation.TestFor(logic.ProxyTypeSOCKS5).Target,
+		TLSVerify: cfg.Validation.TLSVerifyEnabled(),
+		TLS:       cfg.Validation.TLSProbe(),
+		Timeout:   dialTimeout,
+	})
+	history := logic.NewRotationHistory(200)
+	// warmFixed points the warm connection cache at the fixed current node.
+	warmFixed := func() {
+		if !cfg.WarmFixedCurrent {
+			return
+		}
+		if n, ok := fixedManager.Current(); ok {
+			upstreamPool.Warm(n, dialTimeout)
+		}
+	}
+	recordRotation := func(ev logic.RotationEvent) {
+		history.Record(ev)
+		if ev.Mode == "fixed" {
+			warmFixed()
+		}
+	}
+	rotation.OnRotate = func(from, to logic.ProxyNode) {
+		if from.Addr() == to.Addr() {
+			return
+		}
+		recordRotation(logic.RotationEvent{Mode: "fixed", From: from.Addr(), To: to.Addr(), Reason: logic.RotationReasonScheduled})
+		audit.RecordSystem("rotate", map[string]string{"from": from.Addr(), "to": to.Addr()}, nil)
+	}
+	leases := api.NewLeaseStore(fixedManager, logger)
+	rotation.Hold = func(action string) bool {
+		l, held := leases.Active()
+		if held && action == "rotate" {
+			logger.Printf("scheduled rotation skipped: lease %q holds %s until %s", l.Note, l.Node.Addr(), l.Expires.Format(time.RFC3339))
+		}
+		return held
+	}
+
+	// dialsAbandoned counts upstream dials given up because the client's
+	// context was cancelled.
+	var dialsAbandoned atomic.Int64
+	var socksReplies logic.ReplyStats
+	var dialErrors logic.DialErrorStats
+	// staleChecks counts pre-dial health checks of an idle fixed upstream;
+	// staleRotations counts those that moved to another node.
+	var staleChecks, staleRotations atomic.Int64
+	// connLimits count open connections per listener, against their caps
+	// and the global one.
+	globalLimit := newConnLimit("global", cfg.MaxConnections, logger)
+	listenerLimit := func(name string) int {
+		if n, ok := cfg.ListenerMaxConnections[name]; ok {
+			return n
+		}
+		if name == "web" || name == "http" {
+			return 0
+		}
+		return cfg.MaxClients
+	}
+	connLimits := map[string]*connLimit{
+		"fixed": newConnLimit("socks5 (fixed)", listenerLimit("fixed"), logger),
+		"auto":  newConnLimit("socks5 (auto)", listenerLimit("auto"), logger),
+		"web":   newConnLimit("web", listenerLimit("web"), logger),
+		"http":  newConnLimit("http proxy", listenerLimit("http"), logger),
+	}
+	queueWait := connQueueWait
+	if cfg.ConnectionLimitMode == connLimitReject {
+		queueWait = 0
+	}
+	shapers := map[string]*logic.Shaper{
+		"fixed": logic.NewShaper(cfg.BandwidthLimit["fixed"], cfg.PerConnBandwidthLimit["fixed"]),
+		"auto":  logic.NewShaper(cfg.BandwidthLimit["auto"], cfg.PerConnBandwidthLimit["auto"]),
+	}
+	staleAfter := cfg.StaleCurrentAfter.Duration()
+	targetPolicy, err := logic.NewTargetPolicy(cfg.TargetAllowlist, cfg.TargetBlocklist)
+	if err != nil {
+		logger.Fatalf("invalid config: %v", err)
+	}
+	targetPolicy.TrackHosts = cfg.LogTargets
+	// selfGuard starts from the configured listen addresses, for the
+	// startup refresh, and learns the bound ones (e.g. ":0" ports) once
+	// they are bound.
+	selfGuard, err := logic.NewSelfGuard(cfg.SelfAddrs)
+	if err != nil {
+		logger.Fatalf("invalid config: %v", err)
+	}
+	selfGuard.SetListeners([]string{socksFixedAddr, socksAutoAddr, webAddr, httpProxyAddr})
+	access, err := openAccessLog(cfg.AccessLog, cfg.AccessLogFormat)
+	if err != nil {
+		logger.Fatalf("open access log: %v", err)
+	}
+	defer access.Close()
+
+	// checkTarget vets client destinations, before and after local
+	// resolution.
+	checkTarget := func(addr string) error {
+		if err := targetPolicy.Check(addr); err != nil {
+			return err
 		}
-		conn, err = logic.DialViaProxy(ctx, current, network, addr, dialTimeout)
+		return selfGuard.Check(addr)
+	}
+	onAbandon := func(context.Context) { dialsAbandoned.Add(1) }
+	fixedDialer := logic.NewPoolDialer(fixedManager, logic.PoolDialerOptions{
+		Timeout:   dialTimeout,
+		Sticky:    true,
+		RemoteDNS: cfg.RemoteDNS,
+		Check:     checkTarget,
+		Dial:      upstreamPool.DialViaProxy,
+		OnAbandon: onAbandon,
+		OnFailure: func(ctx context.Context, node logic.ProxyNode, addr string, _ int, timeout time.Duration, err error) {
+			dialErrors.Add(err)
+			logger.Printf("socks5 (fixed) conn=%s via %s to %s (timeout %s): %v", logic.RequestIDFrom(ctx), node.Addr(), addr, timeout, err)
+		},
+	})
+	// The auto listener rotates upstream per connection and fails over as
+	// the retry policy allows. The attempts share one dial timeout budget so
+	// the client never waits longer than dialTimeout in total.
+	var preferNear func(ctx context.Context, addr string, attempt int) (logic.ProxyNode, bool)
+	if cfg.AutoGeoAffinity {
+		geo, err := logic.NewGeoAffinity(cfg.AutoGeoTable)
 		if err != nil {
-			fixedManager.ReportFailure(current, 2)
-			return nil, err
+			logger.Fatalf("invalid config: %v", err)
+		}
+		// Prefer upstreams near the target, falling back to the usual
+		// selection when the pool has none.
+		preferNear = func(_ context.Context, addr string, _ int) (logic.ProxyNode, bool) {
+			return autoManager.NextPreferring(geo.Countries(addr))
 		}
-		fixedManager.ReportSuccess(current)
-		return conn, nil
 	}
+	autoDialer := logic.NewPoolDialer(autoManager, logic.PoolDialerOptions{
+		Retry:     cfg.RetryPolicy(),
+		Select:    preferNear,
+		Timeout:   dialTimeout,
+		RemoteDNS: cfg.RemoteDNS,
+		Check:     checkTarget,
+		Dial:      upstreamPool.DialViaProxy,
+		OnAbandon: onAbandon,
+		OnFailure: func(ctx context.Context, node logic.ProxyNode, addr string, attempt int, timeout time.Duration, err error) {
+			dialErrors.Add(err)
+			logger.Printf("socks5 (auto) conn=%s via %s to %s (attempt %d, timeout %s): %v", logic.RequestIDFrom(ctx), node.Addr(), addr, attempt+1, timeout, err)
+		},
+	})
 
-	dialAuto := func(ctx context.Context, network, addr string) (conn logic.Conn, err error) {
-		// SOCKS5 auto listener rotates upstream per connection; fail over a few times.
-		const attempts = 3
-		for i := 0; i < attempts; i++ {
-			current, ok := autoManager.Next()
-			if !ok {
-				return logic.DialDirect(ctx, network, addr, dialTimeout)
-			}
-			conn, err = logic.DialViaProxy(ctx, current, network, addr, dialTimeout)
-			if err == nil {
-				autoManager.ReportSuccess(current)
-				return conn, nil
+	// selfTestDials tells /api/selftest the upstreams the listeners dialed.
+	selfTestDials := api.NewDialWatch()
+	dialFixed := func(ctx context.Context, network, addr string) (conn logic.Conn, err error) {
+		var via logic.ProxyNode
+		defer func() {
+			access.Log(ctx, "fixed", via, addr, err)
+			selfTestDials.Note(ctx, via)
+		}()
+		if err := ctx.Err(); err != nil {
+			dialsAbandoned.Add(1)
+			return nil, err
+		}
+		if err := checkTarget(addr); err != nil {
+			return nil, err
+		}
+		if fired, rotated := rotation.CheckStale(ctx, staleAfter, time.Now()); fired {
+			staleChecks.Add(1)
+			if rotated {
+				staleRotations.Add(1)
+				warmFixed()
 			}
-			autoManager.ReportFailure(current, 2)
 		}
-		return nil, err
+		conn, via, err = fixedDialer.DialNode(ctx, network, addr)
+		return conn, err
+	}
+
+	dialAuto := func(ctx context.Context, network, addr string) (conn logic.Conn, err error) {
+		var via logic.ProxyNode
+		defer func() {
+			access.Log(ctx, "auto", via, addr, err)
+			selfTestDials.Note(ctx, via)
+		}()
+		conn, via, err = autoDialer.DialNode(ctx, network, addr)
+		return conn, err
+	}
+
+	// BIND goes through the listener's dialer like a dial, minus the fixed
+	// listener's stale check: it is rare and often outlives a rotation.
+	bindFixed := func(ctx context.Context, addr string) (bl logic.BindListener, err error) {
+		var via logic.ProxyNode
+		defer func() { access.Log(ctx, "fixed", via, "bind:"+addr, err) }()
+		bl, via, err = fixedDialer.Bind(ctx, addr)
+		return bl, err
+	}
+	bindAuto := func(ctx context.Context, addr string) (bl logic.BindListener, err error) {
+		var via logic.ProxyNode
+		defer func() { access.Log(ctx, "auto", via, "bind:"+addr, err) }()
+		bl, via, err = autoDialer.Bind(ctx, addr)
+		return bl, err
 	}
 
-	indexHTML, err := staticFS.ReadFile("static/index.html")
+	embeddedAssets, err := fs.Sub(staticFS, "static")
 	if err != nil {
-		logger.Fatalf("read embedded static/index.html: %v", err)
+		logger.Fatalf("embedded static: %v", err)
 	}
+	assets := newAssetServer(embeddedAssets, cfg.WebAssetsDir)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	go upstreamPool.Run(ctx)
+
+	socketMode, err := parseSocketMode(cfg.UnixSocketMode)
+	if err != nil {
+		logger.Fatalf("invalid config: %v", err)
+	}
+	// SOCKS5 listeners: fixed, and auto (per-connection rotation). Both can be
+	// disabled and re-enabled at runtime via /api/listener.
+	socksSrvFixed := &logic.SOCKS5Server{
+		Logger:  logger,
+		Dial:    shapers["fixed"].WrapDial(dialFixed),
+		Bind:    shapers["fixed"].WrapBind(bindFixed),
+		OnReply: socksReplies.Add,
+	}
+	socksSrvAuto := &logic.SOCKS5Server{
+		Logger:  logger,
+		Dial:    shapers["auto"].WrapDial(dialAuto),
+		Bind:    shapers["auto"].WrapBind(bindAuto),
+		OnReply: socksReplies.Add,
+	}
+	listeners := map[string]*switchListener{
+		"fixed": {
+			name: "socks5 (fixed)", addr: socksFixedAddr, mode: socketMode, logger: logger, fail: cancel,
+			wrap:  func(ln net.Listener) net.Listener { return limitConnections(ln, queueWait, connLimits["fixed"], globalLimit) },
+			serve: socksSrvFixed.Serve,
+		},
+		"auto": {
+			name: "socks5 (auto)", addr: socksAutoAddr, mode: socketMode, logger: logger, fail: cancel,
+			wrap:  func(ln net.Listener) net.Listener { return limitConnections(ln, queueWait, connLimits["auto"], globalLimit) },
+			serve: socksSrvAuto.Serve,
+		},
+	}
+
+	// The HTTP proxy shares the auto listener's pool and retry policy.
+	httpProxy := &httpproxy.Server{
+		Logger:          logger,
+		DialTimeout:     dialTimeout,
+		KeepAlive:       cfg.UpstreamKeepAlive.Duration(),
+		IdleConnTimeout: cfg.IdleConnTimeout.Duration(),
+		Manager:         autoManager,
+		Targets:         targetPolicy,
+		Self:            selfGuard,
+		Headers:         cfg.HTTPProxyHeaders(),
+		Retry:           cfg.RetryPolicy(),
+
+		MaxResponseBytes: cfg.HTTPProxyMaxResponseBytes,
+		MaxRequestBytes:  cfg.HTTPProxyMaxRequestBytes,
+	}
+
+	// webLn and httpProxyLn are bound together with the SOCKS listeners,
+	// before serving.
+	var (
+		webLn      net.Listener
+		webCleanup func()
+
+		httpProxyLn      net.Listener
+		httpProxyCleanup func()
+	)
 
 	refresh := logic.NewRefresher([]*logic.ProxyManager{fixedManager, autoManager}, *cfg.Sources, cfg.Proxies, cfg.Validation, dialTimeout)
+	refresh.AllowPrivate = cfg.AllowPrivateProxies
+	refresh.TrustStatic = cfg.TrustStatic
+	refresh.MaxPoolSize = cfg.MaxPoolSize
+	refresh.MaxProxyRange = cfg.MaxProxyRange
+	refresh.Progressive = cfg.RefreshProgressive
+	refresh.TypeCache = logic.NewTypeCache(cfg.TypeCacheTTL.Duration())
+	refresh.Seen = logic.NewSeenTracker(cfg.SeenRetention.Duration())
+	refresh.Self = selfGuard
+	if cfg.SeenPath != "" {
+		if err := loadSeen(cfg.SeenPath, refresh.Seen, time.Now()); err != nil {
+			logger.Printf("load seen records: %v", err)
+		}
+	}
+	refresh.Blocklist = logic.NewBlocklist(cfg.BlocklistAfter, cfg.BlocklistDuration.Duration())
+	// saveBlocklistState persists the blocklist when configured to.
+	saveBlocklistState := func() {
+		if cfg.BlocklistPath == "" || refresh.Blocklist == nil {
+			return
+		}
+		if err := saveBlocklist(cfg.BlocklistPath, refresh.Blocklist); err != nil {
+			logger.Printf("save blocklist: %v", err)
+		}
+	}
+	if cfg.BlocklistPath != "" && refresh.Blocklist != nil {
+		if err := loadBlocklist(cfg.BlocklistPath, refresh.Blocklist, time.Now()); err != nil {
+			logger.Printf("load blocklist: %v", err)
+		}
+	}
+	if webhook != nil {
+		go webhook.Run(ctx)
+	}
+	sweeper := logic.NewLatencySweeper([]*logic.ProxyManager{fixedManager, autoManager}, logic.LatencySweepConfig{
+		Every:       cfg.LatencySweepEvery.Duration(),
+		Concurrency: cfg.LatencySweepConcurrency,
+		TestAddr:    cfg.Validation.TestFor(logic.ProxyTypeSOCKS5).Target,
+		Timeout:     dialTimeout,
+	})
+	sweeper.Logger = logger
+	go sweeper.Run(ctx)
+	metrics := &metricsHistory{}
+	sampleMetrics := func(trigger string) metricsSample {
+		s := metricsSample{
+			At:       time.Now().UTC(),
+			Trigger:  trigger,
+			PoolSize: fixedManager.PoolSize(),
+			AutoSize: autoManager.PoolSize(),
+		}
+		if v := refresh.LastValidation(); v != nil {
+			s.Tested, s.Valid = v.Tested, v.Valid
+		}
+		return s
+	}
+	// doRefresh runs a refresh and its bookkeeping; the diff is zero when
+	// the pool was kept.
+	doRefresh := func(ctx context.Context, mode string) (int, logic.PoolDiff, error) {
+		run := refresh.Refresh
+		if mode == logic.RefreshModeTopUp {
+			run = refresh.TopUp
+		}
+		start := time.Now()
+		count, diff, err := run(ctx)
+		sample := sampleMetrics("refresh")
+		sample.RefreshMS = time.Since(start).Milliseconds()
+		if err != nil {
+			sample.RefreshErr = err.Error()
+		}
+		metrics.Add(sample)
+		if cfg.SeenPath != "" {
+			if serr := saveSeen(cfg.SeenPath, refresh.Seen); serr != nil {
+				logger.Printf("save seen records: %v", serr)
+			}
+		}
+		saveBlocklistState()
+		if inferred := refresh.LastInferred(); len(inferred) > 0 {
+			logger.Printf("refresh: detected proxy types %v", inferred)
+		}
+		if v := refresh.LastValidation(); v != nil && v.Blocklisted > 0 {
+			logger.Printf("refresh: skipped %d blocklisted candidates", v.Blocklisted)
+		}
+		if v := refresh.LastValidation(); v != nil && len(v.AuthFailed) > 0 {
+			logger.Printf("refresh: %d proxies rejected their credentials", len(v.AuthFailed))
+			for _, addr := range v.AuthFailed {
+				removedLog.Record(addr, logic.RemovedReasonAuthFailed)
+			}
+		}
+		switch {
+		case !diff.At.IsZero():
+			sum := diff.Summary()
+			if err != nil {
+				logger.Printf("refresh: %d proxies (+%d -%d =%d), warning: %v", count, sum.Added, sum.Removed, sum.Retained, err)
+			} else {
+				logger.Printf("refresh: %d proxies (+%d -%d =%d)", count, sum.Added, sum.Removed, sum.Retained)
+			}
+			errMsg := ""
+			if err != nil {
+				errMsg = err.Error()
+			}
+			emit(logic.Event{Type: logic.EventRefreshCompleted, Count: count, Error: errMsg})
+			for _, addr := range diff.Removed {
+				upstreamPool.Drop(addr)
+			}
+			warmFixed()
+			if cfg.SnapshotPath != "" && count >= cfg.SnapshotMinNodes {
+				path, serr := writeSnapshot(cfg, fixedManager.PoolSnapshot(0), diff.At)
+				if serr != nil {
+					logger.Printf("write snapshot: %v", serr)
+				} else {
+					logger.Printf("snapshot written: %s", path)
+				}
+			}
+		case err != nil:
+			logger.Printf("refresh failed: %v", err)
+		}
+		return count, diff, err
+	}
 
 	go func() {
 		// Best-effort initial refresh; keep running even if it fails.
-		_, _ = refresh.Refresh(ctx)
+		_, _, err := doRefresh(ctx, cfg.RefreshMode)
+		audit.RecordSystem("refresh", map[string]string{"mode": cfg.RefreshMode, "trigger": "startup"}, err)
 		if refreshEvery <= 0 {
 			return
 		}
-		ticker := time.NewTicker(refreshEvery)
-		defer ticker.Stop()
+		// Each interval is drawn anew so instances started together drift
+		// apart; it counts from the start of the previous refresh, like a ticker.
+		jitter := cfg.RefreshJitter.Duration()
+		timer := time.NewTimer(jitterInterval(refreshEvery, jitter))
+		defer timer.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
-				_, _ = refresh.Refresh(ctx)
+			case <-timer.C:
+				start := time.Now()
+				_, _, err := doRefresh(ctx, cfg.RefreshMode)
+				audit.RecordSystem("refresh", map[string]string{"mode": cfg.RefreshMode, "trigger": "schedule"}, err)
+				timer.Reset(jitterInterval(refreshEvery, jitter) - time.Since(start))
 			}
 		}
 	}()
 
-	if rotateEvery > 0 {
-		hcTarget := cfg.Validation.SOCKS5TestAddr
-		hcTimeout := dialTimeout
-		hcTLSVerify := cfg.Validation.TLSVerifyEnabled()
-		if hcTimeout <= 0 || hcTimeout > 10*time.Second {
-			hcTimeout = 10 * time.Second
-		}
+	watchdog := newHealthWatchdog(cfg.UnhealthyExitAfter.Duration(), fixedManager.Status, cancel, logger)
+	go watchdog.Run(ctx)
 
-		ensureValidCurrent := func() {
-			tries := fixedManager.PoolSize()
-			if tries <= 0 {
-				return
-			}
-			for i := 0; i < tries; i++ {
-				current, ok := fixedManager.Current()
-				if !ok {
-					return
-				}
-				cctx, cancel := context.WithTimeout(ctx, hcTimeout)
-				var ok2 bool
-				var err error
-				if hcTLSVerify {
-					ok2, _, err = logic.CheckSOCKS5TLS(cctx, current, hcTarget, hcTimeout)
-				} else {
-					ok2, _, err = logic.CheckSOCKS5TCP(cctx, current, hcTarget, hcTimeout)
-				}
-				cancel()
-				if err == nil && ok2 {
-					fixedManager.ReportSuccess(current)
-					return
-				}
-				fixedManager.ReportFailure(current, 1)
-				_, _ = fixedManager.Next()
-			}
-		}
+	rotation.Start(ctx)
+	defer rotation.Stop()
 
-		go func() {
-			ticker := time.NewTicker(rotateEvery)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-ticker.C:
-					_, _ = fixedManager.Next()
-					ensureValidCurrent()
-				}
+	go metrics.Run(ctx, cfg.HistoryEvery.Duration(), func() metricsSample { return sampleMetrics("timer") })
+
+	var poolHist *poolHistory
+	if cfg.HistoryPath != "" {
+		poolHist = &poolHistory{path: cfg.HistoryPath, retention: cfg.HistoryRetention.Duration(), logger: logger}
+		go poolHist.Run(ctx, cfg.HistoryEvery.Duration(), func() poolSample {
+			s := poolSample{
+				At:        time.Now().UTC(),
+				Fixed:     fixedManager.Metrics(),
+				AutoSize:  autoManager.PoolSize(),
+				Rotations: history.Total(),
 			}
-		}()
+			if v := refresh.LastValidation(); v != nil {
+				s.Tested, s.Valid = v.Tested, v.Valid
+			}
+			return s
+		})
 	}
 
 	// Web (Gin)
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 	router.Use(gin.Recovery())
-	router.Use(func(c *gin.Context) {
-		start := time.Now()
-		c.Next()
-		path := c.Request.URL.Path
-		if path == "/api/status" || path == "/healthz" {
-			return
-		}
-		logger.Printf("%s %s %s %d %s", c.ClientIP(), c.Request.Method, path, c.Writer.Status(), time.Since(start).Truncate(time.Millisecond))
-	})
+	router.Use(api.RequestLog(logger))
 
-	router.GET("/", func(c *gin.Context) {
-		c.Data(http.StatusOK, "text/html; charset=utf-8", indexHTML)
-	})
-	router.GET("/healthz", func(c *gin.Context) {
-		c.String(http.StatusOK, "ok\n")
-	})
+	router.GET("/", gin.WrapH(assets))
+	router.GET("/static/*path", gin.WrapH(http.StripPrefix("/static", assets)))
 
-	api := router.Group("/api")
-	api.GET("/status", func(c *gin.Context) {
-		type apiStatus struct {
-			WebListen        string       `json:"web_listen"`
-			SOCKSFixedListen string       `json:"socks_fixed_listen"`
-			SOCKSAutoListen  string       `json:"socks_auto_listen"`
-			Fixed            logic.Status `json:"fixed"`
-			Auto             logic.Status `json:"auto"`
-
-			// Backward-compatible fields (fixed).
-			CurrentSOCKS5      string    `json:"current_socks5,omitempty"`
-			CurrentSOCKS5Index int       `json:"current_socks5_index"`
-			SOCKS5PoolSize     int       `json:"socks5_pool_size"`
-			PoolSize           int       `json:"pool_size"`
-			LastRefreshAt      time.Time `json:"last_refresh_at,omitempty"`
-			LastRefreshErr     string    `json:"last_refresh_err,omitempty"`
+	boundAddrs := func() map[string]string {
+		out := make(map[string]string)
+		if webLn != nil {
+			out["web"] = webLn.Addr().String()
 		}
-
-		fixed := fixedManager.Status()
-		auto := autoManager.Status()
-		c.JSON(http.StatusOK, apiStatus{
-			WebListen:        webAddr,
-			SOCKSFixedListen: socksFixedAddr,
-			SOCKSAutoListen:  socksAutoAddr,
-			Fixed:            fixed,
-			Auto:             auto,
-
-			CurrentSOCKS5:      fixed.CurrentSOCKS5,
-			CurrentSOCKS5Index: fixed.CurrentSOCKS5Index,
-			SOCKS5PoolSize:     fixed.SOCKS5PoolSize,
-			PoolSize:           fixed.PoolSize,
-			LastRefreshAt:      fixed.LastRefreshAt,
-			LastRefreshErr:     fixed.LastRefreshErr,
-		})
-	})
-	api.POST("/next", func(c *gin.Context) {
-		next, ok := fixedManager.Next()
-		if !ok {
-			c.JSON(http.StatusConflict, gin.H{"status": "empty_pool"})
-			return
+		if httpProxyLn != nil {
+			out["http"] = httpProxyLn.Addr().String()
 		}
-		c.JSON(http.StatusOK, gin.H{"status": "ok", "type": logic.ProxyTypeSOCKS5, "new_proxy": next.String()})
-	})
-	api.POST("/refresh", func(c *gin.Context) {
-		rctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
-		defer cancel()
-		count, err := refresh.Refresh(rctx)
-		if err != nil && count > 0 {
-			c.JSON(http.StatusOK, gin.H{"count": count, "warning": err.Error()})
-			return
+		for name, l := range listeners {
+			if a := l.Addr(); a != nil {
+				out[name] = a.String()
+			}
 		}
-		if err != nil {
-			c.JSON(http.StatusBadGateway, gin.H{"count": count, "error": err.Error()})
-			return
+		return out
+	}
+
+	// guardListeners points selfGuard at the listeners as bound now.
+	guardListeners := func() {
+		bound := boundAddrs()
+		addrs := make([]string, 0, len(bound))
+		for _, a := range bound {
+			addrs = append(addrs, a)
 		}
-		c.JSON(http.StatusOK, gin.H{"count": count})
-	})
-	api.POST("/check", func(c *gin.Context) {
-		rctx, cancel := context.WithTimeout(c.Request.Context(), 20*time.Second)
-		defer cancel()
-
-		mode := c.Query("mode")
-		if mode == "" {
-			mode = "fixed"
-		}
-
-		var (
-			current logic.ProxyNode
-			ok      bool
-		)
-		switch mode {
-		case "fixed":
-			current, ok = fixedManager.Current()
-		case "auto":
-			current, ok = autoManager.Current()
-			if !ok && autoManager.PoolSize() > 0 {
-				current, ok = autoManager.Next()
-			}
-		default:
-			c.JSON(http.StatusBadRequest, gin.H{"valid": false, "error": "invalid mode"})
-			return
+		selfGuard.SetListeners(addrs)
+	}
+
+	// advertised is what /api/status tells clients to connect to, per
+	// listener; readvertise recomputes it after every bind, enable and
+	// reload, so the primary interface address is looked up only then.
+	var (
+		advertiseMu  sync.Mutex
+		advertiseCfg = map[string]string{"web": cfg.WebAdvertise, "fixed": cfg.SOCKSAdvertise, "auto": cfg.SOCKSAutoAdvertise}
+		advertised   map[string]string
+	)
+	readvertise := func() {
+		advertiseMu.Lock()
+		defer advertiseMu.Unlock()
+		out := make(map[string]string)
+		var webBound net.Addr
+		if webLn != nil {
+			webBound = webLn.Addr()
 		}
-		if !ok {
-			c.JSON(http.StatusConflict, gin.H{"valid": false, "error": "empty_pool"})
-			return
+		if a := advertiseAddr(webAddr, advertiseCfg["web"], webBound, primaryIP); a != "" {
+			out["web"] = a
 		}
-		target := c.Query("target")
-		if target == "" {
-			target = "example.com:443"
-		}
-
-		tlsParam := c.Query("tls")
-		tlsVerify := false
-		switch tlsParam {
-		case "1", "true", "yes", "on":
-			tlsVerify = true
-		case "0", "false", "no", "off":
-			tlsVerify = false
-		default:
-			_, _, port, err := logic.ParseTargetAddr(target)
-			if err == nil && port == "443" {
-				tlsVerify = true
+		for name, l := range listeners {
+			if a := advertiseAddr(l.ListenAddr(), advertiseCfg[name], l.Addr(), primaryIP); a != "" {
+				out[name] = a
 			}
 		}
+		advertised = out
+	}
+	advertisedAddrs := func() map[string]string {
+		advertiseMu.Lock()
+		defer advertiseMu.Unlock()
+		return advertised
+	}
 
-		start := time.Now()
-		var (
-			ok2 bool
-			err error
-		)
-		if tlsVerify {
-			ok2, _, err = logic.CheckSOCKS5TLS(rctx, current, target, dialTimeout)
-		} else {
-			ok2, _, err = logic.CheckSOCKS5TCP(rctx, current, target, dialTimeout)
-		}
-		latency := time.Since(start).Milliseconds()
-		if err != nil {
-			if mode == "fixed" {
-				fixedManager.ReportFailure(current, 1)
-			} else {
-				autoManager.ReportFailure(current, 1)
+	// reloadConfig re-reads configPath and, unless dryRun or the shadow
+	// check found problems, applies its reloadable settings: the listeners
+	// move first (back again if one fails), then the refresher takes the
+	// sources and proxies for its next refresh.
+	var (
+		reloadMu sync.Mutex
+		running  = cfg
+	)
+	reloadConfig := func(ctx context.Context, dryRun bool) reloadReport {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		next, rep := prepareReload(ctx, configPath, running)
+		rep.DryRun = dryRun
+		if dryRun || len(rep.Problems) > 0 {
+			return rep
+		}
+		var moved []*switchListener
+		var restore []string
+		for _, m := range []struct {
+			field string
+			l     *switchListener
+			addr  string
+		}{
+			{"socks_listen", listeners["fixed"], next.SOCKSListen},
+			{"socks_auto_listen", listeners["auto"], next.SOCKSAutoListen},
+		} {
+			old := m.l.ListenAddr()
+			if err := m.l.Move(m.addr); err != nil {
+				for i, l := range moved {
+					if berr := l.Move(restore[i]); berr != nil {
+						logger.Printf("reload: restore %s %s: %v", l.name, restore[i], berr)
+					}
+				}
+				rep.problem("listen", m.field, err)
+				return rep
 			}
-			c.JSON(http.StatusOK, gin.H{"valid": false, "latency": latency, "type": logic.ProxyTypeSOCKS5, "proxy": current.String(), "target": target, "tls_verify": tlsVerify, "error": err.Error()})
-			return
+			moved, restore = append(moved, m.l), append(restore, old)
 		}
-		if !ok2 {
-			c.JSON(http.StatusOK, gin.H{"valid": false, "latency": latency, "type": logic.ProxyTypeSOCKS5, "proxy": current.String(), "target": target, "tls_verify": tlsVerify, "error": "check failed"})
-			return
+		guardListeners()
+		advertiseMu.Lock()
+		advertiseCfg = map[string]string{"web": next.WebAdvertise, "fixed": next.SOCKSAdvertise, "auto": next.SOCKSAutoAdvertise}
+		advertiseMu.Unlock()
+		readvertise()
+		refresh.SetSources(*next.Sources, next.Proxies)
+		running.SOCKSListen, running.SOCKSAutoListen = next.SOCKSListen, next.SOCKSAutoListen
+		running.WebAdvertise, running.SOCKSAdvertise, running.SOCKSAutoAdvertise = next.WebAdvertise, next.SOCKSAdvertise, next.SOCKSAutoAdvertise
+		running.Sources, running.Proxies = next.Sources, next.Proxies
+		rep.Applied = true
+		logger.Printf("config reloaded: changed %v", rep.Changed)
+		if len(rep.RestartRequired) > 0 {
+			logger.Printf("config reload: %v take a restart", rep.RestartRequired)
 		}
-		if mode == "fixed" {
-			fixedManager.ReportSuccess(current)
-		} else {
-			autoManager.ReportSuccess(current)
+		return rep
+	}
+
+	apiServer := api.New(cfg.API(), fixedManager, autoManager, apiRefresher{refresh, doRefresh})
+	apiServer.Logger = logger
+	apiServer.Leases = leases
+	apiServer.Audit = audit
+	apiServer.Listeners = map[string]api.Listener{"fixed": listeners["fixed"], "auto": listeners["auto"]}
+	apiServer.SelfTestDials = selfTestDials
+	apiServer.Health = watchdog
+	apiServer.Rotation = rotation
+	apiServer.RotationHistory = history
+	apiServer.RemovedLog = removedLog
+	apiServer.Blocklist = refresh.Blocklist
+	apiServer.Seen = refresh.Seen
+	apiServer.TypeCache = refresh.TypeCache
+	apiServer.Targets = targetPolicy
+	apiServer.Upstreams = upstreamPool
+	apiServer.Shapers = shapers
+	apiServer.DialErrors = &dialErrors
+	apiServer.SOCKSReplies = &socksReplies
+	apiServer.DialsAbandoned = &dialsAbandoned
+	apiServer.StaleChecks = &staleChecks
+	apiServer.StaleRotations = &staleRotations
+	apiServer.Started = started
+	apiServer.Bound = boundAddrs
+	apiServer.Advertised = advertisedAddrs
+	apiServer.Connections = func() map[string]api.ConnStats {
+		out := map[string]api.ConnStats{"global": api.ConnStats(globalLimit.Stats())}
+		for name, l := range connLimits {
+			out[name] = api.ConnStats(l.Stats())
 		}
-		c.JSON(http.StatusOK, gin.H{"valid": true, "latency": latency, "type": logic.ProxyTypeSOCKS5, "proxy": current.String(), "target": target, "tls_verify": tlsVerify})
-	})
-	api.GET("/pool", func(c *gin.Context) {
-		mode := c.Query("mode")
-		if mode == "" {
-			mode = "fixed"
-		}
-		var (
-			nodes []logic.ProxyNode
-			size  int
-		)
-		switch mode {
-		case "fixed":
-			nodes = fixedManager.PoolSnapshot(200)
-			size = fixedManager.PoolSize()
-		case "auto":
-			nodes = autoManager.PoolSnapshot(200)
-			size = autoManager.PoolSize()
-		default:
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode"})
-			return
+		return out
+	}
+	apiServer.ListenersChanged = func() {
+		guardListeners()
+		readvertise()
+	}
+	apiServer.OnRotate = recordRotation
+	apiServer.BlocklistChanged = saveBlocklistState
+	apiServer.History = func(limit int) any { return metrics.Samples(limit) }
+	if poolHist != nil {
+		apiServer.PoolHistory = func(since time.Time) (any, error) { return poolHist.read(since) }
+	}
+	if configPath != "" {
+		apiServer.Reload = func(ctx context.Context, dryRun bool) (any, bool) {
+			rep := reloadConfig(ctx, dryRun)
+			return rep, len(rep.Problems) > 0
 		}
-		c.JSON(http.StatusOK, gin.H{"type": logic.ProxyTypeSOCKS5, "items": nodes, "pool_size": size})
-	})
-
-	webServer := &http.Server{Addr: webAddr, Handler: router}
-	go func() {
-		logger.Printf("web listening on http://%s", webAddr)
-		if err := webServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Printf("web server error: %v", err)
-			cancel()
+	}
+	apiServer.Register(&router.RouterGroup)
+
+	// Bind everything before serving anything: a port conflict then fails
+	// startup as a whole, with every problem listed, instead of half-starting.
+	webCleanup = func() {}
+	httpProxyCleanup = func() {}
+	var targets []bindTarget
+	if !listenOff(webAddr) {
+		targets = append(targets, bindTarget{
+			bind: func() error {
+				ln, cleanup, err := listen(webAddr, socketMode)
+				if err != nil {
+					return fmt.Errorf("listen web %s: %w", webAddr, err)
+				}
+				webLn, webCleanup = ln, cleanup
+				return nil
+			},
+			unbind: func() { _ = webLn.Close(); webCleanup() },
+		})
+	}
+	if !listenOff(httpProxyAddr) {
+		targets = append(targets, bindTarget{
+			bind: func() error {
+				ln, cleanup, err := listen(httpProxyAddr, socketMode)
+				if err != nil {
+					return fmt.Errorf("listen http proxy %s: %w", httpProxyAddr, err)
+				}
+				httpProxyLn, httpProxyCleanup = ln, cleanup
+				return nil
+			},
+			unbind: func() { _ = httpProxyLn.Close(); httpProxyCleanup() },
+		})
+	}
+	for _, name := range []string{"fixed", "auto"} {
+		if l := listeners[name]; !l.Off() {
+			targets = append(targets, bindTarget{bind: l.Bind, unbind: l.Disable})
 		}
-	}()
-
-	// SOCKS5 (fixed)
-	socksSrvFixed, err := socks5.New(&socks5.Config{
-		Logger: logger,
-		Dial:   dialFixed,
-	})
-	if err != nil {
-		logger.Fatalf("create socks5 server: %v", err)
 	}
-
-	socksLnFixed, err := net.Listen("tcp", socksFixedAddr)
-	if err != nil {
-		logger.Fatalf("listen socks5 (fixed) %s: %v", socksFixedAddr, err)
+	if err := bindAll(targets); err != nil {
+		logger.Fatalf("startup failed:\n%v", err)
 	}
+	guardListeners()
+	readvertise()
+	defer webCleanup()
+	defer httpProxyCleanup()
+	webServer := &http.Server{Handler: router}
+	webScheme := "http"
+	var reloadCerts *certReloader
+	if cfg.WebTLSCert != "" {
+		tlsCfg, certs, err := webTLSConfig(cfg)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		webServer.TLSConfig = tlsCfg
+		webScheme = "https"
+		reloadCerts = certs
+	}
+	// SIGHUP re-reads the web TLS certificate and the config.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		<-ctx.Done()
-		_ = socksLnFixed.Close()
-	}()
-	go func() {
-		logger.Printf("socks5 (fixed) listening on %s", socksFixedAddr)
-		if err := socksSrvFixed.Serve(socksLnFixed); err != nil {
-			if !errors.Is(err, net.ErrClosed) {
-				logger.Printf("socks5 server error: %v", err)
-				cancel()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+			if reloadCerts != nil {
+				if err := reloadCerts.Reload(); err != nil {
+					logger.Printf("reload web tls cert: %v", err)
+				} else {
+					logger.Printf("web tls cert reloaded")
+				}
+			}
+			if configPath == "" {
+				continue
+			}
+			rctx, rcancel := context.WithTimeout(ctx, 30*time.Second)
+			rep := reloadConfig(rctx, false)
+			rcancel()
+			for _, p := range rep.Problems {
+				logger.Printf("config reload rejected: %s %s: %s", p.Check, p.Field, p.Error)
 			}
 		}
 	}()
-
-	// SOCKS5 (auto, per-connection rotation)
-	socksSrvAuto, err := socks5.New(&socks5.Config{
-		Logger: logger,
-		Dial:   dialAuto,
-	})
-	if err != nil {
-		logger.Fatalf("create socks5 (auto) server: %v", err)
+	if webLn != nil {
+		webLn = limitConnections(webLn, queueWait, connLimits["web"], globalLimit)
+		go func() {
+			logger.Printf("web listening on %s://%s", webScheme, webLn.Addr())
+			var err error
+			if webServer.TLSConfig != nil {
+				err = webServer.ServeTLS(webLn, "", "")
+			} else {
+				err = webServer.Serve(webLn)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logger.Printf("web server error: %v", err)
+				cancel()
+			}
+		}()
+	} else {
+		logger.Printf("web listener is off")
+	}
+	if httpProxyLn != nil {
+		httpProxyLn = limitConnections(httpProxyLn, queueWait, connLimits["http"], globalLimit)
+		go func() {
+			logger.Printf("http proxy listening on %s", httpProxyLn.Addr())
+			if err := httpProxy.Serve(ctx, httpProxyLn); err != nil {
+				logger.Printf("http proxy error: %v", err)
+				cancel()
+			}
+		}()
 	}
 
-	socksLnAuto, err := net.Listen("tcp", socksAutoAddr)
-	if err != nil {
-		logger.Fatalf("listen socks5 (auto) %s: %v", socksAutoAddr, err)
+	for _, name := range []string{"fixed", "auto"} {
+		if listeners[name].Off() {
+			logger.Printf("%s listener is off", listeners[name].name)
+			continue
+		}
+		if err := listeners[name].Enable(); err != nil {
+			logger.Fatal(err)
+		}
 	}
 	go func() {
 		<-ctx.Done()
-		_ = socksLnAuto.Close()
-	}()
-	go func() {
-		logger.Printf("socks5 (auto) listening on %s", socksAutoAddr)
-		if err := socksSrvAuto.Serve(socksLnAuto); err != nil {
-			if !errors.Is(err, net.ErrClosed) {
-				logger.Printf("socks5 (auto) server error: %v", err)
-				cancel()
-			}
+		for _, l := range listeners {
+			l.Disable()
 		}
 	}()
 
@@ -434,4 +951,27 @@ func main() {
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutdownCancel()
 	_ = webServer.Shutdown(shutdownCtx)
+	if watchdog.Tripped() {
+		os.Exit(1)
+	}
+}
+
+// apiRefresher runs the API's refreshes through run, which adds main's
+// bookkeeping to them.
+type apiRefresher struct {
+	*logic.Refresher
+	run func(ctx context.Context, mode string) (int, logic.PoolDiff, error)
+}
+
+func (r apiRefresher) Run(ctx context.Context, mode string) (int, logic.PoolDiff, error) {
+	return r.run(ctx, mode)
+}
+
+// jitterInterval returns every shifted by a uniform random amount in
+// [-jitter, +jitter], or every itself when jitter <= 0.
+func jitterInterval(every, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return every
+	}
+	return every - jitter + time.Duration(rand.Int63n(int64(2*jitter)+1))
 }
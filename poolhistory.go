@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+// poolSample is one line of the pool history file.
+type poolSample struct {
+	At        time.Time         `json:"at"`
+	Fixed     logic.PoolMetrics `json:"fixed"`
+	AutoSize  int               `json:"auto_size"`
+	Tested    int               `json:"tested,omitempty"`
+	Valid     int               `json:"valid,omitempty"`
+	Rotations int64             `json:"rotations"`
+}
+
+const (
+	poolHistoryDayLayout = "20060102"
+	// maxPoolHistorySamples bounds what /api/history/pool returns.
+	maxPoolHistorySamples = 5000
+)
+
+// poolHistory appends samples to one JSON-lines file per UTC day, named
+// after path ("pool.jsonl" -> "pool-20260102.jsonl"), and removes files
+// older than retention.
+type poolHistory struct {
+	path      string
+	retention time.Duration
+	logger    *log.Logger
+
+	mu sync.Mutex
+}
+
+func (h *poolHistory) Run(ctx context.Context, every time.Duration, sample func() poolSample) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep sampling when the directory is unwritable; it may come back.
+			if err := h.append(sample()); err != nil {
+				h.logger.Printf("pool history: %v", err)
+			}
+		}
+	}
+}
+
+func (h *poolHistory) fileFor(day time.Time) string {
+	dir, prefix, ext := snapshotNameParts(h.path)
+	return filepath.Join(dir, prefix+"-"+day.UTC().Format(poolHistoryDayLayout)+ext)
+}
+
+func (h *poolHistory) append(s poolSample) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dir, _, _ := snapshotNameParts(h.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.fileFor(s.At), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return h.prune(s.At)
+}
+
+// files returns the day files sorted oldest first, with their day.
+func (h *poolHistory) files() ([]string, []time.Time) {
+	dir, prefix, ext := snapshotNameParts(h.path)
+	matches, _ := filepath.Glob(filepath.Join(dir, prefix+"-*"+ext))
+	sort.Strings(matches)
+	var paths []string
+	var days []time.Time
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), prefix+"-"), ext)
+		day, err := time.Parse(poolHistoryDayLayout, stamp)
+		if err != nil {
+			continue
+		}
+		paths = append(paths, m)
+		days = append(days, day)
+	}
+	return paths, days
+}
+
+func (h *poolHistory) prune(now time.Time) error {
+	cutoff := now.Add(-h.retention)
+	paths, days := h.files()
+	for i, p := range paths {
+		// A day file is expired once its last possible sample is.
+		if days[i].Add(24 * time.Hour).Before(cutoff) {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// read returns samples taken at or after since, oldest first, keeping the
+// newest maxPoolHistorySamples.
+func (h *poolHistory) read(since time.Time) ([]poolSample, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []poolSample
+	paths, days := h.files()
+	for i, p := range paths {
+		if days[i].Add(24 * time.Hour).Before(since) {
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var s poolSample
+			if json.Unmarshal(sc.Bytes(), &s) != nil || s.At.Before(since) {
+				continue
+			}
+			out = append(out, s)
+		}
+		_ = f.Close()
+		if len(out) > maxPoolHistorySamples {
+			out = append([]poolSample(nil), out[len(out)-maxPoolHistorySamples:]...)
+		}
+	}
+	return out, nil
+}
+
+// maxMetricsSamples bounds the in-memory trend: a day at the default
+// history_every of 5m.
+const maxMetricsSamples = 288
+
+// metricsSample is one point of the trend served by /api/history.
+type metricsSample struct {
+	At time.Time `json:"at"`
+	// Trigger is "refresh" for samples taken after a refresh and "timer"
+	// for the periodic ones.
+	Trigger  string `json:"trigger"`
+	PoolSize int    `json:"pool_size"`
+	AutoSize int    `json:"auto_size"`
+	Tested   int    `json:"tested,omitempty"`
+	Valid    int    `json:"valid,omitempty"`
+	// RefreshMS and RefreshErr describe the refresh a "refresh" sample
+	// follows.
+	RefreshMS  int64  `json:"refresh_ms,omitempty"`
+	RefreshErr string `json:"refresh_error,omitempty"`
+}
+
+// metricsHistory keeps the newest maxMetricsSamples samples in memory, so
+// the UI can draw trends without history_path.
+type metricsHistory struct {
+	mu      sync.Mutex
+	samples []metricsSample
+}
+
+func (h *metricsHistory) Add(s metricsSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples = append(h.samples, s)
+	if len(h.samples) > maxMetricsSamples {
+		h.samples = append([]metricsSample(nil), h.samples[len(h.samples)-maxMetricsSamples:]...)
+	}
+}
+
+// Samples returns up to limit of the newest samples, oldest first.
+func (h *metricsHistory) Samples(limit int) []metricsSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := h.samples
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return append([]metricsSample(nil), out...)
+}
+
+// Run adds a sample every interval until ctx is done.
+func (h *metricsHistory) Run(ctx context.Context, every time.Duration, sample func() metricsSample) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Add(sample())
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+// reloadSourceTimeout bounds the shadow fetch of one source.
+const reloadSourceTimeout = 10 * time.Second
+
+// reloadable are the config keys a reload applies to the running process;
+// a change to any other key takes a restart.
+var reloadable = map[string]bool{
+	"sources":              true,
+	"proxies":              true,
+	"socks_listen":         true,
+	"socks_auto_listen":    true,
+	"socks_advertise":      true,
+	"socks_auto_advertise": true,
+	"web_advertise":        true,
+}
+
+// reloadProblem is one reason a reload was rejected.
+type reloadProblem struct {
+	// Check is the stage that found it: "config", "source", "listen" or
+	// "file".
+	Check string `json:"check"`
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+}
+
+// reloadReport is the outcome of a config reload, applied or not.
+type reloadReport struct {
+	DryRun  bool `json:"dry_run"`
+	Applied bool `json:"applied"`
+	// Changed lists the config keys that differ from the running config;
+	// RestartRequired lists those among them a reload does not apply.
+	Changed         []string            `json:"changed,omitempty"`
+	RestartRequired []string            `json:"restart_required,omitempty"`
+	Sources         []logic.SourceStats `json:"sources,omitempty"`
+	Problems        []reloadProblem     `json:"problems,omitempty"`
+}
+
+func (r *reloadReport) problem(check, field string, err error) {
+	r.Problems = append(r.Problems, reloadProblem{Check: check, Field: field, Error: err.Error()})
+}
+
+// prepareReload reads the config at path and checks it against the running
+// config cur: it must parse and Validate, then pass shadowCheck. The
+// returned config may be applied only when the report has no problems.
+func prepareReload(ctx context.Context, path string, cur Config) (Config, reloadReport) {
+	var rep reloadReport
+	next, err := LoadConfig(path)
+	if err == nil {
+		next.ApplyDefaults()
+		err = next.Validate()
+	}
+	if err != nil {
+		rep.problem("config", "", err)
+		return next, rep
+	}
+	rep.Changed, rep.RestartRequired, err = configChanges(cur, next)
+	if err != nil {
+		rep.problem("config", "", err)
+		return next, rep
+	}
+	shadowCheck(ctx, cur, next, &rep)
+	return next, rep
+}
+
+// configChanges returns the JSON keys whose values differ between a and b,
+// and those among them that are not reloadable.
+func configChanges(a, b Config) (changed, restart []string, err error) {
+	am, err := configKeys(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	bm, err := configKeys(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range bm {
+		if bytes.Equal(am[k], v) {
+			continue
+		}
+		changed = append(changed, k)
+		if !reloadable[k] {
+			restart = append(restart, k)
+		}
+	}
+	for k := range am {
+		if _, ok := bm[k]; !ok {
+			changed = append(changed, k)
+			if !reloadable[k] {
+				restart = append(restart, k)
+			}
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(restart)
+	return changed, restart, nil
+}
+
+func configKeys(c Config) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// shadowCheck exercises the parts of next that Validate cannot judge,
+// without side effects: it fetches every source cur lacks (reporting the
+// counts in rep.Sources), test-binds every listen address that changed and
+// opens the files next names. Each problem found is added to rep.
+func shadowCheck(ctx context.Context, cur, next Config, rep *reloadReport) {
+	var have logic.Sources
+	if cur.Sources != nil {
+		have = *cur.Sources
+	}
+	var fresh []logic.ProxySource
+	for _, src := range *next.Sources {
+		known := false
+		for _, h := range have {
+			if reflect.DeepEqual(h, src) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			fresh = append(fresh, src)
+		}
+	}
+	stats := make([]logic.SourceStats, len(fresh))
+	var wg sync.WaitGroup
+	for i, src := range fresh {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fctx, cancel := context.WithTimeout(ctx, reloadSourceTimeout)
+			defer cancel()
+			_, st, err := logic.FetchFromSourcesWithStats(fctx, logic.Sources{src})
+			stats[i] = logic.SourceStats{URL: src.URL}
+			if len(st) > 0 {
+				stats[i] = st[0]
+			}
+			if err != nil && stats[i].Error == "" {
+				stats[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	rep.Sources = stats
+	for _, st := range stats {
+		if st.Error != "" {
+			rep.problem("source", st.URL, errors.New(st.Error))
+		}
+	}
+
+	for _, l := range []struct{ field, cur, next string }{
+		{"socks_listen", cur.SOCKSListen, next.SOCKSListen},
+		{"socks_auto_listen", cur.SOCKSAutoListen, next.SOCKSAutoListen},
+		{"web_listen", cur.WebListen, next.WebListen},
+		{"http_proxy_listen", cur.HTTPProxyListen, next.HTTPProxyListen},
+	} {
+		if l.next == l.cur || listenOff(l.next) {
+			continue
+		}
+		if err := tryListen(l.next); err != nil {
+			rep.problem("listen", l.field, err)
+		}
+	}
+
+	if next.WebTLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(next.WebTLSCert, next.WebTLSKey); err != nil {
+			rep.problem("file", "web_tls_cert", err)
+		}
+	}
+	if next.WebTLSClientCA != "" {
+		if _, err := loadClientCAs(next.WebTLSClientCA); err != nil {
+			rep.problem("file", "web_tls_client_ca", err)
+		}
+	}
+	if next.WebAssetsDir != "" {
+		if fi, err := os.Stat(next.WebAssetsDir); err != nil {
+			rep.problem("file", "web_assets_dir", err)
+		} else if !fi.IsDir() {
+			rep.problem("file", "web_assets_dir", fmt.Errorf("%s is not a directory", next.WebAssetsDir))
+		}
+	}
+}
+
+// tryListen reports whether addr could be listened on. TCP addresses are
+// bound and closed at once. A Unix socket is not bound, since that would
+// replace a stale socket file: its directory must exist and the path must
+// not be anything but a socket.
+func tryListen(addr string) error {
+	network, address := splitListenAddr(addr)
+	if network == "unix" {
+		if address == "" {
+			return fmt.Errorf("empty unix socket path in %q", addr)
+		}
+		if fi, err := os.Stat(filepath.Dir(address)); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", filepath.Dir(address))
+		}
+		if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", address)
+		}
+		return nil
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"lite-proxy/logic"
+)
+
+// writeConfig writes c as a config file and returns its path.
+func writeConfig(t *testing.T, c Config) string {
+	t.Helper()
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestPrepareReload feeds prepareReload fixture configs with one problem
+// each, and some without, against the same running config.
+func TestPrepareReload(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "1.2.3.4:1080\n5.6.7.8:1080\n")
+	}))
+	defer good.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	cur := testConfig(t, func(c *Config) { c.Sources = &logic.Sources{{URL: good.URL + "/a"}} })
+	withSource := func(url string) func(*Config) {
+		return func(c *Config) { c.Sources = &logic.Sources{{URL: good.URL + "/a"}, {URL: url}} }
+	}
+
+	tests := []struct {
+		name        string
+		change      func(*Config)
+		raw         string
+		wantCheck   string
+		wantField   string
+		wantChanged string
+		wantRestart string
+	}{
+		{name: "unchanged", wantChanged: "[]", wantRestart: "[]"},
+		{name: "new source", change: withSource(good.URL + "/b"), wantChanged: "[sources]", wantRestart: "[]"},
+		{name: "moved listener", change: func(c *Config) { c.SOCKSListen = "127.0.0.1:0" }, wantChanged: "[socks_listen]", wantRestart: "[]"},
+		{name: "restart key", change: func(c *Config) { c.MaxPoolSize = 7 }, wantChanged: "[max_pool_size]", wantRestart: "[max_pool_size]"},
+		{name: "malformed json", raw: `{"sources": [`, wantCheck: "config"},
+		{name: "overlapping listeners", change: func(c *Config) { c.SOCKSAutoListen = c.SOCKSListen }, wantCheck: "config"},
+		{name: "unreachable source", change: withSource(deadURL), wantCheck: "source", wantField: deadURL},
+		{name: "busy listen address", change: func(c *Config) { c.SOCKSListen = taken.Addr().String() }, wantCheck: "listen", wantField: "socks_listen"},
+		{name: "missing tls cert", change: func(c *Config) {
+			c.WebTLSCert, c.WebTLSKey = filepath.Join(t.TempDir(), "cert.pem"), filepath.Join(t.TempDir(), "key.pem")
+		}, wantCheck: "file", wantField: "web_tls_cert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			if tt.raw != "" {
+				path = filepath.Join(t.TempDir(), "config.json")
+				if err := os.WriteFile(path, []byte(tt.raw), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				path = writeConfig(t, testConfig(t, func(c *Config) {
+					*c = cur
+					if tt.change != nil {
+						tt.change(c)
+					}
+				}))
+			}
+
+			_, rep := prepareReload(context.Background(), path, cur)
+			if tt.wantCheck == "" {
+				if len(rep.Problems) != 0 {
+					t.Fatalf("problems = %+v, want none", rep.Problems)
+				}
+				if got := fmt.Sprint(rep.Changed); got != tt.wantChanged {
+					t.Errorf("Changed = %s, want %s", got, tt.wantChanged)
+				}
+				if got := fmt.Sprint(rep.RestartRequired); got != tt.wantRestart {
+					t.Errorf("RestartRequired = %s, want %s", got, tt.wantRestart)
+				}
+				return
+			}
+			if len(rep.Problems) != 1 {
+				t.Fatalf("problems = %+v, want exactly one", rep.Problems)
+			}
+			if p := rep.Problems[0]; p.Check != tt.wantCheck || p.Field != tt.wantField || p.Error == "" {
+				t.Errorf("problem = %+v, want check %q, field %q", p, tt.wantCheck, tt.wantField)
+			}
+		})
+	}
+}
+
+// TestShadowCheckSourceCounts checks that only sources the running config
+// lacks are fetched, and that their counts are reported.
+func TestShadowCheckSourceCounts(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		fetched []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		io.WriteString(w, "1.2.3.4:1080\n5.6.7.8:1080\n9.9.9.9:3128\n")
+	}))
+	defer srv.Close()
+	cur := testConfig(t, func(c *Config) { c.Sources = &logic.Sources{{URL: srv.URL + "/old"}} })
+	next := testConfig(t, func(c *Config) { c.Sources = &logic.Sources{{URL: srv.URL + "/old"}, {URL: srv.URL + "/new"}} })
+
+	var rep reloadReport
+	shadowCheck(context.Background(), cur, next, &rep)
+	if len(rep.Problems) != 0 {
+		t.Fatalf("problems = %+v", rep.Problems)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(fetched) != "[/new]" {
+		t.Errorf("fetched %v, want only the new source", fetched)
+	}
+	if len(rep.Sources) != 1 || rep.Sources[0].URL != srv.URL+"/new" || rep.Sources[0].Count != 3 {
+		t.Errorf("Sources = %+v, want the new source with 3 nodes", rep.Sources)
+	}
+}
+
+func TestTryListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{unixScheme + filepath.Join(dir, "ok.sock"), false},
+		{unixScheme + filepath.Join(dir, "missing", "lp.sock"), true},
+		{unixScheme + filepath.Join(file, "lp.sock"), true},
+		{unixScheme + file, true},
+	}
+	for _, tt := range tests {
+		if err := tryListen(tt.addr); (err != nil) != tt.wantErr {
+			t.Errorf("tryListen(%s) = %v, want error %v", tt.addr, err, tt.wantErr)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ok.sock")); err == nil {
+		t.Error("tryListen left a socket file behind")
+	}
+}
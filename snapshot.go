@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+// snapshotFile is a Config that can be passed to -config as-is: sources are
+// emptied and the validated pool becomes static proxies. Nodes carries the
+// measured latencies for reference; LoadConfig ignores it.
+type snapshotFile struct {
+	Config
+	SnapshotAt time.Time         `json:"snapshot_at"`
+	Nodes      []logic.ProxyNode `json:"nodes"`
+}
+
+const snapshotTimeLayout = "20060102T150405Z"
+
+// writeSnapshot writes nodes as a timestamped config next to cfg.SnapshotPath,
+// replaces cfg.SnapshotPath with the same content and prunes old snapshots so
+// that at most cfg.SnapshotKeep timestamped files remain.
+func writeSnapshot(cfg Config, nodes []logic.ProxyNode, now time.Time) (string, error) {
+	if cfg.SnapshotPath == "" {
+		return "", nil
+	}
+	empty := logic.Sources{}
+	snap := snapshotFile{
+		Config:     cfg,
+		SnapshotAt: now.UTC(),
+		Nodes:      nodes,
+	}
+	snap.Sources = &empty
+	snap.Proxies = make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		snap.Proxies = append(snap.Proxies, logic.FormatProxySpec(n))
+	}
+
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	b = append(b, '\n')
+
+	dir, prefix, ext := snapshotNameParts(cfg.SnapshotPath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	stamped := filepath.Join(dir, fmt.Sprintf("%s-%s%s", prefix, now.UTC().Format(snapshotTimeLayout), ext))
+	if err := writeFileAtomic(stamped, b); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(cfg.SnapshotPath, b); err != nil {
+		return stamped, err
+	}
+	return stamped, pruneSnapshots(dir, prefix, ext, cfg.SnapshotKeep)
+}
+
+func snapshotNameParts(path string) (dir, prefix, ext string) {
+	dir = filepath.Dir(path)
+	base := filepath.Base(path)
+	ext = filepath.Ext(base)
+	if ext == "" {
+		ext = ".json"
+	}
+	prefix = strings.TrimSuffix(base, filepath.Ext(base))
+	return dir, prefix, ext
+}
+
+func pruneSnapshots(dir, prefix, ext string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, prefix+"-*"+ext))
+	if err != nil {
+		return err
+	}
+	var stamped []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), prefix+"-"), ext)
+		if _, err := time.Parse(snapshotTimeLayout, stamp); err == nil {
+			stamped = append(stamped, m)
+		}
+	}
+	if len(stamped) <= keep {
+		return nil
+	}
+	// The timestamp layout sorts lexically in time order.
+	sort.Strings(stamped)
+	for _, m := range stamped[:len(stamped)-keep] {
+		if err := os.Remove(m); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+// loadSeen restores t from the file at path; a missing file is not an error.
+func loadSeen(path string, t *logic.SeenTracker, now time.Time) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st logic.SeenState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	t.Restore(st, now)
+	return nil
+}
+
+func saveSeen(path string, t *logic.SeenTracker) error {
+	b, err := json.Marshal(t.State())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// loadBlocklist restores b from the file at path; a missing file is not an
+// error.
+func loadBlocklist(path string, b *logic.Blocklist, now time.Time) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st logic.BlocklistState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	b.Restore(st, now)
+	return nil
+}
+
+func saveBlocklist(path string, b *logic.Blocklist) error {
+	data, err := json.Marshal(b.State())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+func TestSeenPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.json")
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := logic.ProxyNode{Type: logic.ProxyTypeSOCKS5, IP: "1.2.3.4", Port: "1080"}
+
+	fresh := logic.NewSeenTracker(0)
+	if err := loadSeen(path, fresh, start); err != nil || fresh.Len() != 0 {
+		t.Fatalf("loadSeen without a file = %v, %d records; want nothing", err, fresh.Len())
+	}
+
+	saved := logic.NewSeenTracker(0)
+	saved.Observe([]logic.ProxyNode{a}, start)
+	saved.Observe([]logic.ProxyNode{a}, start.Add(time.Hour))
+	if err := saveSeen(path, saved); err != nil {
+		t.Fatalf("saveSeen: %v", err)
+	}
+	loaded := logic.NewSeenTracker(0)
+	if err := loadSeen(path, loaded, start.Add(2*time.Hour)); err != nil {
+		t.Fatalf("loadSeen: %v", err)
+	}
+	if s, ok := loaded.Get(a.Addr()); !ok || s.Survival != 1 || !s.FirstSeen.Equal(start) {
+		t.Errorf("loaded %s = %+v, %v; want survival 1 since %v", a.Addr(), s, ok, start)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadSeen(path, loaded, start); err == nil {
+		t.Error("loadSeen of a corrupt file succeeded")
+	}
+}
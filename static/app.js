@@ -0,0 +1,238 @@
+const outEl = document.getElementById("out");
+const refreshHint = document.getElementById("refreshHint");
+const poolHint = document.getElementById("poolHint");
+const copyHint = document.getElementById("copyHint");
+
+const socksFixedAddrEl = document.getElementById("socksFixedAddr");
+const socksAutoAddrEl = document.getElementById("socksAutoAddr");
+const webAddrEl = document.getElementById("webAddr");
+
+const curSocks5FixedEl = document.getElementById("curSocks5Fixed");
+const idxSocks5FixedEl = document.getElementById("idxSocks5Fixed");
+const sizeSocks5FixedEl = document.getElementById("sizeSocks5Fixed");
+const curSocks5AutoEl = document.getElementById("curSocks5Auto");
+const idxSocks5AutoEl = document.getElementById("idxSocks5Auto");
+const sizeSocks5AutoEl = document.getElementById("sizeSocks5Auto");
+const sizeAllEl = document.getElementById("sizeAll");
+const lastRefreshEl = document.getElementById("lastRefresh");
+const lastErrEl = document.getElementById("lastErr");
+
+const checkTargetEl = document.getElementById("checkTarget");
+const snippetsEl = document.getElementById("snippets");
+const poolTypeEl = document.getElementById("poolType");
+const poolBodyEl = document.getElementById("poolBody");
+
+function lsGet(key, fallback) {
+  try { return localStorage.getItem(key) || fallback; } catch { return fallback; }
+}
+function lsSet(key, value) {
+  try { localStorage.setItem(key, value); } catch {}
+}
+
+function inferWebAddr() {
+  const { hostname, port } = window.location;
+  if (!hostname) return "127.0.0.1:8088";
+  const p = port || "8088";
+  return `${hostname}:${p}`;
+}
+
+function inferClientHost() {
+  return window.location.hostname || "127.0.0.1";
+}
+
+function clientAddrFromListen(listen, fallbackPort) {
+  const s = String(listen || "").trim();
+  const idx = s.lastIndexOf(":");
+  if (idx <= 0) return `${inferClientHost()}:${fallbackPort}`;
+  let host = s.slice(0, idx);
+  const port = s.slice(idx + 1) || String(fallbackPort);
+  if (host === "0.0.0.0" || host === "::" || host === "[::]") host = inferClientHost();
+  return `${host}:${port}`;
+}
+
+function renderSnippets() {
+  const socksFixed = socksFixedAddrEl.textContent.trim();
+  const socksAuto = socksAutoAddrEl.textContent.trim();
+  const lines = [
+    `# SOCKS5 固定出口（HTTPS）`,
+    `curl -v --proxy socks5h://${socksFixed} https://google.com -m 20`,
+    ``,
+    `# SOCKS5 自动出口（每连接轮询）`,
+    `curl -v --proxy socks5h://${socksAuto} https://google.com -m 20`,
+  ];
+  snippetsEl.textContent = lines.join("\n");
+}
+
+function setClientAddrsFromStorage() {
+  webAddrEl.textContent = inferWebAddr();
+  socksFixedAddrEl.textContent = lsGet("liteproxy.socks_fixed_addr", "127.0.0.1:1080");
+  socksAutoAddrEl.textContent = lsGet("liteproxy.socks_auto_addr", "127.0.0.1:1081");
+  renderSnippets();
+}
+
+async function fetchJSON(path, opts) {
+  const r = await fetch(path, opts);
+  const text = await r.text();
+  let data = null;
+  try { data = JSON.parse(text); } catch {}
+  if (!r.ok) {
+    const msg = (data && (data.error || data.message)) ? (data.error || data.message) : text;
+    throw new Error(`${path} -> ${r.status}: ${msg}`);
+  }
+  return data ?? text;
+}
+
+function fmtTime(s) {
+  if (!s) return "-";
+  try {
+    const d = new Date(s);
+    if (Number.isNaN(d.getTime())) return String(s);
+    return d.toLocaleString();
+  } catch {
+    return String(s);
+  }
+}
+
+function setText(el, v) { el.textContent = (v === undefined || v === null || v === "") ? "-" : String(v); }
+
+function setErrText(el, v) {
+  if (!v) { el.textContent = "-"; el.className = "v"; return; }
+  el.textContent = String(v);
+  el.className = "v bad";
+}
+
+async function getStatus() {
+  const s = await fetchJSON("/api/status");
+
+  webAddrEl.textContent = inferWebAddr();
+  if (s && s.socks_fixed_listen) socksFixedAddrEl.textContent = clientAddrFromListen(s.socks_fixed_listen, 1080);
+  if (s && s.socks_auto_listen) socksAutoAddrEl.textContent = clientAddrFromListen(s.socks_auto_listen, 1081);
+  renderSnippets();
+
+  const fixed = (s && s.fixed) ? s.fixed : s;
+  const auto = (s && s.auto) ? s.auto : null;
+
+  setText(curSocks5FixedEl, fixed.current_socks5 || "-");
+  setText(idxSocks5FixedEl, fixed.current_socks5_index);
+  setText(sizeSocks5FixedEl, fixed.socks5_pool_size);
+
+  if (auto) {
+    setText(curSocks5AutoEl, auto.current_socks5 || "-");
+    setText(idxSocks5AutoEl, (auto.current_socks5_index < 0) ? "-" : auto.current_socks5_index);
+    setText(sizeSocks5AutoEl, auto.socks5_pool_size);
+  } else {
+    setText(curSocks5AutoEl, "-");
+    setText(idxSocks5AutoEl, "-");
+    setText(sizeSocks5AutoEl, "-");
+  }
+
+  setText(sizeAllEl, fixed.pool_size);
+  setText(lastRefreshEl, fmtTime(fixed.last_refresh_at));
+  setErrText(lastErrEl, fixed.last_refresh_err);
+  return s;
+}
+
+function setBusy(b) {
+  for (const id of ["refresh", "next-socks5", "check", "loadPool"]) {
+    const el = document.getElementById(id);
+    if (el) el.disabled = !!b;
+  }
+}
+
+async function doRefresh() {
+  setBusy(true);
+  refreshHint.textContent = "刷新中…（会并发验证并筛选可用代理）";
+  try {
+    const r = await fetchJSON("/api/refresh", { method: "POST" });
+    outEl.textContent = JSON.stringify(r, null, 2);
+  } catch (e) {
+    outEl.textContent = String(e);
+  } finally {
+    refreshHint.textContent = "";
+    setBusy(false);
+    await safeUpdate();
+  }
+}
+
+async function doNext() {
+  setBusy(true);
+  try {
+    const r = await fetchJSON("/api/next", { method: "POST" });
+    outEl.textContent = JSON.stringify(r, null, 2);
+  } catch (e) {
+    outEl.textContent = String(e);
+  } finally {
+    setBusy(false);
+    await safeUpdate();
+  }
+}
+
+async function doCheck() {
+  setBusy(true);
+  const target = checkTargetEl.value.trim();
+  const url = `/api/check${target ? `?target=${encodeURIComponent(target)}` : ""}`;
+  try {
+    const r = await fetchJSON(url, { method: "POST" });
+    outEl.textContent = JSON.stringify(r, null, 2);
+  } catch (e) {
+    outEl.textContent = String(e);
+  } finally {
+    setBusy(false);
+    await safeUpdate();
+  }
+}
+
+async function loadPool() {
+  setBusy(true);
+  poolHint.textContent = "加载中…";
+  poolBodyEl.innerHTML = "";
+  const t = poolTypeEl.value;
+  const url = t ? `/api/pool?type=${encodeURIComponent(t)}` : "/api/pool";
+  try {
+    const r = await fetchJSON(url);
+    const items = (r && r.items) ? r.items : [];
+    poolHint.textContent = `已加载 ${items.length} 条`;
+    const rows = items.map(n => {
+      const type = (n.type || "").toUpperCase();
+      const addr = `${n.ip}:${n.port}`;
+      const latency = (n.latency === undefined || n.latency === null) ? "" : String(n.latency);
+      return `<tr><td>${type}</td><td><code>${addr}</code></td><td>${latency}</td></tr>`;
+    }).join("");
+    poolBodyEl.innerHTML = rows || `<tr><td colspan="3" class="muted">暂无数据</td></tr>`;
+  } catch (e) {
+    poolHint.textContent = "加载失败";
+    outEl.textContent = String(e);
+  } finally {
+    setBusy(false);
+  }
+}
+
+async function copyText(text) {
+  try {
+    await navigator.clipboard.writeText(text);
+    copyHint.textContent = "已复制到剪贴板";
+    setTimeout(() => (copyHint.textContent = ""), 1200);
+  } catch {
+    copyHint.textContent = "复制失败（浏览器未授权）";
+    setTimeout(() => (copyHint.textContent = ""), 1500);
+  }
+}
+
+async function safeUpdate() {
+  try { await getStatus(); } catch (e) { outEl.textContent = String(e); }
+}
+
+document.getElementById("refresh").onclick = () => doRefresh();
+document.getElementById("next-socks5").onclick = () => doNext();
+document.getElementById("check").onclick = () => doCheck();
+document.getElementById("loadPool").onclick = () => loadPool();
+
+document.getElementById("copyCurlSocksFixed").onclick = () => copyText(snippetsEl.textContent.split("\n").slice(1,2).join("\n"));
+document.getElementById("copyCurlSocksAuto").onclick = () => copyText(snippetsEl.textContent.split("\n").slice(4,5).join("\n"));
+
+setClientAddrsFromStorage();
+checkTargetEl.value = lsGet("liteproxy.check_target", "example.com:443");
+checkTargetEl.onchange = () => lsSet("liteproxy.check_target", checkTargetEl.value);
+
+safeUpdate();
+setInterval(safeUpdate, 2500);
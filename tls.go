@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// certReloader serves a certificate pair that can be re-read from disk, so
+// rotated files are picked up without restarting the listener.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the key pair. On error the previous certificate stays active.
+func (r *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// webTLSConfig builds the web server's TLS config from cfg.WebTLSCert and
+// WebTLSKey, requiring client certificates signed by WebTLSClientCA when it
+// is set. An unreadable or mismatched key pair is an error, so startup fails
+// rather than serving a broken listener. The reloader re-reads the pair.
+func webTLSConfig(cfg Config) (*tls.Config, *certReloader, error) {
+	certs, err := newCertReloader(cfg.WebTLSCert, cfg.WebTLSKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load web tls cert: %w", err)
+	}
+	tlsCfg := &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	if cfg.WebTLSClientCA != "" {
+		cas, err := loadClientCAs(cfg.WebTLSClientCA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load web tls client ca: %w", err)
+		}
+		tlsCfg.ClientCAs = cas
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, certs, nil
+}
+
+// loadClientCAs reads a PEM bundle of CAs trusted to sign client certificates.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a generated key pair, signed by parent or self-signed.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// write stores c as name.crt and name.key in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, c.certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) pair(t *testing.T) tls.Certificate {
+	t.Helper()
+	pair, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "first", nil, false)
+	certFile, keyFile := first.write(t, dir, "web")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	serial := func() *big.Int {
+		c, _ := r.GetCertificate(nil)
+		return c.Leaf.SerialNumber
+	}
+	if serial().Cmp(first.cert.SerialNumber) != 0 {
+		t.Fatal("serving the wrong certificate")
+	}
+
+	// A renewal is picked up by Reload.
+	second := newTestCert(t, "second", nil, false)
+	second.write(t, dir, "web")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if serial().Cmp(second.cert.SerialNumber) != 0 {
+		t.Fatal("Reload did not swap the certificate")
+	}
+
+	// A half-written renewal keeps the current certificate.
+	if err := os.WriteFile(keyFile, first.keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload of a mismatched pair succeeded")
+	}
+	if serial().Cmp(second.cert.SerialNumber) != 0 {
+		t.Fatal("a failed Reload replaced the certificate")
+	}
+}
+
+func TestWebTLSConfigFailsFast(t *testing.T) {
+	dir := t.TempDir()
+	a, b := newTestCert(t, "a", nil, false), newTestCert(t, "b", nil, false)
+	certFile, _ := a.write(t, dir, "a")
+	_, otherKey := b.write(t, dir, "b")
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"mismatched pair", Config{WebTLSCert: certFile, WebTLSKey: otherKey}, "load web tls cert"},
+		{"missing key", Config{WebTLSCert: certFile, WebTLSKey: filepath.Join(dir, "nope.key")}, "load web tls cert"},
+		{"bad client ca", Config{WebTLSCert: certFile, WebTLSKey: filepath.Join(dir, "a.key"), WebTLSClientCA: notPEM}, "no PEM certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := webTLSConfig(tt.cfg); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("webTLSConfig() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "client ca", nil, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, "localhost", nil, false)
+	certFile, keyFile := server.write(t, dir, "server")
+
+	tlsCfg, _, err := webTLSConfig(Config{WebTLSCert: certFile, WebTLSKey: keyFile, WebTLSClientCA: caFile})
+	if err != nil {
+		t.Fatalf("webTLSConfig: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	srv.TLS = tlsCfg
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // rejected handshakes
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+	tests := []struct {
+		name   string
+		client *testCert
+		wantOK bool
+	}{
+		{"signed by the CA", newTestCert(t, "client", ca, false), true},
+		{"no client cert", nil, false},
+		{"self-signed", newTestCert(t, "stranger", nil, false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientCfg := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if tt.client != nil {
+				clientCfg.Certificates = []tls.Certificate{tt.client.pair(t)}
+			}
+			client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: clientCfg}}
+			resp, err := client.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if ok := err == nil && resp.StatusCode == http.StatusOK; ok != tt.wantOK {
+				t.Fatalf("GET = %v, want ok=%v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestWebTLSStatus(t *testing.T) {
+	cfg := testConfig(t, func(c *Config) {
+		c.WebTLSCert, c.WebTLSKey, c.WebTLSClientCA = "web.crt", "web.key", "ca.pem"
+	})
+	if api := cfg.API(); !api.WebTLS || !api.WebMTLS {
+		t.Errorf("API() web_tls, web_mtls = %v, %v; want both", api.WebTLS, api.WebMTLS)
+	}
+	if api := testConfig(t, nil).API(); api.WebTLS || api.WebMTLS {
+		t.Errorf("API() without certs reports web_tls %v, web_mtls %v", api.WebTLS, api.WebMTLS)
+	}
+	bad := testConfig(t, func(c *Config) { c.WebTLSClientCA = "ca.pem" })
+	if err := bad.Validate(); err == nil {
+		t.Error("Validate() accepted web_tls_client_ca without a certificate")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+const (
+	// healthCheckEvery is how often the watchdog samples the manager status.
+	healthCheckEvery = 30 * time.Second
+	// healthWarnEvery spaces out the warnings while unhealthy.
+	healthWarnEvery = 5 * time.Minute
+)
+
+// healthWatchdog watches a manager's pool size and refresh timestamps. The
+// process is unhealthy while the pool is empty or the latest refresh failed:
+// it is reported as degraded at once, warned about every healthWarnEvery,
+// and once unhealthy for exitAfter (0 disables) exit is called.
+type healthWatchdog struct {
+	exitAfter time.Duration
+	status    func() logic.Status
+	now       func() time.Time
+	exit      func()
+	logger    *log.Logger
+
+	mu         sync.Mutex
+	started    time.Time
+	emptySince time.Time
+	badSince   time.Time
+	reason     string
+	lastWarn   time.Time
+	tripped    bool
+}
+
+func newHealthWatchdog(exitAfter time.Duration, status func() logic.Status, exit func(), logger *log.Logger) *healthWatchdog {
+	return &healthWatchdog{exitAfter: exitAfter, status: status, now: time.Now, exit: exit, logger: logger}
+}
+
+func (w *healthWatchdog) Run(ctx context.Context) {
+	every := healthCheckEvery
+	if w.exitAfter > 0 && w.exitAfter/4 < every {
+		every = w.exitAfter / 4
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	w.check()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check takes one status sample, logs transitions and warnings, and calls
+// exit the first time the unhealthy period reaches exitAfter.
+func (w *healthWatchdog) check() {
+	now := w.now()
+	st := w.status()
+
+	w.mu.Lock()
+	if w.started.IsZero() {
+		w.started = now
+	}
+	reason, since := w.assessLocked(st, now)
+	if reason == "" {
+		if w.reason != "" {
+			w.logger.Printf("health: recovered after %s", now.Sub(w.badSince).Truncate(time.Second))
+		}
+		w.reason, w.badSince, w.lastWarn = "", time.Time{}, time.Time{}
+		w.mu.Unlock()
+		return
+	}
+	w.reason, w.badSince = reason, since
+	unhealthyFor := now.Sub(since)
+	trip := w.exitAfter > 0 && unhealthyFor >= w.exitAfter && !w.tripped
+	if trip {
+		w.tripped = true
+	} else if w.lastWarn.IsZero() || now.Sub(w.lastWarn) >= healthWarnEvery {
+		w.lastWarn = now
+		if w.exitAfter > 0 {
+			w.logger.Printf("health: degraded for %s: %s (exiting after %s)", unhealthyFor.Truncate(time.Second), reason, w.exitAfter)
+		} else {
+			w.logger.Printf("health: degraded for %s: %s", unhealthyFor.Truncate(time.Second), reason)
+		}
+	}
+	w.mu.Unlock()
+
+	if trip {
+		w.logger.Printf("health: unhealthy for %s, over unhealthy_exit_after %s: %s; exiting", unhealthyFor.Truncate(time.Second), w.exitAfter, reason)
+		w.exit()
+	}
+}
+
+// assessLocked returns why st is unhealthy and since when, or "" if it is
+// healthy.
+func (w *healthWatchdog) assessLocked(st logic.Status, now time.Time) (string, time.Time) {
+	if st.PoolSize > 0 {
+		w.emptySince = time.Time{}
+	} else if w.emptySince.IsZero() {
+		w.emptySince = now
+	}
+
+	var reason string
+	var since time.Time
+	if !w.emptySince.IsZero() {
+		reason, since = "pool is empty", w.emptySince
+	}
+	if st.LastRefreshAt.After(st.LastRefreshOKAt) {
+		failing := st.LastRefreshOKAt
+		if failing.Before(w.started) {
+			failing = w.started
+		}
+		msg := "refreshes failing"
+		if st.LastRefreshErr != "" {
+			msg = fmt.Sprintf("refreshes failing (last: %s)", st.LastRefreshErr)
+		}
+		if reason == "" {
+			reason, since = msg, failing
+		} else {
+			reason += ", " + msg
+			if failing.Before(since) {
+				since = failing
+			}
+		}
+	}
+	return reason, since
+}
+
+// Degraded reports whether the last check found the process unhealthy, why
+// and since when.
+func (w *healthWatchdog) Degraded() (bool, string, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reason != "", w.reason, w.badSince
+}
+
+// Tripped reports whether the watchdog has called exit.
+func (w *healthWatchdog) Tripped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.tripped
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"lite-proxy/logic"
+)
+
+// fakeHealth drives a healthWatchdog with a settable clock and status.
+type fakeHealth struct {
+	now   time.Time
+	st    logic.Status
+	exits int
+	logs  bytes.Buffer
+}
+
+func (f *fakeHealth) watchdog(exitAfter time.Duration) *healthWatchdog {
+	w := newHealthWatchdog(exitAfter, func() logic.Status { return f.st }, func() { f.exits++ }, log.New(&f.logs, "", 0))
+	w.now = func() time.Time { return f.now }
+	return w
+}
+
+// step advances the clock by d and runs one check.
+func (f *fakeHealth) step(w *healthWatchdog, d time.Duration) {
+	f.now = f.now.Add(d)
+	w.check()
+}
+
+func (f *fakeHealth) lines() int { return strings.Count(f.logs.String(), "\n") }
+
+func TestWatchdogHealthy(t *testing.T) {
+	f := &fakeHealth{now: time.Unix(1e9, 0)}
+	f.st = logic.Status{PoolSize: 3, LastRefreshAt: f.now, LastRefreshOKAt: f.now}
+	w := f.watchdog(time.Minute)
+	for i := 0; i < 10; i++ {
+		f.step(w, time.Minute)
+	}
+	if degraded, _, _ := w.Degraded(); degraded || f.exits != 0 || f.lines() != 0 {
+		t.Fatalf("degraded %v, %d exits, logs %q; want a quiet healthy run", degraded, f.exits, f.logs.String())
+	}
+}
+
+func TestWatchdogEmptyPoolExits(t *testing.T) {
+	f := &fakeHealth{now: time.Unix(1e9, 0)}
+	w := f.watchdog(10 * time.Minute)
+	start := f.now
+
+	f.step(w, 0)
+	degraded, reason, since := w.Degraded()
+	if !degraded || reason != "pool is empty" || !since.Equal(start) {
+		t.Fatalf("Degraded() = %v, %q, %v; want degraded at once", degraded, reason, since)
+	}
+	f.step(w, 9*time.Minute)
+	if f.exits != 0 || w.Tripped() {
+		t.Fatal("exited before unhealthy_exit_after")
+	}
+	f.step(w, time.Minute)
+	if f.exits != 1 || !w.Tripped() {
+		t.Fatalf("exits = %d after 10m empty, want 1", f.exits)
+	}
+	f.step(w, time.Minute)
+	if f.exits != 1 {
+		t.Errorf("exit called %d times, want once", f.exits)
+	}
+	if !strings.Contains(f.logs.String(), "exiting") {
+		t.Errorf("logs %q do not explain the exit", f.logs.String())
+	}
+}
+
+func TestWatchdogRefreshFailing(t *testing.T) {
+	f := &fakeHealth{now: time.Unix(1e9, 0)}
+	okAt := f.now.Add(-time.Hour) // before the watchdog started
+	f.st = logic.Status{PoolSize: 5, LastRefreshOKAt: okAt, LastRefreshAt: f.now, LastRefreshErr: "fetch failed"}
+	w := f.watchdog(30 * time.Minute)
+	start := f.now
+
+	f.step(w, 0)
+	degraded, reason, since := w.Degraded()
+	if !degraded || !strings.Contains(reason, "fetch failed") || !since.Equal(start) {
+		t.Fatalf("Degraded() = %v, %q, %v; want failing since the watchdog started", degraded, reason, since)
+	}
+
+	// The pool empties too: both reasons, the earlier start.
+	f.st.PoolSize = 0
+	f.step(w, 10*time.Minute)
+	if _, reason, since = w.Degraded(); !strings.Contains(reason, "pool is empty") || !strings.Contains(reason, "refreshes failing") || !since.Equal(start) {
+		t.Fatalf("Degraded() = %q since %v, want both reasons since %v", reason, since, start)
+	}
+
+	// A successful refresh refills the pool.
+	f.st = logic.Status{PoolSize: 5, LastRefreshAt: f.now, LastRefreshOKAt: f.now}
+	f.step(w, time.Minute)
+	if degraded, _, _ := w.Degraded(); degraded {
+		t.Fatal("still degraded after recovering")
+	}
+	if !strings.Contains(f.logs.String(), "recovered after 11m") {
+		t.Errorf("logs %q, want the recovery", f.logs.String())
+	}
+	f.step(w, time.Hour)
+	if f.exits != 0 {
+		t.Errorf("exited %d times after recovering", f.exits)
+	}
+}
+
+func TestWatchdogWarnRate(t *testing.T) {
+	f := &fakeHealth{now: time.Unix(1e9, 0)}
+	w := f.watchdog(0) // never exits
+	f.step(w, 0)
+	if f.lines() != 1 {
+		t.Fatalf("logged %d lines on becoming unhealthy, want 1", f.lines())
+	}
+	for i := 0; i < 4; i++ {
+		f.step(w, time.Minute)
+	}
+	if f.lines() != 1 {
+		t.Fatalf("logged %d lines within healthWarnEvery, want 1", f.lines())
+	}
+	f.step(w, time.Minute)
+	if f.lines() != 2 {
+		t.Fatalf("logged %d lines after healthWarnEvery, want 2", f.lines())
+	}
+	f.step(w, 24*time.Hour)
+	if f.exits != 0 {
+		t.Errorf("exited with unhealthy_exit_after 0")
+	}
+}